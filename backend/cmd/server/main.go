@@ -1,45 +1,275 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"learning-telegram/internal/api"
+	"learning-telegram/internal/auth"
+	"learning-telegram/internal/bot"
+	"learning-telegram/internal/config"
+	"learning-telegram/internal/egress"
+	"learning-telegram/internal/mail"
+	"learning-telegram/internal/policy"
+	"learning-telegram/internal/presence"
+	"learning-telegram/internal/realip"
 	"learning-telegram/internal/store"
+	"learning-telegram/internal/webhook"
 	"learning-telegram/internal/websocket"
+	"learning-telegram/internal/websocket/redisbroker"
 )
 
 func main() {
-	store.InitDB("telegram.db")
+	args := os.Args[1:]
+	migrate := len(args) > 0 && args[0] == "migrate"
+	if migrate {
+		args = args[1:]
+	}
+	cfg, args, err := config.Load(args)
+	if err != nil {
+		log.Fatal("config: ", err)
+	}
+	if migrate {
+		runMigrate(cfg.Database.DSN(), args)
+		return
+	}
+	if len(args) > 0 {
+		log.Fatalf("unexpected argument %q; the only subcommand is migrate", args[0])
+	}
+	log.Printf("当前配置:\n%s", cfg.Redacted())
+
+	if cfg.Database.AutoMigrate {
+		store.InitDB(cfg.Database.DSN())
+	} else {
+		if err := store.Open(cfg.Database.DSN()); err != nil {
+			log.Fatal("Open: ", err)
+		}
+		if err := store.CheckSchema(); err != nil {
+			log.Fatal("CheckSchema: ", err)
+		}
+	}
+
+	err = auth.LoadKeys(auth.KeyConfig{
+		KeyDir:       cfg.Auth.KeyDir,
+		SigningKeyID: cfg.Auth.SigningKeyID,
+		HMACSecret:   cfg.Auth.HMACSecret,
+	})
+	if err != nil {
+		log.Fatal("LoadKeys: ", err)
+	}
 
-	fmt.Println("Starting server on :8080")
+	var mailer mail.Mailer = &mail.LogMailer{Dir: cfg.Mail.Dir, From: cfg.Mail.From}
+	if cfg.Mail.SMTPAddr != "" {
+		mailer = &mail.SMTPMailer{
+			Addr:     cfg.Mail.SMTPAddr,
+			Username: cfg.Mail.SMTPUsername,
+			Password: cfg.Mail.SMTPPassword,
+			From:     cfg.Mail.From,
+		}
+	}
 
-	// Auth routes with CORS
-	registerHandler := http.HandlerFunc(api.RegisterHandler)
-	loginHandler := http.HandlerFunc(api.LoginHandler)
+	passwordPolicy := policy.PasswordPolicy{MinLength: cfg.Password.MinLength, MinScore: cfg.Password.MinScore}
+	if path := cfg.Password.BreachedFile; path != "" {
+		if passwordPolicy.Breached, err = policy.LoadBreachedList(path); err != nil {
+			log.Fatal("LoadBreachedList: ", err)
+		}
+		log.Printf("已加载%d条泄露密码哈希", passwordPolicy.Breached.Len())
+	}
+
+	realIP, err := realip.New(cfg.Server.TrustedProxies)
+	if err != nil {
+		log.Fatal("realip.New: ", err)
+	}
+	egressPolicy, err := egress.New(cfg.Webhooks.AllowedNetworks)
+	if err != nil {
+		log.Fatal("egress.New: ", err)
+	}
+
+	repos := store.NewSQLStore(store.DB).Repos()
+	hub, err := websocket.NewHub(cfg.WebSocket.Hub())
+	if err != nil {
+		log.Fatal("websocket.NewHub: ", err)
+	}
+	// Bots connect to the hub in bots.Start, after the broker is set.
+	if cfg.Redis.URL != "" {
+		broker, err := redisbroker.New(cfg.Redis.URL, cfg.Redis.NodeName)
+		if err != nil {
+			log.Fatal("redisbroker.New: ", err)
+		}
+		if err := hub.SetBroker(broker); err != nil {
+			log.Fatal("SetBroker: ", err)
+		}
+		log.Printf("已通过 Redis 连接其他节点 (node: %s)", broker.Node())
+	}
+	webhooks := webhook.NewWorker(repos.Webhooks, egressPolicy)
+	ws := websocket.NewHandler(repos, hub, webhooks, websocket.HandlerConfig{
+		AllowedOrigins: cfg.WebSocket.AllowedOrigins,
+		RealIP:         realIP,
+	})
+	bots := bot.NewHandler(repos, hub, ws, egressPolicy)
+	h := api.NewHandlers(repos, hub, ws, bots, webhooks, api.Config{
+		Mailer:         mailer,
+		ResetURL:       cfg.Mail.ResetURL,
+		PasswordPolicy: &passwordPolicy,
+		RealIP:         realIP,
+		Egress:         egressPolicy,
+	})
+
+	if err := bots.Start(); err != nil {
+		log.Fatal("bots.Start: ", err)
+	}
+
+	webhooks.Start()
+
+	fmt.Println("Starting server on " + cfg.Server.Addr)
+
+	hub.Start()
+	presence.Start(repos.Presence, hub)
+
+	// Auth routes with CORS, throttled against brute force
+	registerGuard := api.NewBruteForceGuard(api.DefaultRegisterGuardConfig, repos.LoginGuard, realIP)
+	loginGuard := api.NewBruteForceGuard(api.DefaultLoginGuardConfig, repos.LoginGuard, realIP)
+	twoFactorGuardConfig := api.DefaultLoginGuardConfig
+	twoFactorGuardConfig.UsernameFrom = api.UsernameFromChallenge
+	twoFactorGuard := api.NewBruteForceGuard(twoFactorGuardConfig, repos.LoginGuard, realIP)
+
+	registerHandler := registerGuard.Middleware(http.HandlerFunc(h.RegisterHandler))
+	loginHandler := loginGuard.Middleware(http.HandlerFunc(h.LoginHandler))
 	http.Handle("/api/register", registerHandler)
 	http.Handle("/api/login", loginHandler)
+	http.Handle("/api/login/2fa", twoFactorGuard.Middleware(http.HandlerFunc(h.TwoFactorLoginHandler)))
+	resetGuard := api.NewBruteForceGuard(api.BruteForceConfig{
+		PerIP:        api.Limit{Max: 10, Window: time.Hour},
+		UsernameFrom: api.NoUsername,
+	}, repos.LoginGuard, realIP)
+	http.Handle("POST /api/password/reset", resetGuard.Middleware(http.HandlerFunc(h.RequestPasswordResetHandler)))
+	http.Handle("POST /api/password/reset/confirm", resetGuard.Middleware(http.HandlerFunc(h.ConfirmPasswordResetHandler)))
+	http.Handle("/api/token/refresh", http.HandlerFunc(h.RefreshTokenHandler))
+	http.Handle("/api/logout", h.AuthMiddleware(http.HandlerFunc(h.LogoutHandler)))
 
 	// Group routes (protected) with CORS
-	createGroupHandler := api.AuthMiddleware(http.HandlerFunc(api.CreateGroupHandler))
-	inviteToGroupHandler := api.AuthMiddleware(http.HandlerFunc(api.InviteToGroupHandler))
+	createGroupHandler := h.AuthMiddleware(http.HandlerFunc(h.CreateGroupHandler))
+	inviteToGroupHandler := h.AuthMiddleware(http.HandlerFunc(h.InviteToGroupHandler))
 	http.Handle("/api/groups/create", createGroupHandler)
 	http.Handle("/api/groups/invite", inviteToGroupHandler)
 
+	// Message history, newest first and paged by message ID, and sending
+	// (protected). Sent messages are pushed to WebSocket clients at once.
+	http.Handle("GET /api/chats/{peer}/messages", h.AuthMiddleware(http.HandlerFunc(h.GetChatMessagesHandler)))
+	http.Handle("POST /api/chats/{peer}/messages", h.AuthMiddleware(http.HandlerFunc(h.SendChatMessageHandler)))
+	http.Handle("GET /api/groups/{id}/messages", h.AuthMiddleware(http.HandlerFunc(h.GetGroupMessagesHandler)))
+	http.Handle("POST /api/groups/{id}/messages", h.AuthMiddleware(http.HandlerFunc(h.SendGroupMessageHandler)))
+
 	// Status route (protected) with CORS
-	statusHandler := api.AuthMiddleware(http.HandlerFunc(api.UserStatusHandler))
+	statusHandler := h.AuthMiddleware(http.HandlerFunc(h.UserStatusHandler))
 	http.Handle("/api/status/user", statusHandler)
 
 	// Chat list route (protected) with CORS
-	chatsHandler := api.AuthMiddleware(http.HandlerFunc(api.GetChatsHandler))
+	chatsHandler := h.AuthMiddleware(http.HandlerFunc(h.GetChatsHandler))
 	http.Handle("/api/me/chats", chatsHandler)
 
+	// Active session (device) management (protected)
+	http.Handle("GET /api/me/sessions", h.AuthMiddleware(http.HandlerFunc(h.ListSessionsHandler)))
+	http.Handle("DELETE /api/me/sessions/{id}", h.AuthMiddleware(http.HandlerFunc(h.TerminateSessionHandler)))
+
+	// Account settings (protected)
+	// Changing the password checks the current one, so wrong guesses count
+	// against the account like failed logins.
+	passwordGuardConfig := api.DefaultLoginGuardConfig
+	passwordGuardConfig.UsernameFrom = api.UsernameFromContext
+	passwordGuardConfig.FailureStatus = http.StatusForbidden
+	passwordGuard := api.NewBruteForceGuard(passwordGuardConfig, repos.LoginGuard, realIP)
+	http.Handle("POST /api/me/password", h.AuthMiddleware(passwordGuard.Middleware(http.HandlerFunc(h.ChangePasswordHandler))))
+	http.Handle("PUT /api/me/email", h.AuthMiddleware(http.HandlerFunc(h.SetEmailHandler)))
+	http.Handle("GET /api/me/privacy", h.AuthMiddleware(http.HandlerFunc(h.GetPrivacyHandler)))
+	http.Handle("PUT /api/me/privacy", h.AuthMiddleware(http.HandlerFunc(h.SetPrivacyHandler)))
+
+	// Two-factor authentication (protected)
+	http.Handle("GET /api/me/2fa", h.AuthMiddleware(http.HandlerFunc(h.TwoFactorStatusHandler)))
+	http.Handle("POST /api/me/2fa/setup", h.AuthMiddleware(http.HandlerFunc(h.TwoFactorSetupHandler)))
+	http.Handle("POST /api/me/2fa/enable", h.AuthMiddleware(http.HandlerFunc(h.TwoFactorEnableHandler)))
+	http.Handle("POST /api/me/2fa/disable", h.AuthMiddleware(http.HandlerFunc(h.TwoFactorDisableHandler)))
+
+	// Bot management (protected)
+	http.Handle("POST /api/bots", h.AuthMiddleware(http.HandlerFunc(h.CreateBotHandler)))
+	http.Handle("GET /api/bots", h.AuthMiddleware(http.HandlerFunc(h.ListBotsHandler)))
+	http.Handle("POST /api/bots/{id}/token", h.AuthMiddleware(http.HandlerFunc(h.RegenerateBotTokenHandler)))
+
+	// Outbound webhooks (protected)
+	http.Handle("POST /api/webhooks", h.AuthMiddleware(http.HandlerFunc(h.CreateWebhookHandler)))
+	http.Handle("GET /api/webhooks", h.AuthMiddleware(http.HandlerFunc(h.ListWebhooksHandler)))
+	http.Handle("DELETE /api/webhooks/{id}", h.AuthMiddleware(http.HandlerFunc(h.DeleteWebhookHandler)))
+	http.Handle("GET /api/webhooks/{id}/deliveries", h.AuthMiddleware(http.HandlerFunc(h.ListWebhookDeliveriesHandler)))
+	http.Handle("GET /api/webhooks/{id}/dead-letters", h.AuthMiddleware(http.HandlerFunc(h.ListWebhookDeadLettersHandler)))
+	http.Handle("POST /api/webhooks/{id}/dead-letters/{letter}/retry", h.AuthMiddleware(http.HandlerFunc(h.RetryWebhookDeadLetterHandler)))
+
+	// Operator routes, enabled by setting ADMIN_TOKEN
+	adminToken := cfg.Admin.Token
+	http.Handle("GET /api/admin/lockouts", api.AdminMiddleware(adminToken, http.HandlerFunc(h.GetLockoutHandler)))
+	http.Handle("POST /api/admin/unlock", api.AdminMiddleware(adminToken, http.HandlerFunc(h.UnlockAccountHandler)))
+	http.Handle("GET /api/admin/metrics/websocket", api.AdminMiddleware(adminToken, http.HandlerFunc(h.WebSocketMetricsHandler)))
+
+	// Public verification keys for tokens issued by this server
+	http.HandleFunc("/.well-known/jwks.json", api.JWKSHandler)
+
+	// Bot API at /bot<token>/<method>. The token is part of the first path
+	// segment, which ServeMux patterns can't match on, so the handler takes
+	// every otherwise unrouted path and answers 404 for anything else.
+	http.Handle("/", bots)
+
 	// Websocket route (auth is handled inside the handler)
-	http.HandleFunc("/ws", websocket.HandleConnections)
+	http.Handle("/ws", ws)
 
-	err := http.ListenAndServe(":8080", nil)
-	if err != nil {
+	// Requests see a context canceled at shutdown, so long polls end
+	// instead of holding it up.
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	srv := &http.Server{
+		Addr:        cfg.Server.Addr,
+		Handler:     api.CORSMiddleware(cfg.CORS.AllowedOrigins, http.DefaultServeMux),
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
+	}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.ListenAndServe() }()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serveErr:
 		log.Fatal("ListenAndServe: ", err)
+	case sig := <-signals:
+		log.Printf("收到信号 %v，开始关闭服务", sig)
+	}
+
+	// Stop accepting requests, tell WebSocket clients to reconnect once
+	// their queued frames are written, stop the reaper, hand the bots'
+	// webhooks over to other nodes and stop the webhook worker, then close
+	// the database once none of them uses it anymore. Presence is published
+	// from connection handlers and the reaper, so it stops with them.
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	cancelRequests()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("关闭HTTP服务失败: %v", err)
+	}
+	if err := ws.Shutdown(ctx); err != nil {
+		log.Printf("关闭WebSocket连接失败: %v", err)
+	}
+	hub.Stop()
+	bots.Stop()
+	webhooks.Stop()
+	if err := store.DB.Close(); err != nil {
+		log.Printf("关闭数据库失败: %v", err)
+	}
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("ListenAndServe: %v", err)
 	}
+	log.Println("服务已关闭")
 }
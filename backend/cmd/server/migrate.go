@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"learning-telegram/internal/store"
+)
+
+const migrateUsage = `usage: server migrate [flags] <command>
+
+commands:
+  up          apply all pending migrations
+  down        revert the last applied migration
+  status      list migrations and whether they are applied
+  to VERSION  apply or revert migrations until the schema is at VERSION
+
+The flags are those of the server; only the database settings are used.`
+
+// runMigrate runs the migrate subcommand against the configured database.
+func runMigrate(dsn string, args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		os.Exit(2)
+	}
+	if err := store.Open(dsn); err != nil {
+		log.Fatal("Open: ", err)
+	}
+	defer store.DB.Close()
+
+	var err error
+	switch cmd := args[0]; {
+	case cmd == "up" && len(args) == 1:
+		err = store.MigrateUp()
+	case cmd == "down" && len(args) == 1:
+		err = store.MigrateDown()
+	case cmd == "status" && len(args) == 1:
+		err = printMigrationStatus()
+	case cmd == "to" && len(args) == 2:
+		version, perr := strconv.Atoi(args[1])
+		if perr != nil {
+			log.Fatalf("migrate to: invalid version %q", args[1])
+		}
+		err = store.MigrateTo(version)
+	default:
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		os.Exit(2)
+	}
+	if err != nil {
+		store.DB.Close()
+		log.Fatal("migrate: ", err)
+	}
+}
+
+func printMigrationStatus() error {
+	version, err := store.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	statuses, err := store.MigrationStatuses()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("schema version: %d (latest: %d)\n", version, store.LatestVersion())
+	if version > store.LatestVersion() {
+		fmt.Println("the database was migrated by a newer binary")
+	}
+	for _, s := range statuses {
+		applied := "pending"
+		if s.AppliedAt != nil {
+			applied = "applied " + s.AppliedAt.Local().Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%04d_%-30s %s\n", s.Version, s.Name, applied)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"learning-telegram/internal/policy"
+)
+
+// AdminMiddleware protects operator endpoints with a static token sent in the
+// X-Admin-Token header. With an empty token the endpoints are disabled.
+func AdminMiddleware(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			http.NotFound(w, r)
+			return
+		}
+		given := r.Header.Get("X-Admin-Token")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			writeError(w, "需要管理员权限", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type UnlockAccountRequest struct {
+	Username string `json:"username"`
+}
+
+// GetLockoutHandler shows the failed login state of a username.
+func (h *Handlers) GetLockoutHandler(w http.ResponseWriter, r *http.Request) {
+	username := policy.NormalizeUsername(r.URL.Query().Get("username"))
+	if username == "" {
+		writeError(w, "查询参数 'username' 不能为空", http.StatusBadRequest)
+		return
+	}
+
+	throttle, err := h.loginGuard.GetLoginThrottle(username)
+	if err != nil {
+		writeError(w, "查询失败", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(throttle)
+}
+
+// UnlockAccountHandler clears the failed login counter and lockout of a
+// username.
+func (h *Handlers) UnlockAccountHandler(w http.ResponseWriter, r *http.Request) {
+	var req UnlockAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "参数错误", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Username) == "" {
+		writeError(w, "用户名不能为空", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.loginGuard.ResetLoginFailures(policy.NormalizeUsername(req.Username)); err != nil {
+		writeError(w, "解锁失败", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// WebSocketMetricsHandler reports the depth of the WebSocket send queues and
+// how many frames were sent, dropped or failed, to spot slow clients.
+func (h *Handlers) WebSocketMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.hub.QueueMetrics())
+}
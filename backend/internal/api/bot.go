@@ -0,0 +1,142 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"learning-telegram/internal/auth"
+	"learning-telegram/internal/policy"
+	"learning-telegram/internal/store"
+)
+
+// maxBotsPerOwner limits how many bots one user can create, as on Telegram.
+const maxBotsPerOwner = 20
+
+type CreateBotRequest struct {
+	Username string `json:"username"`
+}
+
+// BotTokenResponse returns a bot's token; it is only shown when the bot is
+// created or its token is regenerated.
+type BotTokenResponse struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+	Token    string `json:"token"`
+}
+
+// CreateBotHandler creates a bot owned by the current user and returns its
+// token for the Bot API.
+func (h *Handlers) CreateBotHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := r.Context().Value("username").(string)
+	if !ok {
+		writeError(w, "无法从Token获取用户信息", http.StatusUnauthorized)
+		return
+	}
+
+	var req CreateBotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "参数错误", http.StatusBadRequest)
+		return
+	}
+	username := policy.CleanUsername(req.Username)
+	if !checkUsername(w, username, policy.ValidateBotUsername) {
+		return
+	}
+
+	existing, err := h.bots.GetBotsByOwner(owner)
+	if err != nil {
+		writeError(w, "创建机器人失败", http.StatusInternalServerError)
+		return
+	}
+	if len(existing) >= maxBotsPerOwner {
+		writeError(w, "机器人数量已达上限", http.StatusForbidden)
+		return
+	}
+
+	// The token embeds the bot's ID, which is only known after the insert,
+	// so the bot is created with a placeholder hash no token can match.
+	botID, err := h.bots.CreateBot(owner, username, "")
+	if err != nil {
+		writeStoreError(w, err, "创建机器人失败")
+		return
+	}
+	token, ok := h.rotateBotToken(w, owner, botID)
+	if !ok {
+		return
+	}
+
+	b, err := h.bots.GetBot(botID)
+	if err != nil {
+		writeError(w, "创建机器人失败", http.StatusInternalServerError)
+		return
+	}
+	h.botAPI.Announce(b)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(BotTokenResponse{ID: botID, Username: username, Token: token})
+}
+
+// ListBotsHandler returns the bots owned by the current user, without their
+// tokens.
+func (h *Handlers) ListBotsHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := r.Context().Value("username").(string)
+	if !ok {
+		writeError(w, "无法从Token获取用户信息", http.StatusUnauthorized)
+		return
+	}
+
+	bots, err := h.bots.GetBotsByOwner(owner)
+	if err != nil {
+		writeError(w, "获取机器人列表失败", http.StatusInternalServerError)
+		return
+	}
+	if bots == nil {
+		bots = []store.Bot{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bots)
+}
+
+// RegenerateBotTokenHandler issues a new token for one of the current user's
+// bots; the old token stops working immediately.
+func (h *Handlers) RegenerateBotTokenHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := r.Context().Value("username").(string)
+	if !ok {
+		writeError(w, "无法从Token获取用户信息", http.StatusUnauthorized)
+		return
+	}
+	botID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, "机器人不存在", http.StatusNotFound)
+		return
+	}
+
+	token, ok := h.rotateBotToken(w, owner, botID)
+	if !ok {
+		return
+	}
+	b, err := h.bots.GetBot(botID)
+	if err != nil {
+		writeError(w, "重置Token失败", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(BotTokenResponse{ID: botID, Username: b.Username, Token: token})
+}
+
+func (h *Handlers) rotateBotToken(w http.ResponseWriter, owner string, botID int64) (string, bool) {
+	token, secretHash, err := auth.NewBotToken(botID)
+	if err != nil {
+		writeError(w, "生成Token失败", http.StatusInternalServerError)
+		return "", false
+	}
+	err = h.bots.SetBotToken(owner, botID, secretHash)
+	if err != nil {
+		writeStoreError(w, err, "生成Token失败")
+		return "", false
+	}
+	return token, true
+}
@@ -3,27 +3,25 @@ package api
 import (
 	"encoding/json"
 	"net/http"
-
-	"learning-telegram/internal/store"
 )
 
 // GetChatsHandler retrieves all chat partners (users and groups) for the authenticated user.
-func GetChatsHandler(w http.ResponseWriter, r *http.Request) {
+func (h *Handlers) GetChatsHandler(w http.ResponseWriter, r *http.Request) {
 	username, ok := r.Context().Value("username").(string)
 	if !ok {
-		http.Error(w, "无法从Token获取用户信息", http.StatusUnauthorized)
+		writeError(w, "无法从Token获取用户信息", http.StatusUnauthorized)
 		return
 	}
 
-	users, err := store.GetAllUsers(username)
+	users, err := h.users.GetAllUsers(username)
 	if err != nil {
-		http.Error(w, "获取用户列表失败", http.StatusInternalServerError)
+		writeError(w, "获取用户列表失败", http.StatusInternalServerError)
 		return
 	}
 
-	groups, err := store.GetUserGroups(username)
+	groups, err := h.groups.GetUserGroups(username)
 	if err != nil {
-		http.Error(w, "获取群组列表失败", http.StatusInternalServerError)
+		writeError(w, "获取群组列表失败", http.StatusInternalServerError)
 		return
 	}
 
@@ -36,6 +34,6 @@ func GetChatsHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	err = json.NewEncoder(w).Encode(response)
 	if err != nil {
-		http.Error(w, "无法生成响应", http.StatusInternalServerError)
+		writeError(w, "无法生成响应", http.StatusInternalServerError)
 	}
 }
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"learning-telegram/internal/store"
+)
+
+// ErrorResponse is the body of every error the API returns. Code is stable
+// for clients to act on, e.g. "username_taken"; Error is for people.
+type ErrorResponse struct {
+	Code  string `json:"code"`
+	Error string `json:"error"`
+}
+
+// writeError replies with an error whose code follows from the status, e.g.
+// "not_found" for 404. It takes the arguments of http.Error.
+func writeError(w http.ResponseWriter, message string, status int) {
+	writeErrorCode(w, status, statusErrorCode(status), message)
+}
+
+func writeErrorCode(w http.ResponseWriter, status int, code, message string) {
+	writeErrorResponse(w, status, ErrorResponse{Code: code, Error: message})
+}
+
+// writeErrorResponse replies with an error body that carries details beyond
+// an ErrorResponse, e.g. a PolicyErrorResponse. body must embed ErrorResponse.
+func writeErrorResponse(w http.ResponseWriter, status int, body any) {
+	writeJSON(w, status, body)
+}
+
+// writeJSON replies with body encoded as JSON.
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// statusErrorCode turns the text of an HTTP status into a code, e.g.
+// "too_many_requests" for 429.
+func statusErrorCode(status int) string {
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
+
+// storeErrors are the responses to store errors clients can act on. The
+// first entry the error matches with errors.Is applies, so the kinds come
+// last.
+var storeErrors = []struct {
+	err     error
+	status  int
+	code    string
+	message string
+}{
+	{store.ErrUserNotFound, http.StatusNotFound, "user_not_found", "用户不存在"},
+	{store.ErrGroupNotFound, http.StatusNotFound, "group_not_found", "群组不存在"},
+	{store.ErrBotNotFound, http.StatusNotFound, "bot_not_found", "机器人不存在"},
+	{store.ErrWebhookNotFound, http.StatusNotFound, "webhook_not_found", "Webhook不存在"},
+	{store.ErrSessionNotFound, http.StatusNotFound, "session_not_found", "会话不存在"},
+	{store.ErrUsernameTaken, http.StatusConflict, "username_taken", "用户名已存在"},
+	{store.ErrEmailTaken, http.StatusConflict, "email_taken", "邮箱已被使用"},
+	{store.ErrAlreadyMember, http.StatusConflict, "already_member", "用户已在群组中"},
+	{store.ErrClientIDReused, http.StatusConflict, "client_id_reused", "client_id已用于其他消息"},
+	{store.ErrNotGroupMember, http.StatusForbidden, "not_group_member", "你不是该群组成员"},
+	{store.ErrNotFound, http.StatusNotFound, "not_found", "资源不存在"},
+	{store.ErrConflict, http.StatusConflict, "conflict", "资源冲突"},
+	{store.ErrForbidden, http.StatusForbidden, "forbidden", "没有权限"},
+}
+
+// writeStoreError replies to a failed store call. Errors clients can act on
+// get their status and code; anything else is logged and reported as a 500
+// with the given message, so database details don't reach clients.
+func writeStoreError(w http.ResponseWriter, err error, message string) {
+	for _, e := range storeErrors {
+		if errors.Is(err, e.err) {
+			writeErrorCode(w, e.status, e.code, e.message)
+			return
+		}
+	}
+	log.Printf("%s: %v", message, err)
+	writeError(w, message, http.StatusInternalServerError)
+}
@@ -2,9 +2,11 @@ package api
 
 import (
 	"encoding/json"
+	"log"
 	"net/http"
 	"strings"
 
+	"learning-telegram/internal/policy"
 	"learning-telegram/internal/store"
 )
 
@@ -18,26 +20,26 @@ type InviteToGroupRequest struct {
 }
 
 // CreateGroupHandler handles the creation of a new group.
-func CreateGroupHandler(w http.ResponseWriter, r *http.Request) {
+func (h *Handlers) CreateGroupHandler(w http.ResponseWriter, r *http.Request) {
 	creatorUsername, ok := r.Context().Value("username").(string)
 	if !ok {
-		http.Error(w, "无法从Token获取用户信息", http.StatusUnauthorized)
+		writeError(w, "无法从Token获取用户信息", http.StatusUnauthorized)
 		return
 	}
 
 	var req CreateGroupRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "无效的请求参数", http.StatusBadRequest)
+		writeError(w, "无效的请求参数", http.StatusBadRequest)
 		return
 	}
 	if strings.TrimSpace(req.Name) == "" {
-		http.Error(w, "群组名不能为空", http.StatusBadRequest)
+		writeError(w, "群组名不能为空", http.StatusBadRequest)
 		return
 	}
 
-	groupID, err := store.CreateGroup(req.Name, creatorUsername)
+	groupID, err := h.groups.CreateGroup(req.Name, creatorUsername)
 	if err != nil {
-		http.Error(w, "创建群组失败: "+err.Error(), http.StatusInternalServerError)
+		writeStoreError(w, err, "创建群组失败")
 		return
 	}
 
@@ -48,43 +50,61 @@ func CreateGroupHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// InviteToGroupHandler handles inviting a user to a group.
-func InviteToGroupHandler(w http.ResponseWriter, r *http.Request) {
-	// Although we are not using the inviter's username here,
-	// the middleware has already ensured that the request is authenticated.
-	// You could add permission checks here, e.g., if only admins can invite.
-	if _, ok := r.Context().Value("username").(string); !ok {
-		http.Error(w, "无法从Token获取用户信息", http.StatusUnauthorized)
+// InviteToGroupHandler adds a user to a group. Only members of the group may
+// invite: membership grants its history and, through webhooks, its events.
+func (h *Handlers) InviteToGroupHandler(w http.ResponseWriter, r *http.Request) {
+	inviter, ok := r.Context().Value("username").(string)
+	if !ok {
+		writeError(w, "无法从Token获取用户信息", http.StatusUnauthorized)
 		return
 	}
 
 	var req InviteToGroupRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "无效的请求参数", http.StatusBadRequest)
+		writeError(w, "无效的请求参数", http.StatusBadRequest)
 		return
 	}
 	if req.GroupID == 0 || strings.TrimSpace(req.Username) == "" {
-		http.Error(w, "group_id 和 username 不能为空", http.StatusBadRequest)
+		writeError(w, "group_id 和 username 不能为空", http.StatusBadRequest)
+		return
+	}
+	if !policy.IsPlausibleUsername(req.Username) {
+		writeStoreError(w, store.ErrUserNotFound, "邀请失败")
+		return
+	}
+
+	// A group that doesn't exist gets the same answer as one the inviter
+	// isn't in, so group IDs can't be probed.
+	isMember, err := h.groups.IsUserInGroup(inviter, req.GroupID)
+	if err != nil {
+		writeStoreError(w, err, "邀请失败")
+		return
+	}
+	if !isMember {
+		writeStoreError(w, store.ErrNotGroupMember, "邀请失败")
 		return
 	}
 
-	// In a real app, you should also check if the inviter has permission to add members.
-	// For simplicity, we are skipping that check here.
+	if err := h.groups.AddGroupMember(req.GroupID, req.Username); err != nil {
+		writeStoreError(w, err, "邀请失败")
+		return
+	}
 
-	err := store.AddGroupMember(req.GroupID, req.Username)
+	username, err := h.users.ResolveUsername(req.Username)
 	if err != nil {
-		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
-			http.Error(w, "用户已在群组中", http.StatusConflict)
-			return
-		}
-		if strings.Contains(err.Error(), "no rows in result set") {
-			http.Error(w, "要邀请的用户不存在", http.StatusNotFound)
-			return
-		}
-		http.Error(w, "邀请失败: "+err.Error(), http.StatusInternalServerError)
+		writeStoreError(w, err, "邀请失败")
 		return
 	}
+	if members, err := h.groups.GetGroupMembers(req.GroupID); err != nil {
+		log.Printf("Webhook事件生成失败 (group: %d): %v", req.GroupID, err)
+	} else {
+		h.events.EmitMemberAdded(req.GroupID, username, inviter, members)
+	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("邀请成功"))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":  "邀请成功",
+		"group_id": req.GroupID,
+		"username": username,
+	})
 }
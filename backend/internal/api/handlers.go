@@ -0,0 +1,82 @@
+package api
+
+import (
+	"learning-telegram/internal/bot"
+	"learning-telegram/internal/egress"
+	"learning-telegram/internal/mail"
+	"learning-telegram/internal/policy"
+	"learning-telegram/internal/realip"
+	"learning-telegram/internal/store"
+	"learning-telegram/internal/webhook"
+	"learning-telegram/internal/websocket"
+)
+
+// Config configures the handlers. Zero fields get the defaults noted.
+type Config struct {
+	// Mailer sends password reset mail; by default it is logged.
+	Mailer mail.Mailer
+	// ResetURL is the frontend page reset links point to, with the token
+	// appended as the "token" query parameter.
+	ResetURL string
+	// PasswordPolicy is applied to new passwords on registration, password
+	// change and password reset; policy.DefaultPasswordPolicy by default.
+	PasswordPolicy *policy.PasswordPolicy
+	// RealIP finds the address of clients behind trusted proxies.
+	RealIP realip.Resolver
+	// Egress decides which addresses webhooks may point to.
+	Egress egress.Policy
+}
+
+// defaultResetURL is the page of the frontend's dev server.
+const defaultResetURL = "http://localhost:5173/reset-password"
+
+// Handlers serves the API routes from the repositories it was created with.
+// Messages sent through the API are delivered by messenger, like those sent
+// over the WebSocket, to the connections in hub. New bots are connected
+// through botAPI and events emitted to the webhook worker.
+type Handlers struct {
+	users          store.UserRepo
+	groups         store.GroupRepo
+	messages       store.MessageRepo
+	sessions       store.SessionRepo
+	twoFactor      store.TwoFactorRepo
+	loginGuard     store.LoginGuardRepo
+	passwordResets store.PasswordResetRepo
+	presence       store.PresenceRepo
+	bots           store.BotRepo
+	webhooks       store.WebhookRepo
+	hub            *websocket.Hub
+	messenger      *websocket.Handler
+	botAPI         *bot.Handler
+	events         *webhook.Worker
+	cfg            Config
+}
+
+func NewHandlers(repos store.Repos, hub *websocket.Hub, messenger *websocket.Handler, botAPI *bot.Handler, events *webhook.Worker, cfg Config) *Handlers {
+	if cfg.Mailer == nil {
+		cfg.Mailer = &mail.LogMailer{}
+	}
+	if cfg.ResetURL == "" {
+		cfg.ResetURL = defaultResetURL
+	}
+	if cfg.PasswordPolicy == nil {
+		cfg.PasswordPolicy = policy.DefaultPasswordPolicy
+	}
+	return &Handlers{
+		users:          repos.Users,
+		groups:         repos.Groups,
+		messages:       repos.Messages,
+		sessions:       repos.Sessions,
+		twoFactor:      repos.TwoFactor,
+		loginGuard:     repos.LoginGuard,
+		passwordResets: repos.PasswordResets,
+		presence:       repos.Presence,
+		bots:           repos.Bots,
+		webhooks:       repos.Webhooks,
+		hub:            hub,
+		messenger:      messenger,
+		botAPI:         botAPI,
+		events:         events,
+		cfg:            cfg,
+	}
+}
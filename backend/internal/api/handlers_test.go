@@ -0,0 +1,434 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"learning-telegram/internal/api"
+	"learning-telegram/internal/auth"
+	"learning-telegram/internal/bot"
+	"learning-telegram/internal/egress"
+	"learning-telegram/internal/presence"
+	"learning-telegram/internal/realip"
+	"learning-telegram/internal/store"
+	"learning-telegram/internal/store/memstore"
+	"learning-telegram/internal/webhook"
+	"learning-telegram/internal/websocket"
+)
+
+const password = "Correct-Horse-42-battery"
+
+func TestMain(m *testing.M) {
+	if err := auth.LoadKeys(auth.KeyConfig{HMACSecret: "handler-tests-secret-0123456789abcdef"}); err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(m.Run())
+}
+
+// stores runs a test against the in-memory store and a fresh SQLite
+// database, so the handlers are checked against both and memstore against
+// the SQL store it stands in for.
+func stores(t *testing.T, test func(t *testing.T, srv *httptest.Server)) {
+	t.Run("memstore", func(t *testing.T) {
+		test(t, newServer(t, memstore.New().Repos()))
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		if err := store.Open(filepath.Join(t.TempDir(), "test.db")); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.DB.Close() })
+		if err := store.MigrateUp(); err != nil {
+			t.Fatal(err)
+		}
+		test(t, newServer(t, store.NewSQLStore(store.DB).Repos()))
+	})
+}
+
+// newServer serves the routes under test like cmd/server does.
+func newServer(t *testing.T, repos store.Repos) *httptest.Server {
+	hub, err := websocket.NewHub(websocket.DefaultHubConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := webhook.NewWorker(repos.Webhooks, egress.Policy{})
+	ws := websocket.NewHandler(repos, hub, events, websocket.HandlerConfig{})
+	h := api.NewHandlers(repos, hub, ws, bot.NewHandler(repos, hub, ws, egress.Policy{}), events, api.Config{})
+	loginGuard := api.NewBruteForceGuard(api.DefaultLoginGuardConfig, repos.LoginGuard, realip.Resolver{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/register", h.RegisterHandler)
+	mux.Handle("/api/login", loginGuard.Middleware(http.HandlerFunc(h.LoginHandler)))
+	mux.HandleFunc("/api/login/2fa", h.TwoFactorLoginHandler)
+	mux.HandleFunc("POST /api/password/reset", h.RequestPasswordResetHandler)
+	passwordGuardConfig := api.DefaultLoginGuardConfig
+	passwordGuardConfig.UsernameFrom = api.UsernameFromContext
+	passwordGuardConfig.FailureStatus = http.StatusForbidden
+	passwordGuard := api.NewBruteForceGuard(passwordGuardConfig, repos.LoginGuard, realip.Resolver{})
+	mux.Handle("POST /api/me/password", h.AuthMiddleware(passwordGuard.Middleware(http.HandlerFunc(h.ChangePasswordHandler))))
+	mux.Handle("GET /api/me/2fa", h.AuthMiddleware(http.HandlerFunc(h.TwoFactorStatusHandler)))
+	mux.Handle("POST /api/me/2fa/setup", h.AuthMiddleware(http.HandlerFunc(h.TwoFactorSetupHandler)))
+	mux.Handle("POST /api/me/2fa/enable", h.AuthMiddleware(http.HandlerFunc(h.TwoFactorEnableHandler)))
+	mux.Handle("/api/groups/create", h.AuthMiddleware(http.HandlerFunc(h.CreateGroupHandler)))
+	mux.Handle("/api/groups/invite", h.AuthMiddleware(http.HandlerFunc(h.InviteToGroupHandler)))
+	mux.Handle("GET /api/chats/{peer}/messages", h.AuthMiddleware(http.HandlerFunc(h.GetChatMessagesHandler)))
+	mux.Handle("POST /api/chats/{peer}/messages", h.AuthMiddleware(http.HandlerFunc(h.SendChatMessageHandler)))
+	mux.Handle("GET /api/groups/{id}/messages", h.AuthMiddleware(http.HandlerFunc(h.GetGroupMessagesHandler)))
+	mux.Handle("POST /api/groups/{id}/messages", h.AuthMiddleware(http.HandlerFunc(h.SendGroupMessageHandler)))
+	mux.Handle("PUT /api/me/privacy", h.AuthMiddleware(http.HandlerFunc(h.SetPrivacyHandler)))
+	mux.Handle("/api/status/user", h.AuthMiddleware(http.HandlerFunc(h.UserStatusHandler)))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// call sends a JSON request and decodes the JSON response into out, if not
+// nil. It returns the status code.
+func call(t *testing.T, srv *httptest.Server, method, path, token string, body, out any) int {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, srv.URL+path, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: decode response: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// register creates a user and returns their access token.
+func register(t *testing.T, srv *httptest.Server, username string) string {
+	t.Helper()
+	var resp api.LoginResponse
+	status := call(t, srv, "POST", "/api/register", "", api.RegisterRequest{Username: username, Password: password}, &resp)
+	if status != http.StatusCreated || resp.Token == "" {
+		t.Fatalf("register %s: status %d, token %q", username, status, resp.Token)
+	}
+	return resp.Token
+}
+
+func createGroup(t *testing.T, srv *httptest.Server, token, name string) int64 {
+	t.Helper()
+	var resp struct {
+		GroupID int64 `json:"group_id"`
+	}
+	if status := call(t, srv, "POST", "/api/groups/create", token, api.CreateGroupRequest{Name: name}, &resp); status != http.StatusCreated {
+		t.Fatalf("create group: status %d", status)
+	}
+	return resp.GroupID
+}
+
+// send sends a message through the REST API and returns it.
+func send(t *testing.T, srv *httptest.Server, token, path, clientID, content string) api.SentMessageResponse {
+	t.Helper()
+	var sent api.SentMessageResponse
+	status := call(t, srv, "POST", path, token, api.SendMessageRequest{ClientID: clientID, Content: content}, &sent)
+	if status != http.StatusCreated {
+		t.Fatalf("POST %s: status %d", path, status)
+	}
+	return sent
+}
+
+func TestRegister(t *testing.T) {
+	stores(t, func(t *testing.T, srv *httptest.Server) {
+		register(t, srv, "Alice")
+
+		// Usernames are unique after NFKC normalization and case folding.
+		for _, name := range []string{"alice", "ＡＬＩＣＥ"} {
+			var resp api.ErrorResponse
+			status := call(t, srv, "POST", "/api/register", "", api.RegisterRequest{Username: name, Password: password}, &resp)
+			if status != http.StatusConflict || resp.Code != "username_taken" {
+				t.Errorf("register %q: status %d, code %q; want 409 username_taken", name, status, resp.Code)
+			}
+		}
+
+		var invalid api.UsernameErrorResponse
+		status := call(t, srv, "POST", "/api/register", "", api.RegisterRequest{Username: "a b", Password: password}, &invalid)
+		if status != http.StatusBadRequest || invalid.Code != "invalid_username" || invalid.Rule != "charset" {
+			t.Errorf("register invalid username: status %d, code %q, rule %q; want 400 invalid_username charset", status, invalid.Code, invalid.Rule)
+		}
+
+		var weak api.PolicyErrorResponse
+		status = call(t, srv, "POST", "/api/register", "", api.RegisterRequest{Username: "Carol", Password: "carol"}, &weak)
+		if status != http.StatusBadRequest || weak.Code != "password_policy" || weak.Error == "" || len(weak.Violations) == 0 {
+			t.Errorf("register weak password: status %d, body %+v; want 400 password_policy with violations", status, weak)
+		}
+	})
+}
+
+func TestLogin(t *testing.T) {
+	stores(t, func(t *testing.T, srv *httptest.Server) {
+		register(t, srv, "Alice")
+
+		for _, name := range []string{"Alice", "ALICE", "ａｌｉｃｅ"} {
+			var resp api.LoginResponse
+			status := call(t, srv, "POST", "/api/login", "", api.LoginRequest{Username: name, Password: password}, &resp)
+			if status != http.StatusOK || resp.Token == "" || resp.RefreshToken == "" {
+				t.Errorf("login %q: status %d, token %q, refresh token %q", name, status, resp.Token, resp.RefreshToken)
+			}
+		}
+
+		status := call(t, srv, "POST", "/api/login", "", api.LoginRequest{Username: "alice", Password: "wrong"}, nil)
+		if status != http.StatusUnauthorized {
+			t.Errorf("login with wrong password: status %d, want 401", status)
+		}
+		status = call(t, srv, "POST", "/api/login", "", api.LoginRequest{Username: "nobody", Password: password}, nil)
+		if status != http.StatusUnauthorized {
+			t.Errorf("login unknown user: status %d, want 401", status)
+		}
+	})
+}
+
+func TestInviteToGroup(t *testing.T) {
+	stores(t, func(t *testing.T, srv *httptest.Server) {
+		alice := register(t, srv, "alice")
+		bob := register(t, srv, "Bob")
+		groupID := createGroup(t, srv, alice, "friends")
+
+		path := fmt.Sprintf("/api/groups/%d/messages", groupID)
+		if status := call(t, srv, "GET", path, bob, nil, nil); status != http.StatusForbidden {
+			t.Errorf("history before invite: status %d, want 403", status)
+		}
+
+		// Any spelling of the username finds the account.
+		var invited struct {
+			GroupID  int64  `json:"group_id"`
+			Username string `json:"username"`
+		}
+		status := call(t, srv, "POST", "/api/groups/invite", alice, api.InviteToGroupRequest{GroupID: groupID, Username: "BOB"}, &invited)
+		if status != http.StatusOK {
+			t.Fatalf("invite: status %d, want 200", status)
+		}
+		if invited.GroupID != groupID || invited.Username != "Bob" {
+			t.Errorf("invite: response %+v, want group %d and the canonical username Bob", invited, groupID)
+		}
+		invite := func(username string) (int, string) {
+			var resp api.ErrorResponse
+			status := call(t, srv, "POST", "/api/groups/invite", alice, api.InviteToGroupRequest{GroupID: groupID, Username: username}, &resp)
+			return status, resp.Code
+		}
+		if status, code := invite("bob"); status != http.StatusConflict || code != "already_member" {
+			t.Errorf("invite again: status %d, code %q; want 409 already_member", status, code)
+		}
+		if status, code := invite("nobody"); status != http.StatusNotFound || code != "user_not_found" {
+			t.Errorf("invite unknown user: status %d, code %q; want 404 user_not_found", status, code)
+		}
+
+		sent := send(t, srv, bob, path, "c1", "hi")
+		if sent.Sender != "Bob" || sent.GroupID != groupID {
+			t.Errorf("send after invite: message %+v", sent)
+		}
+
+		// Only members invite, so nobody can add themselves to a group.
+		carol := register(t, srv, "carol")
+		for _, id := range []int64{groupID, groupID + 100} {
+			var resp api.ErrorResponse
+			status := call(t, srv, "POST", "/api/groups/invite", carol, api.InviteToGroupRequest{GroupID: id, Username: "carol"}, &resp)
+			if status != http.StatusForbidden || resp.Code != "not_group_member" {
+				t.Errorf("invite by a non-member to group %d: status %d, code %q; want 403 not_group_member", id, status, resp.Code)
+			}
+		}
+		if status := call(t, srv, "GET", path, carol, nil, nil); status != http.StatusForbidden {
+			t.Errorf("history after a rejected invite: status %d, want 403", status)
+		}
+		// Invited members invite in turn.
+		if status := call(t, srv, "POST", "/api/groups/invite", bob, api.InviteToGroupRequest{GroupID: groupID, Username: "carol"}, nil); status != http.StatusOK {
+			t.Errorf("invite by a member: status %d, want 200", status)
+		}
+	})
+}
+
+func TestSendMessageClientID(t *testing.T) {
+	stores(t, func(t *testing.T, srv *httptest.Server) {
+		alice := register(t, srv, "alice")
+		register(t, srv, "bob")
+
+		send := func(clientID, content string) (int, api.SentMessageResponse) {
+			var resp api.SentMessageResponse
+			status := call(t, srv, "POST", "/api/chats/bob/messages", alice, api.SendMessageRequest{ClientID: clientID, Content: content}, &resp)
+			return status, resp
+		}
+		status, first := send("c1", "hello")
+		if status != http.StatusCreated || first.Duplicate {
+			t.Fatalf("send: status %d, duplicate %v", status, first.Duplicate)
+		}
+		status, retry := send("c1", "hello")
+		if status != http.StatusOK || !retry.Duplicate || retry.ID != first.ID {
+			t.Errorf("retry: status %d, duplicate %v, ID %d; want 200, true, %d", status, retry.Duplicate, retry.ID, first.ID)
+		}
+
+		var resp api.ErrorResponse
+		status = call(t, srv, "POST", "/api/chats/bob/messages", alice, api.SendMessageRequest{ClientID: "c1", Content: "other"}, &resp)
+		if status != http.StatusConflict || resp.Code != "client_id_reused" {
+			t.Errorf("reuse client ID: status %d, code %q; want 409 client_id_reused", status, resp.Code)
+		}
+
+		var page store.HistoryPage
+		call(t, srv, "GET", "/api/chats/bob/messages", alice, nil, &page)
+		if len(page.Messages) != 1 {
+			t.Errorf("history has %d messages, want 1", len(page.Messages))
+		}
+	})
+}
+
+func TestSendMessageTooLong(t *testing.T) {
+	stores(t, func(t *testing.T, srv *httptest.Server) {
+		alice := register(t, srv, "alice")
+		register(t, srv, "bob")
+
+		send := func(content string) (int, string) {
+			var resp api.ErrorResponse
+			status := call(t, srv, "POST", "/api/chats/bob/messages", alice, api.SendMessageRequest{ClientID: "c1", Content: content}, &resp)
+			return status, resp.Code
+		}
+		// The limit counts characters, not bytes.
+		if status, _ := send(strings.Repeat("字", websocket.MaxContentLength)); status != http.StatusCreated {
+			t.Errorf("send %d characters: status %d, want 201", websocket.MaxContentLength, status)
+		}
+		if status, code := send(strings.Repeat("a", websocket.MaxContentLength+1)); status != http.StatusBadRequest || code != websocket.ErrMessageTooLong {
+			t.Errorf("send too long content: status %d, code %q; want 400 %s", status, code, websocket.ErrMessageTooLong)
+		}
+		if status, code := send(strings.Repeat("a", 100<<10)); status != http.StatusRequestEntityTooLarge || code != websocket.ErrMessageTooLong {
+			t.Errorf("send too large body: status %d, code %q; want 413 %s", status, code, websocket.ErrMessageTooLong)
+		}
+	})
+}
+
+func TestHistoryPaging(t *testing.T) {
+	stores(t, func(t *testing.T, srv *httptest.Server) {
+		alice := register(t, srv, "alice")
+		bob := register(t, srv, "bob")
+		carol := register(t, srv, "carol")
+
+		// Alice and Bob take turns, while Carol's messages to Alice take IDs
+		// in between, which must not show up in their chat.
+		var ids []int
+		for i := range 7 {
+			from, to := alice, "bob"
+			if i%2 == 1 {
+				from, to = bob, "alice"
+			}
+			sent := send(t, srv, from, "/api/chats/"+to+"/messages", fmt.Sprint("m", i), fmt.Sprint(i))
+			ids = append(ids, sent.ID)
+			send(t, srv, carol, "/api/chats/alice/messages", fmt.Sprint("noise", i), "noise")
+		}
+
+		get := func(query string) store.HistoryPage {
+			t.Helper()
+			var page store.HistoryPage
+			if status := call(t, srv, "GET", "/api/chats/BOB/messages"+query, alice, nil, &page); status != http.StatusOK {
+				t.Fatalf("GET %s: status %d", query, status)
+			}
+			return page
+		}
+		check := func(query string, page store.HistoryPage, want []int, moreBefore, moreAfter bool) {
+			t.Helper()
+			var got []int
+			for _, m := range page.Messages {
+				got = append(got, m.ID)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(want) || page.HasMoreBefore != moreBefore || page.HasMoreAfter != moreAfter {
+				t.Errorf("%s: messages %v, more before %v, more after %v; want %v, %v, %v",
+					query, got, page.HasMoreBefore, page.HasMoreAfter, want, moreBefore, moreAfter)
+			}
+		}
+
+		// Newest first, paging backwards by before_id.
+		page := get("?limit=3")
+		check("?limit=3", page, []int{ids[6], ids[5], ids[4]}, true, false)
+		query := fmt.Sprintf("?limit=3&before_id=%d", page.BeforeID)
+		page = get(query)
+		check(query, page, []int{ids[3], ids[2], ids[1]}, true, true)
+		query = fmt.Sprintf("?limit=3&before_id=%d", page.BeforeID)
+		check(query, get(query), []int{ids[0]}, false, true)
+
+		query = fmt.Sprintf("?limit=2&after_id=%d", ids[0])
+		page = get(query)
+		check(query, page, []int{ids[2], ids[1]}, true, true)
+		if page.AfterID != int64(ids[2]) {
+			t.Errorf("%s: after_id %d, want %d", query, page.AfterID, ids[2])
+		}
+
+		query = fmt.Sprintf("?limit=4&around_id=%d", ids[3])
+		check(query, get(query), []int{ids[4], ids[3], ids[2], ids[1]}, true, true)
+
+		for _, query := range []string{"?before_id=x", "?limit=0", "?before_id=1&after_id=2"} {
+			if status := call(t, srv, "GET", "/api/chats/bob/messages"+query, alice, nil, nil); status != http.StatusBadRequest {
+				t.Errorf("GET %s: status %d, want 400", query, status)
+			}
+		}
+	})
+}
+
+func TestContactsPrivacy(t *testing.T) {
+	stores(t, func(t *testing.T, srv *httptest.Server) {
+		alice := register(t, srv, "alice")
+		bob := register(t, srv, "bob")
+		mallory := register(t, srv, "mallory")
+		privacy := api.PrivacySettings{LastSeen: presence.Contacts}
+		if status := call(t, srv, "PUT", "/api/me/privacy", alice, privacy, nil); status != http.StatusOK {
+			t.Fatalf("set privacy: status %d", status)
+		}
+
+		// Alice has never been online: the exact status is offline, the
+		// approximation long ago.
+		statusOf := func(viewer string) string {
+			t.Helper()
+			var p presence.Presence
+			if status := call(t, srv, "GET", "/api/status/user?username=alice", viewer, nil, &p); status != http.StatusOK {
+				t.Fatalf("get status: status %d", status)
+			}
+			return p.Status
+		}
+
+		// Writing to alice doesn't make mallory her contact, only her
+		// writing to someone does.
+		send(t, srv, mallory, "/api/chats/alice/messages", "m1", "hi")
+		send(t, srv, bob, "/api/chats/alice/messages", "b1", "hi")
+		send(t, srv, alice, "/api/chats/bob/messages", "a1", "hi bob")
+		if got := statusOf(mallory); got != presence.StatusLongAgo {
+			t.Errorf("mallory sees %q, want the approximation %q", got, presence.StatusLongAgo)
+		}
+		if got := statusOf(bob); got != presence.StatusOffline {
+			t.Errorf("bob sees %q, want the exact %q", got, presence.StatusOffline)
+		}
+	})
+}
+
+func TestJWKSHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	api.JWKSHandler(rec, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type %q, want application/json", ct)
+	}
+	// The tests sign with an HMAC secret, which must never be published.
+	var set auth.JWKSet
+	if err := json.NewDecoder(rec.Body).Decode(&set); err != nil {
+		t.Fatal(err)
+	}
+	if set.Keys == nil || len(set.Keys) != 0 {
+		t.Errorf("JWKS %+v, want an empty key list", set)
+	}
+}
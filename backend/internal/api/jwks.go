@@ -0,0 +1,16 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"learning-telegram/internal/auth"
+)
+
+// JWKSHandler publishes the public token verification keys so that other
+// services can validate access tokens issued by this server.
+func JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(auth.JWKS())
+}
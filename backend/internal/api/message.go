@@ -0,0 +1,258 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"learning-telegram/internal/policy"
+	"learning-telegram/internal/store"
+	"learning-telegram/internal/websocket"
+)
+
+// SendMessageRequest is the body of the routes sending messages. ClientID
+// makes retries idempotent, as over the WebSocket: a retry returns the
+// message stored by the first attempt.
+type SendMessageRequest struct {
+	ClientID string `json:"client_id"`
+	Content  string `json:"content"`
+}
+
+// SentMessageResponse is a message sent through the REST API; GroupID is
+// set for group messages. Duplicate is set if an earlier attempt with the
+// same client ID had already stored it.
+type SentMessageResponse struct {
+	store.Message
+	GroupID   int64  `json:"group_id,omitempty"`
+	ClientID  string `json:"client_id"`
+	Duplicate bool   `json:"duplicate,omitempty"`
+}
+
+// GetChatMessagesHandler returns a page of the private chat with the user in
+// the path, newest first. The page is selected by the query parameters
+// before_id, after_id or around_id and limit, see store.HistoryQuery.
+func (h *Handlers) GetChatMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		writeError(w, "无法从Token获取用户信息", http.StatusUnauthorized)
+		return
+	}
+	q, ok := historyQuery(w, r)
+	if !ok {
+		return
+	}
+	peer, ok := h.chatPeer(w, r, "查询历史失败")
+	if !ok {
+		return
+	}
+
+	page, err := h.messages.GetPrivateHistory(username, peer, q)
+	if err != nil {
+		writeStoreError(w, err, "查询历史失败")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// GetGroupMessagesHandler returns a page of the history of a group the user
+// is a member of, like GetChatMessagesHandler.
+func (h *Handlers) GetGroupMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		writeError(w, "无法从Token获取用户信息", http.StatusUnauthorized)
+		return
+	}
+	q, ok := historyQuery(w, r)
+	if !ok {
+		return
+	}
+	groupID, ok := h.memberGroup(w, r, username, "查询群组历史失败")
+	if !ok {
+		return
+	}
+
+	page, err := h.messages.GetGroupHistory(groupID, q)
+	if err != nil {
+		writeStoreError(w, err, "查询群组历史失败")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// SendChatMessageHandler sends a private message to the user in the path.
+// It is delivered like one sent over the WebSocket, so the online devices of
+// both users receive it at once.
+func (h *Handlers) SendChatMessageHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		writeError(w, "无法从Token获取用户信息", http.StatusUnauthorized)
+		return
+	}
+	req, ok := sendMessageRequest(w, r)
+	if !ok {
+		return
+	}
+	peer, ok := h.chatPeer(w, r, "消息存储失败")
+	if !ok {
+		return
+	}
+
+	msg, created, err := h.messenger.SendPrivateMessage(username, peer, req.ClientID, req.Content)
+	if err != nil {
+		writeStoreError(w, err, "消息存储失败")
+		return
+	}
+	writeSentMessage(w, SentMessageResponse{Message: *msg, ClientID: req.ClientID, Duplicate: !created})
+}
+
+// SendGroupMessageHandler sends a message to a group the user is a member
+// of, delivered to its online members like SendChatMessageHandler.
+func (h *Handlers) SendGroupMessageHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		writeError(w, "无法从Token获取用户信息", http.StatusUnauthorized)
+		return
+	}
+	req, ok := sendMessageRequest(w, r)
+	if !ok {
+		return
+	}
+	groupID, ok := h.memberGroup(w, r, username, "消息存储失败")
+	if !ok {
+		return
+	}
+
+	msg, created, err := h.messenger.SendGroupMessage(username, groupID, req.ClientID, req.Content)
+	if err != nil {
+		writeStoreError(w, err, "消息存储失败")
+		return
+	}
+	writeSentMessage(w, SentMessageResponse{Message: *msg, GroupID: groupID, ClientID: req.ClientID, Duplicate: !created})
+}
+
+// chatPeer resolves the user in the path of a private chat route. If there
+// is no such user, it replies with an error and returns false.
+func (h *Handlers) chatPeer(w http.ResponseWriter, r *http.Request, message string) (string, bool) {
+	peer := r.PathValue("peer")
+	if !policy.IsPlausibleUsername(peer) {
+		writeStoreError(w, store.ErrUserNotFound, message)
+		return "", false
+	}
+	peer, err := h.users.ResolveUsername(peer)
+	if err != nil {
+		writeStoreError(w, err, message)
+		return "", false
+	}
+	return peer, true
+}
+
+// memberGroup parses the group ID in the path of a group route and checks
+// that username is a member. Otherwise it replies with an error and returns
+// false.
+func (h *Handlers) memberGroup(w http.ResponseWriter, r *http.Request, username, message string) (int64, bool) {
+	groupID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeStoreError(w, store.ErrGroupNotFound, message)
+		return 0, false
+	}
+	isMember, err := h.groups.IsUserInGroup(username, groupID)
+	if err != nil {
+		writeStoreError(w, err, message)
+		return 0, false
+	}
+	if !isMember {
+		writeStoreError(w, store.ErrNotGroupMember, message)
+		return 0, false
+	}
+	return groupID, true
+}
+
+// maxSendMessageBody is the largest body of a route sending a message, the
+// default limit of a WebSocket frame. Content of websocket.MaxContentLength
+// characters fits in it even if every character is escaped.
+const maxSendMessageBody = 64 << 10
+
+// sendMessageRequest decodes and checks the body of a route sending a
+// message. If it is invalid, it replies with an error and returns false.
+// Content longer than websocket.MaxContentLength is rejected with the code
+// the WebSocket uses, "message_too_long".
+func sendMessageRequest(w http.ResponseWriter, r *http.Request) (*SendMessageRequest, bool) {
+	tooLong := fmt.Sprintf("消息内容不能超过%d个字符", websocket.MaxContentLength)
+
+	var req SendMessageRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxSendMessageBody)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeErrorCode(w, http.StatusRequestEntityTooLarge, websocket.ErrMessageTooLong, tooLong)
+			return nil, false
+		}
+		writeError(w, "无效的请求参数", http.StatusBadRequest)
+		return nil, false
+	}
+	if errs := websocket.ValidClientID(req.ClientID); len(errs) > 0 {
+		writeError(w, "client_id无效: "+errs[0].Message, http.StatusBadRequest)
+		return nil, false
+	}
+	if strings.TrimSpace(req.Content) == "" {
+		writeError(w, "消息内容不能为空", http.StatusBadRequest)
+		return nil, false
+	}
+	if websocket.ContentTooLong(req.Content) {
+		writeErrorCode(w, http.StatusBadRequest, websocket.ErrMessageTooLong, tooLong)
+		return nil, false
+	}
+	return &req, true
+}
+
+// writeSentMessage replies with a sent message: 201 if it was stored now,
+// 200 if a retry found it already stored.
+func writeSentMessage(w http.ResponseWriter, resp SentMessageResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	if !resp.Duplicate {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// historyQuery reads the page of history a request asks for from its query
+// parameters. If they are invalid, it replies with an error and returns
+// false.
+func historyQuery(w http.ResponseWriter, r *http.Request) (store.HistoryQuery, bool) {
+	var q store.HistoryQuery
+	cursors := 0
+	for _, p := range []struct {
+		name string
+		id   *int64
+	}{{"before_id", &q.BeforeID}, {"after_id", &q.AfterID}, {"around_id", &q.AroundID}} {
+		v := r.URL.Query().Get(p.name)
+		if v == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || id < 1 {
+			writeError(w, p.name+"必须是正整数", http.StatusBadRequest)
+			return q, false
+		}
+		*p.id = id
+		cursors++
+	}
+	if cursors > 1 {
+		writeError(w, "before_id、after_id和around_id只能指定一个", http.StatusBadRequest)
+		return q, false
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(w, "limit必须是正整数", http.StatusBadRequest)
+			return q, false
+		}
+		q.Limit = min(n, store.MaxHistoryLimit)
+	}
+	return q, true
+}
@@ -3,20 +3,29 @@ package api
 import (
 	"context"
 	"net/http"
+	"slices"
 	"strings"
 
 	"learning-telegram/internal/auth"
 )
 
-// CORS中间件
-func CORSMiddleware(next http.Handler) http.Handler {
+// CORSMiddleware lets pages from the allowed origins call the API from the
+// browser; "*" allows any origin. Pages served from the API's own origin
+// don't need it.
+func CORSMiddleware(allowedOrigins []string, next http.Handler) http.Handler {
+	anyOrigin := slices.Contains(allowedOrigins, "*")
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		origin := r.Header.Get("Origin")
+		if origin != "" && (anyOrigin || slices.Contains(allowedOrigins, origin)) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Admin-Token")
+		}
+		w.Header().Add("Vary", "Origin")
 
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
+		// 预检请求
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.WriteHeader(http.StatusNoContent)
 			return
 		}
 
@@ -25,27 +34,39 @@ func CORSMiddleware(next http.Handler) http.Handler {
 }
 
 // AuthMiddleware 验证JWT token
-func AuthMiddleware(next http.Handler) http.Handler {
+func (h *Handlers) AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
-			http.Error(w, "需要认证", http.StatusUnauthorized)
+			writeError(w, "需要认证", http.StatusUnauthorized)
 			return
 		}
 
 		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
 		if tokenString == authHeader {
-			http.Error(w, "无效的认证格式", http.StatusUnauthorized)
+			writeError(w, "无效的认证格式", http.StatusUnauthorized)
 			return
 		}
 
 		claims, err := auth.ValidateToken(tokenString)
 		if err != nil {
-			http.Error(w, "无效的token", http.StatusUnauthorized)
+			writeErrorCode(w, http.StatusUnauthorized, "invalid_token", "无效的token")
+			return
+		}
+
+		active, err := h.sessions.IsSessionActive(claims.SessionID)
+		if err != nil {
+			writeError(w, "验证会话失败", http.StatusInternalServerError)
+			return
+		}
+		if !active {
+			writeErrorCode(w, http.StatusUnauthorized, "session_expired", "会话已失效，请重新登录")
 			return
 		}
+		h.sessions.TouchSession(claims.SessionID, h.cfg.RealIP.ClientIP(r))
 
 		ctx := context.WithValue(r.Context(), "username", claims.Username)
+		ctx = context.WithValue(ctx, "session_id", claims.SessionID)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -0,0 +1,253 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	netmail "net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"learning-telegram/internal/auth"
+	"learning-telegram/internal/mail"
+	"learning-telegram/internal/policy"
+	"learning-telegram/internal/store"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// passwordResetTTL is how long a password reset link stays valid.
+const passwordResetTTL = 30 * time.Minute
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type SetEmailRequest struct {
+	Email string `json:"email"`
+}
+
+type PasswordResetRequest struct {
+	Email string `json:"email"`
+}
+
+type PasswordResetConfirmRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+// normalizeEmail validates an optional email address and returns it in the
+// form it is stored in.
+func normalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	if email == "" {
+		return "", nil
+	}
+	addr, err := netmail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "", fmt.Errorf("invalid email address %q", email)
+	}
+	return strings.ToLower(addr.Address), nil
+}
+
+// revokeSessions revokes the sessions of username except keepID and closes
+// their live WebSocket connections.
+func (h *Handlers) revokeSessions(username, keepID string) error {
+	ids, err := h.sessions.RevokeOtherSessions(username, keepID)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		h.hub.CloseSession(username, id)
+	}
+	return nil
+}
+
+// ChangePasswordHandler changes the password of the authenticated user and
+// signs out every other device.
+func (h *Handlers) ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		writeError(w, "无法从Token获取用户信息", http.StatusUnauthorized)
+		return
+	}
+	sessionID, _ := r.Context().Value("session_id").(string)
+
+	var req ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "参数错误", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.NewPassword) == "" {
+		writeError(w, "新密码不能为空", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := h.verifyPassword(username, req.CurrentPassword); err != nil {
+		// 403 rather than 401: the caller is authenticated, and a 401 would
+		// make clients think their token expired.
+		writeError(w, "当前密码错误", http.StatusForbidden)
+		return
+	}
+	if !h.checkPasswordPolicy(w, req.NewPassword, username, h.userEmail(username)) {
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		writeError(w, "密码加密失败", http.StatusInternalServerError)
+		return
+	}
+	if err := h.users.UpdatePasswordHash(username, string(hash)); err != nil {
+		writeError(w, "修改密码失败", http.StatusInternalServerError)
+		return
+	}
+	if err := h.revokeSessions(username, sessionID); err != nil {
+		log.Printf("修改密码后注销其他会话失败 (user: %s): %v", username, err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SetEmailHandler sets or clears the email address of the authenticated user.
+func (h *Handlers) SetEmailHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		writeError(w, "无法从Token获取用户信息", http.StatusUnauthorized)
+		return
+	}
+
+	var req SetEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "参数错误", http.StatusBadRequest)
+		return
+	}
+	email, err := normalizeEmail(req.Email)
+	if err != nil {
+		writeError(w, "邮箱格式不正确", http.StatusBadRequest)
+		return
+	}
+
+	err = h.users.SetUserEmail(username, email)
+	if err != nil {
+		writeStoreError(w, err, "设置邮箱失败")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RequestPasswordResetHandler mails a password reset link to the account
+// registered with the given email. It always answers 202 so that it cannot
+// be used to find out which addresses are registered.
+func (h *Handlers) RequestPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	var req PasswordResetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "参数错误", http.StatusBadRequest)
+		return
+	}
+	email, err := normalizeEmail(req.Email)
+	if err != nil || email == "" {
+		writeError(w, "邮箱格式不正确", http.StatusBadRequest)
+		return
+	}
+
+	// Look up the account and send the mail in the background, so the
+	// response time is the same whether or not the address is registered.
+	go h.sendPasswordReset(email)
+
+	writeJSON(w, http.StatusAccepted, map[string]string{
+		"message": "如果该邮箱已注册，重置密码的邮件已发送",
+	})
+}
+
+func (h *Handlers) sendPasswordReset(email string) {
+	username, err := h.users.GetUsernameByEmail(email)
+	if err != nil {
+		return
+	}
+
+	token, err := auth.NewRefreshToken()
+	if err != nil {
+		log.Printf("生成重置密码Token失败: %v", err)
+		return
+	}
+	if err := h.passwordResets.CreatePasswordReset(username, auth.HashToken(token), time.Now().Add(passwordResetTTL)); err != nil {
+		log.Printf("保存重置密码Token失败 (user: %s): %v", username, err)
+		return
+	}
+
+	link := h.cfg.ResetURL + "?token=" + url.QueryEscape(token)
+	msg := mail.Message{
+		To:      email,
+		Subject: "重置你的密码",
+		Body: fmt.Sprintf(
+			"%s，你好：\n\n我们收到了重置你账户密码的请求。请在%d分钟内打开以下链接设置新密码：\n\n%s\n\n如果这不是你本人的操作，请忽略这封邮件。\n",
+			username, int(passwordResetTTL.Minutes()), link,
+		),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := h.cfg.Mailer.Send(ctx, msg); err != nil {
+		log.Printf("发送重置密码邮件失败 (user: %s): %v", username, err)
+	}
+}
+
+// ConfirmPasswordResetHandler sets a new password using a token from a reset
+// mail. Every session of the account is revoked afterwards.
+func (h *Handlers) ConfirmPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	var req PasswordResetConfirmRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "参数错误", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Token) == "" || strings.TrimSpace(req.NewPassword) == "" {
+		writeError(w, "token和新密码不能为空", http.StatusBadRequest)
+		return
+	}
+
+	tokenHash := auth.HashToken(req.Token)
+	username, err := h.passwordResets.GetPasswordResetUser(tokenHash)
+	if err == store.ErrResetTokenInvalid {
+		writeErrorCode(w, http.StatusBadRequest, "reset_token_invalid", "重置链接无效或已过期")
+		return
+	} else if err != nil {
+		writeError(w, "重置密码失败", http.StatusInternalServerError)
+		return
+	}
+	// Check the policy before redeeming, so a rejected password doesn't
+	// burn the link.
+	if !h.checkPasswordPolicy(w, req.NewPassword, username, h.userEmail(username)) {
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		writeError(w, "密码加密失败", http.StatusInternalServerError)
+		return
+	}
+
+	username, err = h.passwordResets.ConsumePasswordReset(tokenHash)
+	if err == store.ErrResetTokenInvalid {
+		writeErrorCode(w, http.StatusBadRequest, "reset_token_invalid", "重置链接无效或已过期")
+		return
+	} else if err != nil {
+		writeError(w, "重置密码失败", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.users.UpdatePasswordHash(username, string(hash)); err != nil {
+		writeError(w, "重置密码失败", http.StatusInternalServerError)
+		return
+	}
+	if err := h.revokeSessions(username, ""); err != nil {
+		log.Printf("重置密码后注销会话失败 (user: %s): %v", username, err)
+	}
+	h.loginGuard.ResetLoginFailures(policy.NormalizeUsername(username))
+
+	w.WriteHeader(http.StatusNoContent)
+}
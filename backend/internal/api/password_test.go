@@ -0,0 +1,60 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"learning-telegram/internal/api"
+)
+
+// TestChangePasswordThrottled guesses the current password with a stolen
+// access token: the guesses count against the account like failed logins.
+func TestChangePasswordThrottled(t *testing.T) {
+	stores(t, func(t *testing.T, srv *httptest.Server) {
+		token := register(t, srv, "alice")
+		change := func(current string) int {
+			t.Helper()
+			return call(t, srv, "POST", "/api/me/password", token, api.ChangePasswordRequest{CurrentPassword: current, NewPassword: "Another-Horse-43-staple"}, nil)
+		}
+
+		for i := range api.DefaultLoginGuardConfig.FreeAttempts {
+			if status := change("guess"); status != http.StatusForbidden {
+				t.Fatalf("guess %d: status %d, want 403", i+1, status)
+			}
+		}
+		if status := change(password); status != http.StatusTooManyRequests {
+			t.Errorf("change after the free guesses: status %d, want 429", status)
+		}
+		status := call(t, srv, "POST", "/api/login", "", api.LoginRequest{Username: "alice", Password: password}, nil)
+		if status != http.StatusTooManyRequests {
+			t.Errorf("login after the guesses: status %d, want 429", status)
+		}
+	})
+}
+
+func TestRequestPasswordReset(t *testing.T) {
+	stores(t, func(t *testing.T, srv *httptest.Server) {
+		// The answer is the same whether or not the address is registered.
+		resp, err := srv.Client().Post(srv.URL+"/api/password/reset", "application/json", strings.NewReader(`{"email":"nobody@example.com"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted || !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+			t.Errorf("reset: status %d, Content-Type %q; want 202 JSON", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+
+		var accepted struct {
+			Message string `json:"message"`
+		}
+		if status := call(t, srv, "POST", "/api/password/reset", "", api.PasswordResetRequest{Email: "alice@example.com"}, &accepted); status != http.StatusAccepted || accepted.Message == "" {
+			t.Errorf("reset: status %d, body %+v; want 202 with a message", status, accepted)
+		}
+		var invalid api.ErrorResponse
+		if status := call(t, srv, "POST", "/api/password/reset", "", api.PasswordResetRequest{Email: "not an address"}, &invalid); status != http.StatusBadRequest || invalid.Code != "bad_request" {
+			t.Errorf("reset for an invalid address: status %d, body %+v; want 400 bad_request", status, invalid)
+		}
+	})
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"learning-telegram/internal/policy"
+)
+
+// PolicyErrorResponse is the body of a 400 response for a rejected password,
+// listing every rule that failed. Its code is "password_policy".
+type PolicyErrorResponse struct {
+	ErrorResponse
+	Violations []policy.Violation `json:"violations"`
+}
+
+// UsernameErrorResponse is the body of a 400 response for a rejected
+// username. Its code is "invalid_username"; Rule is the rule that failed,
+// e.g. "reserved".
+type UsernameErrorResponse struct {
+	ErrorResponse
+	Rule string `json:"rule"`
+}
+
+// checkPasswordPolicy validates a new password and, if it is rejected, writes
+// a structured error response. userInputs are the username, email and other
+// personal data the password must not be derived from.
+func (h *Handlers) checkPasswordPolicy(w http.ResponseWriter, password string, userInputs ...string) bool {
+	err := h.cfg.PasswordPolicy.Check(password, userInputs...)
+	if err == nil {
+		return true
+	}
+
+	var pe *policy.PasswordError
+	if !errors.As(err, &pe) {
+		writeError(w, "密码校验失败", http.StatusInternalServerError)
+		return false
+	}
+	writeErrorResponse(w, http.StatusBadRequest, PolicyErrorResponse{
+		ErrorResponse: ErrorResponse{Code: "password_policy", Error: "密码不符合安全要求"},
+		Violations:    pe.Violations,
+	})
+	return false
+}
+
+// checkUsername validates a new username with validate, i.e.
+// policy.ValidateUsername or policy.ValidateBotUsername, and, if it is
+// rejected, writes a structured error response.
+func checkUsername(w http.ResponseWriter, username string, validate func(string) error) bool {
+	err := validate(username)
+	if err == nil {
+		return true
+	}
+
+	var ue *policy.UsernameError
+	if !errors.As(err, &ue) {
+		writeError(w, "用户名校验失败", http.StatusInternalServerError)
+		return false
+	}
+	writeErrorResponse(w, http.StatusBadRequest, UsernameErrorResponse{
+		ErrorResponse: ErrorResponse{Code: "invalid_username", Error: ue.Message},
+		Rule:          ue.Rule,
+	})
+	return false
+}
+
+// userEmail returns the email of a user for use as a password policy input,
+// or "" if it can't be loaded.
+func (h *Handlers) userEmail(username string) string {
+	email, _ := h.users.GetUserEmail(username)
+	return email
+}
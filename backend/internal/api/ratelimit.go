@@ -0,0 +1,284 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"learning-telegram/internal/auth"
+	"learning-telegram/internal/policy"
+	"learning-telegram/internal/realip"
+	"learning-telegram/internal/store"
+)
+
+// tooManyAttemptsMessage is deliberately the same for every kind of
+// throttling, so responses don't reveal whether an account exists or is
+// locked.
+const tooManyAttemptsMessage = "尝试次数过多，请稍后再试"
+
+// Limit allows at most Max requests per Window. A zero Max disables it.
+type Limit struct {
+	Max    int
+	Window time.Duration
+}
+
+// BruteForceConfig configures a BruteForceGuard.
+type BruteForceConfig struct {
+	PerIP   Limit
+	PerUser Limit
+
+	// TrackFailures enables failure accounting: a FailureStatus from the
+	// wrapped handler counts as a failed attempt for the username, a 200,
+	// 201 or 204 resets it.
+	// After FreeAttempts failures every further attempt has to wait
+	// BaseDelay, doubling per failure up to MaxDelay, and after
+	// LockoutThreshold failures the username is locked for LockoutDuration.
+	// The first failure after a lockout expired counts as the first again.
+	// Delays are not served by holding the request: an attempt made too
+	// early is answered right away with 429 and a Retry-After header, like
+	// one during a lockout, so throttled clients can't tie up connections.
+	TrackFailures    bool
+	FreeAttempts     int
+	BaseDelay        time.Duration
+	MaxDelay         time.Duration
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	// FailureStatus is the status the wrapped handler answers a wrong
+	// credential with. It defaults to 401.
+	FailureStatus int
+
+	// UsernameFrom extracts the username an attempt is for from the request
+	// and its body. It defaults to the normalized "username" field of a JSON
+	// body.
+	UsernameFrom func(r *http.Request, body []byte) string
+}
+
+// BruteForceGuard is a middleware that throttles credential endpoints per
+// client IP and per username.
+type BruteForceGuard struct {
+	cfg       BruteForceConfig
+	throttles store.LoginGuardRepo
+	realIP    realip.Resolver
+	windows   *slidingWindow
+}
+
+// NewBruteForceGuard creates a guard recording failed attempts in throttles,
+// which is only used with TrackFailures. Clients are told apart by the
+// address realIP finds.
+func NewBruteForceGuard(cfg BruteForceConfig, throttles store.LoginGuardRepo, realIP realip.Resolver) *BruteForceGuard {
+	if cfg.UsernameFrom == nil {
+		cfg.UsernameFrom = usernameFromJSON
+	}
+	if cfg.FailureStatus == 0 {
+		cfg.FailureStatus = http.StatusUnauthorized
+	}
+	return &BruteForceGuard{cfg: cfg, throttles: throttles, realIP: realIP, windows: newSlidingWindow()}
+}
+
+// DefaultLoginGuardConfig is used for the password and two-factor login
+// steps.
+var DefaultLoginGuardConfig = BruteForceConfig{
+	PerIP:            Limit{Max: 30, Window: time.Minute},
+	PerUser:          Limit{Max: 10, Window: time.Minute},
+	TrackFailures:    true,
+	FreeAttempts:     3,
+	BaseDelay:        time.Second,
+	MaxDelay:         time.Minute,
+	LockoutThreshold: 10,
+	LockoutDuration:  15 * time.Minute,
+}
+
+// DefaultRegisterGuardConfig is used for account creation.
+var DefaultRegisterGuardConfig = BruteForceConfig{
+	PerIP: Limit{Max: 10, Window: time.Hour},
+}
+
+// UsernameFromChallenge extracts the username from the challenge token of a
+// two-factor login request, so failed codes count against the account.
+func UsernameFromChallenge(_ *http.Request, body []byte) string {
+	var req TwoFactorLoginRequest
+	if json.Unmarshal(body, &req) != nil {
+		return ""
+	}
+	username, err := auth.ValidateChallengeToken(req.ChallengeToken)
+	if err != nil {
+		return ""
+	}
+	return policy.NormalizeUsername(username)
+}
+
+// UsernameFromContext takes the username of the authenticated user, for
+// endpoints behind AuthMiddleware that check the password again, such as
+// changing it. Failures there count against the same account as failed
+// logins.
+func UsernameFromContext(r *http.Request, _ []byte) string {
+	username, _ := r.Context().Value("username").(string)
+	return policy.NormalizeUsername(username)
+}
+
+// NoUsername is a UsernameFrom for endpoints throttled per IP only.
+func NoUsername(*http.Request, []byte) string { return "" }
+
+func usernameFromJSON(_ *http.Request, body []byte) string {
+	var req struct {
+		Username string `json:"username"`
+	}
+	json.Unmarshal(body, &req)
+	return policy.NormalizeUsername(req.Username)
+}
+
+func (g *BruteForceGuard) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			writeError(w, "参数错误", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		username := g.cfg.UsernameFrom(r, body)
+		now := time.Now()
+
+		if wait := g.windows.hit("ip:"+g.realIP.ClientIP(r), g.cfg.PerIP, now); wait > 0 {
+			tooManyAttempts(w, wait)
+			return
+		}
+		if username != "" {
+			if wait := g.windows.hit("user:"+username, g.cfg.PerUser, now); wait > 0 {
+				tooManyAttempts(w, wait)
+				return
+			}
+		}
+
+		if !g.cfg.TrackFailures || username == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		throttle, err := g.throttles.GetLoginThrottle(username)
+		if err != nil {
+			writeError(w, "服务器内部错误", http.StatusInternalServerError)
+			return
+		}
+		if wait := g.retryAfter(throttle, now); wait > 0 {
+			tooManyAttempts(w, wait)
+			return
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		switch {
+		case rec.status == g.cfg.FailureStatus:
+			g.recordFailure(username, g.realIP.ClientIP(r))
+		case (rec.status == http.StatusOK || rec.status == http.StatusCreated || rec.status == http.StatusNoContent) && throttle.FailedCount > 0:
+			g.throttles.ResetLoginFailures(username)
+		}
+	})
+}
+
+// retryAfter returns how long the next attempt for a username has to wait
+// because of a lockout or the progressive delay.
+func (g *BruteForceGuard) retryAfter(t *store.LoginThrottle, now time.Time) time.Duration {
+	if t.LockedUntil != nil && now.Before(*t.LockedUntil) {
+		return t.LockedUntil.Sub(now)
+	}
+	if t.LastFailedAt == nil || t.FailedCount < g.cfg.FreeAttempts {
+		return 0
+	}
+	exp := float64(t.FailedCount - g.cfg.FreeAttempts)
+	delay := time.Duration(float64(g.cfg.BaseDelay) * math.Pow(2, exp))
+	if delay > g.cfg.MaxDelay || delay <= 0 {
+		delay = g.cfg.MaxDelay
+	}
+	return t.LastFailedAt.Add(delay).Sub(now)
+}
+
+func (g *BruteForceGuard) recordFailure(username, ip string) {
+	count, err := g.throttles.RecordLoginFailure(username)
+	if err != nil {
+		log.Printf("记录登录失败次数出错 (user: %s): %v", username, err)
+		return
+	}
+	if g.cfg.LockoutThreshold > 0 && count >= g.cfg.LockoutThreshold {
+		until := time.Now().Add(g.cfg.LockoutDuration)
+		if err := g.throttles.LockAccount(username, until); err != nil {
+			log.Printf("锁定账户出错 (user: %s): %v", username, err)
+			return
+		}
+		log.Printf("账户 %s 连续%d次登录失败，锁定至 %s (最后来源IP: %s)", username, count, until.Format(time.RFC3339), ip)
+	}
+}
+
+func tooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeError(w, tooManyAttemptsMessage, http.StatusTooManyRequests)
+}
+
+// statusRecorder remembers the status code written by the wrapped handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// slidingWindow is an in-memory sliding window log of request times per key.
+type slidingWindow struct {
+	mu    sync.Mutex
+	hits  map[string][]time.Time
+	calls int
+}
+
+func newSlidingWindow() *slidingWindow {
+	return &slidingWindow{hits: make(map[string][]time.Time)}
+}
+
+// hit records a request for key at now. If the limit is already exhausted
+// the request is not recorded and the time until a slot frees up is returned.
+func (s *slidingWindow) hit(key string, limit Limit, now time.Time) time.Duration {
+	if limit.Max <= 0 {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls++
+	if s.calls%1000 == 0 {
+		s.prune(now, limit.Window)
+	}
+
+	cutoff := now.Add(-limit.Window)
+	times := s.hits[key]
+	i := 0
+	for i < len(times) && !times[i].After(cutoff) {
+		i++
+	}
+	times = times[i:]
+
+	if len(times) >= limit.Max {
+		s.hits[key] = times
+		return times[0].Sub(cutoff)
+	}
+	s.hits[key] = append(times, now)
+	return 0
+}
+
+// prune drops keys whose newest hit is older than window.
+func (s *slidingWindow) prune(now time.Time, window time.Duration) {
+	cutoff := now.Add(-window)
+	for key, times := range s.hits {
+		if len(times) == 0 || !times[len(times)-1].After(cutoff) {
+			delete(s.hits, key)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"learning-telegram/internal/realip"
+	"learning-telegram/internal/store"
+	"learning-telegram/internal/store/memstore"
+)
+
+func TestSlidingWindow(t *testing.T) {
+	s := newSlidingWindow()
+	limit := Limit{Max: 3, Window: time.Minute}
+	start := time.Unix(1000, 0)
+
+	for i := range 3 {
+		if wait := s.hit("k", limit, start.Add(time.Duration(i)*10*time.Second)); wait != 0 {
+			t.Fatalf("hit %d: wait %v, want none", i+1, wait)
+		}
+	}
+	// The oldest hit, at start, leaves the window after a minute.
+	if wait := s.hit("k", limit, start.Add(30*time.Second)); wait != 30*time.Second {
+		t.Errorf("hit over the limit: wait %v, want 30s", wait)
+	}
+	if wait := s.hit("other", limit, start.Add(30*time.Second)); wait != 0 {
+		t.Errorf("hit for another key: wait %v, want none", wait)
+	}
+	// Rejected hits aren't recorded, so a slot frees up on time.
+	if wait := s.hit("k", limit, start.Add(time.Minute+time.Second)); wait != 0 {
+		t.Errorf("hit after the oldest left the window: wait %v, want none", wait)
+	}
+	if wait := s.hit("k", limit, start.Add(time.Minute+2*time.Second)); wait != 8*time.Second {
+		t.Errorf("hit with the window full again: wait %v, want 8s", wait)
+	}
+
+	if wait := s.hit("k", Limit{}, start); wait != 0 {
+		t.Errorf("hit with no limit: wait %v, want none", wait)
+	}
+}
+
+// guardTest serves a login stand-in behind a BruteForceGuard: the password
+// "right" succeeds, any other fails with 401.
+type guardTest struct {
+	t       *testing.T
+	handler http.Handler
+	store   *memstore.Store
+	calls   int
+}
+
+func newGuardTest(t *testing.T, cfg BruteForceConfig) *guardTest {
+	g := &guardTest{t: t, store: memstore.New()}
+	login := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.calls++
+		var req LoginRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Password != "right" {
+			writeError(w, "用户名或密码错误", http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	g.handler = NewBruteForceGuard(cfg, g.store, realip.Resolver{}).Middleware(login)
+	return g
+}
+
+// attempt logs in as username from ip and returns the response.
+func (g *guardTest) attempt(ip, username, password string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(LoginRequest{Username: username, Password: password})
+	r := httptest.NewRequest("POST", "/api/login", strings.NewReader(string(body)))
+	r.RemoteAddr = ip + ":40000"
+	w := httptest.NewRecorder()
+	g.handler.ServeHTTP(w, r)
+	return w
+}
+
+// expect checks the status of an attempt.
+func (g *guardTest) expect(w *httptest.ResponseRecorder, status int, what string) {
+	g.t.Helper()
+	if w.Code != status {
+		g.t.Errorf("%s: status %d, want %d", what, w.Code, status)
+	}
+}
+
+func TestBruteForceGuardPerIP(t *testing.T) {
+	g := newGuardTest(t, BruteForceConfig{PerIP: Limit{Max: 3, Window: time.Minute}})
+	for i := range 3 {
+		g.expect(g.attempt("192.0.2.1", "user"+strconv.Itoa(i), "right"), http.StatusOK, "attempt within the limit")
+	}
+	w := g.attempt("192.0.2.1", "someone", "right")
+	g.expect(w, http.StatusTooManyRequests, "attempt over the IP limit")
+	if retry, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || retry < 1 || retry > 60 {
+		t.Errorf("Retry-After %q, want 1 to 60 seconds", w.Header().Get("Retry-After"))
+	}
+	if g.calls != 3 {
+		t.Errorf("handler called %d times, want 3", g.calls)
+	}
+	g.expect(g.attempt("192.0.2.2", "someone", "right"), http.StatusOK, "attempt from another IP")
+}
+
+func TestBruteForceGuardPerUser(t *testing.T) {
+	g := newGuardTest(t, BruteForceConfig{PerUser: Limit{Max: 2, Window: time.Minute}})
+	g.expect(g.attempt("192.0.2.1", "alice", "right"), http.StatusOK, "first attempt")
+	g.expect(g.attempt("192.0.2.2", "alice", "right"), http.StatusOK, "second attempt from another IP")
+	// The limit holds however the username is spelled and wherever the
+	// attempt comes from.
+	g.expect(g.attempt("192.0.2.3", "ALICE", "right"), http.StatusTooManyRequests, "third attempt")
+	g.expect(g.attempt("192.0.2.1", "bob", "right"), http.StatusOK, "attempt for another user")
+}
+
+func TestBruteForceGuardLockout(t *testing.T) {
+	g := newGuardTest(t, BruteForceConfig{
+		TrackFailures:    true,
+		FreeAttempts:     10,
+		LockoutThreshold: 3,
+		LockoutDuration:  15 * time.Minute,
+	})
+	for range 3 {
+		g.expect(g.attempt("192.0.2.1", "alice", "wrong"), http.StatusUnauthorized, "wrong password")
+	}
+	calls := g.calls
+	w := g.attempt("192.0.2.2", "alice", "right")
+	g.expect(w, http.StatusTooManyRequests, "right password while locked")
+	if retry, _ := strconv.Atoi(w.Header().Get("Retry-After")); retry < 14*60 || retry > 15*60 {
+		t.Errorf("Retry-After %q while locked, want about 15 minutes", w.Header().Get("Retry-After"))
+	}
+	if g.calls != calls {
+		t.Error("handler called during the lockout")
+	}
+
+	// Once the lockout expired, one more wrong password doesn't lock the
+	// account again.
+	if err := g.store.LockAccount("alice", time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	g.expect(g.attempt("192.0.2.1", "alice", "wrong"), http.StatusUnauthorized, "wrong password after the lockout")
+	g.expect(g.attempt("192.0.2.1", "alice", "right"), http.StatusOK, "right password after the lockout")
+
+	// A success forgets the failures.
+	throttle, err := g.store.GetLoginThrottle("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if throttle.FailedCount != 0 || throttle.LockedUntil != nil {
+		t.Errorf("throttle %+v after a successful login, want it reset", throttle)
+	}
+}
+
+// TestBruteForceGuardDelay checks the progressive delay: attempts made
+// before it has passed are answered with 429 and how long is left.
+func TestBruteForceGuardDelay(t *testing.T) {
+	g := newGuardTest(t, BruteForceConfig{
+		TrackFailures: true,
+		FreeAttempts:  2,
+		BaseDelay:     10 * time.Second,
+		MaxDelay:      time.Minute,
+	})
+	g.expect(g.attempt("192.0.2.1", "alice", "wrong"), http.StatusUnauthorized, "first free attempt")
+	g.expect(g.attempt("192.0.2.1", "alice", "wrong"), http.StatusUnauthorized, "second free attempt")
+	w := g.attempt("192.0.2.1", "alice", "right")
+	g.expect(w, http.StatusTooManyRequests, "attempt within the delay")
+	if retry := w.Header().Get("Retry-After"); retry != "10" {
+		t.Errorf("Retry-After %q, want 10", retry)
+	}
+
+	guard := &BruteForceGuard{cfg: BruteForceConfig{FreeAttempts: 1, BaseDelay: 10 * time.Second, MaxDelay: time.Minute}}
+	last := time.Unix(1000, 0)
+	for failures, want := range map[int]time.Duration{0: 0, 1: 10 * time.Second, 2: 20 * time.Second, 3: 40 * time.Second, 4: time.Minute, 60: time.Minute} {
+		throttle := &store.LoginThrottle{FailedCount: failures, LastFailedAt: &last}
+		if got := guard.retryAfter(throttle, last); got != want {
+			t.Errorf("delay after %d failures: %v, want %v", failures, got, want)
+		}
+	}
+}
+
+// TestBruteForceGuardUniformResponse checks that throttling doesn't reveal
+// why: a lockout, the per-user limit and the per-IP limit, for a real or a
+// made-up username, all get the same body.
+func TestBruteForceGuardUniformResponse(t *testing.T) {
+	g := newGuardTest(t, BruteForceConfig{
+		PerIP:            Limit{Max: 5, Window: time.Minute},
+		PerUser:          Limit{Max: 4, Window: time.Minute},
+		TrackFailures:    true,
+		FreeAttempts:     10,
+		LockoutThreshold: 2,
+		LockoutDuration:  time.Minute,
+	})
+	var bodies []string
+	throttled := func(w *httptest.ResponseRecorder, what string) {
+		t.Helper()
+		g.expect(w, http.StatusTooManyRequests, what)
+		bodies = append(bodies, w.Body.String())
+	}
+
+	g.attempt("192.0.2.1", "alice", "wrong")
+	g.attempt("192.0.2.1", "alice", "wrong")
+	throttled(g.attempt("192.0.2.1", "alice", "right"), "locked account")
+
+	for range 4 {
+		g.attempt("192.0.2.2", "nobody", "right")
+	}
+	throttled(g.attempt("192.0.2.3", "nobody", "right"), "per-user limit")
+
+	for range 5 {
+		g.attempt("192.0.2.4", "user", "right")
+	}
+	throttled(g.attempt("192.0.2.4", "user2", "right"), "per-IP limit")
+
+	var resp ErrorResponse
+	if err := json.Unmarshal([]byte(bodies[0]), &resp); err != nil {
+		t.Fatalf("body %q: %v", bodies[0], err)
+	}
+	if resp.Code != "too_many_requests" || resp.Error != tooManyAttemptsMessage {
+		t.Errorf("body %+v, want too_many_requests", resp)
+	}
+	for _, body := range bodies[1:] {
+		if body != bodies[0] {
+			t.Errorf("body %q differs from %q", body, bodies[0])
+		}
+	}
+}
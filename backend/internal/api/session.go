@@ -0,0 +1,187 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"learning-telegram/internal/auth"
+	"learning-telegram/internal/store"
+)
+
+type SessionInfo struct {
+	store.Session
+	Current bool `json:"current"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// issueSession creates a new server-side session for username and writes the
+// access/refresh token pair to the response.
+func (h *Handlers) issueSession(w http.ResponseWriter, r *http.Request, username, deviceName string, status int) {
+	refreshToken, err := auth.NewRefreshToken()
+	if err != nil {
+		writeError(w, "生成Token失败", http.StatusInternalServerError)
+		return
+	}
+
+	sessionID, err := h.sessions.CreateSession(
+		username,
+		auth.HashToken(refreshToken),
+		deviceName,
+		r.UserAgent(),
+		h.cfg.RealIP.ClientIP(r),
+		time.Now().Add(auth.RefreshTokenTTL),
+	)
+	if err != nil {
+		writeError(w, "创建会话失败", http.StatusInternalServerError)
+		return
+	}
+
+	writeTokenPair(w, username, sessionID, refreshToken, status)
+}
+
+func writeTokenPair(w http.ResponseWriter, username, sessionID, refreshToken string, status int) {
+	tokenString, err := auth.GenerateToken(username, sessionID)
+	if err != nil {
+		writeError(w, "生成Token失败", http.StatusInternalServerError)
+		return
+	}
+
+	resp := LoginResponse{
+		Token:        tokenString,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(auth.AccessTokenTTL.Seconds()),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// RefreshTokenHandler exchanges a refresh token for a new access token. The
+// refresh token is rotated on every call; the old one stops working.
+func (h *Handlers) RefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, "方法不允许", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "参数错误", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.RefreshToken) == "" {
+		writeError(w, "refresh_token不能为空", http.StatusBadRequest)
+		return
+	}
+
+	newRefreshToken, err := auth.NewRefreshToken()
+	if err != nil {
+		writeError(w, "生成Token失败", http.StatusInternalServerError)
+		return
+	}
+
+	session, err := h.sessions.RotateRefreshToken(
+		auth.HashToken(req.RefreshToken),
+		auth.HashToken(newRefreshToken),
+		time.Now().Add(auth.RefreshTokenTTL),
+	)
+	switch err {
+	case nil:
+	case store.ErrRefreshTokenReused:
+		log.Printf("refresh token 被重复使用，已注销相关会话 (ip: %s)", h.cfg.RealIP.ClientIP(r))
+		writeErrorCode(w, http.StatusUnauthorized, "session_expired", "会话已失效，请重新登录")
+		return
+	case store.ErrSessionNotFound:
+		writeErrorCode(w, http.StatusUnauthorized, "session_expired", "会话已失效，请重新登录")
+		return
+	default:
+		writeError(w, "刷新Token失败", http.StatusInternalServerError)
+		return
+	}
+
+	writeTokenPair(w, session.Username, session.ID, newRefreshToken, http.StatusOK)
+}
+
+// LogoutHandler revokes the session the current access token belongs to.
+func (h *Handlers) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, "方法不允许", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionID, ok := r.Context().Value("session_id").(string)
+	if !ok {
+		writeError(w, "无法从Token获取会话信息", http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.sessions.RevokeSession(sessionID); err != nil {
+		writeError(w, "退出登录失败", http.StatusInternalServerError)
+		return
+	}
+	if username, ok := r.Context().Value("username").(string); ok {
+		h.hub.CloseSession(username, sessionID)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListSessionsHandler returns the active sessions (devices) of the
+// authenticated user.
+func (h *Handlers) ListSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		writeError(w, "无法从Token获取用户信息", http.StatusUnauthorized)
+		return
+	}
+	currentID, _ := r.Context().Value("session_id").(string)
+
+	sessions, err := h.sessions.GetActiveSessions(username)
+	if err != nil {
+		writeError(w, "获取会话列表失败", http.StatusInternalServerError)
+		return
+	}
+
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		infos = append(infos, SessionInfo{Session: s, Current: s.ID == currentID})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sessions": infos,
+	})
+}
+
+// TerminateSessionHandler revokes one of the authenticated user's sessions and
+// force-closes the WebSocket connections opened with it.
+func (h *Handlers) TerminateSessionHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		writeError(w, "无法从Token获取用户信息", http.StatusUnauthorized)
+		return
+	}
+
+	sessionID := r.PathValue("id")
+	if sessionID == "" {
+		writeError(w, "会话ID不能为空", http.StatusBadRequest)
+		return
+	}
+
+	err := h.sessions.RevokeUserSession(username, sessionID)
+	if err != nil {
+		writeStoreError(w, err, "终止会话失败")
+		return
+	}
+
+	closed := h.hub.CloseSession(username, sessionID)
+	log.Printf("用户 %s 终止了会话 %s，关闭了%d个连接", username, sessionID, closed)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -4,31 +4,94 @@ import (
 	"encoding/json"
 	"net/http"
 
-	"learning-telegram/internal/websocket"
+	"learning-telegram/internal/policy"
+	"learning-telegram/internal/presence"
+	"learning-telegram/internal/store"
 )
 
-// UserStatusHandler checks and returns the online status of a user.
-func UserStatusHandler(w http.ResponseWriter, r *http.Request) {
+// UserStatusHandler returns the presence of a user as the current user may
+// see it: exact if the user's privacy settings allow, approximate otherwise.
+func (h *Handlers) UserStatusHandler(w http.ResponseWriter, r *http.Request) {
+	viewer, ok := r.Context().Value("username").(string)
+	if !ok {
+		writeError(w, "无法从Token获取用户信息", http.StatusUnauthorized)
+		return
+	}
 	// We expect the username to be a query parameter, e.g., /api/status/user?username=testuser
-	username := r.URL.Query().Get("username")
-	if username == "" {
-		http.Error(w, "查询参数 'username' 不能为空", http.StatusBadRequest)
+	query := r.URL.Query().Get("username")
+	if query == "" {
+		writeError(w, "查询参数 'username' 不能为空", http.StatusBadRequest)
+		return
+	}
+	if !policy.IsPlausibleUsername(query) {
+		writeStoreError(w, store.ErrUserNotFound, "查询用户失败")
+		return
+	}
+	username, err := h.users.ResolveUsername(query)
+	if err != nil {
+		writeStoreError(w, err, "查询用户失败")
 		return
 	}
 
-	appHub := websocket.GetHub()
-	isOnline := appHub.IsUserOnline(username)
-
-	response := map[string]interface{}{
-		"username": username,
-		"online":   isOnline,
+	p, err := presence.Get(h.presence, h.hub, viewer, username)
+	if err != nil {
+		writeError(w, "查询在线状态失败", http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	err := json.NewEncoder(w).Encode(response)
+	err = json.NewEncoder(w).Encode(p)
 	if err != nil {
 		// This is unlikely to happen, but good practice to handle.
-		http.Error(w, "无法生成响应", http.StatusInternalServerError)
+		writeError(w, "无法生成响应", http.StatusInternalServerError)
+	}
+}
+
+type PrivacySettings struct {
+	LastSeen string `json:"last_seen"` // everyone, contacts or nobody
+}
+
+// GetPrivacyHandler returns the current user's privacy settings.
+func (h *Handlers) GetPrivacyHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		writeError(w, "无法从Token获取用户信息", http.StatusUnauthorized)
+		return
+	}
+
+	info, err := h.presence.GetPresenceInfo(username)
+	if err != nil {
+		writeError(w, "获取隐私设置失败", http.StatusInternalServerError)
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PrivacySettings{LastSeen: info.Visibility})
+}
+
+// SetPrivacyHandler changes who may see the current user's exact online
+// state and last seen time.
+func (h *Handlers) SetPrivacyHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		writeError(w, "无法从Token获取用户信息", http.StatusUnauthorized)
+		return
+	}
+
+	var req PrivacySettings
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "参数错误", http.StatusBadRequest)
+		return
+	}
+	if !presence.IsVisibility(req.LastSeen) {
+		writeError(w, "last_seen必须是everyone、contacts或nobody", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.presence.SetLastSeenVisibility(username, req.LastSeen); err != nil {
+		writeError(w, "保存隐私设置失败", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(req)
 }
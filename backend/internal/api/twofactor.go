@@ -0,0 +1,282 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"learning-telegram/internal/auth"
+)
+
+// totpIssuer is shown as the account label in authenticator apps.
+const totpIssuer = "Learning Telegram"
+
+const recoveryCodeCount = 10
+
+type TwoFactorChallengeResponse struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	ChallengeToken    string `json:"challenge_token"`
+	ExpiresIn         int    `json:"expires_in"`
+}
+
+type TwoFactorLoginRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code,omitempty"`
+	RecoveryCode   string `json:"recovery_code,omitempty"`
+	DeviceName     string `json:"device_name,omitempty"`
+}
+
+type TwoFactorSetupResponse struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+type TwoFactorEnableRequest struct {
+	Code string `json:"code"`
+}
+
+type TwoFactorEnableResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type TwoFactorDisableRequest struct {
+	Password     string `json:"password"`
+	Code         string `json:"code,omitempty"`
+	RecoveryCode string `json:"recovery_code,omitempty"`
+}
+
+// writeTwoFactorChallenge answers the password step of a login for a user
+// with two-factor auth enabled. No session is created yet.
+func writeTwoFactorChallenge(w http.ResponseWriter, username string) {
+	challenge, err := auth.GenerateChallengeToken(username)
+	if err != nil {
+		writeError(w, "生成Token失败", http.StatusInternalServerError)
+		return
+	}
+
+	// 202 rather than 200: the login is not complete yet, and
+	// BruteForceGuard must not treat it as a success that resets the
+	// failure counter the second step is throttled by.
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(TwoFactorChallengeResponse{
+		TwoFactorRequired: true,
+		ChallengeToken:    challenge,
+		ExpiresIn:         int(auth.ChallengeTokenTTL.Seconds()),
+	})
+}
+
+// verifySecondFactor checks either a TOTP code or a recovery code for a user
+// with two-factor auth enabled, consuming it on success.
+func (h *Handlers) verifySecondFactor(username, code, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		return h.twoFactor.ConsumeRecoveryCode(username, auth.HashToken(auth.NormalizeRecoveryCode(recoveryCode)))
+	}
+
+	tf, err := h.twoFactor.GetTwoFactor(username)
+	if err != nil {
+		return false, err
+	}
+	if !tf.Enabled {
+		return false, nil
+	}
+	step, ok := auth.ValidateTOTP(tf.Secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	return h.twoFactor.ConsumeTOTPStep(username, step)
+}
+
+// TwoFactorLoginHandler completes a two-factor login: it exchanges the
+// challenge token from LoginHandler plus a TOTP or recovery code for a real
+// session.
+func (h *Handlers) TwoFactorLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, "方法不允许", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req TwoFactorLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "参数错误", http.StatusBadRequest)
+		return
+	}
+	if req.ChallengeToken == "" || (strings.TrimSpace(req.Code) == "" && strings.TrimSpace(req.RecoveryCode) == "") {
+		writeError(w, "challenge_token和验证码不能为空", http.StatusBadRequest)
+		return
+	}
+
+	username, err := auth.ValidateChallengeToken(req.ChallengeToken)
+	if err != nil {
+		writeError(w, "验证已过期，请重新登录", http.StatusUnauthorized)
+		return
+	}
+
+	ok, err := h.verifySecondFactor(username, req.Code, req.RecoveryCode)
+	if err != nil {
+		writeError(w, "登录失败", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		writeError(w, "验证码错误", http.StatusUnauthorized)
+		return
+	}
+
+	h.issueSession(w, r, username, req.DeviceName, http.StatusOK)
+}
+
+// TwoFactorStatusHandler reports whether two-factor auth is enabled for the
+// authenticated user and how many recovery codes are left.
+func (h *Handlers) TwoFactorStatusHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		writeError(w, "无法从Token获取用户信息", http.StatusUnauthorized)
+		return
+	}
+
+	tf, err := h.twoFactor.GetTwoFactor(username)
+	if err != nil {
+		writeError(w, "查询两步验证状态失败", http.StatusInternalServerError)
+		return
+	}
+	remaining, err := h.twoFactor.CountRecoveryCodes(username)
+	if err != nil {
+		writeError(w, "查询两步验证状态失败", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":                  tf.Enabled,
+		"recovery_codes_remaining": remaining,
+	})
+}
+
+// TwoFactorSetupHandler starts TOTP enrollment by generating a new secret.
+// Two-factor auth is not active until TwoFactorEnableHandler confirms a code.
+func (h *Handlers) TwoFactorSetupHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		writeError(w, "无法从Token获取用户信息", http.StatusUnauthorized)
+		return
+	}
+
+	tf, err := h.twoFactor.GetTwoFactor(username)
+	if err != nil {
+		writeError(w, "开启两步验证失败", http.StatusInternalServerError)
+		return
+	}
+	if tf.Enabled {
+		writeError(w, "两步验证已开启", http.StatusConflict)
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		writeError(w, "生成密钥失败", http.StatusInternalServerError)
+		return
+	}
+	if err := h.twoFactor.SetPendingTOTPSecret(username, secret); err != nil {
+		writeError(w, "开启两步验证失败", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TwoFactorSetupResponse{
+		Secret:     secret,
+		OTPAuthURI: auth.TOTPURI(totpIssuer, username, secret),
+	})
+}
+
+// TwoFactorEnableHandler confirms enrollment with a code from the
+// authenticator app, turns two-factor auth on and returns the recovery codes.
+// The codes are shown exactly once; only their hashes are stored.
+func (h *Handlers) TwoFactorEnableHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		writeError(w, "无法从Token获取用户信息", http.StatusUnauthorized)
+		return
+	}
+
+	var req TwoFactorEnableRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "参数错误", http.StatusBadRequest)
+		return
+	}
+
+	tf, err := h.twoFactor.GetTwoFactor(username)
+	if err != nil {
+		writeError(w, "开启两步验证失败", http.StatusInternalServerError)
+		return
+	}
+	if tf.Enabled {
+		writeError(w, "两步验证已开启", http.StatusConflict)
+		return
+	}
+	if tf.Secret == "" {
+		writeError(w, "请先获取两步验证密钥", http.StatusBadRequest)
+		return
+	}
+
+	step, valid := auth.ValidateTOTP(tf.Secret, req.Code, time.Now())
+	if !valid {
+		writeError(w, "验证码错误", http.StatusBadRequest)
+		return
+	}
+
+	codes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		writeError(w, "生成恢复码失败", http.StatusInternalServerError)
+		return
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = auth.HashToken(code)
+	}
+	if err := h.twoFactor.EnableTwoFactor(username, hashes); err != nil {
+		writeError(w, "开启两步验证失败", http.StatusInternalServerError)
+		return
+	}
+	h.twoFactor.ConsumeTOTPStep(username, step)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TwoFactorEnableResponse{RecoveryCodes: codes})
+}
+
+// TwoFactorDisableHandler turns two-factor auth off. It requires the password
+// and a current TOTP or recovery code.
+func (h *Handlers) TwoFactorDisableHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		writeError(w, "无法从Token获取用户信息", http.StatusUnauthorized)
+		return
+	}
+
+	var req TwoFactorDisableRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "参数错误", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := h.verifyPassword(username, req.Password); err != nil {
+		writeError(w, "密码错误", http.StatusUnauthorized)
+		return
+	}
+	ok, err := h.verifySecondFactor(username, req.Code, req.RecoveryCode)
+	if err != nil {
+		writeError(w, "关闭两步验证失败", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		writeError(w, "验证码错误", http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.twoFactor.DisableTwoFactor(username); err != nil {
+		writeError(w, "关闭两步验证失败", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
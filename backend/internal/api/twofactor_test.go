@@ -0,0 +1,111 @@
+package api_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"learning-telegram/internal/api"
+)
+
+// totpCode computes the code an authenticator app shows for secret at the
+// 30-second step.
+func totpCode(t *testing.T, secret string, step int64) string {
+	t.Helper()
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:])&0x7fffffff)%1000000)
+}
+
+// TestTwoFactorLogin enables two-factor auth and logs in with TOTP and
+// recovery codes, each of which is accepted once.
+func TestTwoFactorLogin(t *testing.T) {
+	stores(t, func(t *testing.T, srv *httptest.Server) {
+		token := register(t, srv, "alice")
+
+		var setup api.TwoFactorSetupResponse
+		if status := call(t, srv, "POST", "/api/me/2fa/setup", token, nil, &setup); status != http.StatusOK {
+			t.Fatalf("setup: status %d", status)
+		}
+		// The codes are computed for steps counted from now; the server
+		// accepts one step of skew, so the test doesn't depend on when a
+		// period ends.
+		step := time.Now().Unix() / 30
+		var enabled api.TwoFactorEnableResponse
+		status := call(t, srv, "POST", "/api/me/2fa/enable", token, api.TwoFactorEnableRequest{Code: totpCode(t, setup.Secret, step)}, &enabled)
+		if status != http.StatusOK || len(enabled.RecoveryCodes) != 10 {
+			t.Fatalf("enable: status %d, %d recovery codes", status, len(enabled.RecoveryCodes))
+		}
+
+		challenge := func() string {
+			t.Helper()
+			var resp api.TwoFactorChallengeResponse
+			status := call(t, srv, "POST", "/api/login", "", api.LoginRequest{Username: "alice", Password: password}, &resp)
+			if status != http.StatusAccepted || !resp.TwoFactorRequired || resp.ChallengeToken == "" {
+				t.Fatalf("login: status %d, response %+v; want a challenge", status, resp)
+			}
+			return resp.ChallengeToken
+		}
+		secondStep := func(req api.TwoFactorLoginRequest) int {
+			t.Helper()
+			req.ChallengeToken = challenge()
+			var resp api.LoginResponse
+			status := call(t, srv, "POST", "/api/login/2fa", "", req, &resp)
+			if status == http.StatusOK && resp.Token == "" {
+				t.Errorf("second step with %+v: no token", req)
+			}
+			return status
+		}
+
+		// The code confirming the enrollment was used.
+		if status := secondStep(api.TwoFactorLoginRequest{Code: totpCode(t, setup.Secret, step)}); status != http.StatusUnauthorized {
+			t.Errorf("login with the enrollment code: status %d, want 401", status)
+		}
+		next := totpCode(t, setup.Secret, step+1)
+		if status := secondStep(api.TwoFactorLoginRequest{Code: next}); status != http.StatusOK {
+			t.Errorf("login with the next code: status %d, want 200", status)
+		}
+		if status := secondStep(api.TwoFactorLoginRequest{Code: next}); status != http.StatusUnauthorized {
+			t.Errorf("login with a code used before: status %d, want 401", status)
+		}
+		// Nor is the code of an earlier step accepted any more.
+		if status := secondStep(api.TwoFactorLoginRequest{Code: totpCode(t, setup.Secret, step)}); status != http.StatusUnauthorized {
+			t.Errorf("login with the code of an earlier step: status %d, want 401", status)
+		}
+
+		recovery := enabled.RecoveryCodes[0]
+		if status := secondStep(api.TwoFactorLoginRequest{RecoveryCode: " " + strings.ToUpper(recovery) + " "}); status != http.StatusOK {
+			t.Errorf("login with a recovery code: status %d, want 200", status)
+		}
+		if status := secondStep(api.TwoFactorLoginRequest{RecoveryCode: recovery}); status != http.StatusUnauthorized {
+			t.Errorf("login with a used recovery code: status %d, want 401", status)
+		}
+		if status := secondStep(api.TwoFactorLoginRequest{RecoveryCode: "aaaaa-bbbbb"}); status != http.StatusUnauthorized {
+			t.Errorf("login with an unknown recovery code: status %d, want 401", status)
+		}
+
+		var tfStatus struct {
+			Enabled   bool `json:"enabled"`
+			Remaining int  `json:"recovery_codes_remaining"`
+		}
+		call(t, srv, "GET", "/api/me/2fa", token, nil, &tfStatus)
+		if !tfStatus.Enabled || tfStatus.Remaining != 9 {
+			t.Errorf("status %+v, want enabled with 9 recovery codes left", tfStatus)
+		}
+	})
+}
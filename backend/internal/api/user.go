@@ -1,13 +1,12 @@
 package api
 
 import (
-	"database/sql"
 	"encoding/json"
 	"net/http"
 	"strings"
-	"time"
+	"sync"
 
-	"learning-telegram/internal/auth"
+	"learning-telegram/internal/policy"
 	"learning-telegram/internal/store"
 
 	"golang.org/x/crypto/bcrypt"
@@ -16,94 +15,119 @@ import (
 type RegisterRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Email    string `json:"email,omitempty"` // 可选，用于找回密码
 }
 
 type LoginRequest struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	DeviceName string `json:"device_name,omitempty"` // 可选，显示在活跃会话列表中
 }
 
 type LoginResponse struct {
-	Token string `json:"token"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"` // access token lifetime in seconds
 }
 
-func RegisterHandler(w http.ResponseWriter, r *http.Request) {
+func (h *Handlers) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	var req RegisterRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "参数错误", http.StatusBadRequest)
+		writeError(w, "参数错误", http.StatusBadRequest)
 		return
 	}
 	if strings.TrimSpace(req.Username) == "" || strings.TrimSpace(req.Password) == "" {
-		http.Error(w, "用户名和密码不能为空", http.StatusBadRequest)
+		writeError(w, "用户名和密码不能为空", http.StatusBadRequest)
+		return
+	}
+	username := policy.CleanUsername(req.Username)
+	if !checkUsername(w, username, policy.ValidateUsername) {
 		return
 	}
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	email, err := normalizeEmail(req.Email)
 	if err != nil {
-		http.Error(w, "密码加密失败", http.StatusInternalServerError)
+		writeError(w, "邮箱格式不正确", http.StatusBadRequest)
+		return
+	}
+	if !h.checkPasswordPolicy(w, req.Password, username, email) {
 		return
 	}
 
-	_, err = store.DB.Exec(
-		"INSERT INTO users (username, password_hash, created_at) VALUES (?, ?, ?)",
-		req.Username, string(hash), time.Now(),
-	)
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 	if err != nil {
-		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
-			http.Error(w, "用户名已存在", http.StatusConflict)
-			return
-		}
-		http.Error(w, "注册失败", http.StatusInternalServerError)
+		writeError(w, "密码加密失败", http.StatusInternalServerError)
 		return
 	}
 
-	// 注册成功后自动生成token
-	tokenString, err := auth.GenerateToken(req.Username)
-	if err != nil {
-		http.Error(w, "生成Token失败", http.StatusInternalServerError)
+	if err := h.users.CreateUser(username, string(hash), email); err != nil {
+		writeStoreError(w, err, "注册失败")
 		return
 	}
 
-	resp := LoginResponse{Token: tokenString}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(resp)
+	// 注册成功后自动登录
+	h.issueSession(w, r, username, "", http.StatusCreated)
 }
 
-func LoginHandler(w http.ResponseWriter, r *http.Request) {
+func (h *Handlers) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	var req LoginRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "参数错误", http.StatusBadRequest)
+		writeError(w, "参数错误", http.StatusBadRequest)
 		return
 	}
 	if strings.TrimSpace(req.Username) == "" || strings.TrimSpace(req.Password) == "" {
-		http.Error(w, "用户名和密码不能为空", http.StatusBadRequest)
+		writeError(w, "用户名和密码不能为空", http.StatusBadRequest)
 		return
 	}
 
-	var hash string
-	row := store.DB.QueryRow("SELECT password_hash FROM users WHERE username = ?", req.Username)
-	err := row.Scan(&hash)
-	if err == sql.ErrNoRows {
-		http.Error(w, "用户不存在", http.StatusUnauthorized)
+	// 用户不存在和密码错误返回相同的错误，避免泄露哪些用户名已注册
+	username, err := h.verifyPassword(req.Username, req.Password)
+	if err == store.ErrUserNotFound || err == bcrypt.ErrMismatchedHashAndPassword {
+		writeErrorCode(w, http.StatusUnauthorized, "invalid_credentials", "用户名或密码错误")
 		return
 	} else if err != nil {
-		http.Error(w, "登录失败", http.StatusInternalServerError)
+		writeError(w, "登录失败", http.StatusInternalServerError)
 		return
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)); err != nil {
-		http.Error(w, "密码错误", http.StatusUnauthorized)
+	tf, err := h.twoFactor.GetTwoFactor(username)
+	if err != nil {
+		writeError(w, "登录失败", http.StatusInternalServerError)
 		return
 	}
-
-	tokenString, err := auth.GenerateToken(req.Username)
-	if err != nil {
-		http.Error(w, "生成Token失败", http.StatusInternalServerError)
+	if tf.Enabled {
+		writeTwoFactorChallenge(w, username)
 		return
 	}
 
-	resp := LoginResponse{Token: tokenString}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
+	h.issueSession(w, r, username, req.DeviceName, http.StatusOK)
+}
+
+// verifyPassword checks password against the stored hash of the user with
+// the given name, in any spelling, and returns the canonical username. It
+// returns store.ErrUserNotFound if the user does not exist and
+// bcrypt.ErrMismatchedHashAndPassword if the password is wrong.
+func (h *Handlers) verifyPassword(name, password string) (string, error) {
+	username, hash, err := h.users.GetPasswordHash(name)
+	if err == store.ErrUserNotFound {
+		// Spend the same time as for an existing user, so response times
+		// don't reveal whether the username is registered.
+		bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+		return "", err
+	} else if err != nil {
+		return "", err
+	}
+	return username, bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+func dummyPasswordHash() []byte {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	})
+	return dummyHash
 }
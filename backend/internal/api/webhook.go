@@ -0,0 +1,250 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"learning-telegram/internal/egress"
+	"learning-telegram/internal/store"
+	"learning-telegram/internal/webhook"
+)
+
+const (
+	maxWebhooksPerUser     = 20
+	minWebhookSecretLength = 16
+	defaultDeliveriesLimit = 50
+	maxDeliveriesLimit     = 200
+)
+
+type CreateWebhookRequest struct {
+	URL     string   `json:"url"`
+	Secret  string   `json:"secret,omitempty"`   // 为空时自动生成
+	Events  []string `json:"events,omitempty"`   // 为空时订阅全部事件
+	GroupID int64    `json:"group_id,omitempty"` // 为空时订阅当前用户相关的事件
+}
+
+// WebhookCreatedResponse includes the signing secret, which is only returned
+// when the webhook is created.
+type WebhookCreatedResponse struct {
+	store.Webhook
+	Secret string `json:"secret"`
+}
+
+// CreateWebhookHandler subscribes a URL to chat events of the current user or,
+// with group_id, of a group the user is a member of.
+func (h *Handlers) CreateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		writeError(w, "无法从Token获取用户信息", http.StatusUnauthorized)
+		return
+	}
+
+	var req CreateWebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "参数错误", http.StatusBadRequest)
+		return
+	}
+	switch err := h.cfg.Egress.CheckURL(req.URL); {
+	case errors.Is(err, egress.ErrInvalidURL):
+		writeError(w, "url必须是http或https地址", http.StatusBadRequest)
+		return
+	case errors.Is(err, egress.ErrForbiddenAddress):
+		writeErrorCode(w, http.StatusBadRequest, "forbidden_address", "url不能指向内网、本机或其他保留地址")
+		return
+	case err != nil:
+		writeError(w, "无法解析url的主机名", http.StatusBadRequest)
+		return
+	}
+	for _, e := range req.Events {
+		if !webhook.IsEventType(e) {
+			writeError(w, "未知的事件类型: "+e, http.StatusBadRequest)
+			return
+		}
+	}
+	if req.GroupID != 0 {
+		isMember, err := h.groups.IsUserInGroup(username, req.GroupID)
+		if err != nil {
+			writeStoreError(w, err, "创建Webhook失败")
+			return
+		}
+		if !isMember {
+			writeErrorCode(w, http.StatusForbidden, "not_group_member", "只能订阅自己所在群组的事件")
+			return
+		}
+	}
+
+	secret := req.Secret
+	if secret == "" {
+		var err error
+		if secret, err = webhook.NewSecret(); err != nil {
+			writeError(w, "生成密钥失败", http.StatusInternalServerError)
+			return
+		}
+	} else if len(secret) < minWebhookSecretLength {
+		writeError(w, "secret至少需要16个字符", http.StatusBadRequest)
+		return
+	}
+
+	existing, err := h.webhooks.GetWebhooksByOwner(username)
+	if err != nil {
+		writeError(w, "创建Webhook失败", http.StatusInternalServerError)
+		return
+	}
+	if len(existing) >= maxWebhooksPerUser {
+		writeError(w, "Webhook数量已达上限", http.StatusForbidden)
+		return
+	}
+
+	id, err := h.webhooks.CreateWebhook(username, req.GroupID, req.URL, secret, req.Events)
+	if err != nil {
+		writeError(w, "创建Webhook失败", http.StatusInternalServerError)
+		return
+	}
+	hook, err := h.webhooks.GetWebhook(username, id)
+	if err != nil {
+		writeError(w, "创建Webhook失败", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(WebhookCreatedResponse{Webhook: *hook, Secret: hook.Secret})
+}
+
+// ListWebhooksHandler returns the current user's webhooks, without secrets.
+func (h *Handlers) ListWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		writeError(w, "无法从Token获取用户信息", http.StatusUnauthorized)
+		return
+	}
+
+	hooks, err := h.webhooks.GetWebhooksByOwner(username)
+	if err != nil {
+		writeError(w, "获取Webhook列表失败", http.StatusInternalServerError)
+		return
+	}
+	if hooks == nil {
+		hooks = []store.Webhook{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hooks)
+}
+
+// DeleteWebhookHandler removes one of the current user's webhooks together
+// with its pending deliveries.
+func (h *Handlers) DeleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		writeError(w, "无法从Token获取用户信息", http.StatusUnauthorized)
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, "Webhook不存在", http.StatusNotFound)
+		return
+	}
+
+	if err := h.webhooks.DeleteWebhook(username, id); err != nil {
+		writeStoreError(w, err, "删除Webhook失败")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListWebhookDeliveriesHandler returns the delivery log of a webhook, newest
+// first: status, attempts and the last response or error of each event.
+func (h *Handlers) ListWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	hook, ok := h.ownWebhook(w, r)
+	if !ok {
+		return
+	}
+	limit := defaultDeliveriesLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(w, "limit必须是正整数", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxDeliveriesLimit)
+	}
+
+	deliveries, err := h.webhooks.GetWebhookDeliveries(hook.ID, limit)
+	if err != nil {
+		writeError(w, "获取投递记录失败", http.StatusInternalServerError)
+		return
+	}
+	if deliveries == nil {
+		deliveries = []store.WebhookDelivery{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// ListWebhookDeadLettersHandler returns the events of a webhook that could not
+// be delivered after webhook.MaxAttempts attempts, including their payload.
+func (h *Handlers) ListWebhookDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	hook, ok := h.ownWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	letters, err := h.webhooks.GetWebhookDeadLetters(hook.ID)
+	if err != nil {
+		writeError(w, "获取死信失败", http.StatusInternalServerError)
+		return
+	}
+	if letters == nil {
+		letters = []store.WebhookDeadLetter{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(letters)
+}
+
+// RetryWebhookDeadLetterHandler queues a dead letter for delivery again.
+func (h *Handlers) RetryWebhookDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	hook, ok := h.ownWebhook(w, r)
+	if !ok {
+		return
+	}
+	letterID, err := strconv.ParseInt(r.PathValue("letter"), 10, 64)
+	if err != nil {
+		writeError(w, "死信不存在", http.StatusNotFound)
+		return
+	}
+
+	err = h.webhooks.RequeueWebhookDeadLetter(hook.ID, letterID)
+	if err == store.ErrWebhookNotFound {
+		writeError(w, "死信不存在", http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeError(w, "重新投递失败", http.StatusInternalServerError)
+		return
+	}
+	h.events.Wake()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ownWebhook loads the webhook named by the {id} path value if it belongs to
+// the current user, writing an error response otherwise.
+func (h *Handlers) ownWebhook(w http.ResponseWriter, r *http.Request) (*store.Webhook, bool) {
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		writeError(w, "无法从Token获取用户信息", http.StatusUnauthorized)
+		return nil, false
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, "Webhook不存在", http.StatusNotFound)
+		return nil, false
+	}
+
+	hook, err := h.webhooks.GetWebhook(username, id)
+	if err != nil {
+		writeStoreError(w, err, "获取Webhook失败")
+		return nil, false
+	}
+	return hook, true
+}
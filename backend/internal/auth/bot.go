@@ -0,0 +1,31 @@
+package auth
+
+import (
+	"strconv"
+	"strings"
+)
+
+// NewBotToken returns a token for the bot with the given user ID, in the
+// "<id>:<secret>" format of Telegram bot tokens, together with the hash of its
+// secret part to persist.
+func NewBotToken(botID int64) (token, secretHash string, err error) {
+	secret, err := NewRefreshToken()
+	if err != nil {
+		return "", "", err
+	}
+	return strconv.FormatInt(botID, 10) + ":" + secret, HashToken(secret), nil
+}
+
+// ParseBotToken splits a bot token into the bot's user ID and the hash of its
+// secret part, to be compared with the persisted one.
+func ParseBotToken(token string) (botID int64, secretHash string, ok bool) {
+	id, secret, found := strings.Cut(token, ":")
+	if !found || secret == "" {
+		return 0, "", false
+	}
+	botID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || botID <= 0 {
+		return 0, "", false
+	}
+	return botID, HashToken(secret), true
+}
@@ -7,34 +7,47 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-// In a real application, this should be loaded from a secure configuration.
-var jwtSecret = []byte("a_very_secret_key_for_telegram_clone")
+// AccessTokenTTL is how long an access token stays valid. It is kept short
+// because a compromised access token cannot be revoked before it expires
+// except through its session.
+const AccessTokenTTL = 15 * time.Minute
+
+// ChallengeTokenTTL is how long a user has to complete the second login step
+// after the password step succeeded.
+const ChallengeTokenTTL = 5 * time.Minute
+
+// purposeTwoFactor marks a token that only proves the password step of a
+// two-factor login. Such tokens are never accepted as access tokens.
+const purposeTwoFactor = "2fa"
 
 type Claims struct {
-	Username string `json:"username"`
+	Username  string `json:"username"`
+	SessionID string `json:"sid,omitempty"`
+	Purpose   string `json:"pur,omitempty"`
 	jwt.RegisteredClaims
 }
 
-// GenerateToken generates a new JWT for a given username.
-func GenerateToken(username string) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour)
+// GenerateToken generates a new short-lived JWT for a given username,
+// bound to the server-side session it was issued for.
+func GenerateToken(username, sessionID string) (string, error) {
+	expirationTime := time.Now().Add(AccessTokenTTL)
 	claims := &Claims{
-		Username: username,
+		Username:  username,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	return sign(claims)
 }
 
 // ValidateToken validates a JWT string and returns the claims if valid.
+// Callers are still responsible for checking that claims.SessionID has not
+// been revoked.
 func ValidateToken(tokenString string) (*Claims, error) {
 	claims := &Claims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
+	token, err := jwt.ParseWithClaims(tokenString, claims, verificationKey)
 
 	if err != nil {
 		return nil, err
@@ -43,6 +56,39 @@ func ValidateToken(tokenString string) (*Claims, error) {
 	if !token.Valid {
 		return nil, fmt.Errorf("invalid token")
 	}
+	if claims.Purpose != "" {
+		return nil, fmt.Errorf("not an access token")
+	}
+	if claims.SessionID == "" {
+		return nil, fmt.Errorf("token is not bound to a session")
+	}
 
 	return claims, nil
 }
+
+// GenerateChallengeToken issues the short-lived token returned by the password
+// step of a two-factor login.
+func GenerateChallengeToken(username string) (string, error) {
+	claims := &Claims{
+		Username: username,
+		Purpose:  purposeTwoFactor,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ChallengeTokenTTL)),
+		},
+	}
+	return sign(claims)
+}
+
+// ValidateChallengeToken validates a token issued by GenerateChallengeToken and
+// returns the username it was issued for.
+func ValidateChallengeToken(tokenString string) (string, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, verificationKey)
+	if err != nil {
+		return "", err
+	}
+	if !token.Valid || claims.Purpose != purposeTwoFactor {
+		return "", fmt.Errorf("invalid challenge token")
+	}
+	return claims.Username, nil
+}
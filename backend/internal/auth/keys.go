@@ -0,0 +1,272 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// KeyConfig describes where the token signing keys come from.
+//
+// KeyDir holds one PEM file per key; the file name without its extension
+// (and without a trailing ".pub") becomes the key ID. Private keys
+// (PKCS#8 RSA/Ed25519 or PKCS#1 RSA) can sign and verify, public keys
+// (PKIX) can only verify. To rotate, drop the new private key into the
+// directory, point SigningKeyID at it and keep the old key around until every
+// token it signed has expired.
+//
+// HMACSecret configures a single shared HS256 key instead. It cannot be
+// combined with KeyDir and is never published through the JWKS endpoint.
+type KeyConfig struct {
+	KeyDir       string
+	SigningKeyID string
+	HMACSecret   string
+}
+
+type key struct {
+	id      string
+	method  jwt.SigningMethod
+	private crypto.PrivateKey // nil for verification-only keys
+	public  crypto.PublicKey
+}
+
+type keySet struct {
+	signing *key
+	byID    map[string]*key
+}
+
+var keys *keySet
+
+// LoadKeys loads the signing and verification keys described by cfg. It must
+// be called before any token is issued or validated. When cfg is empty an
+// ephemeral Ed25519 key is generated, which is only suitable for local
+// development since every restart invalidates all issued tokens.
+func LoadKeys(cfg KeyConfig) error {
+	var (
+		ks  *keySet
+		err error
+	)
+	switch {
+	case cfg.KeyDir != "" && cfg.HMACSecret != "":
+		return errors.New("auth: key directory and HMAC secret are mutually exclusive")
+	case cfg.KeyDir != "":
+		ks, err = loadKeyDir(cfg.KeyDir, cfg.SigningKeyID)
+	case cfg.HMACSecret != "":
+		ks, err = hmacKeySet(cfg.HMACSecret)
+	default:
+		log.Println("警告：未配置JWT签名密钥，使用临时生成的Ed25519密钥，重启后所有Token将失效")
+		ks, err = ephemeralKeySet()
+	}
+	if err != nil {
+		return err
+	}
+	keys = ks
+	log.Printf("JWT签名密钥已加载: kid=%s alg=%s, 共%d个验证密钥", ks.signing.id, ks.signing.method.Alg(), len(ks.byID))
+	return nil
+}
+
+func loadKeyDir(dir, signingKeyID string) (*keySet, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	ks := &keySet{byID: make(map[string]*key)}
+	var privateIDs []string
+	for _, path := range paths {
+		k, err := loadKeyFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("auth: load %s: %w", path, err)
+		}
+		if existing, ok := ks.byID[k.id]; ok {
+			// A private key and its public counterpart may both be present;
+			// keep the one that can sign.
+			if existing.private != nil {
+				continue
+			}
+		}
+		ks.byID[k.id] = k
+		if k.private != nil {
+			privateIDs = append(privateIDs, k.id)
+		}
+	}
+
+	if signingKeyID == "" {
+		if len(privateIDs) != 1 {
+			return nil, fmt.Errorf("auth: %d private keys in %s, signing key ID must be set explicitly", len(privateIDs), dir)
+		}
+		signingKeyID = privateIDs[0]
+	}
+	signing, ok := ks.byID[signingKeyID]
+	if !ok || signing.private == nil {
+		return nil, fmt.Errorf("auth: no private key with ID %q in %s", signingKeyID, dir)
+	}
+	ks.signing = signing
+	return ks, nil
+}
+
+func loadKeyFile(path string) (*key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	id := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(path), ".pem"), ".pub")
+	k := &key{id: id}
+	switch block.Type {
+	case "PRIVATE KEY":
+		k.private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		k.private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		k.public, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if signer, ok := k.private.(crypto.Signer); ok {
+		k.public = signer.Public()
+	}
+
+	switch pub := k.public.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA key too short: %d bits", pub.N.BitLen())
+		}
+		k.method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		k.method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", k.public)
+	}
+	return k, nil
+}
+
+func hmacKeySet(secret string) (*keySet, error) {
+	if len(secret) < 32 {
+		return nil, errors.New("auth: HMAC secret must be at least 32 bytes")
+	}
+	sum := sha256.Sum256([]byte(secret))
+	k := &key{
+		id:      "hs-" + hex.EncodeToString(sum[:4]),
+		method:  jwt.SigningMethodHS256,
+		private: []byte(secret),
+		public:  []byte(secret),
+	}
+	return &keySet{signing: k, byID: map[string]*key{k.id: k}}, nil
+}
+
+func ephemeralKeySet() (*keySet, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	k := &key{
+		id:      "ephemeral-" + hex.EncodeToString(pub[:4]),
+		method:  jwt.SigningMethodEdDSA,
+		private: priv,
+		public:  pub,
+	}
+	return &keySet{signing: k, byID: map[string]*key{k.id: k}}, nil
+}
+
+// sign signs claims with the current signing key and sets the kid header.
+func sign(claims jwt.Claims) (string, error) {
+	if keys == nil {
+		return "", errors.New("auth: signing keys not loaded")
+	}
+	token := jwt.NewWithClaims(keys.signing.method, claims)
+	token.Header["kid"] = keys.signing.id
+	return token.SignedString(keys.signing.private)
+}
+
+// verificationKey is a jwt.Keyfunc resolving the token's kid against every
+// loaded key, so tokens signed by a key that is being rotated out still
+// validate.
+func verificationKey(token *jwt.Token) (interface{}, error) {
+	if keys == nil {
+		return nil, errors.New("auth: signing keys not loaded")
+	}
+	kid, _ := token.Header["kid"].(string)
+	k, ok := keys.byID[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID %q", kid)
+	}
+	if token.Method.Alg() != k.method.Alg() {
+		return nil, fmt.Errorf("key %q does not use %s", kid, token.Method.Alg())
+	}
+	return k.public, nil
+}
+
+// JWK is a single public key in JSON Web Key format (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// OKP (Ed25519)
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKSet is the document served at /.well-known/jwks.json.
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public halves of all asymmetric verification keys.
+// Symmetric keys are never included.
+func JWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	if keys == nil {
+		return set
+	}
+	for _, k := range keys.byID {
+		jwk := JWK{Kid: k.id, Use: "sig", Alg: k.method.Alg()}
+		switch pub := k.public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = b64(pub.N.Bytes())
+			jwk.E = b64(bigEndian(pub.E))
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = b64(pub)
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].Kid < set.Keys[j].Kid })
+	return set
+}
+
+func bigEndian(n int) []byte {
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return b
+}
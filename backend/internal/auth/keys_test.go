@@ -0,0 +1,269 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	rsaKey      = mustRSAKey(2048)
+	_, edKey, _ = ed25519.GenerateKey(rand.Reader)
+)
+
+func mustRSAKey(bits int) *rsa.PrivateKey {
+	k, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		panic(err)
+	}
+	return k
+}
+
+// writePEM writes a PEM block of type typ holding der to dir/name.
+func writePEM(t *testing.T, dir, name, typ string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func pkcs8(t *testing.T, k any) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func pkix(t *testing.T, k any) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// keyDir returns a key directory with an RSA key in PKCS#1 form, an Ed25519
+// key in PKCS#8 form with its public key next to it, and the public half of
+// a retired RSA key.
+func keyDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	writePEM(t, dir, "rsa-2024.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey))
+	writePEM(t, dir, "ed-2025.pem", "PRIVATE KEY", pkcs8(t, edKey))
+	writePEM(t, dir, "ed-2025.pub.pem", "PUBLIC KEY", pkix(t, edKey.Public()))
+	writePEM(t, dir, "retired.pub.pem", "PUBLIC KEY", pkix(t, &mustRSAKey(2048).PublicKey))
+	return dir
+}
+
+// loadKeys loads cfg for the rest of the test.
+func loadKeys(t *testing.T, cfg KeyConfig) {
+	t.Helper()
+	t.Cleanup(func() { keys = nil })
+	if err := LoadKeys(cfg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadKeyDir(t *testing.T) {
+	dir := keyDir(t)
+	loadKeys(t, KeyConfig{KeyDir: dir, SigningKeyID: "ed-2025"})
+
+	if keys.signing.id != "ed-2025" || keys.signing.method != jwt.SigningMethodEdDSA {
+		t.Errorf("signing key %s %s, want ed-2025 EdDSA", keys.signing.id, keys.signing.method.Alg())
+	}
+	for id, alg := range map[string]string{"rsa-2024": "RS256", "ed-2025": "EdDSA", "retired": "RS256"} {
+		k, ok := keys.byID[id]
+		if !ok {
+			t.Errorf("key %s not loaded", id)
+			continue
+		}
+		if k.method.Alg() != alg {
+			t.Errorf("key %s uses %s, want %s", id, k.method.Alg(), alg)
+		}
+	}
+	if len(keys.byID) != 3 {
+		t.Errorf("%d keys loaded, want 3", len(keys.byID))
+	}
+	if keys.byID["ed-2025"].private == nil {
+		t.Error("public key replaced the private key with the same ID")
+	}
+}
+
+func TestLoadKeyDirErrors(t *testing.T) {
+	t.Cleanup(func() { keys = nil })
+
+	dir := keyDir(t)
+	for name, cfg := range map[string]KeyConfig{
+		"two private keys, no signing key ID": {KeyDir: dir},
+		"signing key ID unknown":              {KeyDir: dir, SigningKeyID: "missing"},
+		"signing key is public only":          {KeyDir: dir, SigningKeyID: "retired"},
+		"directory and HMAC secret":           {KeyDir: dir, SigningKeyID: "ed-2025", HMACSecret: strings.Repeat("s", 32)},
+		"HMAC secret too short":               {HMACSecret: "short"},
+	} {
+		if err := LoadKeys(cfg); err == nil {
+			t.Errorf("%s: loaded", name)
+		}
+	}
+
+	short := t.TempDir()
+	writePEM(t, short, "short.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(mustRSAKey(1024)))
+	if err := LoadKeys(KeyConfig{KeyDir: short}); err == nil || !strings.Contains(err.Error(), "too short") {
+		t.Errorf("1024-bit RSA key: %v, want too short", err)
+	}
+
+	garbage := t.TempDir()
+	os.WriteFile(filepath.Join(garbage, "key.pem"), []byte("not a key"), 0o600)
+	if err := LoadKeys(KeyConfig{KeyDir: garbage}); err == nil {
+		t.Error("file without a PEM block loaded")
+	}
+
+	// A single private key signs without being named.
+	single := t.TempDir()
+	writePEM(t, single, "only.pem", "PRIVATE KEY", pkcs8(t, edKey))
+	if err := LoadKeys(KeyConfig{KeyDir: single}); err != nil || keys.signing.id != "only" {
+		t.Errorf("single private key: %v, want it to sign", err)
+	}
+}
+
+// TestKeyRotation signs a token, moves signing to another key and checks
+// that the kid header picks the key every token is verified with.
+func TestKeyRotation(t *testing.T) {
+	dir := keyDir(t)
+	loadKeys(t, KeyConfig{KeyDir: dir, SigningKeyID: "rsa-2024"})
+	old, err := GenerateToken("alice", "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loadKeys(t, KeyConfig{KeyDir: dir, SigningKeyID: "ed-2025"})
+	current, err := GenerateToken("alice", "s2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for token, kid := range map[string]string{old: "rsa-2024", current: "ed-2025"} {
+		parsed, _, err := jwt.NewParser().ParseUnverified(token, &Claims{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.Header["kid"] != kid {
+			t.Errorf("token signed with kid %v, want %s", parsed.Header["kid"], kid)
+		}
+		if _, err := ValidateToken(token); err != nil {
+			t.Errorf("token of key %s rejected: %v", kid, err)
+		}
+	}
+
+	// Once the old key is removed, its tokens no longer validate.
+	if err := os.Remove(filepath.Join(dir, "rsa-2024.pem")); err != nil {
+		t.Fatal(err)
+	}
+	loadKeys(t, KeyConfig{KeyDir: dir, SigningKeyID: "ed-2025"})
+	if _, err := ValidateToken(old); err == nil {
+		t.Error("token of a removed key accepted")
+	}
+	if _, err := ValidateToken(current); err != nil {
+		t.Errorf("token of the signing key rejected: %v", err)
+	}
+}
+
+// TestAlgorithmConfusion checks that a token is only verified with the
+// algorithm of the key its kid names, so that e.g. a public RSA key can't
+// be used as an HMAC secret to forge tokens.
+func TestAlgorithmConfusion(t *testing.T) {
+	loadKeys(t, KeyConfig{KeyDir: keyDir(t), SigningKeyID: "rsa-2024"})
+	claims := &Claims{
+		Username:         "mallory",
+		SessionID:        "s1",
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+	}
+	forge := func(method jwt.SigningMethod, kid string, key any) string {
+		t.Helper()
+		token := jwt.NewWithClaims(method, claims)
+		token.Header["kid"] = kid
+		s, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkix(t, &rsaKey.PublicKey)})
+	for name, token := range map[string]string{
+		"HS256 with the RSA public key as secret": forge(jwt.SigningMethodHS256, "rsa-2024", publicPEM),
+		"HS256 with the RSA modulus as secret":    forge(jwt.SigningMethodHS256, "rsa-2024", rsaKey.PublicKey.N.Bytes()),
+		"RS256 under the kid of an EdDSA key":     forge(jwt.SigningMethodRS256, "ed-2025", rsaKey),
+		"EdDSA under the kid of an RSA key":       forge(jwt.SigningMethodEdDSA, "rsa-2024", edKey),
+		"none":                                    forge(jwt.SigningMethodNone, "rsa-2024", jwt.UnsafeAllowNoneSignatureType),
+		"unknown kid":                             forge(jwt.SigningMethodRS256, "other", rsaKey),
+		"no kid":                                  forge(jwt.SigningMethodRS256, "", rsaKey),
+	} {
+		if _, err := ValidateToken(token); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+
+	if _, err := ValidateToken(forge(jwt.SigningMethodRS256, "rsa-2024", rsaKey)); err != nil {
+		t.Errorf("token signed correctly rejected: %v", err)
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	loadKeys(t, KeyConfig{KeyDir: keyDir(t), SigningKeyID: "ed-2025"})
+	set := JWKS()
+
+	var kids []string
+	for _, k := range set.Keys {
+		kids = append(kids, k.Kid)
+		if k.Use != "sig" {
+			t.Errorf("key %s: use %q, want sig", k.Kid, k.Use)
+		}
+	}
+	if strings.Join(kids, ",") != "ed-2025,retired,rsa-2024" {
+		t.Fatalf("JWKS keys %v, want ed-2025, retired and rsa-2024 sorted by kid", kids)
+	}
+
+	ed, rsaJWK := set.Keys[0], set.Keys[2]
+	if ed.Kty != "OKP" || ed.Crv != "Ed25519" || ed.Alg != "EdDSA" || ed.N != "" {
+		t.Errorf("Ed25519 JWK %+v", ed)
+	}
+	if x, err := base64.RawURLEncoding.DecodeString(ed.X); err != nil || !edKey.Public().(ed25519.PublicKey).Equal(ed25519.PublicKey(x)) {
+		t.Errorf("Ed25519 JWK x %q doesn't decode to the public key", ed.X)
+	}
+
+	if rsaJWK.Kty != "RSA" || rsaJWK.Alg != "RS256" || rsaJWK.X != "" {
+		t.Errorf("RSA JWK %+v", rsaJWK)
+	}
+	n, errN := base64.RawURLEncoding.DecodeString(rsaJWK.N)
+	e, errE := base64.RawURLEncoding.DecodeString(rsaJWK.E)
+	if errN != nil || errE != nil {
+		t.Fatalf("RSA JWK n %q, e %q: not base64url", rsaJWK.N, rsaJWK.E)
+	}
+	public := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	if !public.Equal(&rsaKey.PublicKey) {
+		t.Error("RSA JWK doesn't decode to the public key")
+	}
+	if rsaJWK.E != "AQAB" {
+		t.Errorf("RSA JWK e %q, want AQAB", rsaJWK.E)
+	}
+
+	// Symmetric keys are never published.
+	loadKeys(t, KeyConfig{HMACSecret: strings.Repeat("s", 32)})
+	if set := JWKS(); len(set.Keys) != 0 {
+		t.Errorf("JWKS of an HMAC key: %+v, want no keys", set.Keys)
+	}
+}
@@ -0,0 +1,35 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+)
+
+// RefreshTokenTTL is how long a refresh token may be used before the user
+// has to log in again. Every successful refresh rotates the token and
+// restarts this window.
+const RefreshTokenTTL = 30 * 24 * time.Hour
+
+// NewRefreshToken returns a random opaque refresh token. Only its hash
+// (see HashToken) should ever be persisted.
+func NewRefreshToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return b64(b), nil
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// HashToken returns the hex encoded SHA-256 of an opaque token. Refresh
+// tokens carry 256 bits of entropy, so a fast hash is sufficient.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 seed of the RFC 6238 test vectors,
+// "12345678901234567890", base32 encoded.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// TestTOTPVectors checks the SHA-1 test vectors of RFC 6238, appendix B. The
+// RFC lists 8-digit codes; 6-digit codes are their last six digits.
+func TestTOTPVectors(t *testing.T) {
+	for _, v := range []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	} {
+		at := time.Unix(v.unix, 0)
+		step, ok := ValidateTOTP(rfc6238Secret, v.code, at)
+		if !ok {
+			t.Errorf("code %s at %d rejected", v.code, v.unix)
+			continue
+		}
+		if want := v.unix / 30; step != want {
+			t.Errorf("code %s at %d: step %d, want %d", v.code, v.unix, step, want)
+		}
+	}
+}
+
+func TestTOTPSkew(t *testing.T) {
+	key, err := totpEncoding.DecodeString(rfc6238Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / 30
+
+	for offset, want := range map[int64]bool{-2: false, -1: true, 0: true, 1: true, 2: false} {
+		code := hotp(key, current+offset)
+		step, ok := ValidateTOTP(rfc6238Secret, code, now)
+		if ok != want {
+			t.Errorf("code of step %+d accepted %v, want %v", offset, ok, want)
+		}
+		if ok && step != current+offset {
+			t.Errorf("code of step %+d: step %d, want %d", offset, step, current+offset)
+		}
+	}
+
+	// The first and last second of the window.
+	code := hotp(key, current-1)
+	if _, ok := ValidateTOTP(rfc6238Secret, code, time.Unix((current+1)*30+29, 0)); ok {
+		t.Error("code accepted two periods later")
+	}
+	if _, ok := ValidateTOTP(rfc6238Secret, code, time.Unix(current*30+29, 0)); !ok {
+		t.Error("code rejected at the last second of the next period")
+	}
+}
+
+func TestTOTPMalformed(t *testing.T) {
+	now := time.Unix(59, 0)
+	for _, code := range []string{"", "28708", "2870820", "28708x", "94287082"} {
+		if _, ok := ValidateTOTP(rfc6238Secret, code, now); ok {
+			t.Errorf("code %q accepted", code)
+		}
+	}
+	if _, ok := ValidateTOTP(rfc6238Secret, " 287082 ", now); !ok {
+		t.Error("code with surrounding spaces rejected")
+	}
+	if _, ok := ValidateTOTP(strings.ToLower(rfc6238Secret), "287082", now); !ok {
+		t.Error("lowercase secret rejected")
+	}
+	if _, ok := ValidateTOTP("not base32!", "287082", now); ok {
+		t.Error("code accepted for an invalid secret")
+	}
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != 10 {
+		t.Fatalf("%d codes, want 10", len(codes))
+	}
+	seen := make(map[string]bool)
+	for _, code := range codes {
+		if len(code) != 11 || code[5] != '-' || code != NormalizeRecoveryCode(code) {
+			t.Errorf("code %q, want the form abcde-fghij", code)
+		}
+		if seen[code] {
+			t.Errorf("code %q generated twice", code)
+		}
+		seen[code] = true
+	}
+	if got := NormalizeRecoveryCode("  ABCDE-FGHIJ\n"); got != "abcde-fghij" {
+		t.Errorf("NormalizeRecoveryCode = %q", got)
+	}
+}
@@ -0,0 +1,391 @@
+package bot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"learning-telegram/internal/egress"
+	"learning-telegram/internal/policy"
+	"learning-telegram/internal/store"
+	"learning-telegram/internal/websocket"
+)
+
+const (
+	maxUpdatesLimit   = 100
+	maxPollingTimeout = 50 * time.Second
+)
+
+// response is the envelope of every Bot API response.
+type response struct {
+	OK          bool        `json:"ok"`
+	Result      interface{} `json:"result,omitempty"`
+	ErrorCode   int         `json:"error_code,omitempty"`
+	Description string      `json:"description,omitempty"`
+}
+
+// apiError is a failed Bot API call. Descriptions follow Telegram's wording,
+// which bot libraries sometimes match on.
+type apiError struct {
+	code        int
+	description string
+}
+
+func (e *apiError) Error() string {
+	return e.description
+}
+
+func badRequest(format string, args ...interface{}) *apiError {
+	return &apiError{http.StatusBadRequest, "Bad Request: " + fmt.Sprintf(format, args...)}
+}
+
+func forbidden(description string) *apiError {
+	return &apiError{http.StatusForbidden, "Forbidden: " + description}
+}
+
+type method func(h *Handler, b *store.Bot, p params, r *http.Request) (interface{}, error)
+
+var methods = map[string]method{
+	"getme":       (*Handler).getMe,
+	"sendmessage": (*Handler).sendMessage,
+	"getupdates":  (*Handler).getUpdates,
+	"setwebhook":  (*Handler).setWebhook,
+}
+
+// ServeHTTP serves the Bot API at /bot<token>/<method>. Like Telegram it
+// accepts parameters in the query string, as a form or as a JSON body, and
+// method names are case-insensitive.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rest, ok := strings.CutPrefix(r.URL.Path, "/bot")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	token, name, _ := strings.Cut(rest, "/")
+
+	b, err := h.Authenticate(token)
+	if err != nil {
+		if err != errUnauthorized {
+			log.Printf("机器人认证失败: %v", err)
+		}
+		writeResponse(w, nil, &apiError{http.StatusUnauthorized, "Unauthorized"})
+		return
+	}
+	m, ok := methods[strings.ToLower(name)]
+	if !ok {
+		writeResponse(w, nil, &apiError{http.StatusNotFound, "Not Found: method not found"})
+		return
+	}
+	p, err := parseParams(r)
+	if err != nil {
+		writeResponse(w, nil, badRequest("invalid parameters: %v", err))
+		return
+	}
+
+	result, err := m(h, b, p, r)
+	writeResponse(w, result, err)
+}
+
+func writeResponse(w http.ResponseWriter, result interface{}, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	if err == nil {
+		json.NewEncoder(w).Encode(response{OK: true, Result: result})
+		return
+	}
+	apiErr, ok := err.(*apiError)
+	if !ok {
+		log.Printf("机器人接口内部错误: %v", err)
+		apiErr = &apiError{http.StatusInternalServerError, "Internal Server Error"}
+	}
+	w.WriteHeader(apiErr.code)
+	json.NewEncoder(w).Encode(response{ErrorCode: apiErr.code, Description: apiErr.description})
+}
+
+// params holds the parameters of a call as strings, whichever way they were
+// sent.
+type params url.Values
+
+func parseParams(r *http.Request) (params, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		if err := r.ParseForm(); err != nil {
+			return nil, err
+		}
+		return params(r.Form), nil
+	}
+
+	p := params(r.URL.Query())
+	var body map[string]json.RawMessage
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&body); err != nil {
+		return nil, err
+	}
+	for k, v := range body {
+		var s string
+		if json.Unmarshal(v, &s) != nil {
+			s = string(v) // numbers and booleans
+		}
+		url.Values(p).Set(k, s)
+	}
+	return p, nil
+}
+
+func (p params) String(key string) string {
+	return url.Values(p).Get(key)
+}
+
+func (p params) Int(key string, def int64) (int64, error) {
+	s := p.String(key)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, badRequest("%s must be an integer", key)
+	}
+	return n, nil
+}
+
+func (p params) Bool(key string) bool {
+	b, _ := strconv.ParseBool(p.String(key))
+	return b
+}
+
+func (h *Handler) getMe(b *store.Bot, p params, r *http.Request) (interface{}, error) {
+	return User{
+		ID:                      b.ID,
+		IsBot:                   true,
+		FirstName:               b.Username,
+		Username:                b.Username,
+		CanJoinGroups:           true,
+		CanReadAllGroupMessages: true,
+	}, nil
+}
+
+// sendMessage sends a text message to a user or a group. As on Telegram a
+// bot can't start a conversation: a user has to write to it first, unless
+// it's the bot's owner. In groups the bot has to be a member.
+func (h *Handler) sendMessage(b *store.Bot, p params, r *http.Request) (interface{}, error) {
+	text := p.String("text")
+	switch {
+	case strings.TrimSpace(text) == "":
+		return nil, badRequest("message text is empty")
+	case websocket.ContentTooLong(text):
+		return nil, badRequest("message is too long")
+	}
+
+	chat, err := h.resolveChat(p.String("chat_id"))
+	if err != nil {
+		return nil, err
+	}
+
+	if chat.Type == "group" {
+		groupID := -chat.ID
+		isMember, err := h.groups.IsUserInGroup(b.Username, groupID)
+		if err != nil {
+			return nil, err
+		}
+		if !isMember {
+			return nil, forbidden("bot is not a member of the group chat")
+		}
+		msg, _, err := h.messenger.SendGroupMessage(b.Username, groupID, "", text)
+		if err != nil {
+			return nil, err
+		}
+		return sentMessage(b, msg, chat), nil
+	}
+
+	to := chat.Username
+	if to == b.Username {
+		return nil, badRequest("chat not found")
+	}
+	isBot, err := h.users.IsBot(to)
+	if err != nil {
+		return nil, err
+	}
+	if isBot {
+		return nil, forbidden("bot can't send messages to bots")
+	}
+	if to != b.Owner {
+		started, err := h.messages.HasMessaged(to, b.Username)
+		if err != nil {
+			return nil, err
+		}
+		if !started {
+			return nil, forbidden("bot can't initiate conversation with a user")
+		}
+	}
+	msg, _, err := h.messenger.SendPrivateMessage(b.Username, to, "", text)
+	if err != nil {
+		return nil, err
+	}
+	return sentMessage(b, msg, chat), nil
+}
+
+// resolveChat looks up the chat a chat_id refers to: a user ID, a negated
+// group ID, or "@username".
+func (h *Handler) resolveChat(chatID string) (Chat, error) {
+	if chatID == "" {
+		return Chat{}, badRequest("chat_id is empty")
+	}
+	notFound := badRequest("chat not found")
+
+	if name, ok := strings.CutPrefix(chatID, "@"); ok {
+		if !policy.IsPlausibleUsername(name) {
+			return Chat{}, notFound
+		}
+		username, err := h.users.ResolveUsername(name)
+		if err != nil {
+			return Chat{}, notFound
+		}
+		id, err := h.users.GetUserID(username)
+		if err != nil {
+			return Chat{}, err
+		}
+		return Chat{ID: id, Type: "private", Username: username, FirstName: username}, nil
+	}
+
+	id, err := strconv.ParseInt(chatID, 10, 64)
+	if err != nil || id == 0 {
+		return Chat{}, notFound
+	}
+	if id < 0 {
+		title, err := h.groups.GetGroupName(-id)
+		if err != nil {
+			return Chat{}, notFound
+		}
+		return Chat{ID: id, Type: "group", Title: title}, nil
+	}
+	username, err := h.users.GetUsernameByID(id)
+	if err != nil {
+		return Chat{}, notFound
+	}
+	return Chat{ID: id, Type: "private", Username: username, FirstName: username}, nil
+}
+
+func sentMessage(b *store.Bot, msg *store.Message, chat Chat) Message {
+	return Message{
+		MessageID: int64(msg.ID),
+		From:      &User{ID: b.ID, IsBot: true, FirstName: b.Username, Username: b.Username},
+		Chat:      chat,
+		Date:      msg.CreatedAt.Unix(),
+		Text:      msg.Content,
+	}
+}
+
+// getUpdates returns pending updates, waiting up to timeout seconds for one
+// to arrive (long polling). Passing an offset confirms, and deletes, every
+// update with a lower ID.
+func (h *Handler) getUpdates(b *store.Bot, p params, r *http.Request) (interface{}, error) {
+	offset, err := p.Int("offset", 0)
+	if err != nil {
+		return nil, err
+	}
+	limit, err := p.Int("limit", maxUpdatesLimit)
+	if err != nil {
+		return nil, err
+	}
+	limit = max(1, min(limit, maxUpdatesLimit))
+	timeoutSec, err := p.Int("timeout", 0)
+	if err != nil {
+		return nil, err
+	}
+	timeout := min(time.Duration(max(timeoutSec, 0))*time.Second, maxPollingTimeout)
+
+	if b.WebhookURL != "" {
+		return nil, &apiError{http.StatusConflict, "Conflict: can't use getUpdates method while webhook is active; use setWebhook with an empty url to remove it first"}
+	}
+	if offset > 0 {
+		if err := h.bots.ConfirmBotUpdates(b.ID, offset); err != nil {
+			return nil, err
+		}
+	}
+	offset = max(offset, 0)
+
+	conn := h.connFor(b)
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		// Take the wake-up channel before querying, so an update queued in
+		// between isn't missed.
+		next := conn.wait()
+		stored, err := h.bots.GetBotUpdates(b.ID, offset, int(limit))
+		if err != nil {
+			return nil, err
+		}
+		if len(stored) > 0 || timeout == 0 {
+			updates := make([]json.RawMessage, 0, len(stored))
+			for _, u := range stored {
+				raw, err := updateJSON(u)
+				if err != nil {
+					return nil, err
+				}
+				updates = append(updates, raw)
+			}
+			return updates, nil
+		}
+
+		select {
+		case <-next:
+		case <-deadline.C:
+			timeout = 0
+		case <-r.Context().Done():
+			return []json.RawMessage{}, nil // the client is gone anyway
+		}
+	}
+}
+
+// setWebhook makes the server post updates to url instead of queueing them
+// for getUpdates; an empty url removes the webhook. If secret_token is set it
+// is sent in the X-Telegram-Bot-Api-Secret-Token header of every request.
+func (h *Handler) setWebhook(b *store.Bot, p params, r *http.Request) (interface{}, error) {
+	rawURL := p.String("url")
+	secret := p.String("secret_token")
+	if rawURL != "" {
+		switch err := h.egress.CheckURL(rawURL); {
+		case errors.Is(err, egress.ErrInvalidURL):
+			return nil, badRequest("bad webhook: invalid webhook URL specified")
+		case errors.Is(err, egress.ErrForbiddenAddress):
+			return nil, badRequest("bad webhook: webhook can't point to an internal address")
+		case err != nil:
+			return nil, badRequest("bad webhook: failed to resolve host")
+		}
+	}
+	if !validSecretToken(secret) {
+		return nil, badRequest("secret token contains unallowed characters")
+	}
+
+	if p.Bool("drop_pending_updates") {
+		if err := h.bots.ConfirmBotUpdates(b.ID, math.MaxInt64); err != nil {
+			return nil, err
+		}
+	}
+	if err := h.bots.SetBotWebhook(b.ID, rawURL, secret); err != nil {
+		return nil, err
+	}
+	b.WebhookURL, b.WebhookSecret = rawURL, secret
+	h.Announce(b)
+	return true, nil
+}
+
+// validSecretToken checks a webhook secret against Telegram's rules: up to 256
+// characters from A-Z, a-z, 0-9, _ and -.
+func validSecretToken(s string) bool {
+	if len(s) > 256 {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
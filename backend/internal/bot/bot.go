@@ -0,0 +1,408 @@
+// Package bot implements bot accounts: a subset of Telegram's Bot API served
+// under /bot<token>/, and the hub connection that turns the messages bots
+// receive into updates.
+package bot
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"learning-telegram/internal/auth"
+	"learning-telegram/internal/egress"
+	"learning-telegram/internal/store"
+	"learning-telegram/internal/websocket"
+)
+
+// User, Chat, Message and Update mirror the Bot API objects of the same name,
+// restricted to the fields this server can fill in.
+type User struct {
+	ID                      int64  `json:"id"`
+	IsBot                   bool   `json:"is_bot"`
+	FirstName               string `json:"first_name"`
+	Username                string `json:"username,omitempty"`
+	CanJoinGroups           bool   `json:"can_join_groups,omitempty"`
+	CanReadAllGroupMessages bool   `json:"can_read_all_group_messages,omitempty"`
+}
+
+// Chat identifies a conversation. As on Telegram, the ID of a private chat is
+// the ID of the other user and group chats have negative IDs, here the
+// negated group ID.
+type Chat struct {
+	ID        int64  `json:"id"`
+	Type      string `json:"type"` // "private" or "group"
+	Title     string `json:"title,omitempty"`
+	Username  string `json:"username,omitempty"`
+	FirstName string `json:"first_name,omitempty"`
+}
+
+type Message struct {
+	MessageID int64  `json:"message_id"`
+	From      *User  `json:"from,omitempty"`
+	Chat      Chat   `json:"chat"`
+	Date      int64  `json:"date"`
+	Text      string `json:"text"`
+}
+
+type Update struct {
+	UpdateID int64    `json:"update_id"`
+	Message  *Message `json:"message,omitempty"`
+}
+
+var errUnauthorized = errors.New("invalid bot token")
+
+// Handler serves the Bot API from the repositories it was created with and
+// connects bots to the hub. Bots send messages through messenger, like
+// WebSocket clients. Webhooks may only point to addresses egress allows.
+type Handler struct {
+	bots      store.BotRepo
+	users     store.UserRepo
+	groups    store.GroupRepo
+	messages  store.MessageRepo
+	hub       *websocket.Hub
+	messenger *websocket.Handler
+	egress    egress.Policy
+	client    *http.Client // posts to webhooks, see postUpdate
+
+	// node identifies this node in webhook leases, see syncWebhook.
+	node string
+	// stopped is set by Stop, after which no webhook is started.
+	stopped atomic.Bool
+	// cancel stops the periodic tasks started by Start; tasks and
+	// webhooks track them and the webhook loops, see Stop.
+	cancel   context.CancelFunc
+	tasks    sync.WaitGroup
+	webhooks sync.WaitGroup
+
+	lock  sync.Mutex
+	conns map[int64]*botConn // the hub connection of every bot
+}
+
+func NewHandler(repos store.Repos, hub *websocket.Hub, messenger *websocket.Handler, egress egress.Policy) *Handler {
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+	return &Handler{
+		bots:      repos.Bots,
+		users:     repos.Users,
+		groups:    repos.Groups,
+		messages:  repos.Messages,
+		hub:       hub,
+		messenger: messenger,
+		egress:    egress,
+		client:    &http.Client{Timeout: webhookTimeout, Transport: egress.Transport()},
+		node:      hex.EncodeToString(suffix),
+		conns:     make(map[int64]*botConn),
+	}
+}
+
+// Authenticate returns the bot a token belongs to.
+func (h *Handler) Authenticate(token string) (*store.Bot, error) {
+	botID, secretHash, ok := auth.ParseBotToken(token)
+	if !ok {
+		return nil, errUnauthorized
+	}
+	b, err := h.bots.GetBot(botID)
+	if err == store.ErrBotNotFound {
+		return nil, errUnauthorized
+	} else if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(secretHash), []byte(b.TokenHash)) != 1 {
+		return nil, errUnauthorized
+	}
+	return b, nil
+}
+
+const (
+	// The node posting a bot's updates to its webhook holds a lease on it,
+	// which it renews every webhookLeaseRenewal. When the node dies another
+	// takes over once the lease ran out.
+	webhookLease        = 30 * time.Second
+	webhookLeaseRenewal = 10 * time.Second
+
+	// botChangedEvent is the hub event that tells the other nodes that a
+	// bot was created or its webhook changed. Its data is the bot's ID.
+	botChangedEvent = "bot_changed"
+)
+
+// Start registers every existing bot with the hub and starts the delivery
+// of their webhooks. It must be called once.
+func (h *Handler) Start() error {
+	all, err := h.bots.GetAllBots()
+	if err != nil {
+		return err
+	}
+	for i := range all {
+		h.Register(&all[i])
+	}
+	h.hub.OnEvent(botChangedEvent, h.botChanged)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	h.tasks.Add(2)
+	go func() {
+		defer h.tasks.Done()
+		h.superviseWebhooks(ctx)
+	}()
+	go func() {
+		defer h.tasks.Done()
+		h.pruneUpdates(ctx)
+	}()
+	return nil
+}
+
+// Stop stops posting to webhooks and gives up the leases on them, so that
+// other nodes take over right away. It returns once the tasks and webhook
+// loops no longer use the repositories.
+func (h *Handler) Stop() {
+	h.stopped.Store(true)
+	if h.cancel != nil {
+		h.cancel()
+	}
+	h.tasks.Wait()
+
+	h.lock.Lock()
+	conns := make([]*botConn, 0, len(h.conns))
+	for _, c := range h.conns {
+		conns = append(conns, c)
+	}
+	h.lock.Unlock()
+	for _, c := range conns {
+		c.syncWebhook("", "")
+	}
+	h.webhooks.Wait()
+}
+
+// Register connects a bot to the hub, so that messages sent to it, or to
+// groups it is a member of, are queued as updates, and posts these to the
+// bot's webhook if this node holds the lease on it. It may be called again
+// with the bot's current state to apply changes.
+func (h *Handler) Register(b *store.Bot) {
+	h.connFor(b).syncWebhook(b.WebhookURL, b.WebhookSecret)
+}
+
+// Announce registers a bot that was just created, or whose webhook changed,
+// on this node and has every other node register it again as well.
+func (h *Handler) Announce(b *store.Bot) {
+	h.Register(b)
+	if err := h.hub.PublishEvent(botChangedEvent, b.ID); err != nil {
+		log.Printf("通知其他节点机器人 %s 已变更失败: %v", b.Username, err)
+	}
+}
+
+func (h *Handler) botChanged(data json.RawMessage) {
+	var id int64
+	if err := json.Unmarshal(data, &id); err != nil {
+		log.Printf("无法解析机器人变更事件: %v", err)
+		return
+	}
+	b, err := h.bots.GetBot(id)
+	if err != nil {
+		log.Printf("读取机器人 %d 失败: %v", id, err)
+		return
+	}
+	h.Register(b)
+}
+
+// connFor returns the hub connection of a bot, connecting it first if this
+// node hasn't yet.
+func (h *Handler) connFor(b *store.Bot) *botConn {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if c, ok := h.conns[b.ID]; ok {
+		return c
+	}
+	c := &botConn{h: h, id: b.ID, username: b.Username, notify: make(chan struct{})}
+	h.conns[b.ID] = c
+	h.hub.Register(b.Username, "", c)
+	return c
+}
+
+// superviseWebhooks periodically registers every bot again. This renews the
+// webhook leases of this node, takes over those of nodes that died and
+// applies changes whose event was lost.
+func (h *Handler) superviseWebhooks(ctx context.Context) {
+	ticker := time.NewTicker(webhookLeaseRenewal)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		all, err := h.bots.GetAllBots()
+		if err != nil {
+			log.Printf("读取机器人失败: %v", err)
+			continue
+		}
+		for i := range all {
+			h.Register(&all[i])
+		}
+	}
+}
+
+// pruneUpdates periodically drops updates no bot fetched in time.
+func (h *Handler) pruneUpdates(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if err := h.bots.PruneBotUpdates(); err != nil {
+			log.Printf("清理过期机器人更新失败: %v", err)
+		}
+	}
+}
+
+// botConn is the hub connection of a bot. Instead of writing push frames to a
+// socket it stores them as updates, which the bot fetches with getUpdates or
+// receives on its webhook.
+type botConn struct {
+	h        *Handler
+	id       int64
+	username string
+
+	lock          sync.Mutex
+	notify        chan struct{} // closed and replaced when an update is queued
+	cancelWebhook context.CancelFunc
+	webhookURL    string // of the running webhook loop
+	webhookSecret string
+}
+
+// WriteJSON queues the messages in frames pushed by the hub as updates.
+func (c *botConn) WriteJSON(v interface{}) error {
+	frame, ok := v.(websocket.Frame)
+	if !ok {
+		return nil
+	}
+
+	var msg *Message
+	var err error
+	switch p := frame.Payload.(type) {
+	case websocket.NewMessagePayload:
+		// The hub echoes messages back to their sender; those aren't updates.
+		if p.From == c.username {
+			return nil
+		}
+		msg, err = c.h.privateMessage(p)
+	case websocket.NewGroupMessagePayload:
+		if p.From == c.username {
+			return nil
+		}
+		msg, err = c.h.groupMessage(p)
+	default:
+		return nil // typing notifications etc.
+	}
+	if err != nil {
+		log.Printf("机器人 %s 更新生成失败: %v", c.username, err)
+		return err
+	}
+
+	payload, err := json.Marshal(Update{Message: msg})
+	if err != nil {
+		return err
+	}
+	if _, err := c.h.bots.AddBotUpdate(c.id, payload); err != nil {
+		log.Printf("机器人 %s 更新存储失败: %v", c.username, err)
+		return err
+	}
+	c.wake()
+	return nil
+}
+
+// Relayed wakes the bot's webhook and long polls for the messages stored by
+// the node they were sent on. Bot connections are websocket.DirectConnection:
+// storing an update is quick, and a bot must not be disconnected for falling
+// behind, as nothing would reconnect it.
+func (c *botConn) Relayed(f websocket.Frame) {
+	switch p := f.Payload.(type) {
+	case websocket.NewMessagePayload:
+		if p.From != c.username {
+			c.wake()
+		}
+	case websocket.NewGroupMessagePayload:
+		if p.From != c.username {
+			c.wake()
+		}
+	}
+}
+
+// ReadJSON is never called: bots don't have a read loop, they talk to the
+// server through the HTTP API.
+func (c *botConn) ReadJSON(v interface{}) error {
+	return errors.New("bot connections can't be read from")
+}
+
+// Close is a no-op; bot connections live as long as their Handler.
+func (c *botConn) Close() error {
+	return nil
+}
+
+// wait returns a channel that is closed when the next update is queued.
+func (c *botConn) wait() <-chan struct{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.notify
+}
+
+func (c *botConn) wake() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	close(c.notify)
+	c.notify = make(chan struct{})
+}
+
+func (h *Handler) userObject(username string) (*User, error) {
+	id, err := h.users.GetUserID(username)
+	if err != nil {
+		return nil, err
+	}
+	isBot, err := h.users.IsBot(username)
+	if err != nil {
+		return nil, err
+	}
+	return &User{ID: id, IsBot: isBot, FirstName: username, Username: username}, nil
+}
+
+func (h *Handler) privateMessage(p websocket.NewMessagePayload) (*Message, error) {
+	from, err := h.userObject(p.From)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{
+		MessageID: p.ID,
+		From:      from,
+		Chat:      Chat{ID: from.ID, Type: "private", Username: from.Username, FirstName: from.FirstName},
+		Date:      time.Now().Unix(),
+		Text:      p.Content,
+	}, nil
+}
+
+func (h *Handler) groupMessage(p websocket.NewGroupMessagePayload) (*Message, error) {
+	from, err := h.userObject(p.From)
+	if err != nil {
+		return nil, err
+	}
+	title, err := h.groups.GetGroupName(p.GroupID)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{
+		MessageID: p.ID,
+		From:      from,
+		Chat:      Chat{ID: -p.GroupID, Type: "group", Title: title},
+		Date:      time.Now().Unix(),
+		Text:      p.Content,
+	}, nil
+}
@@ -0,0 +1,386 @@
+package bot
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"learning-telegram/internal/auth"
+	"learning-telegram/internal/egress"
+	"learning-telegram/internal/store"
+	"learning-telegram/internal/store/memstore"
+	"learning-telegram/internal/webhook"
+	"learning-telegram/internal/websocket"
+)
+
+// node is a Bot API handler with its own hub, like one server instance.
+type node struct {
+	bots      *Handler
+	messenger *websocket.Handler
+}
+
+// newNode creates a node on repo whose webhooks may reach the networks in
+// allowed. It is stopped when the test ends.
+func newNode(t *testing.T, repo *memstore.Store, allowed ...string) *node {
+	t.Helper()
+	policy, err := egress.New(allowed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub, err := websocket.NewHub(websocket.DefaultHubConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repos := repo.Repos()
+	messenger := websocket.NewHandler(repos, hub, webhook.NewWorker(repos.Webhooks, policy), websocket.HandlerConfig{})
+	n := &node{bots: NewHandler(repos, hub, messenger, policy), messenger: messenger}
+	t.Cleanup(n.bots.Stop)
+	return n
+}
+
+// newBot creates the users alice and bob and helper_bot, owned by alice, and
+// returns the bot and its token.
+func newBot(t *testing.T, repo *memstore.Store) (*store.Bot, string) {
+	t.Helper()
+	for _, name := range []string{"alice", "bob"} {
+		if err := repo.CreateUser(name, "hash", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	id, err := repo.CreateBot("alice", "helper_bot", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, hash, err := auth.NewBotToken(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SetBotToken("alice", id, hash); err != nil {
+		t.Fatal(err)
+	}
+	b, err := repo.GetBot(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, token
+}
+
+type result struct {
+	OK          bool            `json:"ok"`
+	Result      json.RawMessage `json:"result"`
+	ErrorCode   int             `json:"error_code"`
+	Description string          `json:"description"`
+}
+
+// request calls a Bot API method with params sent as a form.
+func request(h *Handler, token, method string, params url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/bot"+token+"/"+method, strings.NewReader(params.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// call calls a Bot API method and returns the status code and decoded
+// response.
+func call(t *testing.T, h *Handler, token, method string, params url.Values) (int, result) {
+	t.Helper()
+	return decode(t, method, request(h, token, method, params))
+}
+
+func decode(t *testing.T, method string, rec *httptest.ResponseRecorder) (int, result) {
+	t.Helper()
+	var res result
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatalf("%s: %v", method, err)
+	}
+	if res.OK != (rec.Code == http.StatusOK) {
+		t.Errorf("%s: status %d with ok=%v", method, rec.Code, res.OK)
+	}
+	return rec.Code, res
+}
+
+func TestGetMe(t *testing.T) {
+	repo := memstore.New()
+	b, token := newBot(t, repo)
+	n := newNode(t, repo)
+
+	code, res := call(t, n.bots, token, "getMe", nil)
+	if code != http.StatusOK {
+		t.Fatalf("getMe: %d %s", code, res.Description)
+	}
+	var me User
+	if err := json.Unmarshal(res.Result, &me); err != nil {
+		t.Fatal(err)
+	}
+	if me.ID != b.ID || !me.IsBot || me.Username != "helper_bot" {
+		t.Errorf("getMe returned %+v", me)
+	}
+
+	// Method names are case-insensitive; tokens are checked before them.
+	if code, _ := call(t, n.bots, token, "GETME", nil); code != http.StatusOK {
+		t.Errorf("GETME: %d", code)
+	}
+	for _, bad := range []string{"", "123", strconv.FormatInt(b.ID, 10) + ":wrong", token + "x"} {
+		if code, res := call(t, n.bots, bad, "getMe", nil); code != http.StatusUnauthorized || res.Description != "Unauthorized" {
+			t.Errorf("token %q: %d %s", bad, code, res.Description)
+		}
+	}
+	if code, _ := call(t, n.bots, token, "getChat", nil); code != http.StatusNotFound {
+		t.Errorf("unknown method: %d", code)
+	}
+}
+
+// TestSendMessageInitiation checks that a bot can write to its owner at any
+// time but to other users only once they wrote to it.
+func TestSendMessageInitiation(t *testing.T) {
+	repo := memstore.New()
+	_, token := newBot(t, repo)
+	n := newNode(t, repo)
+
+	send := func(chatID string) (int, result) {
+		return call(t, n.bots, token, "sendMessage", url.Values{"chat_id": {chatID}, "text": {"hello"}})
+	}
+
+	code, res := send("@bob")
+	if code != http.StatusForbidden || res.Description != "Forbidden: bot can't initiate conversation with a user" {
+		t.Fatalf("to a stranger: %d %s", code, res.Description)
+	}
+	if sent, _ := repo.HasMessaged("helper_bot", "bob"); sent {
+		t.Error("forbidden message stored")
+	}
+
+	code, res = send("@alice")
+	if code != http.StatusOK {
+		t.Fatalf("to the owner: %d %s", code, res.Description)
+	}
+	var sent Message
+	if err := json.Unmarshal(res.Result, &sent); err != nil {
+		t.Fatal(err)
+	}
+	aliceID, _ := repo.GetUserID("alice")
+	if sent.Chat.ID != aliceID || sent.Chat.Type != "private" || sent.Text != "hello" || !sent.From.IsBot {
+		t.Errorf("sent %+v", sent)
+	}
+
+	// Once bob wrote to the bot, it may answer, by ID as well as by name.
+	if _, _, err := n.messenger.SendPrivateMessage("bob", "helper_bot", "", "/start"); err != nil {
+		t.Fatal(err)
+	}
+	bobID, _ := repo.GetUserID("bob")
+	for _, chatID := range []string{"@bob", strconv.FormatInt(bobID, 10)} {
+		if code, res := send(chatID); code != http.StatusOK {
+			t.Errorf("to %s after /start: %d %s", chatID, code, res.Description)
+		}
+	}
+
+	if code, res := send("@nobody"); code != http.StatusBadRequest || res.Description != "Bad Request: chat not found" {
+		t.Errorf("to a missing user: %d %s", code, res.Description)
+	}
+}
+
+func TestGetUpdatesLongPolling(t *testing.T) {
+	repo := memstore.New()
+	_, token := newBot(t, repo)
+	n := newNode(t, repo)
+
+	updatesIn := func(rec *httptest.ResponseRecorder) []Update {
+		t.Helper()
+		code, res := decode(t, "getUpdates", rec)
+		if code != http.StatusOK {
+			t.Fatalf("getUpdates: %d %s", code, res.Description)
+		}
+		var updates []Update
+		if err := json.Unmarshal(res.Result, &updates); err != nil {
+			t.Fatal(err)
+		}
+		return updates
+	}
+	getUpdates := func(params url.Values) []Update {
+		t.Helper()
+		return updatesIn(request(n.bots, token, "getUpdates", params))
+	}
+
+	if updates := getUpdates(nil); len(updates) != 0 {
+		t.Fatalf("updates before any message: %+v", updates)
+	}
+
+	// A long poll returns as soon as a message arrives.
+	polled := make(chan *httptest.ResponseRecorder)
+	go func() {
+		polled <- request(n.bots, token, "getUpdates", url.Values{"timeout": {"10"}})
+	}()
+	select {
+	case <-polled:
+		t.Fatal("long poll returned before a message arrived")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, _, err := n.messenger.SendPrivateMessage("bob", "helper_bot", "", "/start"); err != nil {
+		t.Fatal(err)
+	}
+
+	var updates []Update
+	select {
+	case rec := <-polled:
+		updates = updatesIn(rec)
+	case <-time.After(5 * time.Second):
+		t.Fatal("long poll didn't return after a message arrived")
+	}
+	if len(updates) != 1 || updates[0].Message == nil {
+		t.Fatalf("updates %+v", updates)
+	}
+	msg := updates[0].Message
+	bobID, _ := repo.GetUserID("bob")
+	if msg.Text != "/start" || msg.Chat.ID != bobID || msg.From.Username != "bob" {
+		t.Errorf("update message %+v", msg)
+	}
+
+	// Unconfirmed updates are returned again; an offset confirms them.
+	if again := getUpdates(nil); len(again) != 1 || again[0].UpdateID != updates[0].UpdateID {
+		t.Errorf("unconfirmed updates %+v", again)
+	}
+	offset := strconv.FormatInt(updates[0].UpdateID+1, 10)
+	if confirmed := getUpdates(url.Values{"offset": {offset}}); len(confirmed) != 0 {
+		t.Errorf("updates after confirming: %+v", confirmed)
+	}
+}
+
+func TestSetWebhookInternalAddress(t *testing.T) {
+	repo := memstore.New()
+	b, token := newBot(t, repo)
+	n := newNode(t, repo)
+
+	for _, tt := range []struct {
+		url, want string
+	}{
+		{"http://127.0.0.1:8080/hook", "Bad Request: bad webhook: webhook can't point to an internal address"},
+		{"http://[::1]/hook", "Bad Request: bad webhook: webhook can't point to an internal address"},
+		{"http://169.254.169.254/latest/meta-data", "Bad Request: bad webhook: webhook can't point to an internal address"},
+		{"http://10.1.2.3/hook", "Bad Request: bad webhook: webhook can't point to an internal address"},
+		{"ftp://example.com/hook", "Bad Request: bad webhook: invalid webhook URL specified"},
+	} {
+		code, res := call(t, n.bots, token, "setWebhook", url.Values{"url": {tt.url}})
+		if code != http.StatusBadRequest || res.Description != tt.want {
+			t.Errorf("setWebhook %s: %d %s", tt.url, code, res.Description)
+		}
+	}
+	if stored, _ := repo.GetBot(b.ID); stored.WebhookURL != "" {
+		t.Errorf("rejected webhook stored: %s", stored.WebhookURL)
+	}
+
+	// Networks the policy allows are accepted.
+	allowed := newNode(t, repo, "127.0.0.1")
+	if code, res := call(t, allowed.bots, token, "setWebhook", url.Values{"url": {"http://127.0.0.1:8080/hook"}}); code != http.StatusOK {
+		t.Errorf("setWebhook to an allowed network: %d %s", code, res.Description)
+	}
+}
+
+// hook records the updates posted to a bot's webhook.
+type hook struct {
+	*httptest.Server
+	updates chan Update
+	secrets chan string
+}
+
+func newHook(t *testing.T) *hook {
+	t.Helper()
+	h := &hook{updates: make(chan Update, 16), secrets: make(chan string, 16)}
+	h.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var u Update
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &u); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		h.secrets <- r.Header.Get("X-Telegram-Bot-Api-Secret-Token")
+		h.updates <- u
+	}))
+	t.Cleanup(h.Close)
+	return h
+}
+
+// posting reports whether a node runs the webhook loop of a bot.
+func (n *node) posting(botID int64) bool {
+	n.bots.lock.Lock()
+	c := n.bots.conns[botID]
+	n.bots.lock.Unlock()
+	if c == nil {
+		return false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.cancelWebhook != nil
+}
+
+// TestWebhookLease checks that only the node holding the lease on a bot's
+// webhook posts to it, and that another takes over once it stops.
+func TestWebhookLease(t *testing.T) {
+	repo := memstore.New()
+	b, _ := newBot(t, repo)
+	rcv := newHook(t)
+	if err := repo.SetBotWebhook(b.ID, rcv.URL, "s3cret"); err != nil {
+		t.Fatal(err)
+	}
+	b, _ = repo.GetBot(b.ID)
+
+	first, second := newNode(t, repo, "127.0.0.1", "::1"), newNode(t, repo, "127.0.0.1", "::1")
+	first.bots.Register(b)
+	second.bots.Register(b)
+	if !first.posting(b.ID) || second.posting(b.ID) {
+		t.Fatalf("posting: first %v, second %v; want only the first", first.posting(b.ID), second.posting(b.ID))
+	}
+	// Renewing keeps the lease with its holder.
+	second.bots.Register(b)
+	first.bots.Register(b)
+	if !first.posting(b.ID) || second.posting(b.ID) {
+		t.Fatalf("after renewal: first %v, second %v; want only the first", first.posting(b.ID), second.posting(b.ID))
+	}
+	if ok, _ := repo.ClaimBotWebhook(b.ID, "another node", webhookLease); ok {
+		t.Fatal("lease claimed while held")
+	}
+
+	// Stop gives the lease up, so the second node takes over right away.
+	first.bots.Stop()
+	if first.posting(b.ID) {
+		t.Fatal("stopped node still posting")
+	}
+	second.bots.Register(b)
+	if !second.posting(b.ID) {
+		t.Fatal("second node didn't take over the lease")
+	}
+	// A stopped node doesn't claim it back.
+	first.bots.Register(b)
+	if first.posting(b.ID) {
+		t.Fatal("stopped node claimed the lease")
+	}
+
+	if _, _, err := second.messenger.SendPrivateMessage("bob", "helper_bot", "", "/start"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case u := <-rcv.updates:
+		if u.Message == nil || u.Message.Text != "/start" {
+			t.Errorf("posted update %+v", u)
+		}
+		if secret := <-rcv.secrets; secret != "s3cret" {
+			t.Errorf("secret token %q", secret)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("update not posted to the webhook")
+	}
+	// Posted updates are confirmed and not posted again.
+	select {
+	case u := <-rcv.updates:
+		t.Errorf("update posted twice: %+v", u)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if pending, _ := repo.GetBotUpdates(b.ID, 0, 10); len(pending) != 0 {
+		t.Errorf("posted updates still pending: %+v", pending)
+	}
+}
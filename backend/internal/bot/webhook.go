@@ -0,0 +1,156 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"learning-telegram/internal/store"
+)
+
+const (
+	webhookTimeout    = 10 * time.Second
+	webhookMinBackoff = time.Second
+	webhookMaxBackoff = time.Minute
+)
+
+// syncWebhook starts posting the bot's updates to url if this node gets the
+// lease on the bot's webhook, renewing it if it holds it already, and stops
+// posting them otherwise. Only one node posts to a webhook at a time, so
+// every update is posted once. An empty url stops the webhook.
+func (c *botConn) syncWebhook(url, secret string) {
+	if c.h.stopped.Load() {
+		url = ""
+	}
+	owner := false
+	if url != "" {
+		var err error
+		owner, err = c.h.bots.ClaimBotWebhook(c.id, c.h.node, webhookLease)
+		if err != nil {
+			// The lease may run out meanwhile; better stop than post
+			// updates twice.
+			log.Printf("续租机器人 %s 的Webhook失败: %v", c.username, err)
+		}
+	}
+
+	claimed := owner
+
+	c.lock.Lock()
+	running := c.cancelWebhook != nil
+	if owner && running && c.webhookURL == url && c.webhookSecret == secret {
+		c.lock.Unlock()
+		return
+	}
+	if running {
+		c.cancelWebhook()
+		c.cancelWebhook = nil
+	}
+	// Stop may have been called since the check above; it syncs every
+	// webhook under the lock afterwards, so checking again here either
+	// starts no loop or one that Stop cancels and waits for.
+	owner = owner && !c.h.stopped.Load()
+	if owner {
+		ctx, cancel := context.WithCancel(context.Background())
+		c.cancelWebhook, c.webhookURL, c.webhookSecret = cancel, url, secret
+		c.h.webhooks.Add(1)
+		go func() {
+			defer c.h.webhooks.Done()
+			c.runWebhook(ctx, url, secret)
+		}()
+	}
+	c.lock.Unlock()
+
+	// Give up a lease this node holds but doesn't use.
+	if !owner && (running || claimed) {
+		if err := c.h.bots.ReleaseBotWebhook(c.id, c.h.node); err != nil {
+			log.Printf("释放机器人 %s 的Webhook失败: %v", c.username, err)
+		}
+	}
+}
+
+// runWebhook posts pending updates one at a time and in order. An update is
+// confirmed once the webhook answered with a 2xx status; on failure it is
+// retried with exponential backoff, so later updates wait behind it as with
+// Telegram.
+func (c *botConn) runWebhook(ctx context.Context, url, secret string) {
+	backoff := webhookMinBackoff
+	for {
+		next := c.wait()
+		updates, err := c.h.bots.GetBotUpdates(c.id, 0, 100)
+		if err != nil {
+			log.Printf("读取机器人 %s 的更新失败: %v", c.username, err)
+		}
+
+		for _, u := range updates {
+			if err = c.h.postUpdate(ctx, url, secret, u); err != nil {
+				break
+			}
+			if err = c.h.bots.ConfirmBotUpdates(c.id, u.ID+1); err != nil {
+				break
+			}
+			backoff = webhookMinBackoff
+		}
+
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			log.Printf("机器人 %s 的Webhook推送失败，%v后重试: %v", c.username, backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			backoff = min(2*backoff, webhookMaxBackoff)
+		case len(updates) == 0:
+			select {
+			case <-next:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// postUpdate posts an update to a webhook with the handler's client, which
+// can't reach internal addresses, see package egress.
+func (h *Handler) postUpdate(ctx context.Context, url, secret string, u store.BotUpdate) error {
+	body, err := updateJSON(u)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		req.Header.Set("X-Telegram-Bot-Api-Secret-Token", secret)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// updateJSON encodes a stored update with its update_id filled in.
+func updateJSON(u store.BotUpdate) ([]byte, error) {
+	var upd Update
+	if err := json.Unmarshal(u.Payload, &upd); err != nil {
+		return nil, err
+	}
+	upd.UpdateID = u.ID
+	return json.Marshal(upd)
+}
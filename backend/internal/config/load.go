@@ -0,0 +1,195 @@
+package config
+
+import (
+	"encoding"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Load builds the configuration from the defaults, the file named by the
+// -config flag or CONFIG_FILE, the environment and the flags in args, which
+// doesn't include the program name, and validates it. It also returns the
+// arguments following the flags.
+func Load(args []string) (*Config, []string, error) {
+	cfg := Default()
+	fields := cfg.fields()
+
+	fs := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ExitOnError)
+	path := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML (.yaml/.yml) or TOML (.toml) config file; also CONFIG_FILE")
+	var flagged []flagValue
+	for _, f := range fields {
+		if f.secret != "" {
+			continue
+		}
+		fs.Func(f.flagName(), fmt.Sprintf("%s; also %s", f.key, f.env), func(v string) error {
+			flagged = append(flagged, flagValue{f, v})
+			return nil
+		})
+	}
+	fs.Parse(args)
+
+	if *path != "" {
+		if err := loadFile(*path, cfg); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", *path, err)
+		}
+	}
+	for _, f := range fields {
+		if v := os.Getenv(f.env); v != "" {
+			if err := f.set(v); err != nil {
+				return nil, nil, fmt.Errorf("%s: %w", f.env, err)
+			}
+		}
+	}
+	for _, fv := range flagged {
+		if err := fv.f.set(fv.value); err != nil {
+			return nil, nil, fmt.Errorf("-%s: %w", fv.f.flagName(), err)
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return cfg, fs.Args(), nil
+}
+
+type flagValue struct {
+	f     field
+	value string
+}
+
+func loadFile(path string, cfg *Config) error {
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		dec := yaml.NewDecoder(file)
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && err != io.EOF {
+			return err
+		}
+		return nil
+	case ".toml":
+		md, err := toml.DecodeFile(path, cfg)
+		if err != nil {
+			return err
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("unknown keys %v", undecoded)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown config file type %q (want .yaml, .yml or .toml)", ext)
+	}
+}
+
+// field is a setting of the configuration, addressed by its file key.
+type field struct {
+	key    string // e.g. websocket.ping_interval
+	env    string
+	secret string // "true" or "url" for URLs with a password
+	value  reflect.Value
+}
+
+// fields lists the settings of c, which the returned fields set.
+func (c *Config) fields() []field {
+	var fields []field
+	sections := reflect.ValueOf(c).Elem()
+	for i := range sections.NumField() {
+		section, st := sections.Field(i), sections.Type().Field(i)
+		for j := range section.NumField() {
+			ft := section.Type().Field(j)
+			fields = append(fields, field{
+				key:    st.Tag.Get("yaml") + "." + ft.Tag.Get("yaml"),
+				env:    ft.Tag.Get("env"),
+				secret: ft.Tag.Get("secret"),
+				value:  section.Field(j),
+			})
+		}
+	}
+	return fields
+}
+
+func (f field) flagName() string {
+	return strings.ReplaceAll(strings.ToLower(f.env), "_", "-")
+}
+
+// set parses s into the field. Lists are separated by commas.
+func (f field) set(s string) error {
+	v := f.value
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(s))
+	}
+	switch v.Interface().(type) {
+	case time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case string:
+		v.SetString(s)
+	case bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return errors.New("must be true or false")
+		}
+		v.SetBool(b)
+	case int, int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return errors.New("must be an integer")
+		}
+		v.SetInt(n)
+	case []string:
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		panic("config: unsupported field type " + v.Type().String())
+	}
+	return nil
+}
+
+// Redacted returns the configuration as YAML with its secrets masked, for
+// logging.
+func (c *Config) Redacted() string {
+	redacted := *c
+	for _, f := range redacted.fields() {
+		s, _ := f.value.Interface().(string)
+		switch {
+		case s == "":
+		case f.secret == "true":
+			f.value.SetString("******")
+		case f.secret == "url":
+			if u, err := url.Parse(s); err == nil {
+				f.value.SetString(u.Redacted())
+			} else {
+				f.value.SetString("******")
+			}
+		}
+	}
+	out, err := yaml.Marshal(&redacted)
+	if err != nil {
+		return err.Error()
+	}
+	return string(out)
+}
@@ -0,0 +1,138 @@
+// Package egress guards the requests the server makes to URLs users supply,
+// those of webhooks and bot webhooks, against server-side request forgery:
+// they may not reach loopback, private, link-local or other internal
+// addresses, where they could hit the server's own admin routes, other
+// services on its network or a cloud metadata endpoint. Networks that should
+// be reachable anyway, e.g. receivers on a private network, are allowed by
+// the Policy the requests are checked with.
+package egress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+
+	"learning-telegram/internal/realip"
+)
+
+var (
+	ErrInvalidURL = errors.New("egress: URL must be an http or https URL with a host")
+	// ErrForbiddenAddress is returned for URLs, and dials, that would reach
+	// an internal address.
+	ErrForbiddenAddress = errors.New("egress: address not allowed")
+)
+
+// internal are the networks requests may not reach besides the loopback,
+// private, link-local, multicast and unspecified addresses netip knows.
+var internal = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),     // "this network"
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),  // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),   // reserved, and broadcast
+}
+
+// lookupTimeout bounds the DNS lookup of CheckURL.
+const lookupTimeout = 5 * time.Second
+
+// Policy decides which addresses requests may reach: public ones, and the
+// internal networks it allows. The zero Policy allows no internal network.
+type Policy struct {
+	allowed []netip.Prefix
+}
+
+// New returns a Policy that allows requests to the given internal networks,
+// as CIDRs or single addresses, besides public addresses.
+func New(allowedNetworks []string) (Policy, error) {
+	prefixes, err := realip.Parse(allowedNetworks)
+	if err != nil {
+		return Policy{}, err
+	}
+	return Policy{allowed: prefixes}, nil
+}
+
+// Allowed reports whether requests may be sent to addr.
+func (pol Policy) Allowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range pol.allowed {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() || addr.IsMulticast() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, p := range internal {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckURL checks a URL a user wants the server to send requests to: it must
+// be http or https, and every address its host resolves to must be allowed.
+// The check at registration gives the user a clear error; since DNS can
+// change afterwards, Transport checks every connection again.
+func (pol Policy) CheckURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return ErrInvalidURL
+	}
+	host := u.Hostname()
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if !pol.Allowed(addr) {
+			return fmt.Errorf("%w: %s", ErrForbiddenAddress, host)
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("egress: resolving %s: %w", host, err)
+	}
+	for _, addr := range addrs {
+		if !pol.Allowed(addr) {
+			return fmt.Errorf("%w: %s resolves to %s", ErrForbiddenAddress, host, addr.Unmap())
+		}
+	}
+	return nil
+}
+
+// Transport returns an http.Transport that refuses to connect to addresses
+// that aren't allowed. It checks the address actually dialed, after DNS
+// resolution, so a host that resolved to a public address in CheckURL
+// can't be pointed at an internal one later. Proxies from the environment
+// are ignored, as they would connect on the transport's behalf.
+func (pol Policy) Transport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   pol.control,
+	}
+	t.DialContext = dialer.DialContext
+	return t
+}
+
+// control runs before every connection the dialer of Transport makes.
+func (pol Policy) control(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, address)
+	}
+	if !pol.Allowed(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, addrPort.Addr().Unmap())
+	}
+	return nil
+}
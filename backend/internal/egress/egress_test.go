@@ -0,0 +1,86 @@
+package egress
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestAllowed(t *testing.T) {
+	var pol Policy
+	for addr, want := range map[string]bool{
+		"8.8.8.8":            true,
+		"2001:4860::8888":    true,
+		"127.0.0.1":          false,
+		"::1":                false,
+		"::ffff:127.0.0.1":   false,
+		"10.1.2.3":           false,
+		"172.16.0.1":         false,
+		"192.168.1.1":        false,
+		"169.254.169.254":    false, // cloud metadata
+		"fe80::1":            false,
+		"fd00::1":            false,
+		"100.64.0.1":         false,
+		"0.0.0.0":            false,
+		"255.255.255.255":    false,
+		"224.0.0.1":          false,
+		"::":                 false,
+		"::ffff:169.254.1.1": false,
+	} {
+		if got := pol.Allowed(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("Allowed(%s) = %v, want %v", addr, got, want)
+		}
+	}
+
+	pol, err := New([]string{"10.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]bool{"10.1.2.3": true, "::1": true, "127.0.0.1": false, "192.168.1.1": false} {
+		if got := pol.Allowed(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("with 10.0.0.0/8 and ::1 allowed: Allowed(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	for rawURL, want := range map[string]error{
+		"https://93.184.216.34/hook":       nil,
+		"http://[2001:4860::8888]:8080/":   nil,
+		"ftp://93.184.216.34/":             ErrInvalidURL,
+		"https:///hook":                    ErrInvalidURL,
+		"not a url":                        ErrInvalidURL,
+		"http://127.0.0.1:8080/api/admin":  ErrForbiddenAddress,
+		"http://[::1]/":                    ErrForbiddenAddress,
+		"http://169.254.169.254/latest/":   ErrForbiddenAddress,
+		"http://localhost:8080/":           ErrForbiddenAddress,
+		"http://[::ffff:10.0.0.1]:80/hook": ErrForbiddenAddress,
+	} {
+		if err := (Policy{}).CheckURL(rawURL); !errors.Is(err, want) {
+			t.Errorf("CheckURL(%q) = %v, want %v", rawURL, err, want)
+		}
+	}
+}
+
+func TestTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	client := &http.Client{Transport: Policy{}.Transport()}
+
+	if _, err := client.Get(srv.URL); !errors.Is(err, ErrForbiddenAddress) {
+		t.Errorf("request to loopback: %v, want ErrForbiddenAddress", err)
+	}
+
+	pol, err := New([]string{"127.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = &http.Client{Transport: pol.Transport()}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("request to allowed loopback: %v", err)
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,97 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string // plain text
+}
+
+// Mailer delivers outgoing mail. Handlers only depend on this interface so
+// that tests and local development don't need a real mail server.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// SMTPMailer sends mail through an SMTP relay. STARTTLS is used when the
+// server offers it; authentication is skipped when Username is empty.
+type SMTPMailer struct {
+	Addr     string // host:port
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		host := m.Addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(m.Addr, auth, m.From, []string{msg.To}, format(m.From, msg))
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// LogMailer writes mail to the log instead of sending it. If Dir is set,
+// every message is also saved there as an .eml file.
+type LogMailer struct {
+	Dir  string
+	From string
+}
+
+func (m *LogMailer) Send(ctx context.Context, msg Message) error {
+	log.Printf("[mail] to=%s subject=%q\n%s", msg.To, msg.Subject, msg.Body)
+	if m.Dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102-150405.000000000"), sanitize(msg.To))
+	return os.WriteFile(filepath.Join(m.Dir, name), format(m.From, msg), 0o644)
+}
+
+func format(from string, msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '@' || r == '.' || r == '-' || r == '_' ||
+			(r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, s)
+}
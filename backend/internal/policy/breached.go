@@ -0,0 +1,118 @@
+package policy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// BreachedList is a local copy of a breached password corpus such as Have I
+// Been Pwned's Pwned Passwords. Hashes are indexed the same way as the
+// k-anonymity range API: by the first five hex digits of the SHA-1, with the
+// remaining 35 digits sorted per prefix.
+type BreachedList struct {
+	ranges map[string][]string // prefix -> sorted suffixes
+	count  int
+}
+
+// LoadBreachedList loads a breached password corpus. path is either
+//
+//   - a file with one uppercase or lowercase SHA-1 hex digest per line,
+//     optionally followed by ":count" (the pwned-passwords-sha1 format), or
+//   - a directory of range files named after their 5-digit prefix
+//     (e.g. "21BD1.txt"), each holding "SUFFIX:count" lines as returned by
+//     the range API.
+func LoadBreachedList(path string) (*BreachedList, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &BreachedList{ranges: make(map[string][]string)}
+	if info.IsDir() {
+		err = l.loadRangeDir(path)
+	} else {
+		err = l.loadFile(path, "")
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, suffixes := range l.ranges {
+		sort.Strings(suffixes)
+	}
+	return l, nil
+}
+
+func (l *BreachedList) loadRangeDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		prefix := strings.ToUpper(strings.TrimSuffix(e.Name(), filepath.Ext(e.Name())))
+		if e.IsDir() || len(prefix) != 5 || !isHex(prefix) {
+			continue
+		}
+		if err := l.loadFile(filepath.Join(dir, e.Name()), prefix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadFile reads hash lines; with a non-empty prefix the lines only contain
+// the 35-digit suffix.
+func (l *BreachedList) loadFile(path, prefix string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	lineNo := 0
+	for sc.Scan() {
+		lineNo++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			line = line[:i]
+		}
+		hash := strings.ToUpper(prefix + line)
+		if len(hash) != 40 || !isHex(hash) {
+			return fmt.Errorf("%s:%d: not a SHA-1 hex digest", path, lineNo)
+		}
+		l.ranges[hash[:5]] = append(l.ranges[hash[:5]], hash[5:])
+		l.count++
+	}
+	return sc.Err()
+}
+
+// Len returns the number of hashes in the list.
+func (l *BreachedList) Len() int {
+	return l.count
+}
+
+// Contains reports whether password appears in the list.
+func (l *BreachedList) Contains(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	suffixes := l.ranges[hash[:5]]
+	i := sort.SearchStrings(suffixes, hash[5:])
+	return i < len(suffixes) && suffixes[i] == hash[5:]
+}
+
+func isHex(s string) bool {
+	for _, r := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+			return false
+		}
+	}
+	return true
+}
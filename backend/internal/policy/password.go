@@ -0,0 +1,332 @@
+package policy
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PasswordPolicy is the set of rules new passwords have to satisfy.
+type PasswordPolicy struct {
+	// MinLength is the minimum number of characters.
+	MinLength int
+	// MinScore is the minimum strength score from EstimateStrength, 0-4.
+	MinScore int
+	// Breached, if set, rejects passwords that appear in a breach corpus.
+	Breached *BreachedList
+}
+
+// passwordMaxBytes is the longest password bcrypt can hash; it refuses
+// longer input instead of silently truncating it.
+const passwordMaxBytes = 72
+
+// DefaultPasswordPolicy is used when nothing else is configured.
+var DefaultPasswordPolicy = &PasswordPolicy{MinLength: 8, MinScore: 2}
+
+// Violation is a single failed password rule. Rule is a stable,
+// machine-readable identifier; Message is shown to the user.
+type Violation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PasswordError lists every rule a password failed.
+type PasswordError struct {
+	Violations []Violation
+}
+
+func (e *PasswordError) Error() string {
+	msgs := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		msgs[i] = v.Message
+	}
+	return strings.Join(msgs, "；")
+}
+
+// Check validates password against the policy. userInputs are strings the
+// password must not be based on, typically the username and email.
+func (p *PasswordPolicy) Check(password string, userInputs ...string) error {
+	var violations []Violation
+	if n := utf8.RuneCountInString(password); n < p.MinLength {
+		violations = append(violations, Violation{
+			Rule:    "min_length",
+			Message: fmt.Sprintf("密码至少需要%d个字符", p.MinLength),
+		})
+	}
+	if len(password) > passwordMaxBytes {
+		violations = append(violations, Violation{
+			Rule:    "max_length",
+			Message: fmt.Sprintf("密码不能超过%d字节", passwordMaxBytes),
+		})
+	}
+	if strings.TrimSpace(password) == "" {
+		violations = append(violations, Violation{Rule: "blank", Message: "密码不能为空白"})
+	}
+
+	if score, _ := EstimateStrength(password, userInputs...); score < p.MinScore {
+		violations = append(violations, Violation{
+			Rule:    "strength",
+			Message: "密码太容易被猜到，请避免常见单词、键盘序列、重复字符和个人信息",
+		})
+	}
+
+	if p.Breached != nil && p.Breached.Contains(password) {
+		violations = append(violations, Violation{
+			Rule:    "breached",
+			Message: "该密码出现在已泄露的密码库中，请换一个密码",
+		})
+	}
+
+	if len(violations) > 0 {
+		return &PasswordError{Violations: violations}
+	}
+	return nil
+}
+
+// EstimateStrength estimates how many guesses an attacker needs for password
+// and maps that to a 0-4 score, in the spirit of zxcvbn: the password is
+// split greedily into the cheapest known patterns (common passwords and
+// words, the user's own inputs, keyboard walks, alphabetic or numeric
+// sequences, repeated characters), and only what is left is priced as brute
+// force.
+func EstimateStrength(password string, userInputs ...string) (score int, log10Guesses float64) {
+	runes := []rune(password)
+	if len(runes) == 0 {
+		return 0, 0
+	}
+	folded := foldRunes(runes)
+	pool := charsetPool(runes)
+
+	dictionary := make(map[string]int, len(commonPasswords)+len(userInputs))
+	for i, w := range commonPasswords {
+		dictionary[w] = i + 1
+	}
+	for _, in := range userInputs {
+		in = unleet(strings.TrimSpace(in))
+		if utf8.RuneCountInString(in) >= 3 {
+			// Personal information is as good as the top of the list.
+			dictionary[in] = 1
+		}
+		// Also catch the local part of an email address.
+		if at := strings.IndexByte(in, '@'); at >= 3 {
+			dictionary[in[:at]] = 1
+		}
+	}
+
+	var bits float64
+	segments := 0
+	for i := 0; i < len(runes); {
+		n, cost := matchAt(runes, folded, i, dictionary, pool)
+		bits += cost
+		segments++
+		i += n
+	}
+	// An attacker also has to guess how the patterns are combined.
+	bits += log2(float64(segments))
+
+	log10Guesses = bits * 0.30103
+	switch {
+	case log10Guesses < 3:
+		score = 0
+	case log10Guesses < 6:
+		score = 1
+	case log10Guesses < 8:
+		score = 2
+	case log10Guesses < 10:
+		score = 3
+	default:
+		score = 4
+	}
+	return score, log10Guesses
+}
+
+// matchAt finds the cheapest pattern starting at position i and returns its
+// length in runes and its cost in bits.
+func matchAt(runes, folded []rune, i int, dictionary map[string]int, pool int) (int, float64) {
+	// Brute force a single character from its own character class.
+	bestLen, bestCost := 1, log2(float64(charsetPool(runes[i:i+1])))
+
+	consider := func(n int, cost float64) {
+		// Prefer the pattern that covers the most characters per bit.
+		if n > 1 && cost/float64(n) < bestCost/float64(bestLen) {
+			bestLen, bestCost = n, cost
+		}
+	}
+
+	// Dictionary words, longest first.
+	for j := len(folded); j >= i+3; j-- {
+		if rank, ok := dictionary[string(folded[i:j])]; ok {
+			cost := log2(float64(rank)) + 1
+			if string(runes[i:j]) != string(folded[i:j]) {
+				cost++ // capitalization or l33t substitution
+			}
+			consider(j-i, cost)
+			break
+		}
+	}
+
+	// Years, e.g. "1998" or "2024".
+	if i+4 <= len(runes) && isYear(string(runes[i:i+4])) {
+		consider(4, log2(yearSpan))
+	}
+
+	// Repeated character, e.g. "aaaa".
+	j := i + 1
+	for j < len(runes) && runes[j] == runes[i] {
+		j++
+	}
+	if j-i >= 3 {
+		consider(j-i, log2(float64(pool))+log2(float64(j-i)))
+	}
+
+	// Sequences, e.g. "abcd", "4321", and keyboard walks, e.g. "qwerty".
+	if n := sequenceLength(folded, i); n >= 3 {
+		consider(n, log2(26)+log2(float64(n)))
+	}
+	if n := keyboardLength(folded, i); n >= 3 {
+		consider(n, log2(float64(len(keyboardRows)*10))+log2(float64(n)))
+	}
+
+	return bestLen, bestCost
+}
+
+// yearSpan is the number of years an attacker would try.
+const yearSpan = 140
+
+func isYear(s string) bool {
+	var y int
+	if _, err := fmt.Sscanf(s, "%4d", &y); err != nil || len(s) != 4 {
+		return false
+	}
+	return y >= 1900 && y < 1900+yearSpan
+}
+
+func sequenceLength(s []rune, i int) int {
+	if i+1 >= len(s) {
+		return 1
+	}
+	delta := s[i+1] - s[i]
+	if delta != 1 && delta != -1 {
+		return 1
+	}
+	j := i + 1
+	for j < len(s) && s[j]-s[j-1] == delta && isSeqChar(s[j]) && isSeqChar(s[j-1]) {
+		j++
+	}
+	return j - i
+}
+
+func isSeqChar(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9')
+}
+
+var keyboardRows = []string{
+	"`1234567890-=",
+	"qwertyuiop[]\\",
+	"asdfghjkl;'",
+	"zxcvbnm,./",
+}
+
+func keyboardLength(s []rune, i int) int {
+	best := 1
+	for _, row := range keyboardRows {
+		for _, dir := range []string{row, reverse(row)} {
+			start := strings.IndexRune(dir, s[i])
+			if start < 0 {
+				continue
+			}
+			n := 1
+			for i+n < len(s) && start+n < len(dir) && rune(dir[start+n]) == s[i+n] {
+				n++
+			}
+			if n > best {
+				best = n
+			}
+		}
+	}
+	return best
+}
+
+func charsetPool(runes []rune) int {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range runes {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < utf8.RuneSelf && unicode.IsPrint(r):
+			symbol = true
+		default:
+			other = true
+		}
+	}
+	pool := 0
+	if lower {
+		pool += 26
+	}
+	if upper {
+		pool += 26
+	}
+	if digit {
+		pool += 10
+	}
+	if symbol {
+		pool += 33
+	}
+	if other {
+		pool += 100
+	}
+	return pool
+}
+
+var leet = map[rune]rune{
+	'@': 'a', '4': 'a', '3': 'e', '1': 'i', '!': 'i', '0': 'o', '$': 's', '5': 's', '7': 't', '+': 't',
+}
+
+// unleet lowercases s and undoes common character substitutions
+// ("P@ssw0rd" -> "password").
+func unleet(s string) string {
+	return string(foldRunes([]rune(s)))
+}
+
+// foldRunes lowercases and un-leets rune by rune, so indexes into the result
+// line up with the input. Digits-only input is left alone so that numeric
+// sequences stay intact.
+func foldRunes(runes []rune) []rune {
+	digitsOnly := true
+	for _, r := range runes {
+		if r < '0' || r > '9' {
+			digitsOnly = false
+			break
+		}
+	}
+	out := make([]rune, len(runes))
+	for i, r := range runes {
+		r = unicode.ToLower(r)
+		if l, ok := leet[r]; ok && !digitsOnly {
+			r = l
+		}
+		out[i] = r
+	}
+	return out
+}
+
+func log2(x float64) float64 {
+	if x <= 1 {
+		return 0
+	}
+	return math.Log2(x)
+}
+
+func reverse(s string) string {
+	r := []rune(s)
+	for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+		r[i], r[j] = r[j], r[i]
+	}
+	return string(r)
+}
@@ -0,0 +1,121 @@
+// Package policy holds the rules user supplied credentials have to satisfy.
+package policy
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	UsernameMinLength = 3
+	UsernameMaxLength = 32
+)
+
+// reservedUsernames can't be registered because they could be mistaken for
+// the service itself. They are compared after NormalizeUsername.
+var reservedUsernames = map[string]bool{
+	"admin":         true,
+	"administrator": true,
+	"root":          true,
+	"system":        true,
+	"support":       true,
+	"help":          true,
+	"security":      true,
+	"official":      true,
+	"telegram":      true,
+	"moderator":     true,
+	"api":           true,
+	"me":            true,
+	"null":          true,
+	"undefined":     true,
+}
+
+// UsernameError explains why a username was rejected. Rule is a stable,
+// machine-readable identifier; Message is shown to the user.
+type UsernameError struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+func (e *UsernameError) Error() string {
+	return e.Message
+}
+
+var folder = cases.Fold()
+
+// NormalizeUsername returns the canonical form of a username used for
+// uniqueness and lookups: NFKC normalized and case folded, so that "Alice",
+// "alice" and "ａｌｉｃｅ" (fullwidth) all refer to the same account.
+func NormalizeUsername(username string) string {
+	return folder.String(norm.NFKC.String(strings.TrimSpace(username)))
+}
+
+// CleanUsername returns the display form a new username is stored in: trimmed
+// and NFKC normalized, but with its case preserved.
+func CleanUsername(username string) string {
+	return norm.NFKC.String(strings.TrimSpace(username))
+}
+
+// ValidateUsername checks a username chosen at registration. Usernames are
+// restricted to ASCII letters, digits and underscores after NFKC
+// normalization, which rules out whitespace, emoji, control characters and
+// look-alike letters from other scripts.
+func ValidateUsername(username string) error {
+	u := norm.NFKC.String(username)
+	n := utf8.RuneCountInString(u)
+	switch {
+	case n < UsernameMinLength:
+		return &UsernameError{Rule: "min_length", Message: "用户名至少需要3个字符"}
+	case n > UsernameMaxLength:
+		return &UsernameError{Rule: "max_length", Message: "用户名不能超过32个字符"}
+	}
+
+	for _, r := range u {
+		if !isUsernameChar(r) {
+			return &UsernameError{Rule: "charset", Message: "用户名只能包含英文字母、数字和下划线"}
+		}
+	}
+	if !isLetter(rune(u[0])) {
+		return &UsernameError{Rule: "leading_char", Message: "用户名必须以英文字母开头"}
+	}
+	if strings.HasSuffix(u, "_") || strings.Contains(u, "__") {
+		return &UsernameError{Rule: "underscores", Message: "用户名不能以下划线结尾或包含连续下划线"}
+	}
+	if reservedUsernames[NormalizeUsername(u)] {
+		return &UsernameError{Rule: "reserved", Message: "该用户名为系统保留名称"}
+	}
+	return nil
+}
+
+// ValidateBotUsername checks the username of a new bot. On top of the rules
+// for people it has to end in "bot", as on Telegram, so bots are
+// recognizable by name.
+func ValidateBotUsername(username string) error {
+	if err := ValidateUsername(username); err != nil {
+		return err
+	}
+	if !strings.HasSuffix(NormalizeUsername(username), "bot") {
+		return &UsernameError{Rule: "bot_suffix", Message: "机器人用户名必须以bot结尾"}
+	}
+	return nil
+}
+
+// IsPlausibleUsername reports whether s could name an existing account. It is
+// used to reject garbage in lookup fields (e.g. a WebSocket "to") before
+// touching the database; it is looser than ValidateUsername because accounts
+// created before the policy existed may not satisfy it.
+func IsPlausibleUsername(s string) bool {
+	s = strings.TrimSpace(s)
+	return s != "" && len(s) <= 4*UsernameMaxLength && utf8.ValidString(s)
+}
+
+func isLetter(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+}
+
+func isUsernameChar(r rune) bool {
+	return isLetter(r) || (r >= '0' && r <= '9') || r == '_'
+}
@@ -0,0 +1,29 @@
+package policy
+
+// commonPasswords are frequently used passwords and password fragments,
+// roughly ordered by popularity. A match costs log2(rank) bits, so entries
+// near the top are worth almost nothing. Entries are lowercase and un-leeted
+// (see unleet).
+var commonPasswords = []string{
+	"123456", "password", "123456789", "12345678", "12345", "qwerty", "111111",
+	"1234567", "123123", "000000", "1234567890", "abc123", "password1", "iloveyou",
+	"woaini", "5201314", "520520", "1314520", "dragon", "monkey", "letmein",
+	"qwertyuiop", "admin", "welcome", "login", "princess", "sunshine", "master",
+	"shadow", "football", "baseball", "superman", "batman", "trustno1", "michael",
+	"jennifer", "hunter", "starwars", "whatever", "freedom", "passw0rd", "charlie",
+	"donald", "secret", "hello", "ninja", "mustang", "access", "flower", "lovely",
+	"babygirl", "jordan", "liverpool", "chelsea", "arsenal", "pokemon", "killer",
+	"summer", "winter", "spring", "autumn", "soccer", "hockey", "tigger", "ginger",
+	"cookie", "cheese", "pepper", "orange", "banana", "computer", "internet",
+	"google", "telegram", "wechat", "qqqqqq", "zxcvbnm", "asdfghjkl", "qazwsx",
+	"1qaz2wsx", "zaq12wsx", "aini", "wangyi", "zhang", "wang", "liu", "chen",
+	"yang", "huang", "zhao", "zhou", "xiaoming", "beijing", "shanghai", "china",
+	"love", "angel", "happy", "lucky", "money", "family", "forever", "friend",
+	"matrix", "thomas", "robert", "daniel", "andrew", "joshua", "jessica",
+	"ashley", "amanda", "nicole", "michelle", "buster", "maggie", "bailey",
+	"harley", "ranger", "thunder", "silver", "golden", "diamond", "purple",
+	"yellow", "mother", "father", "sister", "brother", "test", "guest", "root",
+	"user", "default", "changeme", "qwer", "asdf", "zxcv", "abcd", "pass",
+	"word", "letme", "iloveu", "loveyou", "hello123", "welcome1", "admin123",
+	"root123", "test123", "qwe123", "a123456", "aa123456", "abc12345",
+}
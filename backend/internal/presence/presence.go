@@ -0,0 +1,166 @@
+// Package presence decides who may see whether a user is online and when
+// they were last seen, and publishes changes of a user's state to them.
+package presence
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"learning-telegram/internal/store"
+	"learning-telegram/internal/websocket"
+)
+
+// Visibility settings: who may see a user's exact state. Everyone else only
+// sees an approximation, as on Telegram.
+const (
+	Everyone = "everyone"
+	Contacts = "contacts" // users the user sent a private message to
+	Nobody   = "nobody"
+)
+
+// IsVisibility reports whether v is a visibility setting.
+func IsVisibility(v string) bool {
+	return v == Everyone || v == Contacts || v == Nobody
+}
+
+// Statuses. Viewers allowed to see the exact state get online or offline
+// with the last seen time; others get one of the approximations.
+const (
+	StatusOnline      = "online"
+	StatusOffline     = "offline"
+	StatusRecently    = "recently" // online now or within 3 days
+	StatusWithinWeek  = "within_week"
+	StatusWithinMonth = "within_month"
+	StatusLongAgo     = "long_ago"
+)
+
+type Presence struct {
+	Username   string     `json:"username"`
+	Online     bool       `json:"online"` // false if hidden from the viewer
+	Status     string     `json:"status"`
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty"`
+}
+
+// Get returns a user's presence as seen by viewer, reading the stored part
+// from repo and whether the user is online from hub.
+func Get(repo store.PresenceRepo, hub *websocket.Hub, viewer, username string) (*Presence, error) {
+	info, err := repo.GetPresenceInfo(username)
+	if err != nil {
+		return nil, err
+	}
+	online := hub.IsUserOnline(username)
+
+	exact, err := canSeeExact(repo, viewer, username, info.Visibility)
+	if err != nil {
+		return nil, err
+	}
+	if !exact {
+		return &Presence{Username: username, Status: approximate(online, info.LastSeenAt, time.Now())}, nil
+	}
+	p := &Presence{Username: username, Online: online, Status: StatusOffline}
+	if online {
+		p.Status = StatusOnline
+	}
+	if info.LastSeenAt.Valid {
+		p.LastSeenAt = &info.LastSeenAt.Time
+	}
+	return p, nil
+}
+
+func canSeeExact(repo store.PresenceRepo, viewer, username, visibility string) (bool, error) {
+	if viewer == username {
+		return true, nil
+	}
+	switch visibility {
+	case Everyone:
+		return true, nil
+	case Contacts:
+		return repo.IsContact(username, viewer)
+	}
+	return false, nil
+}
+
+// approximate hides the exact last seen time behind a coarse bucket, so that
+// a hidden user's activity can't be tracked by polling.
+func approximate(online bool, lastSeen sql.NullTime, now time.Time) string {
+	if online {
+		return StatusRecently
+	}
+	if !lastSeen.Valid {
+		return StatusLongAgo
+	}
+	switch since := now.Sub(lastSeen.Time); {
+	case since <= 3*24*time.Hour:
+		return StatusRecently
+	case since <= 7*24*time.Hour:
+		return StatusWithinWeek
+	case since <= 30*24*time.Hour:
+		return StatusWithinMonth
+	}
+	return StatusLongAgo
+}
+
+// Start records the last seen time of users in repo and publishes their
+// state through hub when they come online or go offline there. It must be
+// called once per hub.
+func Start(repo store.PresenceRepo, hub *websocket.Hub) {
+	hub.OnPresence(func(username string, online bool) {
+		publish(repo, hub, username, online)
+	})
+}
+
+// publish pushes a user's new state to the users subscribed to it: their
+// contacts and, unless the state is only visible to contacts, the members of
+// their groups. Nothing is pushed to users who may only see an
+// approximation, as the timing of the push would give the state away.
+func publish(repo store.PresenceRepo, hub *websocket.Hub, username string, online bool) {
+	now := time.Now()
+	if err := repo.SetLastSeen(username, now); err != nil {
+		log.Printf("记录 %s 最后在线时间失败: %v", username, err)
+	}
+	info, err := repo.GetPresenceInfo(username)
+	if err != nil {
+		log.Printf("读取 %s 在线状态设置失败: %v", username, err)
+		return
+	}
+
+	var audience []string
+	switch info.Visibility {
+	case Everyone:
+		peers, err := repo.GetGroupPeers(username)
+		if err != nil {
+			log.Printf("读取 %s 的群组成员失败: %v", username, err)
+			return
+		}
+		audience = peers
+		fallthrough
+	case Contacts:
+		contacts, err := repo.GetContacts(username)
+		if err != nil {
+			log.Printf("读取 %s 的联系人失败: %v", username, err)
+			return
+		}
+		audience = append(audience, contacts...)
+	default:
+		return
+	}
+
+	status := StatusOffline
+	if online {
+		status = StatusOnline
+	}
+	push := websocket.Frame{Type: "user_status", Payload: websocket.UserStatusPayload{
+		Username:   username,
+		Online:     online,
+		Status:     status,
+		LastSeenAt: store.FormatTime(now),
+	}}
+	sent := make(map[string]bool, len(audience))
+	for _, u := range audience {
+		if !sent[u] {
+			sent[u] = true
+			hub.SendToUser(u, push)
+		}
+	}
+}
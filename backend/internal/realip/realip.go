@@ -0,0 +1,77 @@
+// Package realip finds the address of the client that made a request. The
+// backend is deployed behind nginx, which passes the client's address in the
+// X-Real-IP header; the header is only honored on requests from such trusted
+// proxies, since anyone else could set it to whatever they like.
+package realip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// DefaultTrustedProxies trusts only proxies on the same host, like nginx in
+// local development.
+var DefaultTrustedProxies = []string{"127.0.0.1/32", "::1/128"}
+
+// Resolver finds client addresses, honoring the X-Real-IP header of its
+// trusted proxies. The zero Resolver trusts none.
+type Resolver struct {
+	trusted []netip.Prefix
+}
+
+// New returns a Resolver that trusts proxies, given as CIDRs or single
+// addresses.
+func New(proxies []string) (Resolver, error) {
+	prefixes, err := Parse(proxies)
+	if err != nil {
+		return Resolver{}, err
+	}
+	return Resolver{trusted: prefixes}, nil
+}
+
+// Parse parses a list of CIDRs, like 10.0.0.0/8, or single addresses.
+func Parse(proxies []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, s := range proxies {
+		if addr, err := netip.ParseAddr(s); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q is neither an IP address nor a CIDR like 10.0.0.0/8", s)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// ClientIP returns the address of the client that made the request: the
+// X-Real-IP header if the request comes from a trusted proxy, otherwise the
+// address of the peer.
+func (res Resolver) ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil || !res.isTrusted(peer.Unmap()) {
+		return host
+	}
+	if ip, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return ip.Unmap().String()
+	}
+	return host
+}
+
+func (res Resolver) isTrusted(addr netip.Addr) bool {
+	for _, p := range res.trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package realip
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	res, err := New([]string{"10.0.0.0/8", "172.28.0.10", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remote, header, want string
+	}{
+		{"10.1.2.3:4567", "203.0.113.7", "203.0.113.7"},        // trusted proxy
+		{"172.28.0.10:4567", "203.0.113.7", "203.0.113.7"},     // trusted single address
+		{"[::1]:4567", "2001:db8::1", "2001:db8::1"},           // IPv6 proxy
+		{"[::ffff:10.0.0.1]:80", "203.0.113.7", "203.0.113.7"}, // IPv4-mapped proxy
+		{"172.28.0.11:4567", "203.0.113.7", "172.28.0.11"},     // untrusted peer
+		{"198.51.100.1:4567", "127.0.0.1", "198.51.100.1"},     // spoofing attempt
+		{"198.51.100.1:4567", "", "198.51.100.1"},
+		{"10.1.2.3:4567", "", "10.1.2.3"}, // proxy without header
+		{"10.1.2.3:4567", "not an ip", "10.1.2.3"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remote
+		if tt.header != "" {
+			r.Header.Set("X-Real-IP", tt.header)
+		}
+		if got := res.ClientIP(r); got != tt.want {
+			t.Errorf("ClientIP(%s, X-Real-IP %q) = %s, want %s", tt.remote, tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestNoTrustedProxies(t *testing.T) {
+	empty, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "127.0.0.1:4567"
+	r.Header.Set("X-Real-IP", "203.0.113.7")
+	for name, res := range map[string]Resolver{"empty list": empty, "zero Resolver": {}} {
+		if got := res.ClientIP(r); got != "127.0.0.1" {
+			t.Errorf("%s: ClientIP = %s, want the peer's address", name, got)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, bad := range []string{"", "10.0.0.0/33", "example.com", "10.0.0.1:80"} {
+		if _, err := Parse([]string{bad}); err == nil {
+			t.Errorf("Parse(%q) succeeded", bad)
+		}
+	}
+}
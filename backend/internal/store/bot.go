@@ -0,0 +1,235 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+
+	"learning-telegram/internal/policy"
+)
+
+// ErrBotNotFound is returned when a bot does not exist or, for owner
+// operations, belongs to someone else.
+var ErrBotNotFound = newError(ErrNotFound, "bot not found")
+
+// botUpdateRetention is how long undelivered updates are kept, as in
+// Telegram's Bot API.
+const botUpdateRetention = 24 * time.Hour
+
+type Bot struct {
+	ID            int64     `json:"id"` // 即机器人在users表中的ID
+	Username      string    `json:"username"`
+	Owner         string    `json:"owner"`
+	TokenHash     string    `json:"-"`
+	WebhookURL    string    `json:"webhook_url"`
+	WebhookSecret string    `json:"-"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// BotUpdate is a pending update for a bot; Payload is the JSON encoded
+// update without its update_id, which is the row ID.
+type BotUpdate struct {
+	ID      int64
+	Payload []byte
+}
+
+// CreateBot creates a bot account owned by the given user. Bots are rows in
+// the users table without a password, so they can't log in, but can be
+// addressed and invited to groups like any other user.
+func (st *SQLStore) CreateBot(owner, username, tokenHash string) (int64, error) {
+	normalized := policy.NormalizeUsername(username)
+
+	tx, err := st.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var ownerID int64
+	err = tx.QueryRow("SELECT id FROM users WHERE username = ? AND NOT is_bot", owner).Scan(&ownerID)
+	if err != nil {
+		return 0, err
+	}
+
+	var exists int
+	err = tx.QueryRow("SELECT COUNT(*) FROM users WHERE username_norm = ?", normalized).Scan(&exists)
+	if err != nil {
+		return 0, err
+	}
+	if exists > 0 {
+		return 0, ErrUsernameTaken
+	}
+
+	now := time.Now()
+	var botID int64
+	err = tx.QueryRow(
+		"INSERT INTO users (username, username_norm, password_hash, is_bot, created_at) VALUES (?, ?, '', TRUE, ?) RETURNING id",
+		username, normalized, now,
+	).Scan(&botID)
+	if err != nil {
+		if isUniqueViolation(err, "") {
+			return 0, ErrUsernameTaken
+		}
+		return 0, err
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO bots (user_id, owner_id, token_hash, created_at) VALUES (?, ?, ?, ?)",
+		botID, ownerID, tokenHash, now,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return botID, tx.Commit()
+}
+
+const botColumns = `b.user_id, u.username, o.username, b.token_hash, b.webhook_url, b.webhook_secret, b.created_at
+	FROM bots b
+	JOIN users u ON b.user_id = u.id
+	JOIN users o ON b.owner_id = o.id`
+
+func scanBot(row interface{ Scan(...any) error }) (*Bot, error) {
+	var b Bot
+	err := row.Scan(&b.ID, &b.Username, &b.Owner, &b.TokenHash, &b.WebhookURL, &b.WebhookSecret, &b.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// GetBot returns the bot with the given user ID.
+func (st *SQLStore) GetBot(id int64) (*Bot, error) {
+	b, err := scanBot(st.db.QueryRow("SELECT "+botColumns+" WHERE b.user_id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, ErrBotNotFound
+	}
+	return b, err
+}
+
+// GetAllBots returns every bot, for registering them with the hub at startup.
+func (st *SQLStore) GetAllBots() ([]Bot, error) {
+	return st.queryBots("SELECT " + botColumns + " ORDER BY b.user_id")
+}
+
+// GetBotsByOwner returns the bots created by the given user.
+func (st *SQLStore) GetBotsByOwner(owner string) ([]Bot, error) {
+	return st.queryBots("SELECT "+botColumns+" WHERE o.username = ? ORDER BY b.user_id", owner)
+}
+
+func (st *SQLStore) queryBots(query string, args ...any) ([]Bot, error) {
+	rows, err := st.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bots []Bot
+	for rows.Next() {
+		b, err := scanBot(rows)
+		if err != nil {
+			return nil, err
+		}
+		bots = append(bots, *b)
+	}
+	return bots, rows.Err()
+}
+
+// SetBotToken replaces the token of a bot owned by the given user, revoking
+// the previous one.
+func (st *SQLStore) SetBotToken(owner string, id int64, tokenHash string) error {
+	res, err := st.db.Exec(
+		`UPDATE bots SET token_hash = ?
+		 WHERE user_id = ? AND owner_id = (SELECT id FROM users WHERE username = ?)`,
+		tokenHash, id, owner,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrBotNotFound
+	}
+	return nil
+}
+
+// SetBotWebhook sets or, with an empty url, clears the webhook of a bot.
+func (st *SQLStore) SetBotWebhook(id int64, url, secret string) error {
+	_, err := st.db.Exec("UPDATE bots SET webhook_url = ?, webhook_secret = ? WHERE user_id = ?", url, secret, id)
+	return err
+}
+
+// AddBotUpdate queues an update for a bot and returns its update ID.
+func (st *SQLStore) AddBotUpdate(botID int64, payload []byte) (int64, error) {
+	var id int64
+	err := st.db.QueryRow(
+		"INSERT INTO bot_updates (bot_id, payload, created_at) VALUES (?, ?, ?) RETURNING id",
+		botID, string(payload), time.Now(),
+	).Scan(&id)
+	return id, err
+}
+
+// GetBotUpdates returns up to limit pending updates of a bot with an ID of at
+// least offset, oldest first.
+func (st *SQLStore) GetBotUpdates(botID, offset int64, limit int) ([]BotUpdate, error) {
+	rows, err := st.db.Query(
+		"SELECT id, payload FROM bot_updates WHERE bot_id = ? AND id >= ? AND created_at > ? ORDER BY id LIMIT ?",
+		botID, offset, time.Now().Add(-botUpdateRetention), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var updates []BotUpdate
+	for rows.Next() {
+		var u BotUpdate
+		var payload string
+		if err := rows.Scan(&u.ID, &payload); err != nil {
+			return nil, err
+		}
+		u.Payload = []byte(payload)
+		updates = append(updates, u)
+	}
+	return updates, rows.Err()
+}
+
+// ConfirmBotUpdates deletes the updates of a bot with an ID below offset,
+// i.e. those the bot has acknowledged, along with expired ones.
+func (st *SQLStore) ConfirmBotUpdates(botID, offset int64) error {
+	_, err := st.db.Exec(
+		"DELETE FROM bot_updates WHERE bot_id = ? AND (id < ? OR created_at <= ?)",
+		botID, offset, time.Now().Add(-botUpdateRetention),
+	)
+	return err
+}
+
+// PruneBotUpdates deletes the updates of all bots that expired before they
+// were fetched.
+func (st *SQLStore) PruneBotUpdates() error {
+	_, err := st.db.Exec("DELETE FROM bot_updates WHERE created_at <= ?", time.Now().Add(-botUpdateRetention))
+	return err
+}
+
+// ClaimBotWebhook makes node the one that posts a bot's updates to its
+// webhook for the next lease, unless another node holds an unexpired lease.
+// The holder calls it again before the lease runs out to keep it. It reports
+// whether node holds the lease.
+func (st *SQLStore) ClaimBotWebhook(botID int64, node string, lease time.Duration) (bool, error) {
+	now := time.Now()
+	res, err := st.db.Exec(
+		`INSERT INTO bot_webhook_leases (bot_id, node, expires_at) VALUES (?, ?, ?)
+		 ON CONFLICT (bot_id) DO UPDATE SET node = excluded.node, expires_at = excluded.expires_at
+		 WHERE bot_webhook_leases.node = excluded.node OR bot_webhook_leases.expires_at < ?`,
+		botID, node, now.Add(lease), now,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ReleaseBotWebhook gives up node's lease on a bot's webhook, if it holds it,
+// so that another node can take over right away.
+func (st *SQLStore) ReleaseBotWebhook(botID int64, node string) error {
+	_, err := st.db.Exec("DELETE FROM bot_webhook_leases WHERE bot_id = ? AND node = ?", botID, node)
+	return err
+}
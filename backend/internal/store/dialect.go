@@ -0,0 +1,116 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Dialect is the kind of database a Conn talks to. Queries are written once,
+// with ? placeholders and in SQL both databases understand; where they
+// differ, the code asks the dialect.
+type Dialect int
+
+const (
+	DialectSQLite Dialect = iota
+	DialectPostgres
+)
+
+func (d Dialect) String() string {
+	if d == DialectPostgres {
+		return "postgres"
+	}
+	return "sqlite"
+}
+
+// Conn is a database connection pool that rewrites the placeholders of
+// queries for its dialect.
+type Conn struct {
+	*sql.DB
+	Dialect Dialect
+}
+
+func (c *Conn) Exec(query string, args ...any) (sql.Result, error) {
+	return c.DB.Exec(c.Dialect.rebind(query), args...)
+}
+
+func (c *Conn) Query(query string, args ...any) (*sql.Rows, error) {
+	return c.DB.Query(c.Dialect.rebind(query), args...)
+}
+
+func (c *Conn) QueryRow(query string, args ...any) *sql.Row {
+	return c.DB.QueryRow(c.Dialect.rebind(query), args...)
+}
+
+func (c *Conn) Begin() (*Tx, error) {
+	tx, err := c.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{Tx: tx, Dialect: c.Dialect}, nil
+}
+
+// Tx is a transaction on a Conn.
+type Tx struct {
+	*sql.Tx
+	Dialect Dialect
+}
+
+func (tx *Tx) Exec(query string, args ...any) (sql.Result, error) {
+	return tx.Tx.Exec(tx.Dialect.rebind(query), args...)
+}
+
+func (tx *Tx) Query(query string, args ...any) (*sql.Rows, error) {
+	return tx.Tx.Query(tx.Dialect.rebind(query), args...)
+}
+
+func (tx *Tx) QueryRow(query string, args ...any) *sql.Row {
+	return tx.Tx.QueryRow(tx.Dialect.rebind(query), args...)
+}
+
+// rebind replaces the ? placeholders of query with PostgreSQL's $1, $2, ...
+// Question marks inside string literals are left alone.
+func (d Dialect) rebind(query string) string {
+	if d != DialectPostgres || !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	quoted := false
+	for _, r := range query {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+		case r == '?' && !quoted:
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// isUniqueViolation reports whether err was caused by the unique index or
+// constraint named constraint, e.g. "idx_users_email", or by any unique index
+// or primary key if constraint is empty. It looks at the driver's error codes
+// only. SQLite doesn't report which index was violated, so there any
+// violation matches; its transactions are serializable, so a duplicate
+// checked for earlier in the same transaction can't cause one.
+func isUniqueViolation(err error, constraint string) bool {
+	var sqliteErr sqlite3.Error
+	var pgErr *pgconn.PgError
+	switch {
+	case errors.As(err, &sqliteErr):
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique ||
+			sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	case errors.As(err, &pgErr):
+		return pgErr.Code == "23505" && (constraint == "" || pgErr.ConstraintName == constraint)
+	}
+	return false
+}
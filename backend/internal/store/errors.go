@@ -0,0 +1,49 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// The kinds of errors the store returns for conditions callers handle, to
+// be tested with errors.Is; the API maps them to HTTP statuses. Driver
+// errors meaning one of them, like sql.ErrNoRows or a violated unique
+// constraint, are translated before they leave the package, so callers
+// never look at driver messages.
+var (
+	ErrNotFound  = errors.New("not found")
+	ErrConflict  = errors.New("conflict")
+	ErrForbidden = errors.New("forbidden")
+)
+
+var (
+	// ErrUserNotFound is returned when looking up a user that doesn't
+	// exist.
+	ErrUserNotFound = newError(ErrNotFound, "user not found")
+	// ErrGroupNotFound is returned for groups that don't exist.
+	ErrGroupNotFound = newError(ErrNotFound, "group not found")
+	// ErrNotGroupMember is the error of membership checks that failed.
+	ErrNotGroupMember = newError(ErrForbidden, "not a member of the group")
+)
+
+// kindError is an error of one of the kinds above with a message of its own.
+type kindError struct {
+	kind error
+	msg  string
+}
+
+func newError(kind error, msg string) error {
+	return &kindError{kind: kind, msg: msg}
+}
+
+func (e *kindError) Error() string { return e.msg }
+
+func (e *kindError) Unwrap() error { return e.kind }
+
+// notFound translates sql.ErrNoRows to notFoundErr.
+func notFound(err, notFoundErr error) error {
+	if err == sql.ErrNoRows {
+		return notFoundErr
+	}
+	return err
+}
@@ -1,10 +1,15 @@
 package store
 
 import (
-	"database/sql"
 	"time"
+
+	"learning-telegram/internal/policy"
 )
 
+// ErrAlreadyMember is returned when adding a user to a group they are
+// already a member of.
+var ErrAlreadyMember = newError(ErrConflict, "already a member of the group")
+
 type Group struct {
 	ID        int       `json:"id"`
 	Name      string    `json:"name"`
@@ -13,8 +18,8 @@ type Group struct {
 }
 
 // CreateGroup creates a new group and adds the creator as the first member.
-func CreateGroup(name string, creatorUsername string) (int64, error) {
-	tx, err := DB.Begin()
+func (st *SQLStore) CreateGroup(name string, creatorUsername string) (int64, error) {
+	tx, err := st.db.Begin()
 	if err != nil {
 		return 0, err
 	}
@@ -23,14 +28,11 @@ func CreateGroup(name string, creatorUsername string) (int64, error) {
 	var creatorID int
 	err = tx.QueryRow("SELECT id FROM users WHERE username = ?", creatorUsername).Scan(&creatorID)
 	if err != nil {
-		return 0, err // Creator user not found
+		return 0, notFound(err, ErrUserNotFound)
 	}
 
-	res, err := tx.Exec("INSERT INTO groups (name, creator_id) VALUES (?, ?)", name, creatorID)
-	if err != nil {
-		return 0, err
-	}
-	groupID, err := res.LastInsertId()
+	var groupID int64
+	err = tx.QueryRow("INSERT INTO groups (name, creator_id) VALUES (?, ?) RETURNING id", name, creatorID).Scan(&groupID)
 	if err != nil {
 		return 0, err
 	}
@@ -43,24 +45,43 @@ func CreateGroup(name string, creatorUsername string) (int64, error) {
 	return groupID, tx.Commit()
 }
 
-// AddGroupMember adds a user to a group.
-func AddGroupMember(groupID int64, username string) error {
-	var userID int
-	err := DB.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID)
+// AddGroupMember adds a user to a group. The username may be given in any
+// spelling that normalizes to an existing account. It returns
+// ErrGroupNotFound or ErrUserNotFound if either doesn't exist and
+// ErrAlreadyMember if the user is in the group.
+func (st *SQLStore) AddGroupMember(groupID int64, username string) error {
+	var exists bool
+	err := st.db.QueryRow("SELECT EXISTS (SELECT 1 FROM groups WHERE id = ?)", groupID).Scan(&exists)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return sql.ErrNoRows // User not found
-		}
 		return err
 	}
+	if !exists {
+		return ErrGroupNotFound
+	}
 
-	_, err = DB.Exec("INSERT INTO group_members (group_id, user_id) VALUES (?, ?)", groupID, userID)
+	var userID int
+	err = st.db.QueryRow("SELECT id FROM users WHERE username_norm = ?", policy.NormalizeUsername(username)).Scan(&userID)
+	if err != nil {
+		return notFound(err, ErrUserNotFound)
+	}
+
+	_, err = st.db.Exec("INSERT INTO group_members (group_id, user_id) VALUES (?, ?)", groupID, userID)
+	if isUniqueViolation(err, "group_members_pkey") {
+		return ErrAlreadyMember
+	}
 	return err
 }
 
+// GetGroupName returns the name of a group.
+func (st *SQLStore) GetGroupName(groupID int64) (string, error) {
+	var name string
+	err := st.db.QueryRow("SELECT name FROM groups WHERE id = ?", groupID).Scan(&name)
+	return name, notFound(err, ErrGroupNotFound)
+}
+
 // GetGroupMembers retrieves all member usernames for a given group.
-func GetGroupMembers(groupID int64) ([]string, error) {
-	rows, err := DB.Query("SELECT u.username FROM users u JOIN group_members gm ON u.id = gm.user_id WHERE gm.group_id = ?", groupID)
+func (st *SQLStore) GetGroupMembers(groupID int64) ([]string, error) {
+	rows, err := st.db.Query("SELECT u.username FROM users u JOIN group_members gm ON u.id = gm.user_id WHERE gm.group_id = ?", groupID)
 	if err != nil {
 		return nil, err
 	}
@@ -78,15 +99,15 @@ func GetGroupMembers(groupID int64) ([]string, error) {
 }
 
 // IsUserInGroup checks if a user is a member of a group.
-func IsUserInGroup(username string, groupID int64) (bool, error) {
+func (st *SQLStore) IsUserInGroup(username string, groupID int64) (bool, error) {
 	var userID int
-	err := DB.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID)
+	err := st.db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID)
 	if err != nil {
-		return false, err
+		return false, notFound(err, ErrUserNotFound)
 	}
 
 	var count int
-	err = DB.QueryRow("SELECT COUNT(*) FROM group_members WHERE group_id = ? AND user_id = ?", groupID, userID).Scan(&count)
+	err = st.db.QueryRow("SELECT COUNT(*) FROM group_members WHERE group_id = ? AND user_id = ?", groupID, userID).Scan(&count)
 	if err != nil {
 		return false, err
 	}
@@ -94,14 +115,14 @@ func IsUserInGroup(username string, groupID int64) (bool, error) {
 }
 
 // GetUserGroups retrieves all groups a user is a member of.
-func GetUserGroups(username string) ([]Group, error) {
+func (st *SQLStore) GetUserGroups(username string) ([]Group, error) {
 	var userID int
-	err := DB.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID)
+	err := st.db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID)
 	if err != nil {
-		return nil, err
+		return nil, notFound(err, ErrUserNotFound)
 	}
 
-	rows, err := DB.Query(`
+	rows, err := st.db.Query(`
 		SELECT g.id, g.name, g.creator_id, g.created_at
 		FROM groups g
 		JOIN group_members gm ON g.id = gm.group_id
@@ -0,0 +1,142 @@
+package store
+
+import "math"
+
+// Limits of HistoryQuery.Limit.
+const (
+	DefaultHistoryLimit = 50
+	MaxHistoryLimit     = 100
+)
+
+// HistoryQuery selects a page of a chat's history by message ID, which,
+// unlike an offset, stays put while new messages arrive. With BeforeID the
+// page holds the messages before that ID, with AfterID those after it and
+// with AroundID those around it, including it; with none of them, the
+// newest messages. At most one of them is set. Limit defaults to
+// DefaultHistoryLimit and is capped at MaxHistoryLimit.
+type HistoryQuery struct {
+	BeforeID int64
+	AfterID  int64
+	AroundID int64
+	Limit    int
+}
+
+// Window returns the ID the page is split at and how many messages it
+// takes from below it and from it on.
+func (q HistoryQuery) Window() (pivot int64, before, from int) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultHistoryLimit
+	}
+	limit = min(limit, MaxHistoryLimit)
+	switch {
+	case q.BeforeID != 0:
+		return q.BeforeID, limit, 0
+	case q.AfterID != 0:
+		return q.AfterID + 1, 0, limit
+	case q.AroundID != 0:
+		return q.AroundID, limit / 2, limit - limit/2
+	}
+	return math.MaxInt64, limit, 0
+}
+
+// HistoryPage is a page of a chat's history, newest first. While
+// HasMoreBefore is set there are older messages, fetched by passing BeforeID
+// as HistoryQuery.BeforeID; HasMoreAfter and AfterID are the same for newer
+// ones.
+type HistoryPage struct {
+	Messages      []Message `json:"messages"`
+	HasMoreBefore bool      `json:"has_more_before"`
+	HasMoreAfter  bool      `json:"has_more_after"`
+	BeforeID      int64     `json:"before_id,omitempty"`
+	AfterID       int64     `json:"after_id,omitempty"`
+}
+
+// NewHistoryPage builds the page of q from the messages below the pivot of
+// q.Window, newest first, and those from it on, oldest first. Each list has
+// one message more than the page takes if there are more on its side.
+func NewHistoryPage(q HistoryQuery, older, newer []Message) *HistoryPage {
+	pivot, before, from := q.Window()
+	page := &HistoryPage{
+		Messages:      make([]Message, 0, before+from),
+		HasMoreBefore: len(older) > before,
+		HasMoreAfter:  len(newer) > from,
+	}
+	newer = newer[:min(len(newer), from)]
+	for i := len(newer) - 1; i >= 0; i-- {
+		page.Messages = append(page.Messages, newer[i])
+	}
+	page.Messages = append(page.Messages, older[:min(len(older), before)]...)
+
+	if page.HasMoreBefore {
+		page.BeforeID = pivot
+		if n := len(page.Messages); n > 0 {
+			page.BeforeID = int64(page.Messages[n-1].ID)
+		}
+	}
+	if page.HasMoreAfter {
+		page.AfterID = pivot - 1
+		if len(page.Messages) > 0 {
+			page.AfterID = int64(page.Messages[0].ID)
+		}
+	}
+	return page
+}
+
+// GetPrivateHistory returns a page of the private chat between two users.
+func (st *SQLStore) GetPrivateHistory(user1, user2 string, q HistoryQuery) (*HistoryPage, error) {
+	return st.history(
+		`SELECT m.id, s.username, r.username, m.content, m.created_at
+		 FROM messages m
+		 JOIN users s ON m.sender_id = s.id
+		 JOIN users r ON m.receiver_id = r.id
+		 WHERE ((m.sender_id = (SELECT id FROM users WHERE username = ?) AND m.receiver_id = (SELECT id FROM users WHERE username = ?))
+		     OR (m.sender_id = (SELECT id FROM users WHERE username = ?) AND m.receiver_id = (SELECT id FROM users WHERE username = ?)))`,
+		[]any{user1, user2, user2, user1}, q,
+	)
+}
+
+// GetGroupHistory returns a page of a group's history. The group ID is read
+// into the Receiver of the messages.
+func (st *SQLStore) GetGroupHistory(groupID int64, q HistoryQuery) (*HistoryPage, error) {
+	return st.history(
+		`SELECT m.id, s.username, m.group_id, m.content, m.created_at
+		 FROM messages m
+		 JOIN users s ON m.sender_id = s.id
+		 WHERE m.group_id = ?`,
+		[]any{groupID}, q,
+	)
+}
+
+// history runs query, which selects the messages of a chat, on both sides of
+// the pivot of q and builds the page from them.
+func (st *SQLStore) history(query string, args []any, q HistoryQuery) (*HistoryPage, error) {
+	pivot, before, from := q.Window()
+	older, err := st.queryMessages(query+` AND m.id < ? ORDER BY m.id DESC LIMIT ?`, append(args[:len(args):len(args)], pivot, before+1)...)
+	if err != nil {
+		return nil, err
+	}
+	newer, err := st.queryMessages(query+` AND m.id >= ? ORDER BY m.id LIMIT ?`, append(args[:len(args):len(args)], pivot, from+1)...)
+	if err != nil {
+		return nil, err
+	}
+	return NewHistoryPage(q, older, newer), nil
+}
+
+func (st *SQLStore) queryMessages(query string, args ...any) ([]Message, error) {
+	rows, err := st.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []Message
+	for rows.Next() {
+		var m Message
+		if err := rows.Scan(&m.ID, &m.Sender, &m.Receiver, &m.Content, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, rows.Err()
+}
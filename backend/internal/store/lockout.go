@@ -0,0 +1,72 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+)
+
+// LoginThrottle is the failed login state of a username. It is keyed by the
+// normalized username as submitted, whether or not such a user exists, so
+// that lockouts do not reveal which accounts are real.
+type LoginThrottle struct {
+	Username     string     `json:"username"`
+	FailedCount  int        `json:"failed_count"`
+	LastFailedAt *time.Time `json:"last_failed_at,omitempty"`
+	LockedUntil  *time.Time `json:"locked_until,omitempty"`
+}
+
+// GetLoginThrottle returns the failed login state of username. A username
+// without recorded failures yields a zero LoginThrottle.
+func (st *SQLStore) GetLoginThrottle(username string) (*LoginThrottle, error) {
+	t := LoginThrottle{Username: username}
+	var lastFailedAt, lockedUntil sql.NullTime
+	err := st.db.QueryRow(
+		"SELECT failed_count, last_failed_at, locked_until FROM login_attempts WHERE username = ?", username,
+	).Scan(&t.FailedCount, &lastFailedAt, &lockedUntil)
+	if err == sql.ErrNoRows {
+		return &t, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if lastFailedAt.Valid {
+		t.LastFailedAt = &lastFailedAt.Time
+	}
+	if lockedUntil.Valid {
+		t.LockedUntil = &lockedUntil.Time
+	}
+	return &t, nil
+}
+
+// RecordLoginFailure increments the failure counter of username and returns
+// the new count. The first failure after a lockout has expired starts
+// counting afresh, so that one more wrong password doesn't lock the account
+// again right away.
+func (st *SQLStore) RecordLoginFailure(username string) (int, error) {
+	var count int
+	err := st.db.QueryRow(
+		`INSERT INTO login_attempts (username, failed_count, last_failed_at) VALUES (?, 1, ?)
+		 ON CONFLICT (username) DO UPDATE SET
+			failed_count = CASE WHEN login_attempts.locked_until <= excluded.last_failed_at THEN 1
+				ELSE login_attempts.failed_count + 1 END,
+			locked_until = CASE WHEN login_attempts.locked_until <= excluded.last_failed_at THEN NULL
+				ELSE login_attempts.locked_until END,
+			last_failed_at = excluded.last_failed_at
+		 RETURNING failed_count`,
+		username, time.Now(),
+	).Scan(&count)
+	return count, err
+}
+
+// LockAccount blocks further login attempts for username until the given time.
+func (st *SQLStore) LockAccount(username string, until time.Time) error {
+	_, err := st.db.Exec("UPDATE login_attempts SET locked_until = ? WHERE username = ?", until, username)
+	return err
+}
+
+// ResetLoginFailures forgets all failed attempts and any lockout of username.
+// It is used both after a successful login and by administrators to unlock an
+// account.
+func (st *SQLStore) ResetLoginFailures(username string) error {
+	_, err := st.db.Exec("DELETE FROM login_attempts WHERE username = ?", username)
+	return err
+}
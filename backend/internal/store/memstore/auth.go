@@ -0,0 +1,197 @@
+package memstore
+
+import (
+	"time"
+
+	"learning-telegram/internal/store"
+)
+
+type recoveryCode struct {
+	hash string
+	used bool
+}
+
+type passwordReset struct {
+	username  string
+	tokenHash string
+	expiresAt time.Time
+	used      bool
+}
+
+func (s *Store) GetTwoFactor(username string) (*store.TwoFactor, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	u := s.user(username)
+	if u == nil {
+		return nil, store.ErrUserNotFound
+	}
+	tf := u.twoFactor
+	return &tf, nil
+}
+
+func (s *Store) SetPendingTOTPSecret(username, secret string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if u := s.user(username); u != nil && !u.twoFactor.Enabled {
+		u.twoFactor.Secret = secret
+		u.twoFactor.LastStep = 0
+	}
+	return nil
+}
+
+func (s *Store) EnableTwoFactor(username string, recoveryCodeHashes []string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	u := s.user(username)
+	if u == nil {
+		return store.ErrUserNotFound
+	}
+	u.twoFactor.Enabled = true
+	u.recoveryCodes = nil
+	for _, hash := range recoveryCodeHashes {
+		u.recoveryCodes = append(u.recoveryCodes, recoveryCode{hash: hash})
+	}
+	return nil
+}
+
+func (s *Store) DisableTwoFactor(username string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	u := s.user(username)
+	if u == nil {
+		return store.ErrUserNotFound
+	}
+	u.twoFactor = store.TwoFactor{}
+	u.recoveryCodes = nil
+	return nil
+}
+
+func (s *Store) ConsumeTOTPStep(username string, step int64) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	u := s.user(username)
+	if u == nil || u.twoFactor.LastStep >= step {
+		return false, nil
+	}
+	u.twoFactor.LastStep = step
+	return true, nil
+}
+
+func (s *Store) ConsumeRecoveryCode(username, codeHash string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if u := s.user(username); u != nil {
+		for i, c := range u.recoveryCodes {
+			if c.hash == codeHash && !c.used {
+				u.recoveryCodes[i].used = true
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (s *Store) CountRecoveryCodes(username string) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	n := 0
+	if u := s.user(username); u != nil {
+		for _, c := range u.recoveryCodes {
+			if !c.used {
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
+func (s *Store) GetLoginThrottle(username string) (*store.LoginThrottle, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	t, ok := s.throttles[username]
+	if !ok {
+		t = store.LoginThrottle{Username: username}
+	}
+	return &t, nil
+}
+
+func (s *Store) RecordLoginFailure(username string) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	t := s.throttles[username]
+	t.Username = username
+	if t.LockedUntil != nil && !t.LockedUntil.After(now) {
+		t.FailedCount, t.LockedUntil = 0, nil
+	}
+	t.FailedCount++
+	t.LastFailedAt = &now
+	s.throttles[username] = t
+	return t.FailedCount, nil
+}
+
+func (s *Store) LockAccount(username string, until time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if t, ok := s.throttles[username]; ok {
+		t.LockedUntil = &until
+		s.throttles[username] = t
+	}
+	return nil
+}
+
+func (s *Store) ResetLoginFailures(username string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.throttles, username)
+	return nil
+}
+
+func (s *Store) CreatePasswordReset(username, tokenHash string, expiresAt time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.user(username) == nil {
+		return store.ErrUserNotFound
+	}
+	s.resets = append(s.resets, &passwordReset{username: username, tokenHash: tokenHash, expiresAt: expiresAt})
+	return nil
+}
+
+// validReset returns the unused, unexpired reset with the given token hash,
+// or nil.
+func (s *Store) validReset(tokenHash string) *passwordReset {
+	for _, r := range s.resets {
+		if r.tokenHash == tokenHash {
+			if r.used || time.Now().After(r.expiresAt) {
+				return nil
+			}
+			return r
+		}
+	}
+	return nil
+}
+
+func (s *Store) GetPasswordResetUser(tokenHash string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	r := s.validReset(tokenHash)
+	if r == nil {
+		return "", store.ErrResetTokenInvalid
+	}
+	return r.username, nil
+}
+
+func (s *Store) ConsumePasswordReset(tokenHash string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	r := s.validReset(tokenHash)
+	if r == nil {
+		return "", store.ErrResetTokenInvalid
+	}
+	for _, other := range s.resets {
+		if other.username == r.username {
+			other.used = true
+		}
+	}
+	return r.username, nil
+}
@@ -0,0 +1,175 @@
+package memstore
+
+import (
+	"slices"
+	"time"
+
+	"learning-telegram/internal/store"
+)
+
+// botUpdateRetention is how long undelivered updates are kept, as in the SQL
+// store.
+const botUpdateRetention = 24 * time.Hour
+
+type botUpdate struct {
+	store.BotUpdate
+	botID     int64
+	createdAt time.Time
+}
+
+type botLease struct {
+	node      string
+	expiresAt time.Time
+}
+
+func (s *Store) CreateBot(owner, username, tokenHash string) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	o := s.user(owner)
+	if o == nil || o.isBot {
+		return 0, store.ErrUserNotFound
+	}
+	if s.userByName(username) != nil {
+		return 0, store.ErrUsernameTaken
+	}
+	u := s.addUser(username, "", "")
+	u.isBot = true
+	s.bots = append(s.bots, &store.Bot{
+		ID:        int64(u.ID),
+		Username:  username,
+		Owner:     o.Username,
+		TokenHash: tokenHash,
+		CreatedAt: u.CreatedAt,
+	})
+	return int64(u.ID), nil
+}
+
+func (s *Store) bot(id int64) *store.Bot {
+	for _, b := range s.bots {
+		if b.ID == id {
+			return b
+		}
+	}
+	return nil
+}
+
+func (s *Store) GetBot(id int64) (*store.Bot, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	b := s.bot(id)
+	if b == nil {
+		return nil, store.ErrBotNotFound
+	}
+	result := *b
+	return &result, nil
+}
+
+func (s *Store) GetAllBots() ([]store.Bot, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var bots []store.Bot
+	for _, b := range s.bots {
+		bots = append(bots, *b)
+	}
+	return bots, nil
+}
+
+func (s *Store) GetBotsByOwner(owner string) ([]store.Bot, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var bots []store.Bot
+	for _, b := range s.bots {
+		if b.Owner == owner {
+			bots = append(bots, *b)
+		}
+	}
+	return bots, nil
+}
+
+func (s *Store) SetBotToken(owner string, id int64, tokenHash string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	b := s.bot(id)
+	if b == nil || b.Owner != owner {
+		return store.ErrBotNotFound
+	}
+	b.TokenHash = tokenHash
+	return nil
+}
+
+func (s *Store) SetBotWebhook(id int64, url, secret string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if b := s.bot(id); b != nil {
+		b.WebhookURL, b.WebhookSecret = url, secret
+	}
+	return nil
+}
+
+func (s *Store) AddBotUpdate(botID int64, payload []byte) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	u := botUpdate{
+		BotUpdate: store.BotUpdate{ID: s.nextID("bot_updates"), Payload: slices.Clone(payload)},
+		botID:     botID,
+		createdAt: time.Now(),
+	}
+	s.botUpdates = append(s.botUpdates, u)
+	return u.ID, nil
+}
+
+func (s *Store) GetBotUpdates(botID, offset int64, limit int) ([]store.BotUpdate, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	expired := time.Now().Add(-botUpdateRetention)
+	var updates []store.BotUpdate
+	for _, u := range s.botUpdates {
+		if len(updates) == limit {
+			break
+		}
+		if u.botID == botID && u.ID >= offset && u.createdAt.After(expired) {
+			updates = append(updates, u.BotUpdate)
+		}
+	}
+	return updates, nil
+}
+
+func (s *Store) ConfirmBotUpdates(botID, offset int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	expired := time.Now().Add(-botUpdateRetention)
+	s.botUpdates = slices.DeleteFunc(s.botUpdates, func(u botUpdate) bool {
+		return u.botID == botID && (u.ID < offset || !u.createdAt.After(expired))
+	})
+	return nil
+}
+
+func (s *Store) PruneBotUpdates() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	expired := time.Now().Add(-botUpdateRetention)
+	s.botUpdates = slices.DeleteFunc(s.botUpdates, func(u botUpdate) bool {
+		return !u.createdAt.After(expired)
+	})
+	return nil
+}
+
+func (s *Store) ClaimBotWebhook(botID int64, node string, lease time.Duration) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	if l, ok := s.botLeases[botID]; ok && l.node != node && l.expiresAt.After(now) {
+		return false, nil
+	}
+	s.botLeases[botID] = botLease{node: node, expiresAt: now.Add(lease)}
+	return true, nil
+}
+
+func (s *Store) ReleaseBotWebhook(botID int64, node string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.botLeases[botID].node == node {
+		delete(s.botLeases, botID)
+	}
+	return nil
+}
@@ -0,0 +1,648 @@
+// Package memstore implements the store repositories in memory, for tests of
+// the API and WebSocket handlers that shouldn't need a database. It behaves
+// like the SQL store, errors included, but keeps nothing across restarts.
+package memstore
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"learning-telegram/internal/policy"
+	"learning-telegram/internal/store"
+)
+
+type user struct {
+	store.User
+	norm          string
+	passwordHash  string
+	email         string
+	isBot         bool
+	pts           int64 // last PTS of the user's update sequence
+	twoFactor     store.TwoFactor
+	recoveryCodes []recoveryCode
+	visibility    string
+	lastSeenAt    sql.NullTime
+}
+
+type group struct {
+	store.Group
+	members []string // usernames, in the order they joined
+}
+
+type message struct {
+	store.Message
+	groupID  int64 // 0 for private messages
+	clientID string
+}
+
+type update struct {
+	pts       int64
+	messageID int
+}
+
+type session struct {
+	store.Session
+	refreshHash string
+	prevHash    string
+}
+
+// Store holds the data of every repository. The zero value is not usable; use
+// New.
+type Store struct {
+	lock        sync.Mutex
+	users       []*user // by ID - 1
+	groups      []*group
+	messages    []*message
+	updates     map[string][]update // username -> update sequence
+	sessions    map[string]*session
+	throttles   map[string]store.LoginThrottle
+	resets      []*passwordReset
+	bots        []*store.Bot
+	botUpdates  []botUpdate
+	botLeases   map[int64]botLease
+	webhooks    []*store.Webhook
+	deliveries  []*store.WebhookDelivery
+	deadLetters []*store.WebhookDeadLetter
+	lastID      map[string]int64 // table -> last ID, for tables with deletes
+}
+
+func New() *Store {
+	return &Store{
+		updates:   make(map[string][]update),
+		sessions:  make(map[string]*session),
+		throttles: make(map[string]store.LoginThrottle),
+		botLeases: make(map[int64]botLease),
+		lastID:    make(map[string]int64),
+	}
+}
+
+// Repos returns the store as every repository.
+func (s *Store) Repos() store.Repos {
+	return store.Repos{
+		Users:          s,
+		Groups:         s,
+		Messages:       s,
+		Sessions:       s,
+		TwoFactor:      s,
+		LoginGuard:     s,
+		PasswordResets: s,
+		Presence:       s,
+		Bots:           s,
+		Webhooks:       s,
+	}
+}
+
+// nextID returns the next ID of a table whose rows can be deleted, which
+// like an autoincrement column never hands out an ID twice.
+func (s *Store) nextID(table string) int64 {
+	s.lastID[table]++
+	return s.lastID[table]
+}
+
+// user returns the user with the given canonical username, or nil.
+func (s *Store) user(username string) *user {
+	for _, u := range s.users {
+		if u.Username == username {
+			return u
+		}
+	}
+	return nil
+}
+
+// userByName returns the user with the given name in any spelling, or nil.
+func (s *Store) userByName(name string) *user {
+	norm := policy.NormalizeUsername(name)
+	for _, u := range s.users {
+		if u.norm == norm {
+			return u
+		}
+	}
+	return nil
+}
+
+func (s *Store) emailTaken(email, except string) bool {
+	for _, u := range s.users {
+		if email != "" && u.email == email && u.Username != except {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Store) CreateUser(username, passwordHash, email string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.userByName(username) != nil {
+		return store.ErrUsernameTaken
+	}
+	if s.emailTaken(email, "") {
+		return store.ErrEmailTaken
+	}
+	s.addUser(username, passwordHash, email)
+	return nil
+}
+
+func (s *Store) addUser(username, passwordHash, email string) *user {
+	u := &user{
+		User:         store.User{ID: len(s.users) + 1, Username: username, CreatedAt: time.Now()},
+		norm:         policy.NormalizeUsername(username),
+		passwordHash: passwordHash,
+		email:        email,
+		visibility:   "everyone", // the column default
+	}
+	s.users = append(s.users, u)
+	return u
+}
+
+func (s *Store) ResolveUsername(name string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	u := s.userByName(name)
+	if u == nil {
+		return "", store.ErrUserNotFound
+	}
+	return u.Username, nil
+}
+
+func (s *Store) GetPasswordHash(name string) (username, hash string, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	u := s.userByName(name)
+	if u == nil || u.isBot {
+		return "", "", store.ErrUserNotFound
+	}
+	return u.Username, u.passwordHash, nil
+}
+
+func (s *Store) UpdatePasswordHash(username, hash string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if u := s.user(username); u != nil {
+		u.passwordHash = hash
+	}
+	return nil
+}
+
+func (s *Store) GetUserEmail(username string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	u := s.user(username)
+	if u == nil {
+		return "", store.ErrUserNotFound
+	}
+	return u.email, nil
+}
+
+func (s *Store) SetUserEmail(username, email string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.emailTaken(email, username) {
+		return store.ErrEmailTaken
+	}
+	if u := s.user(username); u != nil {
+		u.email = email
+	}
+	return nil
+}
+
+func (s *Store) GetUsernameByEmail(email string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, u := range s.users {
+		if email != "" && u.email == email {
+			return u.Username, nil
+		}
+	}
+	return "", store.ErrUserNotFound
+}
+
+func (s *Store) GetAllUsers(exceptUsername string) ([]store.User, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var users []store.User
+	for _, u := range s.users {
+		if u.Username != exceptUsername {
+			users = append(users, u.User)
+		}
+	}
+	return users, nil
+}
+
+func (s *Store) IsBot(username string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	u := s.user(username)
+	if u == nil {
+		return false, store.ErrUserNotFound
+	}
+	return u.isBot, nil
+}
+
+func (s *Store) GetUserID(username string) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	u := s.user(username)
+	if u == nil {
+		return 0, store.ErrUserNotFound
+	}
+	return int64(u.ID), nil
+}
+
+func (s *Store) GetUsernameByID(id int64) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if id < 1 || id > int64(len(s.users)) {
+		return "", store.ErrUserNotFound
+	}
+	return s.users[id-1].Username, nil
+}
+
+func (s *Store) CreateGroup(name string, creatorUsername string) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	creator := s.user(creatorUsername)
+	if creator == nil {
+		return 0, store.ErrUserNotFound
+	}
+	g := &group{
+		Group:   store.Group{ID: len(s.groups) + 1, Name: name, CreatorID: creator.ID, CreatedAt: time.Now()},
+		members: []string{creator.Username},
+	}
+	s.groups = append(s.groups, g)
+	return int64(g.ID), nil
+}
+
+// group returns the group with the given ID, or nil.
+func (s *Store) group(groupID int64) *group {
+	if groupID < 1 || groupID > int64(len(s.groups)) {
+		return nil
+	}
+	return s.groups[groupID-1]
+}
+
+func (s *Store) AddGroupMember(groupID int64, username string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	g := s.group(groupID)
+	if g == nil {
+		return store.ErrGroupNotFound
+	}
+	u := s.userByName(username)
+	if u == nil {
+		return store.ErrUserNotFound
+	}
+	if slices.Contains(g.members, u.Username) {
+		return store.ErrAlreadyMember
+	}
+	g.members = append(g.members, u.Username)
+	return nil
+}
+
+func (s *Store) GetGroupName(groupID int64) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	g := s.group(groupID)
+	if g == nil {
+		return "", store.ErrGroupNotFound
+	}
+	return g.Name, nil
+}
+
+func (s *Store) GetGroupMembers(groupID int64) ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if g := s.group(groupID); g != nil {
+		return slices.Clone(g.members), nil
+	}
+	return nil, nil
+}
+
+func (s *Store) IsUserInGroup(username string, groupID int64) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.user(username) == nil {
+		return false, store.ErrUserNotFound
+	}
+	g := s.group(groupID)
+	return g != nil && slices.Contains(g.members, username), nil
+}
+
+func (s *Store) GetUserGroups(username string) ([]store.Group, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.user(username) == nil {
+		return nil, store.ErrUserNotFound
+	}
+	var groups []store.Group
+	for _, g := range s.groups {
+		if slices.Contains(g.members, username) {
+			groups = append(groups, g.Group)
+		}
+	}
+	return groups, nil
+}
+
+func (s *Store) InsertPrivateMessage(sender, receiver, clientID, content string) (*store.Message, []store.Recipient, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.user(receiver) == nil {
+		return nil, nil, store.ErrUserNotFound
+	}
+	return s.insertMessage(sender, receiver, 0, clientID, content)
+}
+
+func (s *Store) InsertGroupMessage(sender string, groupID int64, clientID, content string) (*store.Message, []store.Recipient, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.insertMessage(sender, "", groupID, clientID, content)
+}
+
+// insertMessage stores a message and appends it to the update sequences of
+// its recipients, or returns the message the sender already sent with
+// clientID, like the SQL store.
+func (s *Store) insertMessage(sender, receiver string, groupID int64, clientID, content string) (*store.Message, []store.Recipient, error) {
+	if s.user(sender) == nil {
+		return nil, nil, store.ErrUserNotFound
+	}
+	if clientID != "" {
+		for _, m := range s.messages {
+			if m.Sender != sender || m.clientID != clientID {
+				continue
+			}
+			if m.Receiver != receiver || m.groupID != groupID || m.Content != content {
+				return nil, nil, store.ErrClientIDReused
+			}
+			msg := m.Message
+			return &msg, nil, nil
+		}
+	}
+
+	m := &message{
+		Message: store.Message{
+			ID:        len(s.messages) + 1,
+			Sender:    sender,
+			Receiver:  receiver,
+			Content:   content,
+			CreatedAt: time.Now(),
+		},
+		groupID:  groupID,
+		clientID: clientID,
+	}
+	s.messages = append(s.messages, m)
+
+	recipients := []string{sender}
+	if receiver != sender && receiver != "" {
+		recipients = append(recipients, receiver)
+	}
+	if groupID != 0 {
+		recipients = nil
+		if g := s.group(groupID); g != nil {
+			recipients = g.members
+		}
+	}
+	var users []*user
+	for _, username := range recipients {
+		users = append(users, s.user(username))
+	}
+	slices.SortFunc(users, func(a, b *user) int { return a.ID - b.ID })
+	var result []store.Recipient
+	for _, u := range users {
+		u.pts++
+		s.updates[u.Username] = append(s.updates[u.Username], update{pts: u.pts, messageID: m.ID})
+		result = append(result, store.Recipient{Username: u.Username, PTS: u.pts})
+	}
+
+	msg := m.Message
+	return &msg, result, nil
+}
+
+func (s *Store) GetPrivateHistory(user1, user2 string, q store.HistoryQuery) (*store.HistoryPage, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.history(q, func(m *message) bool {
+		return m.groupID == 0 && (m.Sender == user1 && m.Receiver == user2 || m.Sender == user2 && m.Receiver == user1)
+	}), nil
+}
+
+func (s *Store) GetGroupHistory(groupID int64, q store.HistoryQuery) (*store.HistoryPage, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.history(q, func(m *message) bool { return m.groupID == groupID }), nil
+}
+
+// history pages through the messages in chat like the SQL store, taking
+// one message more than the page on each side of the pivot.
+func (s *Store) history(q store.HistoryQuery, chat func(*message) bool) *store.HistoryPage {
+	pivot, before, from := q.Window()
+	var older, newer []store.Message
+	for i := len(s.messages) - 1; i >= 0 && len(older) <= before; i-- {
+		if m := s.messages[i]; int64(m.ID) < pivot && chat(m) {
+			older = append(older, historyMessage(m))
+		}
+	}
+	for _, m := range s.messages {
+		if len(newer) > from {
+			break
+		}
+		if int64(m.ID) >= pivot && chat(m) {
+			newer = append(newer, historyMessage(m))
+		}
+	}
+	return store.NewHistoryPage(q, older, newer)
+}
+
+func historyMessage(m *message) store.Message {
+	msg := m.Message
+	if m.groupID != 0 {
+		// The SQL store reads the group ID into Receiver.
+		msg.Receiver = strconv.FormatInt(m.groupID, 10)
+	}
+	return msg
+}
+
+func (s *Store) HasMessaged(sender, receiver string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, m := range s.messages {
+		if m.groupID == 0 && m.Sender == sender && m.Receiver == receiver {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *Store) GetUpdateState(username string) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if u := s.user(username); u != nil {
+		return u.pts, nil
+	}
+	return 0, nil
+}
+
+func (s *Store) GetUpdates(username string, pts int64, limit int) ([]store.Update, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var updates []store.Update
+	for _, up := range s.updates[username] {
+		if up.pts <= pts {
+			continue
+		}
+		if len(updates) == limit {
+			break
+		}
+		m := s.messages[up.messageID-1]
+		updates = append(updates, store.Update{
+			PTS:       up.pts,
+			MessageID: int64(m.ID),
+			ClientID:  m.clientID,
+			Sender:    m.Sender,
+			Receiver:  m.Receiver,
+			GroupID:   m.groupID,
+			Content:   m.Content,
+			CreatedAt: m.CreatedAt,
+		})
+	}
+	return updates, nil
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (s *Store) CreateSession(username, refreshHash, deviceName, userAgent, ip string, expiresAt time.Time) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	u := s.user(username)
+	if u == nil {
+		return "", store.ErrUserNotFound
+	}
+	id, err := newSessionID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	s.sessions[id] = &session{
+		Session: store.Session{
+			ID:           id,
+			UserID:       u.ID,
+			Username:     username,
+			DeviceName:   deviceName,
+			UserAgent:    userAgent,
+			IP:           ip,
+			CreatedAt:    now,
+			LastActiveAt: now,
+			ExpiresAt:    expiresAt,
+		},
+		refreshHash: refreshHash,
+	}
+	return id, nil
+}
+
+func (s *Store) RotateRefreshToken(oldHash, newHash string, expiresAt time.Time) (*store.Session, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	for _, sess := range s.sessions {
+		if sess.refreshHash != oldHash {
+			continue
+		}
+		if sess.RevokedAt != nil || now.After(sess.ExpiresAt) {
+			return nil, store.ErrSessionNotFound
+		}
+		sess.prevHash = oldHash
+		sess.refreshHash = newHash
+		sess.LastActiveAt = now
+		sess.ExpiresAt = expiresAt
+		result := sess.Session
+		return &result, nil
+	}
+	for _, sess := range s.sessions {
+		if sess.prevHash == oldHash {
+			if sess.RevokedAt == nil {
+				sess.RevokedAt = &now
+			}
+			return nil, store.ErrRefreshTokenReused
+		}
+	}
+	return nil, store.ErrSessionNotFound
+}
+
+func (s *Store) RevokeSession(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if sess := s.sessions[id]; sess != nil && sess.RevokedAt == nil {
+		now := time.Now()
+		sess.RevokedAt = &now
+	}
+	return nil
+}
+
+func (s *Store) RevokeUserSession(username, id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sess := s.sessions[id]
+	if sess == nil || sess.Username != username || sess.RevokedAt != nil {
+		return store.ErrSessionNotFound
+	}
+	now := time.Now()
+	sess.RevokedAt = &now
+	return nil
+}
+
+func (s *Store) RevokeOtherSessions(username, keepID string) ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	var ids []string
+	for id, sess := range s.sessions {
+		if sess.Username == username && id != keepID && sess.RevokedAt == nil {
+			sess.RevokedAt = &now
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (s *Store) IsSessionActive(id string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sess := s.sessions[id]
+	return sess != nil && sess.RevokedAt == nil && time.Now().Before(sess.ExpiresAt), nil
+}
+
+func (s *Store) TouchSession(id, ip string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	if sess := s.sessions[id]; sess != nil && sess.LastActiveAt.Before(now.Add(-store.SessionTouchInterval)) {
+		sess.LastActiveAt = now
+		sess.IP = ip
+	}
+	return nil
+}
+
+func (s *Store) GetActiveSessions(username string) ([]store.Session, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	var sessions []store.Session
+	for _, sess := range s.sessions {
+		if sess.Username == username && sess.RevokedAt == nil && !now.After(sess.ExpiresAt) {
+			sessions = append(sessions, sess.Session)
+		}
+	}
+	slices.SortFunc(sessions, func(a, b store.Session) int {
+		return b.LastActiveAt.Compare(a.LastActiveAt)
+	})
+	return sessions, nil
+}
@@ -0,0 +1,76 @@
+package memstore
+
+import (
+	"slices"
+	"time"
+
+	"learning-telegram/internal/store"
+)
+
+func (s *Store) GetPresenceInfo(username string) (*store.PresenceInfo, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	u := s.user(username)
+	if u == nil {
+		return nil, store.ErrUserNotFound
+	}
+	return &store.PresenceInfo{Visibility: u.visibility, LastSeenAt: u.lastSeenAt}, nil
+}
+
+func (s *Store) SetLastSeenVisibility(username, visibility string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if u := s.user(username); u != nil {
+		u.visibility = visibility
+	}
+	return nil
+}
+
+func (s *Store) SetLastSeen(username string, t time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if u := s.user(username); u != nil {
+		u.lastSeenAt.Time, u.lastSeenAt.Valid = t, true
+	}
+	return nil
+}
+
+func (s *Store) IsContact(username, other string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, m := range s.messages {
+		if m.groupID == 0 && m.Sender == username && m.Receiver == other {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *Store) GetContacts(username string) ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var contacts []string
+	for _, m := range s.messages {
+		if m.groupID == 0 && m.Sender == username && m.Receiver != username && !slices.Contains(contacts, m.Receiver) {
+			contacts = append(contacts, m.Receiver)
+		}
+	}
+	return contacts, nil
+}
+
+func (s *Store) GetGroupPeers(username string) ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var peers []string
+	for _, g := range s.groups {
+		if !slices.Contains(g.members, username) {
+			continue
+		}
+		for _, m := range g.members {
+			if m != username && !slices.Contains(peers, m) {
+				peers = append(peers, m)
+			}
+		}
+	}
+	return peers, nil
+}
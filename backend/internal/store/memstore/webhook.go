@@ -0,0 +1,243 @@
+package memstore
+
+import (
+	"cmp"
+	"slices"
+	"time"
+
+	"learning-telegram/internal/store"
+)
+
+func (s *Store) CreateWebhook(owner string, groupID int64, url, secret string, events []string) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.user(owner) == nil {
+		return 0, store.ErrUserNotFound
+	}
+	w := &store.Webhook{
+		ID:        s.nextID("webhooks"),
+		Owner:     owner,
+		GroupID:   groupID,
+		URL:       url,
+		Secret:    secret,
+		Events:    append([]string{}, events...),
+		CreatedAt: time.Now(),
+	}
+	s.webhooks = append(s.webhooks, w)
+	return w.ID, nil
+}
+
+func (s *Store) webhook(id int64) *store.Webhook {
+	for _, w := range s.webhooks {
+		if w.ID == id {
+			return w
+		}
+	}
+	return nil
+}
+
+func copyWebhook(w *store.Webhook) *store.Webhook {
+	result := *w
+	result.Events = slices.Clone(w.Events)
+	return &result
+}
+
+func (s *Store) GetWebhook(owner string, id int64) (*store.Webhook, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	w := s.webhook(id)
+	if w == nil || w.Owner != owner {
+		return nil, store.ErrWebhookNotFound
+	}
+	return copyWebhook(w), nil
+}
+
+func (s *Store) GetWebhookByID(id int64) (*store.Webhook, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	w := s.webhook(id)
+	if w == nil {
+		return nil, store.ErrWebhookNotFound
+	}
+	return copyWebhook(w), nil
+}
+
+func (s *Store) GetWebhooksByOwner(owner string) ([]store.Webhook, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var hooks []store.Webhook
+	for _, w := range s.webhooks {
+		if w.Owner == owner {
+			hooks = append(hooks, *copyWebhook(w))
+		}
+	}
+	return hooks, nil
+}
+
+func (s *Store) FindWebhookSubscribers(usernames []string, groupID int64) ([]store.Webhook, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var hooks []store.Webhook
+	for _, w := range s.webhooks {
+		userScoped := w.GroupID == 0 && slices.Contains(usernames, w.Owner)
+		groupScoped := groupID != 0 && w.GroupID == groupID
+		if groupScoped {
+			g := s.group(groupID)
+			groupScoped = g != nil && slices.Contains(g.members, w.Owner)
+		}
+		if userScoped || groupScoped {
+			hooks = append(hooks, *copyWebhook(w))
+		}
+	}
+	return hooks, nil
+}
+
+func (s *Store) DeleteWebhook(owner string, id int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	w := s.webhook(id)
+	if w == nil || w.Owner != owner {
+		return store.ErrWebhookNotFound
+	}
+	s.webhooks = slices.DeleteFunc(s.webhooks, func(w *store.Webhook) bool { return w.ID == id })
+	s.deliveries = slices.DeleteFunc(s.deliveries, func(d *store.WebhookDelivery) bool { return d.WebhookID == id })
+	s.deadLetters = slices.DeleteFunc(s.deadLetters, func(l *store.WebhookDeadLetter) bool { return l.WebhookID == id })
+	return nil
+}
+
+func (s *Store) EnqueueWebhookDelivery(webhookID int64, eventID, eventType string, payload []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	s.deliveries = append(s.deliveries, &store.WebhookDelivery{
+		ID:            s.nextID("webhook_deliveries"),
+		WebhookID:     webhookID,
+		EventID:       eventID,
+		EventType:     eventType,
+		Payload:       string(payload),
+		Status:        store.DeliveryPending,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	})
+	return nil
+}
+
+func (s *Store) delivery(id int64) *store.WebhookDelivery {
+	for _, d := range s.deliveries {
+		if d.ID == id {
+			return d
+		}
+	}
+	return nil
+}
+
+func (s *Store) ClaimDueWebhookDeliveries(limit int, lease time.Duration) ([]store.WebhookDelivery, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	var due []*store.WebhookDelivery
+	for _, d := range s.deliveries {
+		if d.Status == store.DeliveryPending && !d.NextAttemptAt.After(now) {
+			due = append(due, d)
+		}
+	}
+	slices.SortFunc(due, func(a, b *store.WebhookDelivery) int {
+		return cmp.Or(a.NextAttemptAt.Compare(b.NextAttemptAt), cmp.Compare(a.ID, b.ID))
+	})
+	var deliveries []store.WebhookDelivery
+	for _, d := range due[:min(len(due), limit)] {
+		deliveries = append(deliveries, *d)
+		d.NextAttemptAt = now.Add(lease)
+	}
+	return deliveries, nil
+}
+
+func (s *Store) MarkWebhookDelivered(id int64, attempts, statusCode int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if d := s.delivery(id); d != nil {
+		d.Status, d.Attempts, d.LastStatusCode, d.LastError, d.UpdatedAt = store.DeliverySucceeded, attempts, statusCode, "", time.Now()
+	}
+	return nil
+}
+
+func (s *Store) RescheduleWebhookDelivery(id int64, attempts, statusCode int, lastError string, next time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if d := s.delivery(id); d != nil {
+		d.Attempts, d.LastStatusCode, d.LastError, d.NextAttemptAt, d.UpdatedAt = attempts, statusCode, lastError, next, time.Now()
+	}
+	return nil
+}
+
+func (s *Store) DeadLetterWebhookDelivery(d *store.WebhookDelivery, attempts, statusCode int, lastError string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	if stored := s.delivery(d.ID); stored != nil {
+		stored.Status, stored.Attempts, stored.LastStatusCode, stored.LastError, stored.UpdatedAt = store.DeliveryDead, attempts, statusCode, lastError, now
+	}
+	s.deadLetters = append(s.deadLetters, &store.WebhookDeadLetter{
+		ID:             s.nextID("webhook_dead_letters"),
+		DeliveryID:     d.ID,
+		WebhookID:      d.WebhookID,
+		EventType:      d.EventType,
+		Payload:        d.Payload,
+		Attempts:       attempts,
+		LastStatusCode: statusCode,
+		LastError:      lastError,
+		CreatedAt:      now,
+	})
+	return nil
+}
+
+func (s *Store) GetWebhookDeliveries(webhookID int64, limit int) ([]store.WebhookDelivery, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var deliveries []store.WebhookDelivery
+	for i := len(s.deliveries) - 1; i >= 0 && len(deliveries) < limit; i-- {
+		if d := s.deliveries[i]; d.WebhookID == webhookID {
+			deliveries = append(deliveries, *d)
+		}
+	}
+	return deliveries, nil
+}
+
+func (s *Store) GetWebhookDeadLetters(webhookID int64) ([]store.WebhookDeadLetter, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var letters []store.WebhookDeadLetter
+	for i := len(s.deadLetters) - 1; i >= 0; i-- {
+		if l := s.deadLetters[i]; l.WebhookID == webhookID {
+			letters = append(letters, *l)
+		}
+	}
+	return letters, nil
+}
+
+func (s *Store) RequeueWebhookDeadLetter(webhookID, deadLetterID int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	i := slices.IndexFunc(s.deadLetters, func(l *store.WebhookDeadLetter) bool {
+		return l.ID == deadLetterID && l.WebhookID == webhookID
+	})
+	if i < 0 {
+		return store.ErrWebhookNotFound
+	}
+	if d := s.delivery(s.deadLetters[i].DeliveryID); d != nil {
+		now := time.Now()
+		d.Status, d.Attempts, d.NextAttemptAt, d.UpdatedAt = store.DeliveryPending, 0, now, now
+	}
+	s.deadLetters = slices.Delete(s.deadLetters, i, i+1)
+	return nil
+}
+
+func (s *Store) PruneWebhookDeliveries(before time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.deliveries = slices.DeleteFunc(s.deliveries, func(d *store.WebhookDelivery) bool {
+		return d.Status == store.DeliverySucceeded && d.UpdatedAt.Before(before)
+	})
+	return nil
+}
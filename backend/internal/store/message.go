@@ -13,83 +13,109 @@ type Message struct {
 	CreatedAt time.Time `json:"created_at"`
 }
 
-// InsertPrivateMessage inserts a private message into the database.
-func InsertPrivateMessage(sender, receiver, content string) error {
-	_, err := DB.Exec(
-		"INSERT INTO messages (sender_id, receiver_id, content, created_at) VALUES ((SELECT id FROM users WHERE username = ?), (SELECT id FROM users WHERE username = ?), ?, ?)",
-		sender, receiver, content, time.Now(),
-	)
-	return err
+// ErrClientIDReused is returned when a sender reuses a client message ID for a
+// different message.
+var ErrClientIDReused = newError(ErrConflict, "client message id already used for a different message")
+
+// Recipient is a user a new message was delivered to, with the number the
+// message got in the user's update sequence.
+type Recipient struct {
+	Username string
+	PTS      int64
+}
+
+// InsertPrivateMessage stores a private message and appends it to the update
+// sequences of the sender and the receiver. If clientID is not empty and the
+// sender already sent a message with it, that message is returned instead and
+// recipients is nil, so a client can safely retry a send whose outcome it
+// doesn't know.
+func (st *SQLStore) InsertPrivateMessage(sender, receiver, clientID, content string) (msg *Message, recipients []Recipient, err error) {
+	return st.insertMessage(sender, sql.NullString{String: receiver, Valid: true}, sql.NullInt64{}, clientID, content)
 }
 
-// InsertGroupMessage inserts a group message into the database.
-func InsertGroupMessage(sender string, groupID int64, content string) error {
-	_, err := DB.Exec(
-		"INSERT INTO messages (sender_id, group_id, content, created_at) VALUES ((SELECT id FROM users WHERE username = ?), ?, ?, ?)",
-		sender, groupID, content, time.Now(),
-	)
-	return err
+// InsertGroupMessage stores a group message and appends it to the update
+// sequence of every member, deduplicated by clientID like
+// InsertPrivateMessage.
+func (st *SQLStore) InsertGroupMessage(sender string, groupID int64, clientID, content string) (msg *Message, recipients []Recipient, err error) {
+	return st.insertMessage(sender, sql.NullString{}, sql.NullInt64{Int64: groupID, Valid: true}, clientID, content)
 }
 
-// GetPrivateHistory retrieves private chat history between two users.
-func GetPrivateHistory(user1, user2 string) ([]Message, error) {
-	rows, err := DB.Query(
-		`SELECT m.id, u1.username, u2.username, m.content, m.created_at
-		 FROM messages m
-		 JOIN users u1 ON m.sender_id = u1.id
-		 JOIN users u2 ON m.receiver_id = u2.id
-		 WHERE (u1.username = ? AND u2.username = ?) OR (u1.username = ? AND u2.username = ?)
-		 ORDER BY m.created_at ASC LIMIT 100`,
-		user1, user2, user2, user1,
-	)
+func (st *SQLStore) insertMessage(sender string, receiver sql.NullString, groupID sql.NullInt64, clientID, content string) (*Message, []Recipient, error) {
+	var cid sql.NullString
+	if clientID != "" {
+		cid = sql.NullString{String: clientID, Valid: true}
+	}
+
+	tx, err := st.db.Begin()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	defer rows.Close()
+	defer tx.Rollback()
 
-	var msgs []Message
-	for rows.Next() {
-		var m Message
-		if err := rows.Scan(&m.ID, &m.Sender, &m.Receiver, &m.Content, &m.CreatedAt); err != nil {
-			return nil, err
+	now := time.Now()
+	var id int64
+	err = tx.QueryRow(
+		`INSERT INTO messages (sender_id, receiver_id, group_id, client_id, content, created_at)
+		 VALUES ((SELECT id FROM users WHERE username = ?), (SELECT id FROM users WHERE username = ?), ?, ?, ?, ?)
+		 ON CONFLICT (sender_id, client_id) WHERE client_id IS NOT NULL DO NOTHING
+		 RETURNING id`,
+		sender, receiver, groupID, cid, content, now,
+	).Scan(&id)
+	if err == sql.ErrNoRows {
+		// A retry: return the original message, unless the client ID was
+		// reused for something else.
+		var (
+			m            = Message{Sender: sender}
+			prevReceiver sql.NullString
+			prevGroupID  sql.NullInt64
+		)
+		err = tx.QueryRow(
+			`SELECT m.id, r.username, m.group_id, m.content, m.created_at
+			 FROM messages m LEFT JOIN users r ON m.receiver_id = r.id
+			 WHERE m.sender_id = (SELECT id FROM users WHERE username = ?) AND m.client_id = ?`,
+			sender, clientID,
+		).Scan(&m.ID, &prevReceiver, &prevGroupID, &m.Content, &m.CreatedAt)
+		if err != nil {
+			return nil, nil, err
+		}
+		if prevReceiver != receiver || prevGroupID != groupID || m.Content != content {
+			return nil, nil, ErrClientIDReused
 		}
-		msgs = append(msgs, m)
+		m.Receiver = receiver.String
+		return &m, nil, nil
+	} else if err != nil {
+		return nil, nil, err
 	}
-	return msgs, nil
-}
 
-// GetGroupHistory retrieves chat history for a group.
-func GetGroupHistory(groupID int64) ([]Message, error) {
-	rows, err := DB.Query(
-		`SELECT m.id, u.username, m.group_id, m.content, m.created_at
-		 FROM messages m
-		 JOIN users u ON m.sender_id = u.id
-		 WHERE m.group_id = ?
-		 ORDER BY m.created_at ASC LIMIT 100`,
-		groupID,
-	)
+	recipients, err := appendUpdates(tx, id, sender, receiver, groupID)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	defer rows.Close()
-
-	var msgs []Message
-	for rows.Next() {
-		var m Message
-		// Note: m.Receiver will be empty for group messages.
-		if err := rows.Scan(&m.ID, &m.Sender, &m.Receiver, &m.Content, &m.CreatedAt); err != nil {
-			// We expect receiver_id to be NULL, so we create a placeholder for scanning.
-			var groupID sql.NullInt64
-			if scanErr := rows.Scan(&m.ID, &m.Sender, &groupID, &m.Content, &m.CreatedAt); scanErr != nil {
-				return nil, scanErr
-			}
-		}
-		msgs = append(msgs, m)
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
 	}
-	return msgs, nil
+	return &Message{ID: int(id), Sender: sender, Receiver: receiver.String, Content: content, CreatedAt: now}, recipients, nil
+}
+
+// HasMessaged reports whether sender has ever sent receiver a private
+// message.
+func (st *SQLStore) HasMessaged(sender, receiver string) (bool, error) {
+	var exists bool
+	err := st.db.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM messages
+		 WHERE sender_id = (SELECT id FROM users WHERE username = ?)
+		   AND receiver_id = (SELECT id FROM users WHERE username = ?))`,
+		sender, receiver,
+	).Scan(&exists)
+	return exists, err
 }
 
 // 获取当前时间字符串
 func NowStr() string {
-	return time.Now().Format("2006-01-02 15:04:05")
+	return FormatTime(time.Now())
+}
+
+// FormatTime formats a timestamp the way it is sent to WebSocket clients.
+func FormatTime(t time.Time) string {
+	return t.Format("2006-01-02 15:04:05")
 }
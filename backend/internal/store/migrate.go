@@ -0,0 +1,593 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"learning-telegram/internal/policy"
+)
+
+// Migrations are embedded in the binary as pairs of files named
+// NNNN_name.up.sql and NNNN_name.down.sql, numbered from 1 without gaps.
+// Each one is applied in a transaction together with its schema_migrations
+// row, so a failed migration leaves the database as it was, and a run holds
+// a lock so that concurrent runs don't apply the same migrations. Every dialect
+// has its own directory with the same migrations, written in its SQL.
+//
+//go:embed migrations/sqlite/*.sql migrations/postgres/*.sql
+var migrationFiles embed.FS
+
+type Migration struct {
+	Version int
+	Name    string
+	up      string
+	down    string
+}
+
+var migrationSets = mustLoadMigrationSets()
+
+// migrations returns the migrations for the dialect of DB.
+func migrations() []Migration {
+	return migrationSets[DB.Dialect]
+}
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+func mustLoadMigrationSets() map[Dialect][]Migration {
+	sets := map[Dialect][]Migration{
+		DialectSQLite:   mustLoadMigrations("migrations/sqlite"),
+		DialectPostgres: mustLoadMigrations("migrations/postgres"),
+	}
+	sqlite, postgres := sets[DialectSQLite], sets[DialectPostgres]
+	if len(sqlite) != len(postgres) {
+		panic(fmt.Sprintf("store: %d sqlite migrations but %d postgres migrations", len(sqlite), len(postgres)))
+	}
+	for i := range sqlite {
+		if sqlite[i].Name != postgres[i].Name {
+			panic(fmt.Sprintf("store: migration %d is %s for sqlite but %s for postgres", i+1, sqlite[i].Name, postgres[i].Name))
+		}
+	}
+	return sets
+}
+
+func mustLoadMigrations(dir string) []Migration {
+	names, err := fs.Glob(migrationFiles, dir+"/*.sql")
+	if err != nil {
+		panic(err)
+	}
+	byVersion := make(map[int]*Migration)
+	for _, path := range names {
+		m := migrationFileName.FindStringSubmatch(strings.TrimPrefix(path, dir+"/"))
+		if m == nil {
+			panic("store: bad migration file name " + path)
+		}
+		version, _ := strconv.Atoi(m[1])
+		sql, err := migrationFiles.ReadFile(path)
+		if err != nil {
+			panic(err)
+		}
+		mig := byVersion[version]
+		if mig == nil {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		}
+		if m[3] == "up" {
+			mig.up = string(sql)
+		} else {
+			mig.down = string(sql)
+		}
+	}
+
+	list := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		list = append(list, *m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	for i, m := range list {
+		if m.Version != i+1 {
+			panic(fmt.Sprintf("store: migration %d is missing in %s", i+1, dir))
+		}
+		if m.up == "" || m.down == "" {
+			panic(fmt.Sprintf("store: migration %d in %s needs both an up and a down file", m.Version, dir))
+		}
+	}
+	return list
+}
+
+// LatestVersion is the schema version this binary was built for.
+func LatestVersion() int {
+	return len(migrationSets[DialectSQLite])
+}
+
+// SchemaTooNewError is returned when the database was migrated by a newer
+// binary. Running against it could corrupt data the binary doesn't know
+// about, so the server refuses to start.
+type SchemaTooNewError struct {
+	Version, Latest int
+}
+
+func (e *SchemaTooNewError) Error() string {
+	return fmt.Sprintf("数据库结构版本%d比程序支持的版本%d新，请使用更新版本的程序或先用其回滚", e.Version, e.Latest)
+}
+
+var migrationsTable = map[Dialect]string{
+	DialectSQLite: `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL
+	);`,
+	DialectPostgres: `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL
+	);`,
+}
+
+// SchemaVersion returns the version of the last applied migration, 0 for
+// an empty database or one created before migrations were introduced.
+func SchemaVersion() (int, error) {
+	return schemaVersion(DB)
+}
+
+func schemaVersion(q queryer) (int, error) {
+	exists, err := tableExists(q, "schema_migrations")
+	if err != nil || !exists {
+		return 0, err
+	}
+	var version int
+	err = q.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
+
+// CheckSchema returns an error unless the database is at LatestVersion.
+func CheckSchema() error {
+	version, err := SchemaVersion()
+	if err != nil {
+		return err
+	}
+	switch {
+	case version > LatestVersion():
+		return &SchemaTooNewError{version, LatestVersion()}
+	case version < LatestVersion():
+		return fmt.Errorf("数据库结构版本%d落后于程序的版本%d，请先执行 migrate up", version, LatestVersion())
+	}
+	return nil
+}
+
+// MigrationStatus is a migration known to the binary and when it was
+// applied, if it was.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+// MigrationStatuses lists the migrations known to the binary.
+func MigrationStatuses() ([]MigrationStatus, error) {
+	applied := make(map[int]time.Time)
+	exists, err := tableExists(DB, "schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		rows, err := DB.Query("SELECT version, applied_at FROM schema_migrations")
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var version int
+			var at time.Time
+			if err := rows.Scan(&version, &at); err != nil {
+				return nil, err
+			}
+			applied[version] = at
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	statuses := make([]MigrationStatus, LatestVersion())
+	for i, m := range migrations() {
+		statuses[i] = MigrationStatus{Version: m.Version, Name: m.Name}
+		if at, ok := applied[m.Version]; ok {
+			statuses[i].AppliedAt = &at
+		}
+	}
+	return statuses, nil
+}
+
+// MigrateUp applies all pending migrations.
+func MigrateUp() error {
+	return migrate(func(int) (int, error) { return LatestVersion(), nil })
+}
+
+// MigrateDown reverts the last applied migration.
+func MigrateDown() error {
+	return migrate(func(version int) (int, error) {
+		if version == 0 {
+			return 0, errors.New("没有可回滚的迁移")
+		}
+		return version - 1, nil
+	})
+}
+
+// MigrateTo applies or reverts migrations until the schema is at version
+// target. SQLite databases created before migrations were introduced are
+// adopted first, keeping their data.
+func MigrateTo(target int) error {
+	if target < 0 || target > LatestVersion() {
+		return fmt.Errorf("没有版本为%d的迁移（最新版本为%d）", target, LatestVersion())
+	}
+	return migrate(func(int) (int, error) { return target, nil })
+}
+
+// migrate brings the schema to the version targetFor returns for the current
+// one, holding the migration lock for the whole run.
+func migrate(targetFor func(version int) (int, error)) error {
+	return withMigrationLock(func(c *lockedConn) error {
+		version, err := schemaVersion(c)
+		if err != nil {
+			return err
+		}
+		if version > LatestVersion() {
+			return &SchemaTooNewError{version, LatestVersion()}
+		}
+		target, err := targetFor(version)
+		if err != nil {
+			return err
+		}
+		if target > 0 && c.Dialect == DialectSQLite {
+			if err := adoptLegacySchema(c); err != nil {
+				return fmt.Errorf("接管旧数据库失败: %w", err)
+			}
+		}
+		if _, err := c.Exec(migrationsTable[c.Dialect]); err != nil {
+			return err
+		}
+		if version, err = schemaVersion(c); err != nil {
+			return err
+		}
+
+		for ; version < target; version++ {
+			m := migrations()[version]
+			if err := applyMigration(c, m, m.up, func(tx execer) error {
+				_, err := tx.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)", m.Version, m.Name, time.Now())
+				return err
+			}); err != nil {
+				return err
+			}
+			log.Printf("Migration %04d_%s applied.", m.Version, m.Name)
+		}
+		for ; version > target; version-- {
+			m := migrations()[version-1]
+			if err := applyMigration(c, m, m.down, func(tx execer) error {
+				_, err := tx.Exec("DELETE FROM schema_migrations WHERE version = ?", m.Version)
+				return err
+			}); err != nil {
+				return err
+			}
+			log.Printf("Migration %04d_%s reverted.", m.Version, m.Name)
+		}
+		return nil
+	})
+}
+
+func applyMigration(c *lockedConn, m Migration, script string, record func(execer) error) error {
+	return c.step(func(tx execer) error {
+		if _, err := tx.Exec(script); err != nil {
+			return fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		return record(tx)
+	})
+}
+
+// migrationLockID is the key of the PostgreSQL advisory lock held by
+// migration runs; nothing else in the database may use it.
+const migrationLockID int64 = 0x6c74_6d69_6772_6174
+
+// lockedConn is the connection a migration run holds the migration lock on,
+// and runs all its statements on.
+type lockedConn struct {
+	conn    *sql.Conn
+	Dialect Dialect
+}
+
+func (c *lockedConn) Exec(query string, args ...any) (sql.Result, error) {
+	return c.conn.ExecContext(context.Background(), c.Dialect.rebind(query), args...)
+}
+
+func (c *lockedConn) Query(query string, args ...any) (*sql.Rows, error) {
+	return c.conn.QueryContext(context.Background(), c.Dialect.rebind(query), args...)
+}
+
+func (c *lockedConn) QueryRow(query string, args ...any) *sql.Row {
+	return c.conn.QueryRowContext(context.Background(), c.Dialect.rebind(query), args...)
+}
+
+// withMigrationLock runs fn on a connection holding the migration lock, so
+// that of several servers starting at once, or a migrate command run while
+// one starts, only one migrates and the others find the schema up to date.
+// The lock is held from reading the schema version to the last migration.
+//
+// On PostgreSQL it is an advisory lock of the connection's session. On
+// SQLite it is a transaction begun with BEGIN IMMEDIATE, which takes the
+// database's write lock: the whole run is that transaction, and the
+// migrations in it are savepoints, see step. Other runs wait for the lock,
+// on SQLite for as long as the busy timeout of the connection.
+func withMigrationLock(fn func(*lockedConn) error) (err error) {
+	conn, err := DB.DB.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	c := &lockedConn{conn: conn, Dialect: DB.Dialect}
+
+	if c.Dialect == DialectPostgres {
+		if _, err := c.Exec("SELECT pg_advisory_lock(?)", migrationLockID); err != nil {
+			return fmt.Errorf("获取迁移锁失败: %w", err)
+		}
+		defer func() {
+			if _, unlockErr := c.Exec("SELECT pg_advisory_unlock(?)", migrationLockID); unlockErr != nil {
+				// The session still holds the lock; close the connection
+				// rather than return it to the pool.
+				conn.Raw(func(any) error { return driver.ErrBadConn })
+				if err == nil {
+					err = unlockErr
+				}
+			}
+		}()
+		return fn(c)
+	}
+
+	if _, err := c.Exec("BEGIN IMMEDIATE"); err != nil {
+		return fmt.Errorf("获取迁移锁失败: %w", err)
+	}
+	// Migrations applied before a failed one are kept, as on PostgreSQL.
+	err = fn(c)
+	if _, commitErr := c.Exec("COMMIT"); commitErr != nil {
+		c.Exec("ROLLBACK")
+		if err == nil {
+			err = commitErr
+		}
+	}
+	return err
+}
+
+// step runs fn in a transaction of its own, so that if it fails the
+// database is left as it was before it. On SQLite, where the run already is
+// a transaction, that's a savepoint.
+func (c *lockedConn) step(fn func(execer) error) error {
+	if c.Dialect == DialectSQLite {
+		if _, err := c.Exec("SAVEPOINT migration"); err != nil {
+			return err
+		}
+		if err := fn(c); err != nil {
+			c.Exec("ROLLBACK TO migration")
+			c.Exec("RELEASE migration")
+			return err
+		}
+		_, err := c.Exec("RELEASE migration")
+		return err
+	}
+
+	sqlTx, err := c.conn.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	tx := &Tx{Tx: sqlTx, Dialect: c.Dialect}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// adoptLegacySchema brings a database created by createTables, before
+// migrations were introduced, to the schema of the first migration and
+// records it as applied. Such databases may lack columns added over time,
+// which the first migration can't add as it only creates what is missing.
+// Nothing is done for databases that already track migrations or are empty.
+func adoptLegacySchema(c *lockedConn) error {
+	tracked, err := tableExists(c, "schema_migrations")
+	if err != nil || tracked {
+		return err
+	}
+	legacy, err := tableExists(c, "users")
+	if err != nil || !legacy {
+		return err
+	}
+	if err := c.step(adoptLegacyTables); err != nil {
+		return err
+	}
+	first := migrations()[0]
+	log.Printf("Legacy database adopted as migration %04d_%s.", first.Version, first.Name)
+	return nil
+}
+
+// adoptLegacyTables is the step of adoptLegacySchema that changes the
+// database.
+func adoptLegacyTables(tx execer) error {
+	if err := rebuildLegacyMessages(tx); err != nil {
+		return err
+	}
+	for _, c := range []struct{ table, column, definition string }{
+		{"users", "username_norm", "TEXT NOT NULL DEFAULT ''"},
+		{"users", "email", "TEXT NOT NULL DEFAULT ''"},
+		{"users", "totp_secret", "TEXT NOT NULL DEFAULT ''"},
+		{"users", "totp_enabled", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "totp_last_step", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "is_bot", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "last_seen_at", "TIMESTAMP"},
+		{"users", "last_seen_visibility", "TEXT NOT NULL DEFAULT 'everyone'"},
+		{"messages", "client_id", "TEXT"},
+		{"sessions", "device_name", "TEXT NOT NULL DEFAULT ''"},
+	} {
+		if err := addColumnIfMissing(tx, c.table, c.column, c.definition); err != nil {
+			return err
+		}
+	}
+	if err := backfillUsernameNorm(tx); err != nil {
+		return err
+	}
+
+	first := migrations()[0]
+	if _, err := tx.Exec(first.up); err != nil {
+		return fmt.Errorf("migration %04d_%s: %w", first.Version, first.Name, err)
+	}
+	if _, err := tx.Exec(migrationsTable[DialectSQLite]); err != nil {
+		return err
+	}
+	_, err := tx.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)", first.Version, first.Name, time.Now())
+	return err
+}
+
+// rebuildLegacyMessages converts a messages table from before group
+// messages, which lacks group_id and requires receiver_id, keeping its rows.
+func rebuildLegacyMessages(tx execer) error {
+	exists, err := tableExists(tx, "messages")
+	if err != nil || !exists {
+		return err
+	}
+	hasGroupID, err := hasColumn(tx, "messages", "group_id")
+	if err != nil || hasGroupID {
+		return err
+	}
+	// Renaming the new table rather than the old one keeps the references
+	// of other tables pointing at messages.
+	_, err = tx.Exec(`
+		CREATE TABLE messages_new (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			sender_id INTEGER NOT NULL,
+			receiver_id INTEGER,
+			group_id INTEGER,
+			content TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (sender_id) REFERENCES users (id),
+			FOREIGN KEY (receiver_id) REFERENCES users (id),
+			FOREIGN KEY (group_id) REFERENCES groups (id)
+		);
+		INSERT INTO messages_new (id, sender_id, receiver_id, content, created_at)
+			SELECT id, sender_id, receiver_id, content, created_at FROM messages;
+		DROP TABLE messages;
+		ALTER TABLE messages_new RENAME TO messages;`)
+	if err != nil {
+		return fmt.Errorf("rebuild messages table: %w", err)
+	}
+	log.Println("Legacy messages table rebuilt with group_id.")
+	return nil
+}
+
+// backfillUsernameNorm fills users.username_norm for rows created before the
+// column existed, so its unique index can be created. Usernames that only
+// differ in case or character width can't both be kept; they are listed so
+// an operator can rename one of the accounts before trying again.
+func backfillUsernameNorm(tx execer) error {
+	rows, err := tx.Query("SELECT id, username FROM users WHERE username_norm = ''")
+	if err != nil {
+		return err
+	}
+	pending := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var username string
+		if err := rows.Scan(&id, &username); err != nil {
+			rows.Close()
+			return err
+		}
+		pending[id] = username
+	}
+	rows.Close()
+
+	for id, username := range pending {
+		if _, err := tx.Exec("UPDATE users SET username_norm = ? WHERE id = ?", policy.NormalizeUsername(username), id); err != nil {
+			return err
+		}
+	}
+	if len(pending) > 0 {
+		log.Printf("Normalized %d usernames.", len(pending))
+	}
+
+	rows, err = tx.Query(`SELECT group_concat(username, ', ') FROM users
+		GROUP BY username_norm HAVING COUNT(*) > 1`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var clashes []string
+	for rows.Next() {
+		var usernames string
+		if err := rows.Scan(&usernames); err != nil {
+			return err
+		}
+		clashes = append(clashes, usernames)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(clashes) > 0 {
+		return fmt.Errorf("存在仅大小写或字符宽度不同的重复用户名，请先重命名其中的账户: %s", strings.Join(clashes, "; "))
+	}
+	return nil
+}
+
+// queryer is what the schema inspection helpers need of a DB or Tx.
+type queryer interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// execer is what migrations need of a Tx or the connection of a run.
+type execer interface {
+	queryer
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+func tableExists(q queryer, table string) (bool, error) {
+	query := "SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?)"
+	if DB.Dialect == DialectPostgres {
+		query = "SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = ?)"
+	}
+	var exists bool
+	err := q.QueryRow(query, table).Scan(&exists)
+	return exists, err
+}
+
+// hasColumn is only used on SQLite, for adopting legacy databases.
+func hasColumn(q queryer, table, column string) (bool, error) {
+	var exists bool
+	err := q.QueryRow("SELECT EXISTS (SELECT 1 FROM pragma_table_info(?) WHERE name = ?)", table, column).Scan(&exists)
+	return exists, err
+}
+
+// addColumnIfMissing adds a column to a legacy table, if the table exists;
+// missing tables are created by the first migration.
+func addColumnIfMissing(tx execer, table, column, definition string) error {
+	exists, err := tableExists(tx, table)
+	if err != nil || !exists {
+		return err
+	}
+	has, err := hasColumn(tx, table, column)
+	if err != nil || has {
+		return err
+	}
+	if _, err := tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition); err != nil {
+		return fmt.Errorf("add %s.%s column: %w", table, column, err)
+	}
+	log.Printf("Column %s.%s added.", table, column)
+	return nil
+}
@@ -0,0 +1,15 @@
+-- Removes everything, including all data.
+DROP TABLE IF EXISTS webhook_dead_letters;
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhooks;
+DROP TABLE IF EXISTS bot_updates;
+DROP TABLE IF EXISTS bots;
+DROP TABLE IF EXISTS password_resets;
+DROP TABLE IF EXISTS login_attempts;
+DROP TABLE IF EXISTS recovery_codes;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS updates;
+DROP TABLE IF EXISTS messages;
+DROP TABLE IF EXISTS group_members;
+DROP TABLE IF EXISTS groups;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,174 @@
+-- The schema of migrations/sqlite/0001_initial.up.sql in PostgreSQL's types.
+-- There are no PostgreSQL databases from before migrations to adopt.
+
+CREATE TABLE users (
+    id BIGSERIAL PRIMARY KEY,
+    username TEXT NOT NULL UNIQUE,
+    username_norm TEXT NOT NULL DEFAULT '',
+    password_hash TEXT NOT NULL,
+    email TEXT NOT NULL DEFAULT '',
+    totp_secret TEXT NOT NULL DEFAULT '',
+    totp_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+    totp_last_step BIGINT NOT NULL DEFAULT 0,
+    is_bot BOOLEAN NOT NULL DEFAULT FALSE,
+    last_seen_at TIMESTAMPTZ,
+    last_seen_visibility TEXT NOT NULL DEFAULT 'everyone',
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+CREATE UNIQUE INDEX idx_users_username_norm ON users (username_norm);
+CREATE UNIQUE INDEX idx_users_email ON users (email) WHERE email != '';
+
+CREATE TABLE groups (
+    id BIGSERIAL PRIMARY KEY,
+    name TEXT NOT NULL,
+    creator_id BIGINT NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (creator_id) REFERENCES users (id)
+);
+
+CREATE TABLE group_members (
+    group_id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL,
+    joined_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (group_id, user_id),
+    FOREIGN KEY (group_id) REFERENCES groups (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE messages (
+    id BIGSERIAL PRIMARY KEY,
+    sender_id BIGINT NOT NULL,
+    receiver_id BIGINT, -- NULL for group messages
+    group_id BIGINT,    -- NULL for private messages
+    client_id TEXT,     -- NULL for messages sent by bots
+    content TEXT NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (sender_id) REFERENCES users (id),
+    FOREIGN KEY (receiver_id) REFERENCES users (id),
+    FOREIGN KEY (group_id) REFERENCES groups (id)
+);
+-- Client generated message IDs make sends idempotent.
+CREATE UNIQUE INDEX idx_messages_sender_client_id ON messages (sender_id, client_id) WHERE client_id IS NOT NULL;
+
+-- updates numbers the messages each user sent or received, so clients can
+-- detect and fill gaps after being offline.
+CREATE TABLE updates (
+    user_id BIGINT NOT NULL,
+    pts BIGINT NOT NULL,
+    message_id BIGINT NOT NULL,
+    PRIMARY KEY (user_id, pts),
+    FOREIGN KEY (user_id) REFERENCES users (id),
+    FOREIGN KEY (message_id) REFERENCES messages (id)
+);
+CREATE INDEX idx_updates_message_id ON updates (message_id);
+
+CREATE TABLE sessions (
+    id TEXT PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    refresh_token_hash TEXT NOT NULL UNIQUE,
+    prev_refresh_hash TEXT,
+    device_name TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    ip TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL,
+    last_active_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    revoked_at TIMESTAMPTZ,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX idx_sessions_user_id ON sessions (user_id);
+CREATE INDEX idx_sessions_prev_refresh_hash ON sessions (prev_refresh_hash);
+
+CREATE TABLE recovery_codes (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    code_hash TEXT NOT NULL,
+    used_at TIMESTAMPTZ,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX idx_recovery_codes_user_id ON recovery_codes (user_id);
+
+CREATE TABLE login_attempts (
+    username TEXT PRIMARY KEY,
+    failed_count INTEGER NOT NULL DEFAULT 0,
+    last_failed_at TIMESTAMPTZ,
+    locked_until TIMESTAMPTZ
+);
+
+CREATE TABLE password_resets (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE bots (
+    user_id BIGINT PRIMARY KEY,
+    owner_id BIGINT NOT NULL,
+    token_hash TEXT NOT NULL,
+    webhook_url TEXT NOT NULL DEFAULT '',
+    webhook_secret TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (owner_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX idx_bots_owner_id ON bots (owner_id);
+
+CREATE TABLE bot_updates (
+    id BIGSERIAL PRIMARY KEY,
+    bot_id BIGINT NOT NULL,
+    payload TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    FOREIGN KEY (bot_id) REFERENCES bots (user_id) ON DELETE CASCADE
+);
+CREATE INDEX idx_bot_updates_bot_id ON bot_updates (bot_id, id);
+
+CREATE TABLE webhooks (
+    id BIGSERIAL PRIMARY KEY,
+    owner_id BIGINT NOT NULL,
+    group_id BIGINT,                 -- NULL for user-scoped subscriptions
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    events TEXT NOT NULL DEFAULT '', -- comma separated, empty for all events
+    created_at TIMESTAMPTZ NOT NULL,
+    FOREIGN KEY (owner_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (group_id) REFERENCES groups (id) ON DELETE CASCADE
+);
+CREATE INDEX idx_webhooks_owner_id ON webhooks (owner_id);
+CREATE INDEX idx_webhooks_group_id ON webhooks (group_id);
+
+CREATE TABLE webhook_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    webhook_id BIGINT NOT NULL,
+    event_id TEXT NOT NULL,
+    event_type TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending', -- pending, succeeded or dead
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_status_code INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    next_attempt_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL,
+    FOREIGN KEY (webhook_id) REFERENCES webhooks (id) ON DELETE CASCADE
+);
+CREATE INDEX idx_webhook_deliveries_due ON webhook_deliveries (status, next_attempt_at);
+CREATE INDEX idx_webhook_deliveries_webhook_id ON webhook_deliveries (webhook_id, id);
+
+CREATE TABLE webhook_dead_letters (
+    id BIGSERIAL PRIMARY KEY,
+    delivery_id BIGINT NOT NULL UNIQUE,
+    webhook_id BIGINT NOT NULL,
+    event_type TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    attempts INTEGER NOT NULL,
+    last_status_code INTEGER NOT NULL,
+    last_error TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    FOREIGN KEY (delivery_id) REFERENCES webhook_deliveries (id) ON DELETE CASCADE,
+    FOREIGN KEY (webhook_id) REFERENCES webhooks (id) ON DELETE CASCADE
+);
+CREATE INDEX idx_webhook_dead_letters_webhook_id ON webhook_dead_letters (webhook_id);
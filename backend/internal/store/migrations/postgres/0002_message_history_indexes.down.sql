@@ -0,0 +1,2 @@
+DROP INDEX idx_messages_group_id_id;
+DROP INDEX idx_messages_sender_receiver_id;
@@ -0,0 +1 @@
+DROP TABLE bot_webhook_leases;
@@ -0,0 +1,7 @@
+-- The node that posts a bot's updates to its webhook; see ClaimBotWebhook.
+CREATE TABLE bot_webhook_leases (
+    bot_id BIGINT PRIMARY KEY,
+    node TEXT NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    FOREIGN KEY (bot_id) REFERENCES bots (user_id) ON DELETE CASCADE
+);
@@ -0,0 +1,3 @@
+-- History is paged by message ID within a chat, see HistoryQuery.
+CREATE INDEX idx_messages_sender_receiver_id ON messages (sender_id, receiver_id, id);
+CREATE INDEX idx_messages_group_id_id ON messages (group_id, id);
@@ -0,0 +1,7 @@
+-- The node that posts a bot's updates to its webhook; see ClaimBotWebhook.
+CREATE TABLE IF NOT EXISTS bot_webhook_leases (
+    bot_id INTEGER PRIMARY KEY,
+    node TEXT NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (bot_id) REFERENCES bots (user_id) ON DELETE CASCADE
+);
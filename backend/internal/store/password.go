@@ -0,0 +1,149 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrResetTokenInvalid is returned for password reset tokens that don't exist,
+// have expired or were already used.
+var ErrResetTokenInvalid = errors.New("password reset token invalid")
+
+// UpdatePasswordHash replaces the stored password hash of a user.
+func (st *SQLStore) UpdatePasswordHash(username, hash string) error {
+	_, err := st.db.Exec("UPDATE users SET password_hash = ? WHERE username = ?", hash, username)
+	return err
+}
+
+// SetUserEmail sets the address password reset mail is sent to. An empty
+// email removes it. It returns ErrEmailTaken if another user has the address.
+func (st *SQLStore) SetUserEmail(username, email string) error {
+	_, err := st.db.Exec("UPDATE users SET email = ? WHERE username = ?", email, username)
+	if isUniqueViolation(err, "idx_users_email") {
+		return ErrEmailTaken
+	}
+	return err
+}
+
+// GetUserEmail returns the email address of a user, which may be empty.
+func (st *SQLStore) GetUserEmail(username string) (string, error) {
+	var email string
+	err := st.db.QueryRow("SELECT email FROM users WHERE username = ?", username).Scan(&email)
+	return email, notFound(err, ErrUserNotFound)
+}
+
+// GetUsernameByEmail returns the user an email address belongs to, or
+// ErrUserNotFound.
+func (st *SQLStore) GetUsernameByEmail(email string) (string, error) {
+	var username string
+	err := st.db.QueryRow("SELECT username FROM users WHERE email = ? AND email != ''", email).Scan(&username)
+	return username, notFound(err, ErrUserNotFound)
+}
+
+// RevokeOtherSessions revokes every active session of username except
+// keepID (which may be empty to revoke all of them) and returns the IDs of
+// the sessions it revoked.
+func (st *SQLStore) RevokeOtherSessions(username, keepID string) ([]string, error) {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(
+		`SELECT id FROM sessions
+		 WHERE revoked_at IS NULL AND id != ? AND user_id = (SELECT id FROM users WHERE username = ?)`,
+		keepID, username,
+	)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	now := time.Now()
+	for _, id := range ids {
+		if _, err := tx.Exec("UPDATE sessions SET revoked_at = ? WHERE id = ?", now, id); err != nil {
+			return nil, err
+		}
+	}
+	return ids, tx.Commit()
+}
+
+// CreatePasswordReset stores the hash of a new password reset token.
+func (st *SQLStore) CreatePasswordReset(username, tokenHash string, expiresAt time.Time) error {
+	_, err := st.db.Exec(
+		`INSERT INTO password_resets (user_id, token_hash, created_at, expires_at)
+		 VALUES ((SELECT id FROM users WHERE username = ?), ?, ?, ?)`,
+		username, tokenHash, time.Now(), expiresAt,
+	)
+	return err
+}
+
+// GetPasswordResetUser returns the user a still valid reset token was issued
+// for, without redeeming it.
+func (st *SQLStore) GetPasswordResetUser(tokenHash string) (string, error) {
+	var (
+		username  string
+		expiresAt time.Time
+		usedAt    sql.NullTime
+	)
+	err := st.db.QueryRow(
+		`SELECT u.username, pr.expires_at, pr.used_at
+		 FROM password_resets pr JOIN users u ON pr.user_id = u.id
+		 WHERE pr.token_hash = ?`, tokenHash,
+	).Scan(&username, &expiresAt, &usedAt)
+	if err == sql.ErrNoRows {
+		return "", ErrResetTokenInvalid
+	} else if err != nil {
+		return "", err
+	}
+	if usedAt.Valid || time.Now().After(expiresAt) {
+		return "", ErrResetTokenInvalid
+	}
+	return username, nil
+}
+
+// ConsumePasswordReset redeems a reset token and returns the user it was
+// issued for. The token is checked and marked used in one statement, so of
+// concurrent redemptions only one succeeds. Redeeming a token invalidates
+// every other outstanding token of the same user.
+func (st *SQLStore) ConsumePasswordReset(tokenHash string) (string, error) {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	var userID int
+	err = tx.QueryRow(
+		`UPDATE password_resets SET used_at = ?
+		 WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?
+		 RETURNING user_id`,
+		now, tokenHash, now,
+	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return "", ErrResetTokenInvalid
+	} else if err != nil {
+		return "", err
+	}
+
+	if _, err = tx.Exec("UPDATE password_resets SET used_at = ? WHERE user_id = ? AND used_at IS NULL", now, userID); err != nil {
+		return "", err
+	}
+	var username string
+	if err = tx.QueryRow("SELECT username FROM users WHERE id = ?", userID).Scan(&username); err != nil {
+		return "", err
+	}
+	return username, tx.Commit()
+}
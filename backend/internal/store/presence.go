@@ -0,0 +1,93 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+)
+
+// PresenceInfo is what is stored about a user's presence; whether the user
+// is online is only known to the hub.
+type PresenceInfo struct {
+	Visibility string       // who may see the exact state, see package presence
+	LastSeenAt sql.NullTime // NULL if the user never connected
+}
+
+// GetPresenceInfo returns a user's presence privacy setting and last seen
+// time.
+func (st *SQLStore) GetPresenceInfo(username string) (*PresenceInfo, error) {
+	var p PresenceInfo
+	err := st.db.QueryRow(
+		"SELECT last_seen_visibility, last_seen_at FROM users WHERE username = ?", username,
+	).Scan(&p.Visibility, &p.LastSeenAt)
+	if err != nil {
+		return nil, notFound(err, ErrUserNotFound)
+	}
+	return &p, nil
+}
+
+// SetLastSeenVisibility changes who may see a user's exact presence.
+func (st *SQLStore) SetLastSeenVisibility(username, visibility string) error {
+	_, err := st.db.Exec("UPDATE users SET last_seen_visibility = ? WHERE username = ?", visibility, username)
+	return err
+}
+
+// SetLastSeen records when a user was last online.
+func (st *SQLStore) SetLastSeen(username string, t time.Time) error {
+	_, err := st.db.Exec("UPDATE users SET last_seen_at = ? WHERE username = ?", t, username)
+	return err
+}
+
+// IsContact reports whether other is a contact of username, i.e. username
+// sent other a private message. Receiving messages doesn't make the sender a
+// contact, so anyone can't become one by writing to a user.
+func (st *SQLStore) IsContact(username, other string) (bool, error) {
+	var exists bool
+	err := st.db.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM messages m
+		 JOIN users s ON m.sender_id = s.id
+		 JOIN users r ON m.receiver_id = r.id
+		 WHERE s.username = ? AND r.username = ?)`,
+		username, other,
+	).Scan(&exists)
+	return exists, err
+}
+
+// GetContacts returns the contacts of a user: the users they sent a private
+// message to.
+func (st *SQLStore) GetContacts(username string) ([]string, error) {
+	return st.queryUsernames(
+		`SELECT u.username FROM users u WHERE u.id IN (
+			SELECT m.receiver_id FROM messages m WHERE m.sender_id = (SELECT id FROM users WHERE username = ?)
+		) AND u.username != ?`,
+		username, username,
+	)
+}
+
+// GetGroupPeers returns the users sharing at least one group with a user.
+func (st *SQLStore) GetGroupPeers(username string) ([]string, error) {
+	return st.queryUsernames(
+		`SELECT DISTINCT u.username FROM users u
+		 JOIN group_members peer ON peer.user_id = u.id
+		 JOIN group_members self ON self.group_id = peer.group_id
+		 WHERE self.user_id = (SELECT id FROM users WHERE username = ?) AND u.username != ?`,
+		username, username,
+	)
+}
+
+func (st *SQLStore) queryUsernames(query string, args ...any) ([]string, error) {
+	rows, err := st.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var usernames []string
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		usernames = append(usernames, username)
+	}
+	return usernames, rows.Err()
+}
@@ -0,0 +1,142 @@
+package store
+
+import "time"
+
+// Repos are the repositories the API and WebSocket handlers, bots, webhooks
+// and presence use, passed to their constructors or Start functions.
+// NewSQLStore provides them on the database and package memstore in memory.
+type Repos struct {
+	Users          UserRepo
+	Groups         GroupRepo
+	Messages       MessageRepo
+	Sessions       SessionRepo
+	TwoFactor      TwoFactorRepo
+	LoginGuard     LoginGuardRepo
+	PasswordResets PasswordResetRepo
+	Presence       PresenceRepo
+	Bots           BotRepo
+	Webhooks       WebhookRepo
+}
+
+// UserRepo stores accounts. Lookups of users that don't exist return
+// ErrUserNotFound.
+type UserRepo interface {
+	CreateUser(username, passwordHash, email string) error
+	ResolveUsername(name string) (string, error)
+	GetPasswordHash(name string) (username, hash string, err error)
+	UpdatePasswordHash(username, hash string) error
+	GetUserEmail(username string) (string, error)
+	SetUserEmail(username, email string) error
+	GetUsernameByEmail(email string) (string, error)
+	GetAllUsers(exceptUsername string) ([]User, error)
+	IsBot(username string) (bool, error)
+	GetUserID(username string) (int64, error)
+	GetUsernameByID(id int64) (string, error)
+}
+
+// GroupRepo stores groups and their members.
+type GroupRepo interface {
+	CreateGroup(name string, creatorUsername string) (int64, error)
+	AddGroupMember(groupID int64, username string) error
+	GetGroupName(groupID int64) (string, error)
+	GetGroupMembers(groupID int64) ([]string, error)
+	IsUserInGroup(username string, groupID int64) (bool, error)
+	GetUserGroups(username string) ([]Group, error)
+}
+
+// MessageRepo stores messages and the update sequences they are appended to.
+type MessageRepo interface {
+	InsertPrivateMessage(sender, receiver, clientID, content string) (*Message, []Recipient, error)
+	InsertGroupMessage(sender string, groupID int64, clientID, content string) (*Message, []Recipient, error)
+	GetPrivateHistory(user1, user2 string, q HistoryQuery) (*HistoryPage, error)
+	GetGroupHistory(groupID int64, q HistoryQuery) (*HistoryPage, error)
+	HasMessaged(sender, receiver string) (bool, error)
+	GetUpdateState(username string) (int64, error)
+	GetUpdates(username string, pts int64, limit int) ([]Update, error)
+}
+
+// SessionRepo stores login sessions.
+type SessionRepo interface {
+	CreateSession(username, refreshHash, deviceName, userAgent, ip string, expiresAt time.Time) (string, error)
+	RotateRefreshToken(oldHash, newHash string, expiresAt time.Time) (*Session, error)
+	RevokeSession(id string) error
+	RevokeUserSession(username, id string) error
+	RevokeOtherSessions(username, keepID string) ([]string, error)
+	IsSessionActive(id string) (bool, error)
+	TouchSession(id, ip string) error
+	GetActiveSessions(username string) ([]Session, error)
+}
+
+// TwoFactorRepo stores the TOTP secrets and recovery codes of users.
+type TwoFactorRepo interface {
+	GetTwoFactor(username string) (*TwoFactor, error)
+	SetPendingTOTPSecret(username, secret string) error
+	EnableTwoFactor(username string, recoveryCodeHashes []string) error
+	DisableTwoFactor(username string) error
+	ConsumeTOTPStep(username string, step int64) (bool, error)
+	ConsumeRecoveryCode(username, codeHash string) (bool, error)
+	CountRecoveryCodes(username string) (int, error)
+}
+
+// LoginGuardRepo stores failed logins and lockouts, keyed by normalized
+// username.
+type LoginGuardRepo interface {
+	GetLoginThrottle(username string) (*LoginThrottle, error)
+	RecordLoginFailure(username string) (int, error)
+	LockAccount(username string, until time.Time) error
+	ResetLoginFailures(username string) error
+}
+
+// PasswordResetRepo stores password reset tokens. Invalid tokens yield
+// ErrResetTokenInvalid.
+type PasswordResetRepo interface {
+	CreatePasswordReset(username, tokenHash string, expiresAt time.Time) error
+	GetPasswordResetUser(tokenHash string) (string, error)
+	ConsumePasswordReset(tokenHash string) (string, error)
+}
+
+// PresenceRepo stores last seen times and who may see them.
+type PresenceRepo interface {
+	GetPresenceInfo(username string) (*PresenceInfo, error)
+	SetLastSeenVisibility(username, visibility string) error
+	SetLastSeen(username string, t time.Time) error
+	IsContact(username, other string) (bool, error)
+	GetContacts(username string) ([]string, error)
+	GetGroupPeers(username string) ([]string, error)
+}
+
+// BotRepo stores bot accounts, their pending updates and which node posts
+// them to their webhook.
+type BotRepo interface {
+	CreateBot(owner, username, tokenHash string) (int64, error)
+	GetBot(id int64) (*Bot, error)
+	GetAllBots() ([]Bot, error)
+	GetBotsByOwner(owner string) ([]Bot, error)
+	SetBotToken(owner string, id int64, tokenHash string) error
+	SetBotWebhook(id int64, url, secret string) error
+	AddBotUpdate(botID int64, payload []byte) (int64, error)
+	GetBotUpdates(botID, offset int64, limit int) ([]BotUpdate, error)
+	ConfirmBotUpdates(botID, offset int64) error
+	PruneBotUpdates() error
+	ClaimBotWebhook(botID int64, node string, lease time.Duration) (bool, error)
+	ReleaseBotWebhook(botID int64, node string) error
+}
+
+// WebhookRepo stores webhook subscriptions and their delivery queue.
+type WebhookRepo interface {
+	CreateWebhook(owner string, groupID int64, url, secret string, events []string) (int64, error)
+	GetWebhook(owner string, id int64) (*Webhook, error)
+	GetWebhookByID(id int64) (*Webhook, error)
+	GetWebhooksByOwner(owner string) ([]Webhook, error)
+	FindWebhookSubscribers(usernames []string, groupID int64) ([]Webhook, error)
+	DeleteWebhook(owner string, id int64) error
+	EnqueueWebhookDelivery(webhookID int64, eventID, eventType string, payload []byte) error
+	ClaimDueWebhookDeliveries(limit int, lease time.Duration) ([]WebhookDelivery, error)
+	MarkWebhookDelivered(id int64, attempts, statusCode int) error
+	RescheduleWebhookDelivery(id int64, attempts, statusCode int, lastError string, next time.Time) error
+	DeadLetterWebhookDelivery(d *WebhookDelivery, attempts, statusCode int, lastError string) error
+	GetWebhookDeliveries(webhookID int64, limit int) ([]WebhookDelivery, error)
+	GetWebhookDeadLetters(webhookID int64) ([]WebhookDeadLetter, error)
+	RequeueWebhookDeadLetter(webhookID, deadLetterID int64) error
+	PruneWebhookDeliveries(before time.Time) error
+}
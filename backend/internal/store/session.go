@@ -0,0 +1,216 @@
+package store
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrSessionNotFound is returned when a refresh token does not belong to
+	// any live session.
+	ErrSessionNotFound = newError(ErrNotFound, "session not found")
+	// ErrRefreshTokenReused is returned when an already rotated refresh token
+	// is presented again. The owning session is revoked when this happens,
+	// since the token has most likely leaked.
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+)
+
+type Session struct {
+	ID           string     `json:"id"`
+	UserID       int        `json:"-"`
+	Username     string     `json:"-"`
+	DeviceName   string     `json:"device_name"`
+	UserAgent    string     `json:"user_agent"`
+	IP           string     `json:"ip"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastActiveAt time.Time  `json:"last_active_at"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// SessionTouchInterval limits how often last_active_at is written for a
+// session that is in constant use. Callers touching a session for every
+// request or frame may skip touches within it without losing anything.
+const SessionTouchInterval = time.Minute
+
+// CreateSession persists a new login session for username and returns its ID.
+func (st *SQLStore) CreateSession(username, refreshHash, deviceName, userAgent, ip string, expiresAt time.Time) (string, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	_, err = st.db.Exec(
+		`INSERT INTO sessions (id, user_id, refresh_token_hash, device_name, user_agent, ip, created_at, last_active_at, expires_at)
+		 VALUES (?, (SELECT id FROM users WHERE username = ?), ?, ?, ?, ?, ?, ?, ?)`,
+		id, username, refreshHash, deviceName, userAgent, ip, now, now, expiresAt,
+	)
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// RotateRefreshToken swaps the refresh token of the session currently holding
+// oldHash for newHash and returns the updated session. Presenting a token that
+// was already rotated away revokes the whole session.
+func (st *SQLStore) RotateRefreshToken(oldHash, newHash string, expiresAt time.Time) (*Session, error) {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var s Session
+	var revokedAt sql.NullTime
+	err = tx.QueryRow(
+		`SELECT s.id, s.user_id, u.username, s.expires_at, s.revoked_at
+		 FROM sessions s JOIN users u ON s.user_id = u.id
+		 WHERE s.refresh_token_hash = ?`, oldHash,
+	).Scan(&s.ID, &s.UserID, &s.Username, &s.ExpiresAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		var reusedID string
+		err = tx.QueryRow("SELECT id FROM sessions WHERE prev_refresh_hash = ?", oldHash).Scan(&reusedID)
+		if err == sql.ErrNoRows {
+			return nil, ErrSessionNotFound
+		} else if err != nil {
+			return nil, err
+		}
+		if _, err = tx.Exec("UPDATE sessions SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", time.Now(), reusedID); err != nil {
+			return nil, err
+		}
+		if err = tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	} else if err != nil {
+		return nil, err
+	}
+	if revokedAt.Valid || time.Now().After(s.ExpiresAt) {
+		return nil, ErrSessionNotFound
+	}
+
+	// The token is checked again by the update: a concurrent refresh with
+	// the same token may have rotated it since the select, in which case
+	// the token was used twice.
+	now := time.Now()
+	res, err := tx.Exec(
+		`UPDATE sessions SET refresh_token_hash = ?, prev_refresh_hash = ?, last_active_at = ?, expires_at = ?
+		 WHERE id = ? AND refresh_token_hash = ? AND revoked_at IS NULL`,
+		newHash, oldHash, now, expiresAt, s.ID, oldHash,
+	)
+	if err != nil {
+		return nil, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if n != 1 {
+		if _, err = tx.Exec("UPDATE sessions SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", now, s.ID); err != nil {
+			return nil, err
+		}
+		if err = tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+	s.LastActiveAt = now
+	s.ExpiresAt = expiresAt
+	return &s, tx.Commit()
+}
+
+// RevokeSession marks a session as revoked. Revoking an already revoked
+// session is a no-op.
+func (st *SQLStore) RevokeSession(id string) error {
+	_, err := st.db.Exec("UPDATE sessions SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", time.Now(), id)
+	return err
+}
+
+// IsSessionActive reports whether the session exists, has not been revoked
+// and has not expired.
+func (st *SQLStore) IsSessionActive(id string) (bool, error) {
+	var expiresAt time.Time
+	var revokedAt sql.NullTime
+	err := st.db.QueryRow("SELECT expires_at, revoked_at FROM sessions WHERE id = ?", id).Scan(&expiresAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return !revokedAt.Valid && time.Now().Before(expiresAt), nil
+}
+
+// TouchSession records activity on a session, updating its last known IP.
+// Writes are throttled to one per SessionTouchInterval.
+func (st *SQLStore) TouchSession(id, ip string) error {
+	now := time.Now()
+	_, err := st.db.Exec(
+		"UPDATE sessions SET last_active_at = ?, ip = ? WHERE id = ? AND last_active_at < ?",
+		now, ip, id, now.Add(-SessionTouchInterval),
+	)
+	return err
+}
+
+// GetActiveSessions lists the unrevoked, unexpired sessions of a user, most
+// recently active first.
+func (st *SQLStore) GetActiveSessions(username string) ([]Session, error) {
+	rows, err := st.db.Query(
+		`SELECT s.id, s.user_id, u.username, s.device_name, s.user_agent, s.ip, s.created_at, s.last_active_at, s.expires_at
+		 FROM sessions s JOIN users u ON s.user_id = u.id
+		 WHERE u.username = ? AND s.revoked_at IS NULL
+		 ORDER BY s.last_active_at DESC`,
+		username,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	var sessions []Session
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.UserID, &s.Username, &s.DeviceName, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastActiveAt, &s.ExpiresAt); err != nil {
+			return nil, err
+		}
+		if now.After(s.ExpiresAt) {
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeUserSession revokes session id if it belongs to username. It returns
+// ErrSessionNotFound if the session does not exist, belongs to someone else or
+// was already revoked.
+func (st *SQLStore) RevokeUserSession(username, id string) error {
+	res, err := st.db.Exec(
+		`UPDATE sessions SET revoked_at = ?
+		 WHERE id = ? AND revoked_at IS NULL AND user_id = (SELECT id FROM users WHERE username = ?)`,
+		time.Now(), id, username,
+	)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
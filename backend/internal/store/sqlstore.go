@@ -0,0 +1,27 @@
+package store
+
+// SQLStore implements the repositories on a SQLite or PostgreSQL database
+// migrated with MigrateUp.
+type SQLStore struct {
+	db *Conn
+}
+
+func NewSQLStore(db *Conn) *SQLStore {
+	return &SQLStore{db: db}
+}
+
+// Repos returns the store as every repository.
+func (st *SQLStore) Repos() Repos {
+	return Repos{
+		Users:          st,
+		Groups:         st,
+		Messages:       st,
+		Sessions:       st,
+		TwoFactor:      st,
+		LoginGuard:     st,
+		PasswordResets: st,
+		Presence:       st,
+		Bots:           st,
+		Webhooks:       st,
+	}
+}
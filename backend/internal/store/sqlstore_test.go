@@ -0,0 +1,473 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dialects runs a test against a fresh SQLite database and, if DATABASE_URL
+// is set, against PostgreSQL. The PostgreSQL database gets a schema of its
+// own for every test, which is dropped afterwards, so DATABASE_URL may point
+// at a database that is in use.
+func dialects(t *testing.T, test func(t *testing.T)) {
+	t.Run("sqlite", func(t *testing.T) {
+		// Concurrent writers wait for each other instead of failing.
+		dsn := "file:" + filepath.Join(t.TempDir(), "test.db") + "?_busy_timeout=10000&_txlock=immediate"
+		if err := Open(dsn); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { DB.Close() })
+		test(t)
+	})
+	t.Run("postgres", func(t *testing.T) {
+		openPostgres(t)
+		test(t)
+	})
+}
+
+func openPostgres(t *testing.T) {
+	dsn := os.Getenv("DATABASE_URL")
+	if dsn == "" {
+		t.Skip("DATABASE_URL not set")
+	}
+	admin, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := fmt.Sprintf("store_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		admin.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			t.Error(err)
+		}
+		admin.Close()
+	})
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	q.Set("search_path", schema)
+	u.RawQuery = q.Encode()
+	if err := Open(u.String()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { DB.Close() })
+}
+
+// migrated applies every migration and returns the store.
+func migrated(t *testing.T) *SQLStore {
+	t.Helper()
+	if err := MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+	return NewSQLStore(DB)
+}
+
+func TestMigrations(t *testing.T) {
+	dialects(t, func(t *testing.T) {
+		version := func() int {
+			t.Helper()
+			v, err := SchemaVersion()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return v
+		}
+
+		if err := MigrateUp(); err != nil {
+			t.Fatal(err)
+		}
+		if v := version(); v != LatestVersion() {
+			t.Fatalf("version %d after migrating up, want %d", v, LatestVersion())
+		}
+
+		// Every down migration undoes its up migration, one at a time.
+		for want := LatestVersion() - 1; want >= 0; want-- {
+			if err := MigrateDown(); err != nil {
+				t.Fatal(err)
+			}
+			if v := version(); v != want {
+				t.Fatalf("version %d after migrating down, want %d", v, want)
+			}
+		}
+		for _, table := range []string{"users", "messages", "updates", "bots", "bot_webhook_leases"} {
+			if exists, err := tableExists(DB, table); err != nil || exists {
+				t.Errorf("table %s left after reverting every migration (err %v)", table, err)
+			}
+		}
+
+		if err := MigrateUp(); err != nil {
+			t.Fatalf("migrating up again: %v", err)
+		}
+		if v := version(); v != LatestVersion() {
+			t.Fatalf("version %d after migrating up again, want %d", v, LatestVersion())
+		}
+	})
+}
+
+// TestConcurrentMigrations runs migrations the way servers starting at the
+// same time do: each run waits for the lock, and only the first migrates.
+func TestConcurrentMigrations(t *testing.T) {
+	dialects(t, func(t *testing.T) {
+		const runs = 4
+		var wg sync.WaitGroup
+		errs := make(chan error, runs)
+		for range runs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- MigrateUp()
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Errorf("concurrent migration: %v", err)
+			}
+		}
+
+		var applied int
+		if err := DB.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&applied); err != nil {
+			t.Fatal(err)
+		}
+		if applied != LatestVersion() {
+			t.Errorf("%d migrations recorded, want %d", applied, LatestVersion())
+		}
+	})
+}
+
+func TestUniqueViolations(t *testing.T) {
+	dialects(t, func(t *testing.T) {
+		st := migrated(t)
+		if err := st.CreateUser("alice", "hash", "alice@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if err := st.CreateUser("bob", "hash", ""); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := st.CreateUser("ALICE", "hash", ""); !errors.Is(err, ErrUsernameTaken) {
+			t.Errorf("CreateUser with a taken username: %v, want ErrUsernameTaken", err)
+		}
+		if err := st.CreateUser("carol", "hash", "alice@example.com"); !errors.Is(err, ErrEmailTaken) {
+			t.Errorf("CreateUser with a taken email: %v, want ErrEmailTaken", err)
+		}
+		if err := st.SetUserEmail("bob", "alice@example.com"); !errors.Is(err, ErrEmailTaken) {
+			t.Errorf("SetUserEmail with a taken email: %v, want ErrEmailTaken", err)
+		}
+
+		groupID, err := st.CreateGroup("friends", "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := st.AddGroupMember(groupID, "bob"); err != nil {
+			t.Fatal(err)
+		}
+		if err := st.AddGroupMember(groupID, "bob"); !errors.Is(err, ErrAlreadyMember) {
+			t.Errorf("AddGroupMember twice: %v, want ErrAlreadyMember", err)
+		}
+
+		// A violation the store didn't check for beforehand, as when two
+		// registrations race, is recognized from the driver's error.
+		_, err = DB.Exec(
+			"INSERT INTO users (username, username_norm, password_hash, email, created_at) VALUES (?, ?, '', '', ?)",
+			"Bob", "bob", time.Now(),
+		)
+		if !isUniqueViolation(err, "") {
+			t.Errorf("duplicate username_norm: %v, want a unique violation", err)
+		}
+		// Only PostgreSQL names the violated index.
+		if DB.Dialect == DialectPostgres && isUniqueViolation(err, "idx_users_email") {
+			t.Error("duplicate username_norm taken for a duplicate email")
+		}
+		if isUniqueViolation(errors.New("UNIQUE constraint failed: users.email"), "") {
+			t.Error("an error that isn't from the driver taken for a unique violation")
+		}
+	})
+}
+
+func TestReturningID(t *testing.T) {
+	dialects(t, func(t *testing.T) {
+		st := migrated(t)
+		for _, name := range []string{"alice", "bob"} {
+			if err := st.CreateUser(name, "hash", ""); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var ids []int
+		for i := range 3 {
+			msg, _, err := st.InsertPrivateMessage("alice", "bob", fmt.Sprintf("c%d", i), "hi")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, msg.ID)
+		}
+		if ids[0] <= 0 || ids[1] <= ids[0] || ids[2] <= ids[1] {
+			t.Errorf("message IDs %v, want increasing positive IDs", ids)
+		}
+		// A retry with the same client ID returns the stored message.
+		msg, _, err := st.InsertPrivateMessage("alice", "bob", "c1", "hi")
+		if err != nil || msg.ID != ids[1] {
+			t.Errorf("retried message: ID %d, err %v; want ID %d", msg.ID, err, ids[1])
+		}
+
+		botID, err := st.CreateBot("alice", "helper_bot", "hash")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, err := st.GetBot(botID); err != nil || b.Username != "helper_bot" {
+			t.Errorf("GetBot(%d) = %+v, %v; want helper_bot", botID, b, err)
+		}
+		first, err := st.AddBotUpdate(botID, []byte(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := st.AddBotUpdate(botID, []byte(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		updates, err := st.GetBotUpdates(botID, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(updates) != 2 || updates[0].ID != first || updates[1].ID != second {
+			t.Errorf("bot updates %+v, want IDs %d and %d", updates, first, second)
+		}
+	})
+}
+
+// TestConcurrentUpdates sends messages to overlapping sets of users at the
+// same time and checks that every user's update sequence still numbers
+// their messages 1, 2, 3, ... without gaps or duplicates.
+func TestConcurrentUpdates(t *testing.T) {
+	dialects(t, func(t *testing.T) {
+		st := migrated(t)
+		users := []string{"alice", "bob", "carol", "dave"}
+		for _, name := range users {
+			if err := st.CreateUser(name, "hash", ""); err != nil {
+				t.Fatal(err)
+			}
+		}
+		groupID, err := st.CreateGroup("all", "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range users[1:] {
+			if err := st.AddGroupMember(groupID, name); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		const perSender = 10
+		var wg sync.WaitGroup
+		errs := make(chan error, len(users)*perSender)
+		for i, sender := range users {
+			receiver := users[(i+1)%len(users)]
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for n := range perSender {
+					clientID := fmt.Sprintf("%s-%d", sender, n)
+					var err error
+					if n%2 == 0 {
+						_, _, err = st.InsertGroupMessage(sender, groupID, clientID, "hi all")
+					} else {
+						_, _, err = st.InsertPrivateMessage(sender, receiver, clientID, "hi")
+					}
+					if err != nil {
+						errs <- err
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatal(err)
+		}
+
+		// Everyone gets every group message, plus the private messages they
+		// sent and received.
+		want := len(users)*perSender/2 + 2*perSender/2
+		for _, name := range users {
+			updates, err := st.GetUpdates(name, 0, 1000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(updates) != want {
+				t.Errorf("%s has %d updates, want %d", name, len(updates), want)
+			}
+			seen := make(map[int64]bool)
+			for i, u := range updates {
+				if u.PTS != int64(i+1) {
+					t.Errorf("%s: update %d has PTS %d, want %d", name, i, u.PTS, i+1)
+					break
+				}
+				if seen[u.MessageID] {
+					t.Errorf("%s: message %d appended twice", name, u.MessageID)
+				}
+				seen[u.MessageID] = true
+			}
+			if state, err := st.GetUpdateState(name); err != nil || state != int64(len(updates)) {
+				t.Errorf("%s: update state %d, %v; want %d", name, state, err, len(updates))
+			}
+		}
+	})
+}
+
+// TestConcurrentRefresh presents the same refresh token several times at
+// once, as a client and an attacker holding a leaked token might: one
+// refresh wins, every other one counts as reuse and revokes the session.
+func TestConcurrentRefresh(t *testing.T) {
+	dialects(t, func(t *testing.T) {
+		st := migrated(t)
+		if err := st.CreateUser("alice", "hash", ""); err != nil {
+			t.Fatal(err)
+		}
+		expiresAt := time.Now().Add(time.Hour)
+		id, err := st.CreateSession("alice", "token-0", "phone", "test", "192.0.2.1", expiresAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		const refreshes = 8
+		var wg sync.WaitGroup
+		errs := make(chan error, refreshes)
+		for n := range refreshes {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := st.RotateRefreshToken("token-0", fmt.Sprintf("token-%d", n+1), expiresAt)
+				errs <- err
+			}()
+		}
+		wg.Wait()
+		close(errs)
+
+		rotated, reused := 0, 0
+		for err := range errs {
+			switch {
+			case err == nil:
+				rotated++
+			case errors.Is(err, ErrRefreshTokenReused):
+				reused++
+			default:
+				t.Errorf("concurrent refresh: %v", err)
+			}
+		}
+		if rotated != 1 || reused != refreshes-1 {
+			t.Errorf("%d refreshes rotated the token and %d were reuse, want 1 and %d", rotated, reused, refreshes-1)
+		}
+		if active, err := st.IsSessionActive(id); err != nil || active {
+			t.Errorf("session active %v (err %v) after its refresh token was reused", active, err)
+		}
+	})
+}
+
+// TestLoginFailuresAfterLockout checks that a failure after a lockout has
+// expired starts counting afresh instead of locking the account again.
+func TestLoginFailuresAfterLockout(t *testing.T) {
+	dialects(t, func(t *testing.T) {
+		st := migrated(t)
+		for want := 1; want <= 3; want++ {
+			if count, err := st.RecordLoginFailure("alice"); err != nil || count != want {
+				t.Fatalf("failure %d: count %d, %v", want, count, err)
+			}
+		}
+
+		// A failure during the lockout keeps counting.
+		if err := st.LockAccount("alice", time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if count, err := st.RecordLoginFailure("alice"); err != nil || count != 4 {
+			t.Errorf("failure while locked: count %d, %v; want 4", count, err)
+		}
+
+		if err := st.LockAccount("alice", time.Now().Add(-time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		if count, err := st.RecordLoginFailure("alice"); err != nil || count != 1 {
+			t.Errorf("failure after the lockout expired: count %d, %v; want 1", count, err)
+		}
+		throttle, err := st.GetLoginThrottle("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if throttle.FailedCount != 1 || throttle.LockedUntil != nil {
+			t.Errorf("throttle %+v after the lockout expired, want one failure and no lockout", throttle)
+		}
+	})
+}
+
+// TestPasswordResetSingleUse redeems the same reset token several times at
+// once: only one redemption may set a password.
+func TestPasswordResetSingleUse(t *testing.T) {
+	dialects(t, func(t *testing.T) {
+		st := migrated(t)
+		if err := st.CreateUser("alice", "hash", "alice@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		for _, token := range []string{"token", "other"} {
+			if err := st.CreatePasswordReset("alice", token, time.Now().Add(time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := st.CreatePasswordReset("alice", "expired", time.Now().Add(-time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := st.ConsumePasswordReset("expired"); !errors.Is(err, ErrResetTokenInvalid) {
+			t.Errorf("expired token: %v, want ErrResetTokenInvalid", err)
+		}
+		if _, err := st.ConsumePasswordReset("unknown"); !errors.Is(err, ErrResetTokenInvalid) {
+			t.Errorf("unknown token: %v, want ErrResetTokenInvalid", err)
+		}
+
+		const redemptions = 8
+		var wg sync.WaitGroup
+		errs := make(chan error, redemptions)
+		for range redemptions {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				username, err := st.ConsumePasswordReset("token")
+				if err == nil && username != "alice" {
+					err = fmt.Errorf("redeemed for %q", username)
+				}
+				errs <- err
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		redeemed := 0
+		for err := range errs {
+			switch {
+			case err == nil:
+				redeemed++
+			case !errors.Is(err, ErrResetTokenInvalid):
+				t.Errorf("concurrent redemption: %v", err)
+			}
+		}
+		if redeemed != 1 {
+			t.Errorf("token redeemed %d times, want once", redeemed)
+		}
+
+		// Redeeming a token invalidates the other tokens of the user.
+		if _, err := st.ConsumePasswordReset("other"); !errors.Is(err, ErrResetTokenInvalid) {
+			t.Errorf("other token after a redemption: %v, want ErrResetTokenInvalid", err)
+		}
+	})
+}
@@ -0,0 +1,122 @@
+package store
+
+import "time"
+
+// TwoFactor is the TOTP state of a user. Secret is set as soon as enrollment
+// starts, Enabled only once the user proved they can generate codes.
+type TwoFactor struct {
+	Secret   string
+	Enabled  bool
+	LastStep int64
+}
+
+// GetTwoFactor returns the TOTP state of a user.
+func (st *SQLStore) GetTwoFactor(username string) (*TwoFactor, error) {
+	var tf TwoFactor
+	err := st.db.QueryRow(
+		"SELECT totp_secret, totp_enabled, totp_last_step FROM users WHERE username = ?", username,
+	).Scan(&tf.Secret, &tf.Enabled, &tf.LastStep)
+	if err != nil {
+		return nil, notFound(err, ErrUserNotFound)
+	}
+	return &tf, nil
+}
+
+// SetPendingTOTPSecret stores a secret for an enrollment that has not been
+// confirmed yet. It does nothing if two-factor auth is already enabled.
+func (st *SQLStore) SetPendingTOTPSecret(username, secret string) error {
+	_, err := st.db.Exec(
+		"UPDATE users SET totp_secret = ?, totp_last_step = 0 WHERE username = ? AND NOT totp_enabled",
+		secret, username,
+	)
+	return err
+}
+
+// EnableTwoFactor turns on TOTP for a user and replaces their recovery codes
+// with the given hashes.
+func (st *SQLStore) EnableTwoFactor(username string, recoveryCodeHashes []string) error {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	if err = tx.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("UPDATE users SET totp_enabled = TRUE WHERE id = ?", userID); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	for _, hash := range recoveryCodeHashes {
+		if _, err = tx.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, hash); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DisableTwoFactor removes the TOTP secret and all recovery codes of a user.
+func (st *SQLStore) DisableTwoFactor(username string) error {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	if err = tx.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("UPDATE users SET totp_secret = '', totp_enabled = FALSE, totp_last_step = 0 WHERE id = ?", userID); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ConsumeTOTPStep records that the code for step has been used. It returns
+// false if a code for this or a later step was already accepted, which makes
+// every code single-use.
+func (st *SQLStore) ConsumeTOTPStep(username string, step int64) (bool, error) {
+	res, err := st.db.Exec(
+		"UPDATE users SET totp_last_step = ? WHERE username = ? AND totp_last_step < ?",
+		step, username, step,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// ConsumeRecoveryCode marks the recovery code with the given hash as used.
+// It returns false if no unused code matches.
+func (st *SQLStore) ConsumeRecoveryCode(username, codeHash string) (bool, error) {
+	res, err := st.db.Exec(
+		`UPDATE recovery_codes SET used_at = ?
+		 WHERE code_hash = ? AND used_at IS NULL AND user_id = (SELECT id FROM users WHERE username = ?)`,
+		time.Now(), codeHash, username,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// CountRecoveryCodes returns how many unused recovery codes a user has left.
+func (st *SQLStore) CountRecoveryCodes(username string) (int, error) {
+	var n int
+	err := st.db.QueryRow(
+		`SELECT COUNT(*) FROM recovery_codes
+		 WHERE used_at IS NULL AND user_id = (SELECT id FROM users WHERE username = ?)`,
+		username,
+	).Scan(&n)
+	return n, err
+}
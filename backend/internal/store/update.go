@@ -0,0 +1,115 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Update is an entry of a user's update sequence: a message the user sent or
+// received. PTS numbers the entries of each user 1, 2, 3, ... without gaps,
+// so a client that knows the last PTS it processed can tell whether it
+// missed anything and fetch exactly what it missed.
+type Update struct {
+	PTS       int64
+	MessageID int64
+	ClientID  string
+	Sender    string
+	Receiver  string // empty for group messages
+	GroupID   int64  // 0 for private messages
+	Content   string
+	CreatedAt time.Time
+}
+
+// appendUpdates appends a new message to the update sequence of everyone it
+// is delivered to: the sender and the receiver of a private message, or the
+// members of a group. It must run in the transaction storing the message, so
+// that a message is never stored without its updates or the other way round.
+func appendUpdates(tx *Tx, messageID int64, sender string, receiver sql.NullString, groupID sql.NullInt64) ([]Recipient, error) {
+	var (
+		from = "users u WHERE u.username IN (?, ?)"
+		args = []any{sender, receiver.String}
+	)
+	if groupID.Valid {
+		from = "group_members gm JOIN users u ON gm.user_id = u.id WHERE gm.group_id = ?"
+		args = []any{groupID.Int64}
+	}
+
+	// SQLite allows one writer at a time, so MAX(pts) + 1 can't race with
+	// another transaction. PostgreSQL doesn't; there the rows of the
+	// recipients are locked first, in ID order so that concurrent messages to
+	// overlapping recipients can't deadlock.
+	if tx.Dialect == DialectPostgres {
+		if _, err := tx.Exec("SELECT u.id FROM "+from+" ORDER BY u.id FOR UPDATE OF u", args...); err != nil {
+			return nil, err
+		}
+	}
+	const next = `(SELECT COALESCE(MAX(up.pts), 0) + 1 FROM updates up WHERE up.user_id = u.id)`
+	_, err := tx.Exec(
+		`INSERT INTO updates (user_id, pts, message_id)
+		 SELECT u.id, `+next+`, CAST(? AS BIGINT) FROM `+from,
+		append([]any{messageID}, args...)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(
+		`SELECT u.username, up.pts FROM updates up JOIN users u ON up.user_id = u.id WHERE up.message_id = ?`,
+		messageID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var recipients []Recipient
+	for rows.Next() {
+		var r Recipient
+		if err := rows.Scan(&r.Username, &r.PTS); err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, r)
+	}
+	return recipients, rows.Err()
+}
+
+// GetUpdateState returns the PTS of a user's latest update, 0 if there is
+// none yet.
+func (st *SQLStore) GetUpdateState(username string) (int64, error) {
+	var pts int64
+	err := st.db.QueryRow(
+		`SELECT COALESCE(MAX(pts), 0) FROM updates WHERE user_id = (SELECT id FROM users WHERE username = ?)`,
+		username,
+	).Scan(&pts)
+	return pts, err
+}
+
+// GetUpdates returns up to limit updates of a user with a PTS greater than
+// pts, oldest first.
+func (st *SQLStore) GetUpdates(username string, pts int64, limit int) ([]Update, error) {
+	rows, err := st.db.Query(
+		`SELECT up.pts, m.id, COALESCE(m.client_id, ''), s.username, COALESCE(r.username, ''),
+		        COALESCE(m.group_id, 0), m.content, m.created_at
+		 FROM updates up
+		 JOIN messages m ON up.message_id = m.id
+		 JOIN users s ON m.sender_id = s.id
+		 LEFT JOIN users r ON m.receiver_id = r.id
+		 WHERE up.user_id = (SELECT id FROM users WHERE username = ?) AND up.pts > ?
+		 ORDER BY up.pts ASC LIMIT ?`,
+		username, pts, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var updates []Update
+	for rows.Next() {
+		var u Update
+		if err := rows.Scan(&u.PTS, &u.MessageID, &u.ClientID, &u.Sender, &u.Receiver, &u.GroupID, &u.Content, &u.CreatedAt); err != nil {
+			return nil, err
+		}
+		updates = append(updates, u)
+	}
+	return updates, rows.Err()
+}
@@ -1,6 +1,18 @@
 package store
 
-import "time"
+import (
+	"time"
+
+	"learning-telegram/internal/policy"
+)
+
+var (
+	// ErrUsernameTaken is returned when a username is already in use,
+	// compared after policy.NormalizeUsername.
+	ErrUsernameTaken = newError(ErrConflict, "username already taken")
+	// ErrEmailTaken is returned when an email is already in use.
+	ErrEmailTaken = newError(ErrConflict, "email already taken")
+)
 
 type User struct {
 	ID        int       `json:"id"`
@@ -8,9 +20,99 @@ type User struct {
 	CreatedAt time.Time `json:"created_at"`
 }
 
+// CreateUser inserts a new user. Usernames are unique regardless of case and
+// Unicode compatibility forms.
+func (st *SQLStore) CreateUser(username, passwordHash, email string) error {
+	normalized := policy.NormalizeUsername(username)
+
+	tx, err := st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The unique indexes on username_norm and email enforce these as well;
+	// checking first tells the cases apart on SQLite, whose errors don't
+	// name the violated index.
+	var exists int
+	err = tx.QueryRow("SELECT COUNT(*) FROM users WHERE username_norm = ?", normalized).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists > 0 {
+		return ErrUsernameTaken
+	}
+	if email != "" {
+		err = tx.QueryRow("SELECT COUNT(*) FROM users WHERE email = ?", email).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists > 0 {
+			return ErrEmailTaken
+		}
+	}
+
+	// On PostgreSQL a concurrent registration can still take the username
+	// or email between the checks and the insert.
+	_, err = tx.Exec(
+		"INSERT INTO users (username, username_norm, password_hash, email, created_at) VALUES (?, ?, ?, ?, ?)",
+		username, normalized, passwordHash, email, time.Now(),
+	)
+	if err != nil {
+		switch {
+		case isUniqueViolation(err, "idx_users_email"):
+			return ErrEmailTaken
+		case isUniqueViolation(err, ""):
+			return ErrUsernameTaken
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// ResolveUsername maps user input to the canonical spelling of an existing
+// username, e.g. "ALICE" to "Alice". It returns ErrUserNotFound if no such
+// user exists.
+func (st *SQLStore) ResolveUsername(name string) (string, error) {
+	var username string
+	err := st.db.QueryRow("SELECT username FROM users WHERE username_norm = ?", policy.NormalizeUsername(name)).Scan(&username)
+	return username, notFound(err, ErrUserNotFound)
+}
+
+// GetPasswordHash looks a user up by any spelling of their name and returns
+// the canonical username together with the stored password hash. Bots have no
+// password and are reported as ErrUserNotFound.
+func (st *SQLStore) GetPasswordHash(name string) (username, hash string, err error) {
+	err = st.db.QueryRow(
+		"SELECT username, password_hash FROM users WHERE username_norm = ? AND NOT is_bot", policy.NormalizeUsername(name),
+	).Scan(&username, &hash)
+	return username, hash, notFound(err, ErrUserNotFound)
+}
+
+// IsBot reports whether the user with the given username is a bot.
+func (st *SQLStore) IsBot(username string) (bool, error) {
+	var isBot bool
+	err := st.db.QueryRow("SELECT is_bot FROM users WHERE username = ?", username).Scan(&isBot)
+	return isBot, notFound(err, ErrUserNotFound)
+}
+
+// GetUserID returns the ID of the user with the given canonical username.
+func (st *SQLStore) GetUserID(username string) (int64, error) {
+	var id int64
+	err := st.db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&id)
+	return id, notFound(err, ErrUserNotFound)
+}
+
+// GetUsernameByID returns the username of the user with the given ID.
+func (st *SQLStore) GetUsernameByID(id int64) (string, error) {
+	var username string
+	err := st.db.QueryRow("SELECT username FROM users WHERE id = ?", id).Scan(&username)
+	return username, notFound(err, ErrUserNotFound)
+}
+
 // GetAllUsers retrieves all users except the one with the given username.
-func GetAllUsers(exceptUsername string) ([]User, error) {
-	rows, err := DB.Query("SELECT id, username, created_at FROM users WHERE username != ?", exceptUsername)
+func (st *SQLStore) GetAllUsers(exceptUsername string) ([]User, error) {
+	rows, err := st.db.Query("SELECT id, username, created_at FROM users WHERE username != ?", exceptUsername)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,393 @@
+package store
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// ErrWebhookNotFound is returned when a webhook or dead letter does not exist
+// or belongs to someone else.
+var ErrWebhookNotFound = newError(ErrNotFound, "webhook not found")
+
+// Webhook delivery states.
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryDead      = "dead"
+)
+
+// Webhook is an outbound event subscription. User-scoped webhooks (GroupID 0)
+// receive the events their owner sees; group-scoped ones the events of one
+// group, as long as the owner is a member.
+type Webhook struct {
+	ID        int64     `json:"id"`
+	Owner     string    `json:"owner"`
+	GroupID   int64     `json:"group_id,omitempty"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"-"`
+	Events    []string  `json:"events"` // empty for all events
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Wants reports whether the webhook subscribed to the given event type.
+func (w *Webhook) Wants(eventType string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+type WebhookDelivery struct {
+	ID             int64     `json:"id"`
+	WebhookID      int64     `json:"webhook_id"`
+	EventID        string    `json:"event_id"`
+	EventType      string    `json:"event_type"`
+	Payload        string    `json:"-"`
+	Status         string    `json:"status"`
+	Attempts       int       `json:"attempts"`
+	LastStatusCode int       `json:"last_status_code,omitempty"`
+	LastError      string    `json:"last_error,omitempty"`
+	NextAttemptAt  time.Time `json:"next_attempt_at"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+type WebhookDeadLetter struct {
+	ID             int64     `json:"id"`
+	DeliveryID     int64     `json:"delivery_id"`
+	WebhookID      int64     `json:"webhook_id"`
+	EventType      string    `json:"event_type"`
+	Payload        string    `json:"payload"`
+	Attempts       int       `json:"attempts"`
+	LastStatusCode int       `json:"last_status_code,omitempty"`
+	LastError      string    `json:"last_error,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// CreateWebhook subscribes url to events for the given owner. A groupID of 0
+// creates a user-scoped webhook.
+func (st *SQLStore) CreateWebhook(owner string, groupID int64, url, secret string, events []string) (int64, error) {
+	var group sql.NullInt64
+	if groupID != 0 {
+		group = sql.NullInt64{Int64: groupID, Valid: true}
+	}
+	var id int64
+	err := st.db.QueryRow(
+		`INSERT INTO webhooks (owner_id, group_id, url, secret, events, created_at)
+		 VALUES ((SELECT id FROM users WHERE username = ?), ?, ?, ?, ?, ?) RETURNING id`,
+		owner, group, url, secret, strings.Join(events, ","), time.Now(),
+	).Scan(&id)
+	return id, err
+}
+
+const webhookColumns = `w.id, u.username, w.group_id, w.url, w.secret, w.events, w.created_at
+	FROM webhooks w JOIN users u ON w.owner_id = u.id`
+
+func scanWebhook(row interface{ Scan(...any) error }) (*Webhook, error) {
+	var (
+		w       Webhook
+		groupID sql.NullInt64
+		events  string
+	)
+	err := row.Scan(&w.ID, &w.Owner, &groupID, &w.URL, &w.Secret, &events, &w.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	w.GroupID = groupID.Int64
+	w.Events = []string{}
+	if events != "" {
+		w.Events = strings.Split(events, ",")
+	}
+	return &w, nil
+}
+
+func (st *SQLStore) queryWebhooks(query string, args ...any) ([]Webhook, error) {
+	rows, err := st.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hooks []Webhook
+	for rows.Next() {
+		w, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, *w)
+	}
+	return hooks, rows.Err()
+}
+
+// GetWebhook returns a webhook of the given owner.
+func (st *SQLStore) GetWebhook(owner string, id int64) (*Webhook, error) {
+	w, err := scanWebhook(st.db.QueryRow("SELECT "+webhookColumns+" WHERE w.id = ? AND u.username = ?", id, owner))
+	if err == sql.ErrNoRows {
+		return nil, ErrWebhookNotFound
+	}
+	return w, err
+}
+
+// GetWebhookByID returns a webhook regardless of its owner, for delivery.
+func (st *SQLStore) GetWebhookByID(id int64) (*Webhook, error) {
+	w, err := scanWebhook(st.db.QueryRow("SELECT "+webhookColumns+" WHERE w.id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, ErrWebhookNotFound
+	}
+	return w, err
+}
+
+// GetWebhooksByOwner returns the webhooks created by the given user.
+func (st *SQLStore) GetWebhooksByOwner(owner string) ([]Webhook, error) {
+	return st.queryWebhooks("SELECT "+webhookColumns+" WHERE u.username = ? ORDER BY w.id", owner)
+}
+
+// FindWebhookSubscribers returns the webhooks an event concerning the given
+// users and, if groupID is not 0, group should be delivered to: user-scoped
+// webhooks of those users and group-scoped webhooks of the group whose owner
+// is still a member. Event filters are not applied.
+func (st *SQLStore) FindWebhookSubscribers(usernames []string, groupID int64) ([]Webhook, error) {
+	query := "SELECT " + webhookColumns + " WHERE "
+	var args []any
+	var conds []string
+	if len(usernames) > 0 {
+		conds = append(conds, "(w.group_id IS NULL AND u.username IN (?"+strings.Repeat(", ?", len(usernames)-1)+"))")
+		for _, u := range usernames {
+			args = append(args, u)
+		}
+	}
+	if groupID != 0 {
+		conds = append(conds, `(w.group_id = ? AND EXISTS (
+			SELECT 1 FROM group_members gm WHERE gm.group_id = w.group_id AND gm.user_id = w.owner_id))`)
+		args = append(args, groupID)
+	}
+	if len(conds) == 0 {
+		return nil, nil
+	}
+	return st.queryWebhooks(query+strings.Join(conds, " OR ")+" ORDER BY w.id", args...)
+}
+
+// DeleteWebhook removes a webhook of the given owner together with its
+// delivery log.
+func (st *SQLStore) DeleteWebhook(owner string, id int64) error {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM webhooks WHERE id = ? AND owner_id = (SELECT id FROM users WHERE username = ?)", id, owner)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrWebhookNotFound
+	}
+	if _, err := tx.Exec("DELETE FROM webhook_dead_letters WHERE webhook_id = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM webhook_deliveries WHERE webhook_id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// EnqueueWebhookDelivery queues an event for delivery to a webhook, due
+// immediately.
+func (st *SQLStore) EnqueueWebhookDelivery(webhookID int64, eventID, eventType string, payload []byte) error {
+	now := time.Now()
+	_, err := st.db.Exec(
+		`INSERT INTO webhook_deliveries (webhook_id, event_id, event_type, payload, next_attempt_at, created_at, updated_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		webhookID, eventID, eventType, string(payload), now, now, now,
+	)
+	return err
+}
+
+// ClaimDueWebhookDeliveries returns up to limit pending deliveries whose next
+// attempt is due and pushes their next attempt back by lease, so a delivery
+// isn't picked up twice while in flight. If the process dies mid-delivery it
+// is retried once the lease ran out.
+func (st *SQLStore) ClaimDueWebhookDeliveries(limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT id, webhook_id, event_id, event_type, payload, status, attempts, last_status_code, last_error,
+		        next_attempt_at, created_at, updated_at
+		 FROM webhook_deliveries
+		 WHERE status = ? AND next_attempt_at <= ?
+		 ORDER BY next_attempt_at, id LIMIT ?`
+	if tx.Dialect == DialectPostgres {
+		// Instances sharing the database claim different deliveries rather
+		// than waiting for each other's claims.
+		query += " FOR UPDATE SKIP LOCKED"
+	}
+	now := time.Now()
+	rows, err := tx.Query(query, DeliveryPending, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	deliveries, err := scanDeliveries(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, d := range deliveries {
+		_, err := tx.Exec("UPDATE webhook_deliveries SET next_attempt_at = ? WHERE id = ?", now.Add(lease), d.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return deliveries, tx.Commit()
+}
+
+func scanDeliveries(rows *sql.Rows) ([]WebhookDelivery, error) {
+	defer rows.Close()
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var d WebhookDelivery
+		err := rows.Scan(&d.ID, &d.WebhookID, &d.EventID, &d.EventType, &d.Payload, &d.Status, &d.Attempts,
+			&d.LastStatusCode, &d.LastError, &d.NextAttemptAt, &d.CreatedAt, &d.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// MarkWebhookDelivered records a successful delivery attempt.
+func (st *SQLStore) MarkWebhookDelivered(id int64, attempts, statusCode int) error {
+	_, err := st.db.Exec(
+		"UPDATE webhook_deliveries SET status = ?, attempts = ?, last_status_code = ?, last_error = '', updated_at = ? WHERE id = ?",
+		DeliverySucceeded, attempts, statusCode, time.Now(), id,
+	)
+	return err
+}
+
+// RescheduleWebhookDelivery records a failed attempt and when to try again.
+func (st *SQLStore) RescheduleWebhookDelivery(id int64, attempts, statusCode int, lastError string, next time.Time) error {
+	_, err := st.db.Exec(
+		`UPDATE webhook_deliveries SET attempts = ?, last_status_code = ?, last_error = ?, next_attempt_at = ?, updated_at = ?
+		 WHERE id = ?`,
+		attempts, statusCode, lastError, next, time.Now(), id,
+	)
+	return err
+}
+
+// DeadLetterWebhookDelivery records the final failed attempt of a delivery
+// and moves it to the dead letter table.
+func (st *SQLStore) DeadLetterWebhookDelivery(d *WebhookDelivery, attempts, statusCode int, lastError string) error {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	_, err = tx.Exec(
+		"UPDATE webhook_deliveries SET status = ?, attempts = ?, last_status_code = ?, last_error = ?, updated_at = ? WHERE id = ?",
+		DeliveryDead, attempts, statusCode, lastError, now, d.ID,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		`INSERT INTO webhook_dead_letters (delivery_id, webhook_id, event_type, payload, attempts, last_status_code, last_error, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		d.ID, d.WebhookID, d.EventType, d.Payload, attempts, statusCode, lastError, now,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetWebhookDeliveries returns the most recent deliveries of a webhook,
+// newest first.
+func (st *SQLStore) GetWebhookDeliveries(webhookID int64, limit int) ([]WebhookDelivery, error) {
+	rows, err := st.db.Query(
+		`SELECT id, webhook_id, event_id, event_type, payload, status, attempts, last_status_code, last_error,
+		        next_attempt_at, created_at, updated_at
+		 FROM webhook_deliveries WHERE webhook_id = ? ORDER BY id DESC LIMIT ?`,
+		webhookID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanDeliveries(rows)
+}
+
+// GetWebhookDeadLetters returns the dead letters of a webhook, newest first.
+func (st *SQLStore) GetWebhookDeadLetters(webhookID int64) ([]WebhookDeadLetter, error) {
+	rows, err := st.db.Query(
+		`SELECT id, delivery_id, webhook_id, event_type, payload, attempts, last_status_code, last_error, created_at
+		 FROM webhook_dead_letters WHERE webhook_id = ? ORDER BY id DESC`,
+		webhookID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var letters []WebhookDeadLetter
+	for rows.Next() {
+		var l WebhookDeadLetter
+		err := rows.Scan(&l.ID, &l.DeliveryID, &l.WebhookID, &l.EventType, &l.Payload, &l.Attempts,
+			&l.LastStatusCode, &l.LastError, &l.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, l)
+	}
+	return letters, rows.Err()
+}
+
+// RequeueWebhookDeadLetter removes a dead letter of the given webhook and
+// queues its delivery again with a fresh retry budget.
+func (st *SQLStore) RequeueWebhookDeadLetter(webhookID, deadLetterID int64) error {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var deliveryID int64
+	err = tx.QueryRow(
+		"SELECT delivery_id FROM webhook_dead_letters WHERE id = ? AND webhook_id = ?", deadLetterID, webhookID,
+	).Scan(&deliveryID)
+	if err == sql.ErrNoRows {
+		return ErrWebhookNotFound
+	} else if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	_, err = tx.Exec(
+		"UPDATE webhook_deliveries SET status = ?, attempts = 0, next_attempt_at = ?, updated_at = ? WHERE id = ?",
+		DeliveryPending, now, now, deliveryID,
+	)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM webhook_dead_letters WHERE id = ?", deadLetterID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// PruneWebhookDeliveries deletes successful deliveries last updated before
+// the given time. Dead deliveries are kept as long as their dead letter.
+func (st *SQLStore) PruneWebhookDeliveries(before time.Time) error {
+	_, err := st.db.Exec("DELETE FROM webhook_deliveries WHERE status = ? AND updated_at < ?", DeliverySucceeded, before)
+	return err
+}
@@ -0,0 +1,128 @@
+// Package webhook delivers chat events to user- and group-scoped webhook
+// subscriptions as HMAC-signed JSON POST requests, retrying failed
+// deliveries with exponential backoff.
+package webhook
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// Event types a webhook can subscribe to.
+const (
+	EventPrivateMessage = "message.private"
+	EventGroupMessage   = "message.group"
+	EventMemberAdded    = "group.member_added"
+)
+
+var eventTypes = map[string]bool{
+	EventPrivateMessage: true,
+	EventGroupMessage:   true,
+	EventMemberAdded:    true,
+}
+
+// IsEventType reports whether s names a known event type.
+func IsEventType(s string) bool {
+	return eventTypes[s]
+}
+
+// Event is the JSON body of every webhook request.
+type Event struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+type PrivateMessageData struct {
+	MessageID int64  `json:"message_id"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Content   string `json:"content"`
+}
+
+type GroupMessageData struct {
+	MessageID int64  `json:"message_id"`
+	GroupID   int64  `json:"group_id"`
+	From      string `json:"from"`
+	Content   string `json:"content"`
+}
+
+type MemberAddedData struct {
+	GroupID  int64  `json:"group_id"`
+	Username string `json:"username"`
+	AddedBy  string `json:"added_by"`
+}
+
+// EmitPrivateMessage queues a message.private event for the webhooks of the
+// sender and the receiver.
+func (w *Worker) EmitPrivateMessage(messageID int64, from, to, content string) {
+	w.emit(EventPrivateMessage, PrivateMessageData{
+		MessageID: messageID,
+		From:      from,
+		To:        to,
+		Content:   content,
+	}, []string{from, to}, 0)
+}
+
+// EmitGroupMessage queues a message.group event for the webhooks of the group
+// and of its members.
+func (w *Worker) EmitGroupMessage(messageID, groupID int64, from, content string, members []string) {
+	w.emit(EventGroupMessage, GroupMessageData{
+		MessageID: messageID,
+		GroupID:   groupID,
+		From:      from,
+		Content:   content,
+	}, members, groupID)
+}
+
+// EmitMemberAdded queues a group.member_added event for the webhooks of the
+// group and of its members, including the new one.
+func (w *Worker) EmitMemberAdded(groupID int64, username, addedBy string, members []string) {
+	w.emit(EventMemberAdded, MemberAddedData{
+		GroupID:  groupID,
+		Username: username,
+		AddedBy:  addedBy,
+	}, members, groupID)
+}
+
+// emit stores one delivery per matching webhook and wakes the worker.
+// Failures are logged rather than returned: webhooks must never keep a
+// message from being sent.
+func (w *Worker) emit(eventType string, data interface{}, usernames []string, groupID int64) {
+	hooks, err := w.webhooks.FindWebhookSubscribers(usernames, groupID)
+	if err != nil {
+		log.Printf("查询Webhook订阅失败 (%s): %v", eventType, err)
+		return
+	}
+
+	var payload []byte
+	var event Event
+	for _, hook := range hooks {
+		if !hook.Wants(eventType) {
+			continue
+		}
+		if payload == nil {
+			event = Event{ID: newEventID(), Type: eventType, CreatedAt: time.Now().UTC(), Data: data}
+			if payload, err = json.Marshal(event); err != nil {
+				log.Printf("Webhook事件编码失败 (%s): %v", eventType, err)
+				return
+			}
+		}
+		if err := w.webhooks.EnqueueWebhookDelivery(hook.ID, event.ID, eventType, payload); err != nil {
+			log.Printf("Webhook投递入队失败 (webhook: %d): %v", hook.ID, err)
+		}
+	}
+	if payload != nil {
+		w.Wake()
+	}
+}
+
+func newEventID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return "evt_" + hex.EncodeToString(b)
+}
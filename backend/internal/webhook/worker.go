@@ -0,0 +1,210 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"learning-telegram/internal/egress"
+	"learning-telegram/internal/store"
+)
+
+const (
+	// MaxAttempts is how often a delivery is tried before it is moved to the
+	// dead letter table.
+	MaxAttempts = 8
+
+	deliveryTimeout = 10 * time.Second
+	minBackoff      = 10 * time.Second
+	maxBackoff      = time.Hour
+	// claimLease must be longer than a delivery can take, or deliveries could
+	// be sent twice.
+	claimLease   = time.Minute
+	batchSize    = 8
+	pollInterval = 5 * time.Second
+	// deliveryRetention is how long successful deliveries stay in the log.
+	deliveryRetention = 7 * 24 * time.Hour
+)
+
+// Worker queues the events emitted to it for the matching webhooks in its
+// repository and delivers them.
+type Worker struct {
+	webhooks store.WebhookRepo
+	client   *http.Client
+	wakeup   chan struct{}
+	cancel   context.CancelFunc // of the running worker, see Start
+	done     sync.WaitGroup
+}
+
+// NewWorker returns a worker on the subscriptions and the delivery queue in
+// repo, whose requests may only reach the addresses egress allows. Events
+// emitted to it are queued at once, but only delivered once it was started.
+func NewWorker(repo store.WebhookRepo, egress egress.Policy) *Worker {
+	client := &http.Client{
+		Timeout: deliveryTimeout,
+		// Subscribers can't make the server reach internal addresses.
+		Transport: egress.Transport(),
+		// A redirect would turn the POST into a GET; treat it as a failure
+		// so the subscriber fixes the URL.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return &Worker{webhooks: repo, client: client, wakeup: make(chan struct{}, 1)}
+}
+
+// Start starts delivering. It must be called once; deliveries queued by a
+// previous run are picked up again.
+func (w *Worker) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	w.cancel = cancel
+	w.done.Add(2)
+	go func() {
+		defer w.done.Done()
+		w.run(ctx)
+	}()
+	go func() {
+		defer w.done.Done()
+		w.prune(ctx)
+	}()
+}
+
+// Stop stops the worker and waits until it no longer uses the repository.
+// Deliveries in flight are aborted without being recorded, so they are sent
+// again once their claim ran out.
+func (w *Worker) Stop() {
+	if w.cancel == nil {
+		return
+	}
+	w.cancel()
+	w.done.Wait()
+}
+
+// Wake makes the worker look for due deliveries now rather than at its next
+// poll.
+func (w *Worker) Wake() {
+	select {
+	case w.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (w *Worker) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		deliveries, err := w.webhooks.ClaimDueWebhookDeliveries(batchSize, claimLease)
+		if err != nil {
+			log.Printf("读取待投递Webhook失败: %v", err)
+		}
+
+		var wg sync.WaitGroup
+		for i := range deliveries {
+			wg.Add(1)
+			go func(d *store.WebhookDelivery) {
+				defer wg.Done()
+				w.deliver(ctx, d)
+			}(&deliveries[i])
+		}
+		wg.Wait()
+
+		if len(deliveries) == batchSize {
+			continue // there may be more due
+		}
+		select {
+		case <-w.wakeup:
+		case <-time.After(pollInterval):
+		case <-ctx.Done():
+		}
+	}
+}
+
+func (w *Worker) deliver(ctx context.Context, d *store.WebhookDelivery) {
+	hook, err := w.webhooks.GetWebhookByID(d.WebhookID)
+	if err == store.ErrWebhookNotFound {
+		return // deleted since the event was queued
+	} else if err != nil {
+		log.Printf("读取Webhook失败 (webhook: %d): %v", d.WebhookID, err)
+		return
+	}
+
+	attempts := d.Attempts + 1
+	statusCode, err := w.post(ctx, hook, d)
+	if ctx.Err() != nil {
+		return // stopped; the attempt doesn't count
+	}
+	if err == nil {
+		err = w.webhooks.MarkWebhookDelivered(d.ID, attempts, statusCode)
+		if err != nil {
+			log.Printf("记录Webhook投递结果失败 (delivery: %d): %v", d.ID, err)
+		}
+		return
+	}
+
+	if attempts >= MaxAttempts {
+		log.Printf("Webhook投递失败%d次，移入死信 (delivery: %d): %v", attempts, d.ID, err)
+		err = w.webhooks.DeadLetterWebhookDelivery(d, attempts, statusCode, err.Error())
+	} else {
+		err = w.webhooks.RescheduleWebhookDelivery(d.ID, attempts, statusCode, err.Error(), time.Now().Add(backoff(attempts)))
+	}
+	if err != nil {
+		log.Printf("记录Webhook投递结果失败 (delivery: %d): %v", d.ID, err)
+	}
+}
+
+// post sends a delivery and returns the response status code, if any. Only
+// 2xx responses count as delivered.
+func (w *Worker) post(ctx context.Context, hook *store.Webhook, d *store.WebhookDelivery) (int, error) {
+	body := []byte(d.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "learning-telegram-webhooks/1.0")
+	req.Header.Set(EventHeader, d.EventType)
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(d.ID, 10))
+	req.Header.Set(SignatureHeader, Sign(hook.Secret, time.Now(), body))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// backoff returns the delay before the next attempt after the given number of
+// failed ones: 10s, 20s, 40s, ... capped at an hour, with up to 20% jitter so
+// deliveries that failed together don't retry together.
+func backoff(attempts int) time.Duration {
+	d := maxBackoff
+	if attempts-1 < 16 {
+		d = min(minBackoff<<(attempts-1), maxBackoff)
+	}
+	return d + rand.N(d/5+1)
+}
+
+func (w *Worker) prune(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if err := w.webhooks.PruneWebhookDeliveries(time.Now().Add(-deliveryRetention)); err != nil {
+			log.Printf("清理Webhook投递记录失败: %v", err)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"learning-telegram/internal/egress"
+	"learning-telegram/internal/store"
+	"learning-telegram/internal/store/memstore"
+)
+
+const testSecret = "whsec_test_secret"
+
+type receiver struct {
+	*httptest.Server
+	status   atomic.Int32
+	hang     atomic.Bool // don't answer until the request is canceled
+	requests chan *http.Request
+	bodies   chan []byte
+}
+
+// newReceiver starts a webhook receiver answering with status, subscribes
+// it to the events of alice and returns it with the webhook and a worker,
+// not started, on its repository.
+func newReceiver(t *testing.T, status int) (*receiver, *store.Webhook, *Worker) {
+	t.Helper()
+	rcv := &receiver{requests: make(chan *http.Request, MaxAttempts+1), bodies: make(chan []byte, MaxAttempts+1)}
+	rcv.status.Store(int32(status))
+	rcv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rcv.requests <- r
+		rcv.bodies <- body
+		if rcv.hang.Load() {
+			<-r.Context().Done()
+			return
+		}
+		w.WriteHeader(int(rcv.status.Load()))
+	}))
+	t.Cleanup(rcv.Close)
+
+	repo := memstore.New()
+	if err := repo.CreateUser("alice", "hash", ""); err != nil {
+		t.Fatal(err)
+	}
+	id, err := repo.CreateWebhook("alice", 0, rcv.URL, testSecret, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook, err := repo.GetWebhookByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The receiver listens on loopback, which webhooks may only reach if
+	// it is allowed.
+	loopback, err := egress.New([]string{"127.0.0.1", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rcv, hook, NewWorker(repo, loopback)
+}
+
+// claim returns the deliveries of w that are due.
+func claim(t *testing.T, w *Worker) []store.WebhookDelivery {
+	t.Helper()
+	deliveries, err := w.webhooks.ClaimDueWebhookDeliveries(batchSize, claimLease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deliveries
+}
+
+// latest returns the stored state of the newest delivery of hook.
+func latest(t *testing.T, w *Worker, hook *store.Webhook) store.WebhookDelivery {
+	t.Helper()
+	deliveries, err := w.webhooks.GetWebhookDeliveries(hook.ID, 1)
+	if err != nil || len(deliveries) != 1 {
+		t.Fatalf("deliveries %+v, %v; want one", deliveries, err)
+	}
+	return deliveries[0]
+}
+
+func TestDeliverySigned(t *testing.T) {
+	rcv, hook, w := newReceiver(t, http.StatusNoContent)
+	w.EmitPrivateMessage(7, "alice", "bob", "hi")
+
+	deliveries := claim(t, w)
+	if len(deliveries) != 1 {
+		t.Fatalf("claimed %d deliveries, want 1", len(deliveries))
+	}
+	w.deliver(context.Background(), &deliveries[0])
+
+	r, body := <-rcv.requests, <-rcv.bodies
+	if err := Verify(testSecret, r.Header.Get(SignatureHeader), body, time.Minute, time.Now()); err != nil {
+		t.Errorf("signature of the delivery: %v", err)
+	}
+	if err := Verify(testSecret, r.Header.Get(SignatureHeader), body, time.Minute, time.Now().Add(2*time.Minute)); err != ErrSignatureExpired {
+		t.Errorf("signature verified later than the tolerance: %v, want ErrSignatureExpired", err)
+	}
+	if err := Verify("whsec_other", r.Header.Get(SignatureHeader), body, time.Minute, time.Now()); err != ErrInvalidSignature {
+		t.Errorf("signature verified with another secret: %v, want ErrInvalidSignature", err)
+	}
+	if got := r.Header.Get(EventHeader); got != EventPrivateMessage {
+		t.Errorf("event header %q, want %q", got, EventPrivateMessage)
+	}
+	if got := r.Header.Get(DeliveryHeader); got != strconv.FormatInt(deliveries[0].ID, 10) {
+		t.Errorf("delivery header %q, want %d", got, deliveries[0].ID)
+	}
+
+	var event struct {
+		Type string             `json:"type"`
+		Data PrivateMessageData `json:"data"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != EventPrivateMessage || event.Data.MessageID != 7 || event.Data.Content != "hi" {
+		t.Errorf("event %+v, want message 7", event)
+	}
+
+	d := latest(t, w, hook)
+	if d.Status != store.DeliverySucceeded || d.Attempts != 1 || d.LastStatusCode != http.StatusNoContent {
+		t.Errorf("delivery %+v, want succeeded after one attempt", d)
+	}
+}
+
+// TestRetryUntilDeadLetter fails every attempt of a delivery, which is
+// retried with growing delays and then moved to the dead letters. Requeued,
+// it is delivered once the receiver works again.
+func TestRetryUntilDeadLetter(t *testing.T) {
+	rcv, hook, w := newReceiver(t, http.StatusInternalServerError)
+	w.EmitPrivateMessage(7, "alice", "bob", "hi")
+
+	deliveries := claim(t, w)
+	if len(deliveries) != 1 {
+		t.Fatalf("claimed %d deliveries, want 1", len(deliveries))
+	}
+	d := deliveries[0]
+	for attempt := 1; attempt < MaxAttempts; attempt++ {
+		before := time.Now()
+		w.deliver(context.Background(), &d)
+		d = latest(t, w, hook)
+		if d.Status != store.DeliveryPending || d.Attempts != attempt || d.LastStatusCode != http.StatusInternalServerError {
+			t.Fatalf("after attempt %d: delivery %+v, want pending", attempt, d)
+		}
+		wait := min(minBackoff<<(attempt-1), maxBackoff)
+		if d.NextAttemptAt.Before(before.Add(wait)) || d.NextAttemptAt.After(time.Now().Add(wait+wait/5)) {
+			t.Errorf("after attempt %d: next attempt in %v, want %v plus up to 20%%", attempt, d.NextAttemptAt.Sub(before), wait)
+		}
+		if len(claim(t, w)) != 0 {
+			t.Fatalf("after attempt %d: delivery due before its backoff", attempt)
+		}
+	}
+	w.deliver(context.Background(), &d)
+	if d := latest(t, w, hook); d.Status != store.DeliveryDead || d.Attempts != MaxAttempts {
+		t.Fatalf("delivery %+v, want dead after %d attempts", d, MaxAttempts)
+	}
+	if n := len(rcv.requests); n != MaxAttempts {
+		t.Errorf("receiver got %d requests, want %d", n, MaxAttempts)
+	}
+
+	letters, err := w.webhooks.GetWebhookDeadLetters(hook.ID)
+	if err != nil || len(letters) != 1 {
+		t.Fatalf("dead letters %+v, %v; want one", letters, err)
+	}
+	if l := letters[0]; l.DeliveryID != d.ID || l.Attempts != MaxAttempts || l.Payload != d.Payload || l.LastStatusCode != http.StatusInternalServerError {
+		t.Errorf("dead letter %+v, want the failed delivery", l)
+	}
+
+	rcv.status.Store(http.StatusOK)
+	if err := w.webhooks.RequeueWebhookDeadLetter(hook.ID, letters[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	deliveries = claim(t, w)
+	if len(deliveries) != 1 || deliveries[0].ID != d.ID || deliveries[0].Attempts != 0 {
+		t.Fatalf("claimed %+v after requeueing, want the delivery with no attempts", deliveries)
+	}
+	w.deliver(context.Background(), &deliveries[0])
+	if d := latest(t, w, hook); d.Status != store.DeliverySucceeded || d.Attempts != 1 {
+		t.Errorf("delivery %+v, want succeeded after requeueing", d)
+	}
+	if letters, _ := w.webhooks.GetWebhookDeadLetters(hook.ID); len(letters) != 0 {
+		t.Errorf("dead letters %+v left after requeueing", letters)
+	}
+}
+
+func TestDeliveryToInternalAddress(t *testing.T) {
+	rcv, hook, w := newReceiver(t, http.StatusOK)
+	// The URL was accepted while loopback was allowed, or its host resolved
+	// to a public address then; the connection is checked again.
+	w = NewWorker(w.webhooks, egress.Policy{})
+	w.EmitPrivateMessage(7, "alice", "bob", "hi")
+
+	deliveries := claim(t, w)
+	if len(deliveries) != 1 {
+		t.Fatalf("claimed %d deliveries, want 1", len(deliveries))
+	}
+	w.deliver(context.Background(), &deliveries[0])
+	if d := latest(t, w, hook); d.Status != store.DeliveryPending || d.Attempts != 1 || d.LastStatusCode != 0 {
+		t.Errorf("delivery %+v, want a failed attempt", d)
+	}
+	if len(rcv.requests) != 0 {
+		t.Error("request sent to a loopback address")
+	}
+}
+
+// TestWorkerStop stops the worker while a delivery is in flight. Stop
+// returns without waiting for the receiver, and the aborted attempt doesn't
+// count.
+func TestWorkerStop(t *testing.T) {
+	rcv, hook, w := newReceiver(t, http.StatusOK)
+	rcv.hang.Store(true)
+	w.EmitPrivateMessage(7, "alice", "bob", "hi")
+	w.Start()
+
+	select {
+	case <-rcv.requests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery not sent")
+	}
+	stopped := make(chan struct{})
+	go func() {
+		w.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop waited for the receiver")
+	}
+	if d := latest(t, w, hook); d.Status != store.DeliveryPending || d.Attempts != 0 {
+		t.Errorf("delivery %+v, want pending with no attempts", d)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		1:  10 * time.Second,
+		2:  20 * time.Second,
+		3:  40 * time.Second,
+		9:  2560 * time.Second,
+		10: time.Hour,
+		40: time.Hour,
+	} {
+		for range 20 {
+			if d := backoff(attempts); d < want || d > want+want/5 {
+				t.Errorf("backoff(%d) = %v, want %v plus up to 20%%", attempts, d, want)
+			}
+		}
+	}
+}
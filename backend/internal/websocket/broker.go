@@ -0,0 +1,47 @@
+package websocket
+
+import "encoding/json"
+
+// Broker connects the hubs of several backend instances (nodes), so that
+// users connected to different nodes reach each other. The hub delivers
+// frames to its own connections itself and uses the broker to relay them to
+// the other nodes, and to keep a cluster-wide registry of who is online.
+//
+// Brokers are expected to be best effort: a frame lost between nodes shows
+// up as a gap in the PTS of pushes, which clients fill with get_difference.
+type Broker interface {
+	// Subscribe starts receiving what other nodes publish. deliver is called
+	// with frames for users, closeSession with sessions whose connections
+	// must be closed and event with the events published with PublishEvent.
+	Subscribe(deliver func(username string, f Frame), closeSession func(username, sessionID string), event func(name string, data json.RawMessage)) error
+	// Publish relays a frame for a user to the other nodes.
+	Publish(username string, f Frame) error
+	// PublishCloseSession asks the other nodes to close the connections of
+	// a session.
+	PublishCloseSession(username, sessionID string) error
+	// PublishEvent relays an event, whose data is JSON, to the other nodes.
+	PublishEvent(name string, data json.RawMessage) error
+
+	// Connected and Disconnected are called when a user gets their first
+	// connection to this node and loses their last one.
+	Connected(username string) error
+	Disconnected(username string) error
+	// IsOnline reports whether a user is connected to another node.
+	IsOnline(username string) (bool, error)
+
+	Close() error
+}
+
+// LocalBroker is the broker of a single node: there is nothing to relay to.
+type LocalBroker struct{}
+
+func (LocalBroker) Subscribe(func(string, Frame), func(string, string), func(string, json.RawMessage)) error {
+	return nil
+}
+func (LocalBroker) Publish(string, Frame) error                { return nil }
+func (LocalBroker) PublishCloseSession(string, string) error   { return nil }
+func (LocalBroker) PublishEvent(string, json.RawMessage) error { return nil }
+func (LocalBroker) Connected(string) error                     { return nil }
+func (LocalBroker) Disconnected(string) error                  { return nil }
+func (LocalBroker) IsOnline(string) (bool, error)              { return false, nil }
+func (LocalBroker) Close() error                               { return nil }
@@ -0,0 +1,106 @@
+package websocket
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// clientConn is the hub connection of a WebSocket client. It encodes frames
+// for the protocol negotiated at the handshake. It is written to only by the
+// write pump of its send queue, as gorilla connections support one
+// concurrent writer; pings are control frames, which may be written
+// concurrently.
+type clientConn struct {
+	ws        *websocket.Conn
+	protocol  string
+	heartbeat HeartbeatConfig
+	lastSeen  atomic.Int64 // unix nanoseconds of the last frame or pong read
+	done      chan struct{}
+	close     sync.Once
+}
+
+// newClientConn sets up the heartbeat of a connection: a frame size limit, a
+// read deadline that every frame and pong extends, and a ping loop.
+func newClientConn(ws *websocket.Conn, hb HeartbeatConfig) *clientConn {
+	c := &clientConn{ws: ws, protocol: ws.Subprotocol(), heartbeat: hb, done: make(chan struct{})}
+	ws.SetReadLimit(hb.MaxFrameSize)
+	c.seen()
+	ws.SetPongHandler(func(string) error {
+		c.seen()
+		return nil
+	})
+	go c.pingLoop()
+	return c
+}
+
+// seen records that the client is alive and extends the read deadline.
+func (c *clientConn) seen() {
+	now := time.Now()
+	c.lastSeen.Store(now.UnixNano())
+	c.ws.SetReadDeadline(now.Add(c.heartbeat.PongTimeout))
+}
+
+// LastSeen implements Liveness.
+func (c *clientConn) LastSeen() time.Time {
+	return time.Unix(0, c.lastSeen.Load())
+}
+
+func (c *clientConn) pingLoop() {
+	ticker := time.NewTicker(c.heartbeat.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.heartbeat.WriteTimeout))
+			if err != nil {
+				return // the read loop notices as well
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// WriteJSON writes a Frame encoded for the connection's protocol. Other
+// values are written as they are.
+func (c *clientConn) WriteJSON(v interface{}) error {
+	c.ws.SetWriteDeadline(time.Now().Add(c.heartbeat.WriteTimeout))
+	f, ok := v.(Frame)
+	if !ok {
+		return c.ws.WriteJSON(v)
+	}
+	data, err := encodeFrame(c.protocol, f)
+	if err != nil {
+		return err
+	}
+	return c.ws.WriteMessage(websocket.TextMessage, data)
+}
+
+func (c *clientConn) ReadJSON(v interface{}) error {
+	if err := c.ws.ReadJSON(v); err != nil {
+		return err
+	}
+	c.seen()
+	return nil
+}
+
+// ReadFrame reads the next frame and decodes it into an envelope. A non-nil
+// error is a read error that ends the connection; an ErrorPayload reports a
+// malformed frame to the client.
+func (c *clientConn) ReadFrame() (*Envelope, *ErrorPayload, error) {
+	_, data, err := c.ws.ReadMessage()
+	if err != nil {
+		return nil, nil, err
+	}
+	c.seen()
+	env, perr := decodeFrame(c.protocol, data)
+	return env, perr, nil
+}
+
+func (c *clientConn) Close() error {
+	c.close.Do(func() { close(c.done) })
+	return c.ws.Close()
+}
@@ -0,0 +1,86 @@
+package websocket
+
+import (
+	"learning-telegram/internal/store"
+)
+
+// SendPrivateMessage stores a private message, pushes it to every online
+// connection of the receiver and, for multi-device sync, of the sender, and
+// emits it to webhooks. It is the single delivery path for messages from
+// WebSocket clients, the REST API and bots.
+//
+// If the sender already sent a message with the same non-empty clientID, the
+// original message is returned with created set to false and nothing is
+// pushed again.
+func (h *Handler) SendPrivateMessage(from, to, clientID, content string) (msg *store.Message, created bool, err error) {
+	msg, recipients, err := h.messages.InsertPrivateMessage(from, to, clientID, content)
+	if err != nil || recipients == nil {
+		return msg, false, err
+	}
+	h.push(recipients, store.Update{
+		MessageID: int64(msg.ID),
+		ClientID:  clientID,
+		Sender:    from,
+		Receiver:  to,
+		Content:   content,
+		CreatedAt: msg.CreatedAt,
+	})
+	h.webhooks.EmitPrivateMessage(int64(msg.ID), from, to, content)
+	return msg, true, nil
+}
+
+// SendGroupMessage stores a group message, pushes it to every online member
+// of the group, including the sender, and emits it to webhooks. Callers
+// check membership. Retries are deduplicated as in SendPrivateMessage.
+func (h *Handler) SendGroupMessage(from string, groupID int64, clientID, content string) (msg *store.Message, created bool, err error) {
+	msg, recipients, err := h.messages.InsertGroupMessage(from, groupID, clientID, content)
+	if err != nil || recipients == nil {
+		return msg, false, err
+	}
+	h.push(recipients, store.Update{
+		MessageID: int64(msg.ID),
+		ClientID:  clientID,
+		Sender:    from,
+		GroupID:   groupID,
+		Content:   content,
+		CreatedAt: msg.CreatedAt,
+	})
+	members := make([]string, len(recipients))
+	for i, r := range recipients {
+		members[i] = r.Username
+	}
+	h.webhooks.EmitGroupMessage(int64(msg.ID), groupID, from, content, members)
+	return msg, true, nil
+}
+
+// push sends a new message to its recipients, each with the PTS it got in
+// their update sequence. Offline recipients fetch it with get_difference.
+func (h *Handler) push(recipients []store.Recipient, u store.Update) {
+	for _, r := range recipients {
+		u.PTS = r.PTS
+		h.hub.SendToUser(r.Username, updateFrame(&u))
+	}
+}
+
+// updateFrame builds the push frame of an update.
+func updateFrame(u *store.Update) Frame {
+	ts := store.FormatTime(u.CreatedAt)
+	if u.GroupID != 0 {
+		return Frame{Type: "new_group_message", PTS: u.PTS, Payload: NewGroupMessagePayload{
+			ID:       u.MessageID,
+			ClientID: u.ClientID,
+			GroupID:  u.GroupID,
+			From:     u.Sender,
+			Content:  u.Content,
+			TS:       ts,
+		}}
+	}
+	return Frame{Type: "new_message", PTS: u.PTS, Payload: NewMessagePayload{
+		ID:       u.MessageID,
+		ClientID: u.ClientID,
+		From:     u.Sender,
+		To:       u.Receiver,
+		Content:  u.Content,
+		TS:       ts,
+	}}
+}
@@ -1,22 +1,98 @@
 package websocket
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"learning-telegram/internal/auth"
+	"learning-telegram/internal/policy"
+	"learning-telegram/internal/realip"
 	"learning-telegram/internal/store"
+	"learning-telegram/internal/webhook"
 
 	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // 允许所有来源的连接，方便测试
-	},
+// HandlerConfig configures which connections a Handler accepts and how it
+// finds their clients' addresses.
+type HandlerConfig struct {
+	// AllowedOrigins are the origins, like https://chat.example.com, whose
+	// pages may open connections besides pages from the server's own
+	// origin; "*" allows any.
+	AllowedOrigins []string
+	// RealIP finds the address of clients behind trusted proxies.
+	RealIP realip.Resolver
 }
 
-func HandleConnections(w http.ResponseWriter, r *http.Request) {
+// Handler accepts WebSocket connections, registers them with its hub and
+// serves the requests received on them from the repositories it was created
+// with. Sent messages are emitted to webhooks through its worker.
+type Handler struct {
+	users    store.UserRepo
+	groups   store.GroupRepo
+	messages store.MessageRepo
+	sessions store.SessionRepo
+	hub      *Hub
+	webhooks *webhook.Worker
+	cfg      HandlerConfig
+	upgrader websocket.Upgrader
+
+	// draining is set once Shutdown was called; new connections are
+	// refused from then on.
+	draining atomic.Bool
+	// running counts the running connection handlers. A handler returns
+	// after its connection is unregistered and the user's presence
+	// published, so Shutdown waits for them rather than for the hub to be
+	// empty.
+	running atomic.Int64
+}
+
+func NewHandler(repos store.Repos, hub *Hub, webhooks *webhook.Worker, cfg HandlerConfig) *Handler {
+	h := &Handler{
+		users:    repos.Users,
+		groups:   repos.Groups,
+		messages: repos.Messages,
+		sessions: repos.Sessions,
+		hub:      hub,
+		webhooks: webhooks,
+		cfg:      cfg,
+	}
+	h.upgrader = websocket.Upgrader{
+		Subprotocols: []string{ProtocolV1},
+		CheckOrigin:  h.checkOrigin,
+	}
+	return h
+}
+
+// checkOrigin keeps pages from other sites from connecting with the
+// credentials of the browser's user.
+func (h *Handler) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true // not a browser
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	allowed := h.cfg.AllowedOrigins
+	return slices.Contains(allowed, "*") || slices.Contains(allowed, origin)
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.running.Add(1)
+	defer h.running.Add(-1)
+	if h.draining.Load() {
+		http.Error(w, "服务器正在重启，请稍后重连", http.StatusServiceUnavailable)
+		return
+	}
+
 	// 支持URL参数中的token
 	tokenString := r.URL.Query().Get("token")
 	if tokenString == "" {
@@ -33,163 +109,325 @@ func HandleConnections(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "未授权：无效的Token", http.StatusUnauthorized)
 		return
 	}
+	active, err := h.sessions.IsSessionActive(claims.SessionID)
+	if err != nil || !active {
+		http.Error(w, "未授权：会话已失效", http.StatusUnauthorized)
+		return
+	}
 	username := claims.Username
 
-	ws, err := upgrader.Upgrade(w, r, nil)
+	// Clients opt into the v1 protocol through the subprotocol header; those
+	// asking only for protocols we don't speak are refused instead of being
+	// silently downgraded to the legacy one.
+	if offered := websocket.Subprotocols(r); len(offered) > 0 && !slices.Contains(offered, ProtocolV1) {
+		http.Error(w, "不支持的子协议，请使用"+ProtocolV1, http.StatusBadRequest)
+		return
+	}
+
+	ws, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println("upgrade error:", err)
 		return
 	}
-	defer ws.Close()
+	conn := newClientConn(ws, h.hub.heartbeat)
+	defer conn.Close()
 
-	hub.Register(username, ws)
-	defer hub.Unregister(username, ws)
+	// Replies go through the same send queue as pushes, so they are written
+	// in order and by a single goroutine.
+	queued := h.hub.Register(username, claims.SessionID, conn)
+	defer h.hub.Unregister(username, conn)
+	c := &Client{Username: username, SessionID: claims.SessionID, Conn: queued, h: h}
+	if h.draining.Load() {
+		// Shutdown started during the handshake and may have missed it.
+		queued.(*peer).drain(CloseServiceRestart, "server restarting, reconnect")
+	}
 
-	log.Printf("用户 %s 已连接", username)
+	log.Printf("用户 %s 已连接 (协议: %s)", username, protocolName(conn.protocol))
+	ip := h.cfg.RealIP.ClientIP(r)
+	c.touch(ip)
 
 	for {
-		var msg map[string]interface{}
-		err := ws.ReadJSON(&msg)
+		env, perr, err := conn.ReadFrame()
 		if err != nil {
 			log.Printf("%s 断开连接: %v", username, err)
 			break
 		}
-		typeVal, _ := msg["type"].(string)
-		switch typeVal {
-		case "send_message", "private":
-			to, _ := msg["to"].(string)
-			content, _ := msg["content"].(string)
-			if to == "" || content == "" {
-				ws.WriteJSON(map[string]interface{}{"type": "error", "msg": "to和content不能为空"})
-				continue
-			}
-			// 存储消息
-			err := store.InsertPrivateMessage(username, to, content)
-			if err != nil {
-				log.Printf("消息存储失败 (from: %s, to: %s): %v", username, to, err)
-				ws.WriteJSON(map[string]interface{}{"type": "error", "msg": "消息存储失败，请检查目标用户是否存在"})
-				continue
-			}
-			// 推送给目标用户所有在线端
-			push := map[string]interface{}{
-				"type":    "new_message",
-				"from":    username,
-				"content": content,
-				"ts":      store.NowStr(),
-			}
-			hub.SendToUser(to, push)
-			// 也回显给自己（多端同步）
-			hub.SendToUser(username, push)
-		case "send_group_message", "group":
-			groupIDFloat, _ := msg["group_id"].(float64)
-			groupID := int64(groupIDFloat)
-			content, _ := msg["content"].(string)
-			if groupID == 0 || content == "" {
-				ws.WriteJSON(map[string]interface{}{"type": "error", "msg": "group_id和content不能为空"})
-				continue
-			}
-
-			// 1. 存储群消息
-			err := store.InsertGroupMessage(username, groupID, content)
-			if err != nil {
-				log.Printf("群消息存储失败 (user: %s, group: %d): %v", username, groupID, err)
-				ws.WriteJSON(map[string]interface{}{"type": "error", "msg": "群消息存储失败"})
-				continue
-			}
-
-			// 2. 获取所有群成员
-			members, err := store.GetGroupMembers(groupID)
-			if err != nil {
-				log.Printf("获取群成员失败 (group: %d): %v", groupID, err)
-				continue
-			}
-
-			// 3. 向所有在线的群成员推送消息
-			push := map[string]interface{}{
-				"type":     "new_group_message",
-				"group_id": groupID,
-				"from":     username,
-				"content":  content,
-				"ts":       store.NowStr(),
-			}
-			for _, member := range members {
-				hub.SendToUser(member, push)
-			}
-		case "history":
-			with, _ := msg["with"].(string)
-			if with == "" {
-				ws.WriteJSON(map[string]interface{}{"type": "error", "msg": "with不能为空"})
-				continue
-			}
-			msgs, err := store.GetPrivateHistory(username, with)
-			if err != nil {
-				ws.WriteJSON(map[string]interface{}{"type": "error", "msg": "查询历史失败"})
-				continue
-			}
-			ws.WriteJSON(map[string]interface{}{
-				"type":     "history",
-				"with":     with,
-				"messages": msgs,
-			})
-		case "history_group":
-			groupIDFloat, _ := msg["group_id"].(float64)
-			groupID := int64(groupIDFloat)
-			if groupID == 0 {
-				ws.WriteJSON(map[string]interface{}{"type": "error", "msg": "group_id不能为空"})
-				continue
-			}
-			// 1. 验证用户是否在群组中
-			isMember, err := store.IsUserInGroup(username, groupID)
-			if err != nil || !isMember {
-				ws.WriteJSON(map[string]interface{}{"type": "error", "msg": "无权限访问该群组历史"})
-				continue
-			}
-			// 2. 获取群组历史消息
-			msgs, err := store.GetGroupHistory(groupID)
-			if err != nil {
-				ws.WriteJSON(map[string]interface{}{"type": "error", "msg": "查询群组历史失败"})
-				continue
-			}
-			ws.WriteJSON(map[string]interface{}{
-				"type":     "history_group",
-				"group_id": groupID,
-				"messages": msgs,
-			})
-		case "typing":
-			to, _ := msg["to"].(string)
-			groupIDFloat, _ := msg["group_id"].(float64)
-			groupID := int64(groupIDFloat)
-
-			if to != "" { // Private chat typing
-				push := map[string]interface{}{
-					"type": "user_typing",
-					"from": username,
-				}
-				hub.SendToUser(to, push)
-			} else if groupID != 0 { // Group chat typing
-				isMember, err := store.IsUserInGroup(username, groupID)
-				if err != nil || !isMember {
-					// Don't send error back, just ignore silently.
-					continue
-				}
-				members, err := store.GetGroupMembers(groupID)
-				if err != nil {
-					continue
-				}
-				push := map[string]interface{}{
-					"type":     "user_typing",
-					"from":     username,
-					"group_id": groupID,
-				}
-				// Broadcast to all members except the sender
-				for _, member := range members {
-					if member != username {
-						hub.SendToUser(member, push)
-					}
-				}
-			}
-		default:
-			ws.WriteJSON(map[string]interface{}{"type": "error", "msg": "未知消息类型"})
+		c.touch(ip)
+		c.dispatch(env, perr, conn.protocol == ProtocolV1)
+	}
+}
+
+// touch records activity on the client's session. The store writes it at
+// most once per store.SessionTouchInterval; touches within that interval of
+// the last one are skipped here, so a busy connection doesn't query the
+// database for every frame.
+func (c *Client) touch(ip string) {
+	now := time.Now()
+	if !c.lastTouch.IsZero() && now.Sub(c.lastTouch) < store.SessionTouchInterval {
+		return
+	}
+	c.lastTouch = now
+	if err := c.h.sessions.TouchSession(c.SessionID, ip); err != nil {
+		log.Printf("记录会话活动失败 (session: %s): %v", c.SessionID, err)
+	}
+}
+
+func protocolName(protocol string) string {
+	if protocol == "" {
+		return "legacy"
+	}
+	return protocol
+}
+
+// route decodes the payload of one message type and handles it.
+type route struct {
+	decode func(raw json.RawMessage, strict bool) (payload, []FieldError)
+	handle func(c *Client, id string, p payload)
+}
+
+// on builds the route of a handler taking the payload type P, which is
+// decoded and validated before the handler is called.
+func on[T any, P interface {
+	*T
+	payload
+}](handle func(c *Client, id string, p P)) route {
+	return route{
+		decode: func(raw json.RawMessage, strict bool) (payload, []FieldError) {
+			p := P(new(T))
+			return p, decodePayload(raw, p, strict)
+		},
+		handle: func(c *Client, id string, p payload) {
+			handle(c, id, p.(P))
+		},
+	}
+}
+
+// routes is the dispatch table of client to server message types.
+var routes = map[string]route{
+	"send_message":       on(handleSendMessage),
+	"send_group_message": on(handleSendGroupMessage),
+	"history":            on(handleHistory),
+	"history_group":      on(handleGroupHistory),
+	"typing":             on(handleTyping),
+	"get_state":          on(handleGetState),
+	"get_difference":     on(handleGetDifference),
+}
+
+// dispatch handles one decoded frame. Unknown payload fields are rejected
+// only for v1 clients; legacy clients never had them checked.
+func (c *Client) dispatch(env *Envelope, perr *ErrorPayload, strict bool) {
+	var id string
+	if env != nil {
+		id = env.ID
+	}
+	if perr != nil {
+		c.replyError(id, *perr)
+		return
+	}
+
+	rt, ok := routes[env.Type]
+	if !ok {
+		c.replyError(id, ErrorPayload{Code: ErrUnknownType, Message: "未知消息类型"})
+		return
+	}
+	p, fieldErrs := rt.decode(env.Payload, strict)
+	if len(fieldErrs) > 0 {
+		c.replyError(id, ErrorPayload{Code: ErrInvalidPayload, Message: invalidPayloadMessage(fieldErrs), Fields: fieldErrs})
+		return
+	}
+	rt.handle(c, id, p)
+}
+
+func invalidPayloadMessage(errs []FieldError) string {
+	parts := make([]string, len(errs))
+	for i, e := range errs {
+		parts[i] = e.Field + ": " + e.Message
+	}
+	return "参数错误 (" + strings.Join(parts, "; ") + ")"
+}
+
+func (c *Client) reply(id, typ string, payload interface{}) {
+	c.Conn.WriteJSON(Frame{Type: typ, ID: id, Payload: payload})
+}
+
+func (c *Client) replyError(id string, e ErrorPayload) {
+	c.reply(id, "error", e)
+}
+
+// contentTooLong replies with an error if content exceeds MaxContentLength.
+func (c *Client) contentTooLong(id, content string) bool {
+	if !ContentTooLong(content) {
+		return false
+	}
+	c.replyError(id, ErrorPayload{
+		Code:    ErrMessageTooLong,
+		Message: fmt.Sprintf("消息内容不能超过%d个字符", MaxContentLength),
+		Fields:  []FieldError{{"content", fmt.Sprintf("must be at most %d characters", MaxContentLength)}},
+	})
+	return true
+}
+
+func handleSendMessage(c *Client, id string, p *SendMessagePayload) {
+	if c.contentTooLong(id, p.Content) {
+		return
+	}
+	to, ok := c.h.resolveUsername(p.To)
+	if !ok {
+		c.replyError(id, ErrorPayload{Code: ErrNotFound, Message: "目标用户不存在"})
+		return
+	}
+	// 存储消息并推送给双方所有在线端
+	msg, created, err := c.h.SendPrivateMessage(c.Username, to, p.ClientID, p.Content)
+	if err != nil {
+		c.replySendError(id, err)
+		return
+	}
+	c.ack(id, p.ClientID, msg, created)
+}
+
+func handleSendGroupMessage(c *Client, id string, p *SendGroupMessagePayload) {
+	if c.contentTooLong(id, p.Content) {
+		return
+	}
+	isMember, err := c.h.groups.IsUserInGroup(c.Username, p.GroupID)
+	if err != nil || !isMember {
+		c.replyError(id, ErrorPayload{Code: ErrForbidden, Message: "你不是该群组成员"})
+		return
+	}
+	// 存储群消息并推送给所有在线的群成员
+	msg, created, err := c.h.SendGroupMessage(c.Username, p.GroupID, p.ClientID, p.Content)
+	if err != nil {
+		c.replySendError(id, err)
+		return
+	}
+	c.ack(id, p.ClientID, msg, created)
+}
+
+// ack confirms a send to the connection it came from.
+func (c *Client) ack(id, clientID string, msg *store.Message, created bool) {
+	c.reply(id, "ack", AckPayload{
+		ClientID:  clientID,
+		ID:        int64(msg.ID),
+		TS:        store.FormatTime(msg.CreatedAt),
+		Duplicate: !created,
+	})
+}
+
+func (c *Client) replySendError(id string, err error) {
+	if err == store.ErrClientIDReused {
+		c.replyError(id, ErrorPayload{Code: ErrConflict, Message: "client_id已用于另一条消息", Fields: []FieldError{{"client_id", "already used"}}})
+		return
+	}
+	log.Printf("消息存储失败 (from: %s): %v", c.Username, err)
+	c.replyError(id, ErrorPayload{Code: ErrInternal, Message: "消息存储失败"})
+}
+
+func handleHistory(c *Client, id string, p *HistoryPayload) {
+	with, ok := c.h.resolveUsername(p.With)
+	if !ok {
+		c.replyError(id, ErrorPayload{Code: ErrNotFound, Message: "目标用户不存在"})
+		return
+	}
+	page, err := c.h.messages.GetPrivateHistory(c.Username, with, p.query())
+	if err != nil {
+		c.replyError(id, ErrorPayload{Code: ErrInternal, Message: "查询历史失败"})
+		return
+	}
+	c.reply(id, "history", HistoryResultPayload{With: with, HistoryPage: *page})
+}
+
+func handleGroupHistory(c *Client, id string, p *GroupHistoryPayload) {
+	// 1. 验证用户是否在群组中
+	isMember, err := c.h.groups.IsUserInGroup(c.Username, p.GroupID)
+	if err != nil || !isMember {
+		c.replyError(id, ErrorPayload{Code: ErrForbidden, Message: "无权限访问该群组历史"})
+		return
+	}
+	// 2. 获取群组历史消息
+	page, err := c.h.messages.GetGroupHistory(p.GroupID, p.query())
+	if err != nil {
+		c.replyError(id, ErrorPayload{Code: ErrInternal, Message: "查询群组历史失败"})
+		return
+	}
+	c.reply(id, "history_group", GroupHistoryResultPayload{GroupID: p.GroupID, HistoryPage: *page})
+}
+
+func handleGetState(c *Client, id string, p *GetStatePayload) {
+	pts, err := c.h.messages.GetUpdateState(c.Username)
+	if err != nil {
+		c.replyError(id, ErrorPayload{Code: ErrInternal, Message: "查询同步状态失败"})
+		return
+	}
+	c.reply(id, "state", StatePayload{PTS: pts})
+}
+
+// handleGetDifference returns the updates a client missed, e.g. while it was
+// offline or after it saw a gap in the PTS of pushes.
+func handleGetDifference(c *Client, id string, p *GetDifferencePayload) {
+	limit := p.Limit
+	if limit == 0 {
+		limit = defaultDifferenceLimit
+	}
+	// Fetch one more than requested to know whether there are more.
+	updates, err := c.h.messages.GetUpdates(c.Username, p.PTS, limit+1)
+	if err != nil {
+		c.replyError(id, ErrorPayload{Code: ErrInternal, Message: "查询更新失败"})
+		return
+	}
+	more := len(updates) > limit
+	if more {
+		updates = updates[:limit]
+	}
+
+	diff := DifferencePayload{Updates: make([]DifferenceUpdate, len(updates)), PTS: p.PTS, More: more}
+	for i := range updates {
+		f := updateFrame(&updates[i])
+		diff.Updates[i] = DifferenceUpdate{PTS: f.PTS, Type: f.Type, Payload: f.Payload}
+		diff.PTS = f.PTS
+	}
+	c.reply(id, "difference", diff)
+}
+
+// handleTyping forwards a typing notification. Failures are ignored
+// silently, as typing notifications are best effort.
+func handleTyping(c *Client, id string, p *TypingPayload) {
+	if p.To != "" { // Private chat typing
+		to, ok := c.h.resolveUsername(p.To)
+		if !ok {
+			return
+		}
+		c.h.hub.SendToUser(to, Frame{Type: "user_typing", Payload: UserTypingPayload{From: c.Username}})
+		return
+	}
+
+	// Group chat typing
+	isMember, err := c.h.groups.IsUserInGroup(c.Username, p.GroupID)
+	if err != nil || !isMember {
+		return
+	}
+	members, err := c.h.groups.GetGroupMembers(p.GroupID)
+	if err != nil {
+		return
+	}
+	push := Frame{Type: "user_typing", Payload: UserTypingPayload{From: c.Username, GroupID: p.GroupID}}
+	// Broadcast to all members except the sender
+	for _, member := range members {
+		if member != c.Username {
+			c.h.hub.SendToUser(member, push)
 		}
 	}
 }
+
+// resolveUsername maps a username received from a client to the canonical
+// spelling of an existing account, so that e.g. "ALICE" reaches the hub
+// entry of "Alice".
+func (h *Handler) resolveUsername(name string) (string, bool) {
+	if !policy.IsPlausibleUsername(name) {
+		return "", false
+	}
+	username, err := h.users.ResolveUsername(name)
+	if err != nil {
+		return "", false
+	}
+	return username, true
+}
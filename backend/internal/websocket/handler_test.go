@@ -0,0 +1,37 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+
+	"learning-telegram/internal/store"
+)
+
+// countingSessions counts the touches that reach the store.
+type countingSessions struct {
+	store.SessionRepo
+	touches int
+}
+
+func (s *countingSessions) TouchSession(id, ip string) error {
+	s.touches++
+	return nil
+}
+
+func TestTouchThrottled(t *testing.T) {
+	sessions := &countingSessions{}
+	c := &Client{SessionID: "s1", h: &Handler{sessions: sessions}}
+
+	for range 100 {
+		c.touch("192.0.2.1")
+	}
+	if sessions.touches != 1 {
+		t.Fatalf("%d touches of the store for frames in quick succession, want 1", sessions.touches)
+	}
+
+	c.lastTouch = time.Now().Add(-store.SessionTouchInterval)
+	c.touch("192.0.2.1")
+	if sessions.touches != 2 {
+		t.Errorf("%d touches of the store, want another one after store.SessionTouchInterval", sessions.touches)
+	}
+}
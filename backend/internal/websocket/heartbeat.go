@@ -0,0 +1,104 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// HeartbeatConfig controls how dead connections are detected. The server
+// pings every client each PingInterval; a connection from which nothing,
+// not even a pong, was read for PongTimeout is considered dead and closed.
+// Browsers answer pings on their own.
+type HeartbeatConfig struct {
+	PingInterval time.Duration
+	PongTimeout  time.Duration // must be longer than PingInterval
+	WriteTimeout time.Duration // for a single frame
+	MaxFrameSize int64         // in bytes; larger frames close the connection
+}
+
+var DefaultHeartbeatConfig = HeartbeatConfig{
+	PingInterval: 30 * time.Second,
+	PongTimeout:  60 * time.Second,
+	WriteTimeout: 10 * time.Second,
+	MaxFrameSize: 64 << 10,
+}
+
+// Validate checks that the intervals are consistent.
+func (cfg HeartbeatConfig) Validate() error {
+	if cfg.PingInterval <= 0 || cfg.WriteTimeout <= 0 || cfg.MaxFrameSize <= 0 {
+		return fmt.Errorf("heartbeat intervals and frame size must be positive")
+	}
+	if cfg.PongTimeout <= cfg.PingInterval {
+		return fmt.Errorf("pong timeout %v must be longer than ping interval %v", cfg.PongTimeout, cfg.PingInterval)
+	}
+	return nil
+}
+
+// Liveness is implemented by connections that know when their client was
+// last heard from. The reaper closes and unregisters those that have been
+// silent for longer than the pong timeout.
+type Liveness interface {
+	LastSeen() time.Time
+}
+
+// Start starts the reaper of the hub. It must be called once.
+func (h *Hub) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	h.stopReaper = cancel
+	h.reaper.Add(1)
+	go func() {
+		defer h.reaper.Done()
+		ticker := time.NewTicker(h.heartbeat.PingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			if n := h.reap(time.Now().Add(-h.heartbeat.PongTimeout)); n > 0 {
+				log.Printf("清理了%d个失效的连接", n)
+			}
+		}
+	}()
+}
+
+// Stop stops the reaper and waits for it to return, so it no longer
+// unregisters connections, which calls the presence functions.
+func (h *Hub) Stop() {
+	if h.stopReaper == nil {
+		return
+	}
+	h.stopReaper()
+	h.reaper.Wait()
+}
+
+// reap closes and unregisters the connections not heard from since the
+// deadline. Read deadlines already end the read loops of most dead
+// connections; this also catches read loops that are stuck elsewhere, so
+// IsUserOnline doesn't report ghosts.
+func (h *Hub) reap(deadline time.Time) int {
+	type stale struct {
+		username string
+		conn     Connection
+		p        *peer
+	}
+	var found []stale
+	h.lock.RLock()
+	for username, peers := range h.clients {
+		for conn, p := range peers {
+			if l, ok := conn.(Liveness); ok && l.LastSeen().Before(deadline) {
+				found = append(found, stale{username, conn, p})
+			}
+		}
+	}
+	h.lock.RUnlock()
+
+	for _, s := range found {
+		s.p.Close()
+		h.Unregister(s.username, s.conn)
+	}
+	return len(found)
+}
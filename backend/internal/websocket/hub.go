@@ -1,12 +1,22 @@
 package websocket
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
 	"sync"
+	"time"
 )
 
+// Client is the server side of one WebSocket connection.
 type Client struct {
-	Username string
-	Conn     Connection
+	Username  string
+	SessionID string
+	Conn      Connection
+
+	h         *Handler
+	lastTouch time.Time // of the session, see touch
 }
 
 type Connection interface {
@@ -15,56 +25,301 @@ type Connection interface {
 	Close() error
 }
 
+// Hub tracks the live connections of every user. Each connection gets a
+// bounded send queue drained by its own goroutine, see peer, so pushing to a
+// user never waits for the user's clients. Connections to other nodes are
+// reached through the Broker.
 type Hub struct {
-	clients map[string]map[Connection]struct{} // 用户名 -> 连接集合
-	lock    sync.RWMutex
+	clients   map[string]map[Connection]*peer // 用户名 -> 连接集合
+	queueSize int
+	overflow  OverflowPolicy
+	heartbeat HeartbeatConfig
+	presence  []func(username string, online bool)
+	events    map[string][]func(data json.RawMessage)
+	broker    Broker
+	lock      sync.RWMutex
+
+	// reported is the presence last reported to the broker, per user
+	// connected to this node; presenceLock serializes the reports.
+	reported     map[string]bool
+	presenceLock sync.Mutex
+
+	stopReaper context.CancelFunc // see Start
+	reaper     sync.WaitGroup
+}
+
+// HubConfig configures the send queues of connections, how many frames
+// they hold and what happens when one is full, and how dead connections are
+// detected.
+type HubConfig struct {
+	SendQueueSize int
+	Overflow      OverflowPolicy
+	Heartbeat     HeartbeatConfig
 }
 
-var hub = &Hub{
-	clients: make(map[string]map[Connection]struct{}),
+var DefaultHubConfig = HubConfig{
+	SendQueueSize: DefaultSendQueueSize,
+	Overflow:      OverflowDisconnect,
+	Heartbeat:     DefaultHeartbeatConfig,
+}
+
+// NewHub returns a hub with no connections that only reaches this node,
+// see SetBroker.
+func NewHub(cfg HubConfig) (*Hub, error) {
+	if cfg.SendQueueSize <= 0 {
+		return nil, fmt.Errorf("send queue size must be positive")
+	}
+	if err := cfg.Heartbeat.Validate(); err != nil {
+		return nil, err
+	}
+	return &Hub{
+		clients:   make(map[string]map[Connection]*peer),
+		queueSize: cfg.SendQueueSize,
+		overflow:  cfg.Overflow,
+		heartbeat: cfg.Heartbeat,
+		events:    make(map[string][]func(json.RawMessage)),
+		broker:    LocalBroker{},
+		reported:  make(map[string]bool),
+	}, nil
 }
 
-// 用户上线，注册连接
-func (h *Hub) Register(username string, conn Connection) {
+// SetBroker connects the hub to other nodes. It must be called before
+// connections are registered.
+func (h *Hub) SetBroker(b Broker) error {
+	err := b.Subscribe(
+		func(username string, f Frame) { h.deliver(username, f, true) },
+		func(username, sessionID string) { h.closeLocalSession(username, sessionID) },
+		h.event,
+	)
+	if err != nil {
+		return err
+	}
 	h.lock.Lock()
 	defer h.lock.Unlock()
+	h.broker = b
+	return nil
+}
+
+// 用户上线，注册连接。Frames to the connection should be written to the
+// returned Connection, which queues them behind the hub's pushes, rather than
+// to conn directly.
+func (h *Hub) Register(username, sessionID string, conn Connection) Connection {
+	h.lock.Lock()
 	if h.clients[username] == nil {
-		h.clients[username] = make(map[Connection]struct{})
+		h.clients[username] = make(map[Connection]*peer)
 	}
-	h.clients[username][conn] = struct{}{}
+	if p, ok := h.clients[username][conn]; ok {
+		h.lock.Unlock()
+		return p
+	}
+	p := newPeer(conn, h.queueSize, h.overflow)
+	p.sessionID = sessionID
+	h.clients[username][conn] = p
+	first := len(h.clients[username]) == 1
+	h.lock.Unlock()
+
+	if first {
+		h.presenceChanged(username)
+	}
+	return p
 }
 
-// 用户下线，移除连接
+// 用户下线，移除连接并停止其发送队列
 func (h *Hub) Unregister(username string, conn Connection) {
+	h.lock.Lock()
+	p, ok := h.clients[username][conn]
+	if !ok {
+		h.lock.Unlock()
+		return
+	}
+	p.shutdown()
+	delete(h.clients[username], conn)
+	last := len(h.clients[username]) == 0
+	if last {
+		delete(h.clients, username)
+	}
+	h.lock.Unlock()
+
+	if last {
+		h.presenceChanged(username)
+	}
+}
+
+// OnPresence registers a function that is called when a user comes online
+// with their first connection or goes offline with their last one.
+func (h *Hub) OnPresence(f func(username string, online bool)) {
 	h.lock.Lock()
 	defer h.lock.Unlock()
-	if conns, ok := h.clients[username]; ok {
-		delete(conns, conn)
-		if len(h.clients[username]) == 0 {
-			delete(h.clients, username)
+	h.presence = append(h.presence, f)
+}
+
+// OnEvent registers a function that is called with the data of the events
+// of the given name that other nodes publish, see PublishEvent.
+func (h *Hub) OnEvent(name string, f func(data json.RawMessage)) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.events[name] = append(h.events[name], f)
+}
+
+// PublishEvent sends an event with v encoded as JSON to the other nodes, so
+// that packages which keep state per node, like bots, can tell them about
+// changes. Like frames, events are relayed best effort.
+func (h *Hub) PublishEvent(name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return h.getBroker().PublishEvent(name, data)
+}
+
+func (h *Hub) event(name string, data json.RawMessage) {
+	h.lock.RLock()
+	funcs := h.events[name]
+	h.lock.RUnlock()
+	for _, f := range funcs {
+		f(data)
+	}
+}
+
+// presenceChanged reports a user's presence on this node to the broker and
+// calls the presence functions with the user's cluster-wide state. Both use
+// the current state rather than the transition that triggered the call, so
+// that a connection and disconnection racing each other can't leave a stale
+// state behind.
+func (h *Hub) presenceChanged(username string) {
+	h.presenceLock.Lock()
+	h.lock.RLock()
+	local := len(h.clients[username]) > 0
+	broker := h.broker
+	h.lock.RUnlock()
+	if local != h.reported[username] {
+		var err error
+		if local {
+			err = broker.Connected(username)
+			h.reported[username] = true
+		} else {
+			err = broker.Disconnected(username)
+			delete(h.reported, username)
+		}
+		if err != nil {
+			log.Printf("同步 %s 的在线状态失败: %v", username, err)
 		}
 	}
+	h.presenceLock.Unlock()
+
+	h.lock.RLock()
+	funcs := h.presence
+	h.lock.RUnlock()
+	online := h.IsUserOnline(username)
+	for _, f := range funcs {
+		f(username, online)
+	}
 }
 
-// 向某个用户的所有在线端推送消息
-func (h *Hub) SendToUser(username string, msg interface{}) {
+// peers returns the connections of a user, so they can be written to
+// without holding the lock.
+func (h *Hub) peers(username string) []*peer {
 	h.lock.RLock()
 	defer h.lock.RUnlock()
-	for conn := range h.clients[username] {
-		conn.WriteJSON(msg)
+	peers := make([]*peer, 0, len(h.clients[username]))
+	for _, p := range h.clients[username] {
+		peers = append(peers, p)
 	}
+	return peers
 }
 
-// IsUserOnline checks if a user has at least one active connection.
-func (h *Hub) IsUserOnline(username string) bool {
+// 向某个用户的所有在线端推送消息，包括连接到其他节点的。It only queues the
+// message and never blocks on clients.
+func (h *Hub) SendToUser(username string, f Frame) {
+	h.deliver(username, f, false)
+	if err := h.getBroker().Publish(username, f); err != nil {
+		log.Printf("转发消息到其他节点失败 (user: %s): %v", username, err)
+	}
+}
+
+// deliver queues a frame for the connections of a user on this node. Direct
+// connections, such as those of bots, store what they are written, so a
+// frame relayed from another node that may have written it to its own is
+// only passed to their Relayed method.
+func (h *Hub) deliver(username string, f Frame, relayed bool) {
+	for _, p := range h.peers(username) {
+		if relayed && p.direct {
+			p.conn.(DirectConnection).Relayed(f)
+			continue
+		}
+		p.push(f)
+	}
+}
+
+func (h *Hub) getBroker() Broker {
 	h.lock.RLock()
 	defer h.lock.RUnlock()
-	connections, ok := h.clients[username]
-	return ok && len(connections) > 0
+	return h.broker
+}
+
+// CloseSession closes every live connection opened with the given session,
+// on any node, e.g. after the session was terminated from another device.
+// The read loops of the closed connections unregister them. It returns the
+// number of connections closed on this node.
+func (h *Hub) CloseSession(username, sessionID string) int {
+	if err := h.getBroker().PublishCloseSession(username, sessionID); err != nil {
+		log.Printf("通知其他节点关闭会话失败 (session: %s): %v", sessionID, err)
+	}
+	return h.closeLocalSession(username, sessionID)
 }
 
-// GetHub provides access to the global hub instance.
-// This is a simple way to allow other packages to access the hub.
-func GetHub() *Hub {
-	return hub
+func (h *Hub) closeLocalSession(username, sessionID string) int {
+	var closing []*peer
+	for _, p := range h.peers(username) {
+		if p.sessionID == sessionID {
+			closing = append(closing, p)
+		}
+	}
+
+	for _, p := range closing {
+		p.Close()
+	}
+	return len(closing)
+}
+
+// QueueMetrics returns the current depth of the send queues and the
+// counters of frames sent, dropped and failed.
+func (h *Hub) QueueMetrics() QueueMetrics {
+	h.lock.RLock()
+	m := QueueMetrics{QueueSize: h.queueSize, Overflow: h.overflow}
+	for _, peers := range h.clients {
+		for _, p := range peers {
+			if p.direct {
+				continue
+			}
+			d := p.depth()
+			m.Connections++
+			m.QueuedFrames += d
+			m.MaxQueueDepth = max(m.MaxQueueDepth, d)
+		}
+	}
+	h.lock.RUnlock()
+
+	m.FramesSent = framesSent.Load()
+	m.FramesDropped = framesDropped.Load()
+	m.OverflowDisconnects = overflowDisconnects.Load()
+	m.WriteErrors = writeErrors.Load()
+	return m
+}
+
+// IsUserOnline checks if a user has at least one active connection to any
+// node.
+func (h *Hub) IsUserOnline(username string) bool {
+	h.lock.RLock()
+	local := len(h.clients[username]) > 0
+	broker := h.broker
+	h.lock.RUnlock()
+	if local {
+		return true
+	}
+	online, err := broker.IsOnline(username)
+	if err != nil {
+		log.Printf("查询 %s 的在线状态失败: %v", username, err)
+	}
+	return online
 }
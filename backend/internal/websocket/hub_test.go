@@ -0,0 +1,297 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCluster connects the brokers of several hubs in memory, like Redis
+// connects the nodes of a real cluster.
+type fakeCluster struct {
+	lock    sync.Mutex
+	brokers []*fakeBroker
+	online  map[string]map[*fakeBroker]bool // username -> nodes
+}
+
+type fakeBroker struct {
+	cluster      *fakeCluster
+	deliver      func(string, Frame)
+	closeSession func(string, string)
+	event        func(string, json.RawMessage)
+}
+
+// newNodes returns n hubs connected through a fakeCluster.
+func newNodes(t *testing.T, n int) []*Hub {
+	t.Helper()
+	cluster := &fakeCluster{online: make(map[string]map[*fakeBroker]bool)}
+	hubs := make([]*Hub, n)
+	for i := range hubs {
+		hub, err := NewHub(DefaultHubConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hubs[i] = hub
+		if err := hubs[i].SetBroker(&fakeBroker{cluster: cluster}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return hubs
+}
+
+func (b *fakeBroker) Subscribe(deliver func(string, Frame), closeSession func(string, string), event func(string, json.RawMessage)) error {
+	b.deliver, b.closeSession, b.event = deliver, closeSession, event
+	b.cluster.lock.Lock()
+	defer b.cluster.lock.Unlock()
+	b.cluster.brokers = append(b.cluster.brokers, b)
+	return nil
+}
+
+// others returns the brokers of the other nodes.
+func (b *fakeBroker) others() []*fakeBroker {
+	b.cluster.lock.Lock()
+	defer b.cluster.lock.Unlock()
+	var others []*fakeBroker
+	for _, o := range b.cluster.brokers {
+		if o != b {
+			others = append(others, o)
+		}
+	}
+	return others
+}
+
+// Publish relays the frame as JSON, as a real broker would.
+func (b *fakeBroker) Publish(username string, f Frame) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	for _, o := range b.others() {
+		var relayed Frame
+		if err := json.Unmarshal(data, &relayed); err != nil {
+			return err
+		}
+		o.deliver(username, relayed)
+	}
+	return nil
+}
+
+func (b *fakeBroker) PublishCloseSession(username, sessionID string) error {
+	for _, o := range b.others() {
+		o.closeSession(username, sessionID)
+	}
+	return nil
+}
+
+func (b *fakeBroker) PublishEvent(name string, data json.RawMessage) error {
+	for _, o := range b.others() {
+		o.event(name, data)
+	}
+	return nil
+}
+
+func (b *fakeBroker) Connected(username string) error {
+	b.cluster.lock.Lock()
+	defer b.cluster.lock.Unlock()
+	if b.cluster.online[username] == nil {
+		b.cluster.online[username] = make(map[*fakeBroker]bool)
+	}
+	b.cluster.online[username][b] = true
+	return nil
+}
+
+func (b *fakeBroker) Disconnected(username string) error {
+	b.cluster.lock.Lock()
+	defer b.cluster.lock.Unlock()
+	delete(b.cluster.online[username], b)
+	return nil
+}
+
+func (b *fakeBroker) IsOnline(username string) (bool, error) {
+	b.cluster.lock.Lock()
+	defer b.cluster.lock.Unlock()
+	for node := range b.cluster.online[username] {
+		if node != b {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (b *fakeBroker) Close() error { return nil }
+
+// testConn records the frames written to it.
+type testConn struct {
+	frames chan interface{}
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newTestConn() *testConn {
+	return &testConn{frames: make(chan interface{}, 16), closed: make(chan struct{})}
+}
+
+func (c *testConn) WriteJSON(v interface{}) error {
+	c.frames <- v
+	return nil
+}
+
+func (c *testConn) ReadJSON(v interface{}) error {
+	<-c.closed
+	return errors.New("closed")
+}
+
+func (c *testConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *testConn) next(t *testing.T) Frame {
+	t.Helper()
+	select {
+	case v := <-c.frames:
+		return v.(Frame)
+	case <-time.After(time.Second):
+		t.Fatal("no frame written")
+		return Frame{}
+	}
+}
+
+func (c *testConn) none(t *testing.T) {
+	t.Helper()
+	select {
+	case v := <-c.frames:
+		t.Fatalf("unexpected frame %+v", v)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// testDirectConn is a DirectConnection like those of bots.
+type testDirectConn struct {
+	testConn
+	relayed chan Frame
+}
+
+func newTestDirectConn() *testDirectConn {
+	return &testDirectConn{testConn: *newTestConn(), relayed: make(chan Frame, 16)}
+}
+
+func (c *testDirectConn) Relayed(f Frame) {
+	c.relayed <- f
+}
+
+func TestCrossNodeDelivery(t *testing.T) {
+	nodes := newNodes(t, 2)
+	onA, onB := newTestConn(), newTestConn()
+	nodes[0].Register("alice", "s1", onA)
+	nodes[1].Register("alice", "s2", onB)
+	bob := newTestConn()
+	nodes[1].Register("bob", "s3", bob)
+
+	sent := NewMessagePayload{ID: 7, From: "bob", To: "alice", Content: "hi"}
+	nodes[1].SendToUser("alice", Frame{Type: "new_message", PTS: 3, Payload: sent})
+
+	for _, c := range []*testConn{onA, onB} {
+		f := c.next(t)
+		if f.Type != "new_message" || f.PTS != 3 || f.Payload != sent {
+			t.Errorf("got %+v, want the sent frame", f)
+		}
+		c.none(t)
+	}
+	bob.none(t)
+}
+
+func TestCrossNodeDirectConnection(t *testing.T) {
+	nodes := newNodes(t, 2)
+	onA, onB := newTestDirectConn(), newTestDirectConn()
+	nodes[0].Register("bot", "", onA)
+	nodes[1].Register("bot", "", onB)
+
+	sent := NewMessagePayload{ID: 7, From: "alice", To: "bot", Content: "/start"}
+	nodes[0].SendToUser("bot", Frame{Type: "new_message", Payload: sent})
+
+	// Only the sending node writes the frame; the other one is told about it.
+	if f := onA.next(t); f.Payload != sent {
+		t.Errorf("written %+v, want the sent frame", f)
+	}
+	onB.none(t)
+	select {
+	case f := <-onB.relayed:
+		if f.Payload != sent {
+			t.Errorf("relayed %+v, want the sent frame", f)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("frame not relayed")
+	}
+	if len(onA.relayed) != 0 {
+		t.Error("the sending node relayed the frame to itself")
+	}
+}
+
+func TestIsUserOnline(t *testing.T) {
+	nodes := newNodes(t, 2)
+	conn := newTestConn()
+
+	if nodes[0].IsUserOnline("alice") {
+		t.Fatal("alice online before connecting")
+	}
+	nodes[1].Register("alice", "s1", conn)
+	for i, h := range nodes {
+		if !h.IsUserOnline("alice") {
+			t.Errorf("node %d: alice offline while connected to node 1", i)
+		}
+	}
+	nodes[1].Unregister("alice", conn)
+	for i, h := range nodes {
+		if h.IsUserOnline("alice") {
+			t.Errorf("node %d: alice online after disconnecting", i)
+		}
+	}
+}
+
+func TestCloseSessionOnOtherNode(t *testing.T) {
+	nodes := newNodes(t, 2)
+	closing, other, local := newTestConn(), newTestConn(), newTestConn()
+	nodes[1].Register("alice", "s1", closing)
+	nodes[1].Register("alice", "s2", other)
+	nodes[0].Register("alice", "s1", local)
+
+	if n := nodes[0].CloseSession("alice", "s1"); n != 1 {
+		t.Errorf("closed %d connections on node 0, want 1", n)
+	}
+	for name, c := range map[string]*testConn{"node 0": local, "node 1": closing} {
+		select {
+		case <-c.closed:
+		default:
+			t.Errorf("%s: connection of the session not closed", name)
+		}
+	}
+	select {
+	case <-other.closed:
+		t.Error("connection of another session closed")
+	default:
+	}
+}
+
+func TestEvents(t *testing.T) {
+	nodes := newNodes(t, 2)
+	got := make(chan int64, 2)
+	for _, h := range nodes {
+		h.OnEvent("bot_changed", func(data json.RawMessage) {
+			var id int64
+			if err := json.Unmarshal(data, &id); err != nil {
+				t.Error(err)
+			}
+			got <- id
+		})
+	}
+
+	if err := nodes[0].PublishEvent("bot_changed", 42); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || <-got != 42 {
+		t.Error("event not handled once by the other node")
+	}
+}
@@ -0,0 +1,527 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"learning-telegram/internal/store"
+)
+
+// ProtocolV1 is the WebSocket subprotocol of the versioned envelope protocol.
+// Clients that don't request it speak the legacy protocol of flat JSON
+// objects with a "type" field, which the bundled frontend still uses.
+const (
+	ProtocolV1      = "tg.v1"
+	protocolVersion = 1
+)
+
+// Envelope is a frame of the v1 protocol. ID is chosen by the client for
+// requests and echoed in the direct reply, so the two can be correlated;
+// pushes caused by other clients carry no ID. PTS is set on pushes of
+// entries of the receiving user's update sequence, see store.Update.
+type Envelope struct {
+	V       int             `json:"v"`
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	PTS     int64           `json:"pts,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Frame is a message to a client. It is encoded as an Envelope for v1
+// connections and flattened for legacy ones by the connection it is written
+// to, so the hub can push the same Frame to both.
+type Frame struct {
+	Type    string
+	ID      string
+	PTS     int64
+	Payload interface{}
+}
+
+// wireFrame is the JSON form of a Frame relayed between nodes by a Broker.
+type wireFrame struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	PTS     int64           `json:"pts,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+func (f Frame) MarshalJSON() ([]byte, error) {
+	payload, err := json.Marshal(f.Payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(wireFrame{Type: f.Type, ID: f.ID, PTS: f.PTS, Payload: payload})
+}
+
+// UnmarshalJSON decodes the payload of frames pushed through the hub into
+// the same type the sending node pushed, so that connections that look at
+// payloads, like those of bots, can't tell relayed frames from local ones.
+// Other payloads are kept as raw JSON.
+func (f *Frame) UnmarshalJSON(data []byte) error {
+	var w wireFrame
+	if err := json.Unmarshal(data, &w); err != nil {
+		return err
+	}
+	*f = Frame{Type: w.Type, ID: w.ID, PTS: w.PTS, Payload: w.Payload}
+	if decode, ok := pushPayloads[w.Type]; ok {
+		payload, err := decode(w.Payload)
+		if err != nil {
+			return fmt.Errorf("frame %q: %w", w.Type, err)
+		}
+		f.Payload = payload
+	}
+	return nil
+}
+
+// pushPayloads decodes the payloads of the frame types pushed through
+// Hub.SendToUser.
+var pushPayloads = map[string]func(json.RawMessage) (interface{}, error){
+	"new_message":       decodeAs[NewMessagePayload],
+	"new_group_message": decodeAs[NewGroupMessagePayload],
+	"user_typing":       decodeAs[UserTypingPayload],
+	"user_status":       decodeAs[UserStatusPayload],
+}
+
+func decodeAs[T any](raw json.RawMessage) (interface{}, error) {
+	var v T
+	err := json.Unmarshal(raw, &v)
+	return v, err
+}
+
+// Client to server payloads.
+
+// maxClientIDLength bounds client message IDs; a UUID has 36 characters.
+const maxClientIDLength = 64
+
+// ValidClientID checks a client message ID: 1 to 64 ASCII letters, digits and
+// "-", "_", ".", ":". The REST API checks the IDs of messages sent through it
+// with it too.
+func ValidClientID(id string) []FieldError {
+	if id == "" {
+		return []FieldError{{"client_id", "required"}}
+	}
+	if len(id) > maxClientIDLength {
+		return []FieldError{{"client_id", "must be at most 64 characters"}}
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.:", r)) {
+			return []FieldError{{"client_id", "may only contain letters, digits and - _ . :"}}
+		}
+	}
+	return nil
+}
+
+// MaxContentLength is the length, in characters, of the longest message
+// content accepted over the WebSocket, the REST API and the Bot API. Longer
+// content is rejected with ErrMessageTooLong.
+const MaxContentLength = 4096
+
+// ContentTooLong reports whether message content exceeds MaxContentLength.
+func ContentTooLong(content string) bool {
+	return utf8.RuneCountInString(content) > MaxContentLength
+}
+
+// SendMessagePayload sends a private message. ClientID is generated by the
+// client, e.g. a UUID, and makes retries of the same send idempotent.
+type SendMessagePayload struct {
+	ClientID string `json:"client_id"`
+	To       string `json:"to"`
+	Content  string `json:"content"`
+}
+
+func (p *SendMessagePayload) validate() []FieldError {
+	errs := ValidClientID(p.ClientID)
+	if strings.TrimSpace(p.To) == "" {
+		errs = append(errs, FieldError{"to", "required"})
+	}
+	if strings.TrimSpace(p.Content) == "" {
+		errs = append(errs, FieldError{"content", "required"})
+	}
+	return errs
+}
+
+type SendGroupMessagePayload struct {
+	ClientID string `json:"client_id"`
+	GroupID  int64  `json:"group_id"`
+	Content  string `json:"content"`
+}
+
+func (p *SendGroupMessagePayload) validate() []FieldError {
+	errs := ValidClientID(p.ClientID)
+	if p.GroupID <= 0 {
+		errs = append(errs, FieldError{"group_id", "required"})
+	}
+	if strings.TrimSpace(p.Content) == "" {
+		errs = append(errs, FieldError{"content", "required"})
+	}
+	return errs
+}
+
+// HistoryPayload requests a page of the private chat with a user. At most
+// one of BeforeID, AfterID and AroundID is set, see store.HistoryQuery;
+// without them the page holds the newest messages.
+type HistoryPayload struct {
+	With     string `json:"with"`
+	BeforeID int64  `json:"before_id,omitempty"`
+	AfterID  int64  `json:"after_id,omitempty"`
+	AroundID int64  `json:"around_id,omitempty"`
+	Limit    int    `json:"limit,omitempty"`
+}
+
+func (p *HistoryPayload) validate() []FieldError {
+	errs := validateHistoryQuery(p.query())
+	if strings.TrimSpace(p.With) == "" {
+		errs = append(errs, FieldError{"with", "required"})
+	}
+	return errs
+}
+
+func (p *HistoryPayload) query() store.HistoryQuery {
+	return store.HistoryQuery{BeforeID: p.BeforeID, AfterID: p.AfterID, AroundID: p.AroundID, Limit: p.Limit}
+}
+
+// GroupHistoryPayload requests a page of a group's history, like
+// HistoryPayload.
+type GroupHistoryPayload struct {
+	GroupID  int64 `json:"group_id"`
+	BeforeID int64 `json:"before_id,omitempty"`
+	AfterID  int64 `json:"after_id,omitempty"`
+	AroundID int64 `json:"around_id,omitempty"`
+	Limit    int   `json:"limit,omitempty"`
+}
+
+func (p *GroupHistoryPayload) validate() []FieldError {
+	errs := validateHistoryQuery(p.query())
+	if p.GroupID <= 0 {
+		errs = append(errs, FieldError{"group_id", "required"})
+	}
+	return errs
+}
+
+func (p *GroupHistoryPayload) query() store.HistoryQuery {
+	return store.HistoryQuery{BeforeID: p.BeforeID, AfterID: p.AfterID, AroundID: p.AroundID, Limit: p.Limit}
+}
+
+// validateHistoryQuery checks the cursor fields shared by the history
+// payloads.
+func validateHistoryQuery(q store.HistoryQuery) []FieldError {
+	var errs []FieldError
+	set := 0
+	for _, c := range []struct {
+		field string
+		id    int64
+	}{{"after_id", q.AfterID}, {"around_id", q.AroundID}, {"before_id", q.BeforeID}} {
+		if c.id < 0 {
+			errs = append(errs, FieldError{c.field, "must be positive"})
+		}
+		if c.id != 0 {
+			set++
+			if set > 1 {
+				errs = append(errs, FieldError{c.field, "only one of before_id, after_id and around_id allowed"})
+			}
+		}
+	}
+	if q.Limit < 0 || q.Limit > store.MaxHistoryLimit {
+		errs = append(errs, FieldError{"limit", "must be between 1 and 100"})
+	}
+	return errs
+}
+
+// GetStatePayload requests the PTS of the user's latest update; it has no
+// fields.
+type GetStatePayload struct{}
+
+func (p *GetStatePayload) validate() []FieldError {
+	return nil
+}
+
+// Limits of GetDifferencePayload.Limit.
+const (
+	defaultDifferenceLimit = 100
+	maxDifferenceLimit     = 1000
+)
+
+// GetDifferencePayload requests the updates after PTS, at most Limit of them
+// (default 100).
+type GetDifferencePayload struct {
+	PTS   int64 `json:"pts"`
+	Limit int   `json:"limit,omitempty"`
+}
+
+func (p *GetDifferencePayload) validate() []FieldError {
+	var errs []FieldError
+	if p.PTS < 0 {
+		errs = append(errs, FieldError{"pts", "must not be negative"})
+	}
+	if p.Limit < 0 || p.Limit > maxDifferenceLimit {
+		errs = append(errs, FieldError{"limit", "must be between 1 and 1000"})
+	}
+	return errs
+}
+
+// TypingPayload names either a user or a group.
+type TypingPayload struct {
+	To      string `json:"to,omitempty"`
+	GroupID int64  `json:"group_id,omitempty"`
+}
+
+func (p *TypingPayload) validate() []FieldError {
+	switch {
+	case p.To == "" && p.GroupID == 0:
+		return []FieldError{{"to", "to or group_id required"}}
+	case p.To != "" && p.GroupID != 0:
+		return []FieldError{{"group_id", "only one of to and group_id allowed"}}
+	case p.GroupID < 0:
+		return []FieldError{{"group_id", "must be positive"}}
+	}
+	return nil
+}
+
+// Server to client payloads.
+
+// NewMessagePayload pushes a private message. ClientID lets the sender's
+// other devices match the message to an optimistic local copy; it is empty
+// for messages sent by bots.
+type NewMessagePayload struct {
+	ID       int64  `json:"id"`
+	ClientID string `json:"client_id,omitempty"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Content  string `json:"content"`
+	TS       string `json:"ts"`
+}
+
+type NewGroupMessagePayload struct {
+	ID       int64  `json:"id"`
+	ClientID string `json:"client_id,omitempty"`
+	GroupID  int64  `json:"group_id"`
+	From     string `json:"from"`
+	Content  string `json:"content"`
+	TS       string `json:"ts"`
+}
+
+// AckPayload confirms a send to the connection it came from, with the
+// server's message ID and timestamp. Duplicate is set if the message had
+// already been stored by an earlier attempt.
+type AckPayload struct {
+	ClientID  string `json:"client_id"`
+	ID        int64  `json:"id"`
+	TS        string `json:"ts"`
+	Duplicate bool   `json:"duplicate,omitempty"`
+}
+
+// HistoryResultPayload is a page of the private chat with With, newest
+// first, with the cursors of the pages before and after it.
+type HistoryResultPayload struct {
+	With string `json:"with"`
+	store.HistoryPage
+}
+
+type GroupHistoryResultPayload struct {
+	GroupID int64 `json:"group_id"`
+	store.HistoryPage
+}
+
+type StatePayload struct {
+	PTS int64 `json:"pts"`
+}
+
+// DifferencePayload answers get_difference. Updates have the same type and
+// payload as the pushes they were sent as. PTS is where the next request
+// should continue; while More is set, there are further updates.
+type DifferencePayload struct {
+	Updates []DifferenceUpdate `json:"updates"`
+	PTS     int64              `json:"pts"`
+	More    bool               `json:"more"`
+}
+
+type DifferenceUpdate struct {
+	PTS     int64       `json:"pts"`
+	Type    string      `json:"type"`
+	Payload interface{} `json:"payload"`
+}
+
+// UserStatusPayload announces that a user came online or went offline. It
+// is only pushed to users allowed to see the exact state, see package
+// presence.
+type UserStatusPayload struct {
+	Username   string `json:"username"`
+	Online     bool   `json:"online"`
+	Status     string `json:"status"`
+	LastSeenAt string `json:"last_seen_at"`
+}
+
+type UserTypingPayload struct {
+	From    string `json:"from"`
+	GroupID int64  `json:"group_id,omitempty"`
+}
+
+// Error codes of ErrorPayload.
+const (
+	ErrBadFrame           = "bad_frame"
+	ErrUnsupportedVersion = "unsupported_version"
+	ErrUnknownType        = "unknown_type"
+	ErrInvalidPayload     = "invalid_payload"
+	ErrNotFound           = "not_found"
+	ErrForbidden          = "forbidden"
+	ErrConflict           = "conflict"
+	ErrMessageTooLong     = "message_too_long"
+	ErrInternal           = "internal"
+)
+
+type ErrorPayload struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Fields  []FieldError `json:"fields,omitempty"`
+}
+
+// FieldError reports a problem with one payload field.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// payload is implemented by all client to server payloads.
+type payload interface {
+	validate() []FieldError
+}
+
+// decodePayload decodes raw into dst field by field and validates it, so
+// that every unknown, mistyped, missing or invalid field is reported rather
+// than just the first. Unknown fields are only an error if strict is set.
+func decodePayload(raw json.RawMessage, dst payload, strict bool) []FieldError {
+	fields := map[string]json.RawMessage{}
+	if len(raw) > 0 && !bytes.Equal(raw, []byte("null")) {
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return []FieldError{{"payload", "must be an object"}}
+		}
+	}
+
+	var errs []FieldError
+	v := reflect.ValueOf(dst).Elem()
+	t := v.Type()
+	known := make(map[string]bool, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		known[name] = true
+		value, ok := fields[name]
+		if !ok {
+			continue
+		}
+		if err := json.Unmarshal(value, v.Field(i).Addr().Interface()); err != nil {
+			errs = append(errs, FieldError{name, "must be " + jsonKind(t.Field(i).Type)})
+		}
+	}
+	if strict {
+		for name := range fields {
+			if !known[name] {
+				errs = append(errs, FieldError{name, "unknown field"})
+			}
+		}
+	}
+	// A mistyped field was left empty; don't report it a second time as
+	// missing.
+	reported := make(map[string]bool, len(errs))
+	for _, e := range errs {
+		reported[e.Field] = true
+	}
+	for _, e := range dst.validate() {
+		if !reported[e.Field] {
+			errs = append(errs, e)
+		}
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+	return errs
+}
+
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "an integer"
+	case reflect.Bool:
+		return "a boolean"
+	}
+	return "a " + t.Kind().String()
+}
+
+// encodeFrame encodes a frame for the given protocol.
+func encodeFrame(protocol string, f Frame) ([]byte, error) {
+	if protocol == ProtocolV1 {
+		payload, err := json.Marshal(f.Payload)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(Envelope{V: protocolVersion, Type: f.Type, ID: f.ID, PTS: f.PTS, Payload: payload})
+	}
+
+	// Legacy frames are the payload's fields plus "type"; errors only ever
+	// had a "msg".
+	if e, ok := f.Payload.(ErrorPayload); ok {
+		return json.Marshal(map[string]string{"type": f.Type, "msg": e.Message})
+	}
+	flat := map[string]json.RawMessage{}
+	raw, err := json.Marshal(f.Payload)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &flat); err != nil {
+		return nil, fmt.Errorf("legacy frame %q: payload is not an object", f.Type)
+	}
+	flat["type"], _ = json.Marshal(f.Type)
+	if f.PTS != 0 {
+		flat["pts"], _ = json.Marshal(f.PTS)
+	}
+	return json.Marshal(flat)
+}
+
+// legacyTypes maps the aliases of the legacy protocol to message types.
+var legacyTypes = map[string]string{
+	"private": "send_message",
+	"group":   "send_group_message",
+}
+
+// decodeFrame parses a frame received on a connection speaking the given
+// protocol into an envelope. Legacy frames are converted: their fields other
+// than "type" become the payload.
+func decodeFrame(protocol string, data []byte) (*Envelope, *ErrorPayload) {
+	if protocol == ProtocolV1 {
+		var env Envelope
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&env); err != nil {
+			// Still echo the request ID if there is one.
+			var id struct {
+				ID string `json:"id"`
+			}
+			json.Unmarshal(data, &id)
+			return &Envelope{ID: id.ID}, &ErrorPayload{Code: ErrBadFrame, Message: "invalid envelope: " + err.Error()}
+		}
+		if env.V != protocolVersion {
+			return &env, &ErrorPayload{Code: ErrUnsupportedVersion, Message: fmt.Sprintf("unsupported protocol version %d", env.V)}
+		}
+		if env.Type == "" {
+			return &env, &ErrorPayload{Code: ErrBadFrame, Message: "type is required", Fields: []FieldError{{"type", "required"}}}
+		}
+		return &env, nil
+	}
+
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, &ErrorPayload{Code: ErrBadFrame, Message: "消息格式错误"}
+	}
+	env := &Envelope{V: protocolVersion}
+	json.Unmarshal(fields["type"], &env.Type)
+	delete(fields, "type")
+	if alias, ok := legacyTypes[env.Type]; ok {
+		env.Type = alias
+	}
+	env.Payload, _ = json.Marshal(fields)
+	return env, nil
+}
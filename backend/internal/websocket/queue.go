@@ -0,0 +1,285 @@
+package websocket
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// OverflowPolicy decides what happens when a connection's send queue is full
+// because the client reads slower than frames are pushed to it.
+type OverflowPolicy int
+
+const (
+	// OverflowDisconnect closes the connection. The client reconnects and
+	// catches up with get_difference.
+	OverflowDisconnect OverflowPolicy = iota
+	// OverflowDropOldest discards the oldest queued push to make room. The
+	// client sees a gap in the PTS of pushes and fills it with
+	// get_difference. Replies to the client's requests and the close frame
+	// are never discarded.
+	OverflowDropOldest
+)
+
+// DefaultSendQueueSize is the number of frames queued per connection before
+// the overflow policy applies.
+const DefaultSendQueueSize = 256
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowDisconnect:
+		return "disconnect"
+	case OverflowDropOldest:
+		return "drop_oldest"
+	}
+	return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+}
+
+// ParseOverflowPolicy parses the name of an overflow policy, "disconnect" or
+// "drop_oldest".
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch s {
+	case "disconnect":
+		return OverflowDisconnect, nil
+	case "drop_oldest":
+		return OverflowDropOldest, nil
+	}
+	return 0, fmt.Errorf("unknown overflow policy %q (want disconnect or drop_oldest)", s)
+}
+
+// DirectConnection is implemented by connections whose WriteJSON doesn't
+// wait for a remote client, like the hub connections of bots, which store
+// frames in the database. The hub writes to them synchronously instead of
+// through a send queue, so they are never dropped for falling behind.
+//
+// The node a frame was sent on writes it to the user's direct connection
+// there, if any. Every other node with a direct connection of the user gets
+// the frame passed to Relayed instead, e.g. to wake up whoever waits on what
+// WriteJSON stored.
+type DirectConnection interface {
+	Connection
+	Relayed(f Frame)
+}
+
+var errQueueClosed = errors.New("connection closed")
+
+// Counters of all send queues since the server started.
+var (
+	framesSent          atomic.Int64
+	framesDropped       atomic.Int64
+	overflowDisconnects atomic.Int64
+	writeErrors         atomic.Int64
+)
+
+// QueueMetrics reports the state of the send queues.
+type QueueMetrics struct {
+	Connections   int            `json:"connections"`   // connections with a send queue
+	QueuedFrames  int            `json:"queued_frames"` // frames waiting in all queues
+	MaxQueueDepth int            `json:"max_queue_depth"`
+	QueueSize     int            `json:"queue_size"`
+	Overflow      OverflowPolicy `json:"overflow_policy"`
+
+	FramesSent          int64 `json:"frames_sent"`
+	FramesDropped       int64 `json:"frames_dropped"` // by the drop_oldest policy
+	OverflowDisconnects int64 `json:"overflow_disconnects"`
+	WriteErrors         int64 `json:"write_errors"`
+}
+
+func (p OverflowPolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *OverflowPolicy) UnmarshalText(text []byte) error {
+	policy, err := ParseOverflowPolicy(string(text))
+	if err != nil {
+		return err
+	}
+	*p = policy
+	return nil
+}
+
+// peer is a registered connection with its send queue. Frames written to it
+// are queued and written to the underlying connection by its own goroutine,
+// so a slow client only ever delays itself, and the underlying connection
+// never sees concurrent writes.
+type peer struct {
+	conn      Connection
+	sessionID string
+	policy    OverflowPolicy
+	direct    bool
+
+	lock    sync.Mutex
+	queue   []queued // oldest first
+	size    int
+	closing bool          // a closeRequest is queued; later frames are discarded
+	ready   chan struct{} // signaled when something was queued
+	done    chan struct{} // closed when the pump stops
+	stop    sync.Once
+}
+
+// queued is a value waiting in a send queue. Only pushes are evictable under
+// OverflowDropOldest: the client notices lost messages from the gap in
+// their PTS, and typing and status notifications are stale soon anyway.
+// Replies to the client's own requests and close requests are never
+// discarded, or the client would wait for them in vain.
+type queued struct {
+	v         interface{}
+	evictable bool
+}
+
+func newPeer(conn Connection, size int, policy OverflowPolicy) *peer {
+	p := &peer{conn: conn, policy: policy, done: make(chan struct{})}
+	if _, ok := conn.(DirectConnection); ok {
+		p.direct = true
+		return p
+	}
+	p.size = size
+	p.ready = make(chan struct{}, 1)
+	go p.writePump()
+	return p
+}
+
+// WriteJSON queues v, such as a reply to a request of the client, for
+// writing. It never blocks: if the queue is full, the overflow policy
+// applies.
+func (p *peer) WriteJSON(v interface{}) error {
+	if p.direct {
+		return p.write(v)
+	}
+	return p.enqueue(queued{v: v})
+}
+
+// push queues a frame pushed to the user, which OverflowDropOldest may
+// discard.
+func (p *peer) push(f Frame) error {
+	if p.direct {
+		return p.write(f)
+	}
+	return p.enqueue(queued{v: f, evictable: true})
+}
+
+func (p *peer) enqueue(q queued) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	select {
+	case <-p.done:
+		return errQueueClosed
+	default:
+	}
+	if p.closing {
+		return errQueueClosed
+	}
+
+	if len(p.queue) >= p.size {
+		if p.policy == OverflowDisconnect || !p.evict(q) {
+			overflowDisconnects.Add(1)
+			log.Printf("发送队列已满（%d帧），断开连接", p.size)
+			p.Close()
+			return errQueueClosed
+		}
+		framesDropped.Add(1)
+		if q.evictable && len(p.queue) >= p.size {
+			return nil // q itself was the oldest evictable frame
+		}
+	}
+	p.queue = append(p.queue, q)
+	p.signal()
+	return nil
+}
+
+// evict discards the oldest evictable frame to make room for q. If the
+// queue holds none, an evictable q is discarded instead. It reports false if
+// nothing could be discarded.
+func (p *peer) evict(q queued) bool {
+	for i, old := range p.queue {
+		if old.evictable {
+			p.queue = slices.Delete(p.queue, i, i+1)
+			return true
+		}
+	}
+	return q.evictable
+}
+
+func (p *peer) signal() {
+	select {
+	case p.ready <- struct{}{}:
+	default:
+	}
+}
+
+// next removes and returns the oldest queued value.
+func (p *peer) next() (interface{}, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.queue) == 0 {
+		return nil, false
+	}
+	q := p.queue[0]
+	p.queue[0] = queued{}
+	p.queue = p.queue[1:]
+	return q.v, true
+}
+
+func (p *peer) ReadJSON(v interface{}) error {
+	return p.conn.ReadJSON(v)
+}
+
+// Close stops the write pump, discarding queued frames, and closes the
+// underlying connection; its read loop then ends and unregisters it.
+func (p *peer) Close() error {
+	p.shutdown()
+	return p.conn.Close()
+}
+
+// shutdown stops the write pump without closing the connection.
+func (p *peer) shutdown() {
+	p.stop.Do(func() { close(p.done) })
+}
+
+func (p *peer) depth() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.queue)
+}
+
+func (p *peer) writePump() {
+	for {
+		select {
+		case <-p.ready:
+		case <-p.done:
+			return
+		}
+		for {
+			v, ok := p.next()
+			if !ok {
+				break
+			}
+			select {
+			case <-p.done:
+				return
+			default:
+			}
+			if req, ok := v.(closeRequest); ok {
+				p.closeWith(req)
+				return
+			}
+			if err := p.write(v); err != nil {
+				// The connection is broken; stop writing to it.
+				p.Close()
+				return
+			}
+		}
+	}
+}
+
+func (p *peer) write(v interface{}) error {
+	if err := p.conn.WriteJSON(v); err != nil {
+		writeErrors.Add(1)
+		return err
+	}
+	framesSent.Add(1)
+	return nil
+}
@@ -0,0 +1,147 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+)
+
+// stalledConn is a client that doesn't read: writes block until release is
+// closed, so frames pile up in the send queue.
+type stalledConn struct {
+	testConn
+	writing chan struct{} // receives when a write starts
+	release chan struct{}
+	closing chan int // receives the close code
+}
+
+func newStalledConn() *stalledConn {
+	return &stalledConn{
+		testConn: *newTestConn(),
+		writing:  make(chan struct{}, 16),
+		release:  make(chan struct{}),
+		closing:  make(chan int, 1),
+	}
+}
+
+func (c *stalledConn) WriteJSON(v interface{}) error {
+	c.writing <- struct{}{}
+	<-c.release
+	return c.testConn.WriteJSON(v)
+}
+
+func (c *stalledConn) CloseWithMessage(code int, reason string) error {
+	c.closing <- code
+	return c.Close()
+}
+
+// stalledPeer returns a peer with a queue of size frames whose pump is
+// stuck writing a first frame.
+func stalledPeer(t *testing.T, size int) (*peer, *stalledConn) {
+	t.Helper()
+	conn := newStalledConn()
+	p := newPeer(conn, size, OverflowDropOldest)
+	t.Cleanup(func() { p.Close() })
+	p.push(pushFrame("first"))
+	select {
+	case <-conn.writing:
+	case <-time.After(time.Second):
+		t.Fatal("first frame not written")
+	}
+	return p, conn
+}
+
+func pushFrame(content string) Frame {
+	return Frame{Type: "new_message", Payload: NewMessagePayload{Content: content}}
+}
+
+func reply(id string) Frame {
+	return Frame{Type: "ack", ID: id}
+}
+
+func TestDropOldestKeepsRepliesAndClose(t *testing.T) {
+	p, conn := stalledPeer(t, 3)
+	dropped := framesDropped.Load()
+
+	p.WriteJSON(reply("r1"))
+	p.push(pushFrame("p2"))
+	p.push(pushFrame("p3"))
+	p.push(pushFrame("p4")) // evicts p2, not the older reply
+	p.drain(CloseServiceRestart, "restarting")
+	p.push(pushFrame("p5")) // after the close request: discarded
+	if n := framesDropped.Load() - dropped; n != 1 {
+		t.Errorf("%d frames dropped, want 1", n)
+	}
+
+	close(conn.release)
+	var got []string
+	for range 4 {
+		f := conn.next(t)
+		if f.ID != "" {
+			got = append(got, f.ID)
+		} else {
+			got = append(got, f.Payload.(NewMessagePayload).Content)
+		}
+	}
+	want := []string{"first", "r1", "p3", "p4"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("written %v, want %v", got, want)
+		}
+	}
+	select {
+	case code := <-conn.closing:
+		if code != CloseServiceRestart {
+			t.Errorf("closed with %d, want %d", code, CloseServiceRestart)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed after its queued frames")
+	}
+	conn.none(t)
+}
+
+func TestDropOldestCloseRequestIsNeverEvicted(t *testing.T) {
+	p, conn := stalledPeer(t, 2)
+
+	p.push(pushFrame("p1"))
+	p.push(pushFrame("p2"))
+	p.drain(CloseServiceRestart, "restarting") // queued beyond the full queue
+	close(conn.release)
+
+	for _, want := range []string{"first", "p1", "p2"} {
+		if f := conn.next(t); f.Payload.(NewMessagePayload).Content != want {
+			t.Errorf("written %+v, want %s", f, want)
+		}
+	}
+	select {
+	case <-conn.closing:
+	case <-time.After(time.Second):
+		t.Fatal("close request lost")
+	}
+}
+
+func TestDropOldestQueueOfReplies(t *testing.T) {
+	p, conn := stalledPeer(t, 2)
+	disconnects := overflowDisconnects.Load()
+
+	p.WriteJSON(reply("r1"))
+	p.WriteJSON(reply("r2"))
+	// Nothing in the queue may be evicted; a push is dropped itself.
+	if err := p.push(pushFrame("p1")); err != nil {
+		t.Errorf("push to a queue full of replies: %v", err)
+	}
+	if overflowDisconnects.Load() != disconnects {
+		t.Fatal("disconnected for a push")
+	}
+	// A reply can't be dropped, so the client is disconnected.
+	if err := p.WriteJSON(reply("r3")); err != errQueueClosed {
+		t.Errorf("reply to a queue full of replies: %v, want errQueueClosed", err)
+	}
+	if overflowDisconnects.Load() != disconnects+1 {
+		t.Error("not disconnected")
+	}
+	select {
+	case <-conn.closed:
+	default:
+		t.Error("connection not closed")
+	}
+}
@@ -0,0 +1,253 @@
+// Package redisbroker relays hub pushes between backend instances through
+// Redis pub/sub and keeps the cluster-wide registry of online users in Redis.
+package redisbroker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"learning-telegram/internal/websocket"
+)
+
+const (
+	channel   = "tg:hub"
+	keyPrefix = "tg:"
+
+	// A node announces itself every aliveInterval; it is taken for dead when
+	// it missed a few announcements, e.g. after it crashed, and the users it
+	// registered as online are ignored from then on.
+	aliveInterval = 10 * time.Second
+	aliveTTL      = 3 * aliveInterval
+
+	opTimeout = 5 * time.Second
+)
+
+// message is what nodes publish on the channel: a frame for a user, a
+// session to close or an event.
+type message struct {
+	Node         string           `json:"node"`
+	Username     string           `json:"username,omitempty"`
+	Frame        *websocket.Frame `json:"frame,omitempty"`
+	CloseSession string           `json:"close_session,omitempty"`
+	Event        string           `json:"event,omitempty"`
+	Data         json.RawMessage  `json:"data,omitempty"`
+}
+
+// Broker is a websocket.Broker backed by Redis.
+//
+// Every user online on a node is a field of the hash tg:online:<username>
+// named after the node, and every live node keeps the key tg:node:<id>
+// alive, so a crashed node's users don't stay online forever.
+type Broker struct {
+	client *redis.Client
+	node   string
+	pubsub *redis.PubSub
+	stop   chan struct{}
+	close  sync.Once
+}
+
+// New connects to the Redis server at url, e.g. redis://localhost:6379/0.
+// The node's ID is name followed by a random suffix, so a restarted node is
+// never mistaken for its previous run; name defaults to the host name.
+func New(url, name string) (*Broker, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+
+	b := &Broker{
+		client: redis.NewClient(opts),
+		node:   name + "-" + hex.EncodeToString(suffix),
+		stop:   make(chan struct{}),
+	}
+	if err := b.announce(); err != nil {
+		b.client.Close()
+		return nil, err
+	}
+	go b.keepAlive()
+	return b, nil
+}
+
+// Node returns the ID of this node.
+func (b *Broker) Node() string {
+	return b.node
+}
+
+func nodeKey(node string) string       { return keyPrefix + "node:" + node }
+func onlineKey(username string) string { return keyPrefix + "online:" + username }
+
+func (b *Broker) announce() error {
+	ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+	defer cancel()
+	return b.client.Set(ctx, nodeKey(b.node), 1, aliveTTL).Err()
+}
+
+func (b *Broker) keepAlive() {
+	ticker := time.NewTicker(aliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+			if err := b.announce(); err != nil {
+				log.Printf("Redis 节点心跳失败: %v", err)
+			}
+		}
+	}
+}
+
+func (b *Broker) Subscribe(deliver func(username string, f websocket.Frame), closeSession func(username, sessionID string), event func(name string, data json.RawMessage)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+	defer cancel()
+	b.pubsub = b.client.Subscribe(ctx, channel)
+	// Wait for the subscription, so nothing published after Subscribe
+	// returns is missed.
+	if _, err := b.pubsub.Receive(ctx); err != nil {
+		b.pubsub.Close()
+		return err
+	}
+
+	go func() {
+		for msg := range b.pubsub.Channel() {
+			var m message
+			if err := json.Unmarshal([]byte(msg.Payload), &m); err != nil {
+				log.Printf("无法解析其他节点的消息: %v", err)
+				continue
+			}
+			if m.Node == b.node {
+				continue
+			}
+			switch {
+			case m.Frame != nil:
+				deliver(m.Username, *m.Frame)
+			case m.CloseSession != "":
+				closeSession(m.Username, m.CloseSession)
+			case m.Event != "":
+				event(m.Event, m.Data)
+			}
+		}
+	}()
+	return nil
+}
+
+func (b *Broker) publish(m message) error {
+	m.Node = b.node
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+	defer cancel()
+	return b.client.Publish(ctx, channel, data).Err()
+}
+
+func (b *Broker) Publish(username string, f websocket.Frame) error {
+	return b.publish(message{Username: username, Frame: &f})
+}
+
+func (b *Broker) PublishCloseSession(username, sessionID string) error {
+	return b.publish(message{Username: username, CloseSession: sessionID})
+}
+
+func (b *Broker) PublishEvent(name string, data json.RawMessage) error {
+	return b.publish(message{Event: name, Data: data})
+}
+
+// Connected also forgets the user's connections to dead nodes, which would
+// otherwise pile up with every crash.
+func (b *Broker) Connected(username string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+	defer cancel()
+	if err := b.client.HSet(ctx, onlineKey(username), b.node, 1).Err(); err != nil {
+		return err
+	}
+	nodes, err := b.otherNodes(ctx, username)
+	if err != nil {
+		return err
+	}
+	for node, alive := range nodes {
+		if !alive {
+			if err := b.client.HDel(ctx, onlineKey(username), node).Err(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *Broker) Disconnected(username string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+	defer cancel()
+	return b.client.HDel(ctx, onlineKey(username), b.node).Err()
+}
+
+func (b *Broker) IsOnline(username string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+	defer cancel()
+	nodes, err := b.otherNodes(ctx, username)
+	if err != nil {
+		return false, err
+	}
+	for _, alive := range nodes {
+		if alive {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// otherNodes returns the other nodes a user is connected to and whether
+// each of them is alive.
+func (b *Broker) otherNodes(ctx context.Context, username string) (map[string]bool, error) {
+	fields, err := b.client.HKeys(ctx, onlineKey(username)).Result()
+	if err != nil {
+		return nil, err
+	}
+	nodes := make(map[string]bool, len(fields))
+	for _, node := range fields {
+		if node == b.node {
+			continue
+		}
+		n, err := b.client.Exists(ctx, nodeKey(node)).Result()
+		if err != nil {
+			return nil, err
+		}
+		nodes[node] = n > 0
+	}
+	return nodes, nil
+}
+
+// Close stops relaying and removes the node, so that the other nodes take
+// the users still registered by it for offline right away.
+func (b *Broker) Close() error {
+	var err error
+	b.close.Do(func() {
+		close(b.stop)
+		if b.pubsub != nil {
+			b.pubsub.Close()
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+		defer cancel()
+		err = b.client.Del(ctx, nodeKey(b.node)).Err()
+		if cerr := b.client.Close(); err == nil {
+			err = cerr
+		}
+	})
+	return err
+}
@@ -0,0 +1,136 @@
+package redisbroker
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"learning-telegram/internal/websocket"
+)
+
+type received struct {
+	username string
+	frame    websocket.Frame
+	session  string
+	event    string
+	data     json.RawMessage
+}
+
+// newNode connects a broker to the Redis server at REDIS_URL and subscribes
+// it, or skips the test if REDIS_URL is unset.
+func newNode(t *testing.T) (*Broker, chan received) {
+	t.Helper()
+	url := os.Getenv("REDIS_URL")
+	if url == "" {
+		t.Skip("REDIS_URL not set")
+	}
+	b, err := New(url, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+
+	got := make(chan received, 16)
+	err = b.Subscribe(
+		func(username string, f websocket.Frame) { got <- received{username: username, frame: f} },
+		func(username, sessionID string) { got <- received{username: username, session: sessionID} },
+		func(name string, data json.RawMessage) { got <- received{event: name, data: data} },
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, got
+}
+
+func next(t *testing.T, got chan received) received {
+	t.Helper()
+	select {
+	case r := <-got:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing received")
+		return received{}
+	}
+}
+
+func none(t *testing.T, got chan received) {
+	t.Helper()
+	select {
+	case r := <-got:
+		t.Fatalf("unexpected %+v", r)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestRelay(t *testing.T) {
+	a, fromA := newNode(t)
+	_, fromB := newNode(t)
+
+	sent := websocket.NewMessagePayload{ID: 7, From: "bob", To: "alice", Content: "hi"}
+	if err := a.Publish("alice", websocket.Frame{Type: "new_message", PTS: 3, Payload: sent}); err != nil {
+		t.Fatal(err)
+	}
+	r := next(t, fromB)
+	if r.username != "alice" || r.frame.Type != "new_message" || r.frame.PTS != 3 || r.frame.Payload != sent {
+		t.Errorf("got %+v, want the published frame", r)
+	}
+
+	if err := a.PublishCloseSession("alice", "s1"); err != nil {
+		t.Fatal(err)
+	}
+	if r := next(t, fromB); r.username != "alice" || r.session != "s1" {
+		t.Errorf("got %+v, want session s1 of alice closed", r)
+	}
+
+	if err := a.PublishEvent("bot_changed", json.RawMessage("42")); err != nil {
+		t.Fatal(err)
+	}
+	if r := next(t, fromB); r.event != "bot_changed" || string(r.data) != "42" {
+		t.Errorf("got %+v, want the published event", r)
+	}
+
+	// A node doesn't receive what it published itself.
+	none(t, fromA)
+}
+
+func TestOnline(t *testing.T) {
+	a, _ := newNode(t)
+	b, _ := newNode(t)
+	username := "redisbroker-test-" + a.Node()
+
+	isOnline := func(b *Broker) bool {
+		t.Helper()
+		online, err := b.IsOnline(username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return online
+	}
+
+	if err := a.Connected(username); err != nil {
+		t.Fatal(err)
+	}
+	if !isOnline(b) {
+		t.Error("user connected to another node is offline")
+	}
+	if isOnline(a) {
+		t.Error("IsOnline counts this node's own connections")
+	}
+
+	if err := a.Disconnected(username); err != nil {
+		t.Fatal(err)
+	}
+	if isOnline(b) {
+		t.Error("user online after disconnecting")
+	}
+
+	// The users of a node are offline once it is gone.
+	if err := a.Connected(username); err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+	if isOnline(b) {
+		t.Error("user online on a closed node")
+	}
+}
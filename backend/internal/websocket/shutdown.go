@@ -0,0 +1,112 @@
+package websocket
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// CloseServiceRestart is the close code sent to clients when the server shuts
+// down: the server is restarting and the client should reconnect, to this
+// instance once it is back or to another one.
+const CloseServiceRestart = websocket.CloseServiceRestart
+
+// closeRequest is queued behind a connection's pending frames to close it
+// once they are written.
+type closeRequest struct {
+	code   int
+	reason string
+}
+
+// CloseMessenger is implemented by connections that can tell their client
+// why they are closed.
+type CloseMessenger interface {
+	CloseWithMessage(code int, reason string) error
+}
+
+// Shutdown closes every connection with CloseServiceRestart after writing
+// the frames already queued for it, and refuses new connections. It waits
+// until the handlers of all connections returned or ctx is done, then closes the
+// remaining ones without waiting for their queues and disconnects the hub
+// from the other nodes.
+func (h *Handler) Shutdown(ctx context.Context) error {
+	h.draining.Store(true)
+	for _, p := range h.hub.allPeers() {
+		p.drain(CloseServiceRestart, "server restarting, reconnect")
+	}
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	var err error
+	for h.running.Load() > 0 && err == nil {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	if err != nil {
+		for _, p := range h.hub.allPeers() {
+			p.Close()
+		}
+		log.Printf("等待连接关闭超时，已强制关闭")
+	}
+
+	if berr := h.hub.getBroker().Close(); berr != nil && err == nil {
+		err = berr
+	}
+	return err
+}
+
+// allPeers returns the connections with a send queue, i.e. those of clients.
+func (h *Hub) allPeers() []*peer {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	var peers []*peer
+	for _, ps := range h.clients {
+		for _, p := range ps {
+			if !p.direct {
+				peers = append(peers, p)
+			}
+		}
+	}
+	return peers
+}
+
+// drain queues a close request behind the frames already queued, so the
+// client gets them before the close frame. Frames queued after it are
+// discarded. The close request is queued even if the queue is full and is
+// never evicted. Direct connections have nothing to drain.
+func (p *peer) drain(code int, reason string) {
+	if p.direct {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closing {
+		return
+	}
+	p.closing = true
+	p.queue = append(p.queue, queued{v: closeRequest{code, reason}})
+	p.signal()
+}
+
+// closeWith stops the write pump and closes the connection, with a close
+// frame if it supports one.
+func (p *peer) closeWith(req closeRequest) {
+	p.shutdown()
+	if c, ok := p.conn.(CloseMessenger); ok {
+		c.CloseWithMessage(req.code, req.reason)
+		return
+	}
+	p.conn.Close()
+}
+
+// CloseWithMessage sends a close frame and closes the connection.
+func (c *clientConn) CloseWithMessage(code int, reason string) error {
+	msg := websocket.FormatCloseMessage(code, reason)
+	c.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(c.heartbeat.WriteTimeout))
+	return c.Close()
+}
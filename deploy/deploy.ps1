@@ -146,7 +146,7 @@ Write-Host ""
 Write-Host "🎉 部署完成！" -ForegroundColor Green
 Write-Host ""
 Write-Host "📋 下一步操作：" -ForegroundColor Cyan
-Write-Host "1. 启动Go后端服务: go run cmd/server/main.go"
+Write-Host "1. 启动Go后端服务: go run ./cmd/server"
 Write-Host "2. 启动前端开发服务: cd frontend && npm run dev"
 Write-Host "3. 访问应用: http://localhost"
 Write-Host ""
@@ -86,7 +86,7 @@ echo ""
 echo "🎉 部署完成！"
 echo ""
 echo "📋 下一步操作："
-echo "1. 启动Go后端服务: cd backend && go run cmd/server/main.go"
+echo "1. 启动Go后端服务: cd backend && go run ./cmd/server"
 echo "2. 启动前端开发服务: cd frontend && npm run dev"
 echo "3. 访问应用: http://localhost"
 echo ""
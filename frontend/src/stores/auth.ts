@@ -3,24 +3,136 @@ import { ref } from 'vue'
 import { jwtDecode } from 'jwt-decode'
 import { buildApiUrl } from '../config/api'
 
+// 接口的错误响应为 {"code": "username_taken", "error": "用户名已存在"}
+const readError = async (response: Response, fallback: string) => {
+  const text = await response.text()
+  try {
+    return JSON.parse(text).error || fallback
+  } catch {
+    return text || fallback
+  }
+}
+
+// 登录成功时返回的token对
+interface TokenPair {
+  token: string
+  refresh_token: string
+  expires_in: number
+}
+
+// 开启两步验证的账户登录时返回202和一个挑战，需再提交验证码
+export interface TwoFactorChallenge {
+  challengeToken: string
+  expiresIn: number
+}
+
+// access token在过期前这么多秒内就提前刷新
+const REFRESH_MARGIN_SECONDS = 60
+
 export const useAuthStore = defineStore('auth', () => {
   const token = ref<string | null>(localStorage.getItem('token'))
+  const refreshToken = ref<string | null>(localStorage.getItem('refresh_token'))
   const username = ref<string>('')
+  // access token的过期时间（秒级时间戳）
+  let expiresAt = 0
+  // 进行中的刷新请求，同时发起的请求共用一次刷新（refresh token每次刷新后失效）
+  let refreshing: Promise<string | null> | null = null
+
+  const clear = () => {
+    token.value = null
+    refreshToken.value = null
+    username.value = ''
+    expiresAt = 0
+    localStorage.removeItem('token')
+    localStorage.removeItem('refresh_token')
+  }
+
+  // 从access token中解析用户名和过期时间
+  const decode = (t: string) => {
+    const decoded: any = jwtDecode(t)
+    username.value = decoded.username || ''
+    expiresAt = decoded.exp || 0
+  }
+
+  const setTokens = (data: TokenPair) => {
+    decode(data.token)
+    token.value = data.token
+    refreshToken.value = data.refresh_token
+    localStorage.setItem('token', data.token)
+    localStorage.setItem('refresh_token', data.refresh_token)
+  }
 
   // 初始化时从token中解析用户信息
   if (token.value) {
     try {
-      const decoded: any = jwtDecode(token.value)
-      username.value = decoded.username || ''
-      console.log('从token解析的用户名:', decoded.username)
+      decode(token.value)
     } catch (error) {
       console.error('Token解析失败:', error)
-      token.value = null
-      localStorage.removeItem('token')
+      clear()
+    }
+  }
+
+  // 用refresh token换新的token对；会话已失效时清除登录状态并返回null
+  const refresh = () => {
+    if (!refreshing) {
+      refreshing = (async () => {
+        if (!refreshToken.value) {
+          clear()
+          return null
+        }
+        const response = await fetch(buildApiUrl('/api/token/refresh'), {
+          method: 'POST',
+          headers: { 'Content-Type': 'application/json' },
+          body: JSON.stringify({ refresh_token: refreshToken.value })
+        })
+        if (response.status === 401 || response.status === 400) {
+          clear()
+          return null
+        }
+        if (!response.ok) {
+          throw new Error(await readError(response, '刷新登录状态失败'))
+        }
+        setTokens(await response.json())
+        return token.value
+      })().finally(() => {
+        refreshing = null
+      })
+    }
+    return refreshing
+  }
+
+  // 返回可用的access token，快过期时先刷新；未登录或会话已失效时返回null。
+  // 建立WebSocket连接（包括重连）前也应调用它
+  const getValidToken = async () => {
+    if (!token.value) {
+      return null
+    }
+    if (expiresAt - Date.now() / 1000 < REFRESH_MARGIN_SECONDS) {
+      return refresh()
+    }
+    return token.value
+  }
+
+  // 带认证的fetch：自动附加token，收到401时刷新token后重试一次
+  const authFetch = async (url: string, init: RequestInit = {}) => {
+    const send = (t: string | null) => {
+      const headers = new Headers(init.headers)
+      if (t) {
+        headers.set('Authorization', `Bearer ${t}`)
+      }
+      return fetch(url, { ...init, headers })
+    }
+
+    const response = await send(await getValidToken())
+    if (response.status !== 401 || !refreshToken.value) {
+      return response
     }
+    const t = await refresh()
+    return t ? send(t) : response
   }
 
-  const login = async (usernameInput: string, password: string) => {
+  // 登录成功返回null；账户开启了两步验证时返回挑战，用verifyTwoFactor完成登录
+  const login = async (usernameInput: string, password: string): Promise<TwoFactorChallenge | null> => {
     const response = await fetch(buildApiUrl('/api/login'), {
       method: 'POST',
       headers: {
@@ -33,14 +145,35 @@ export const useAuthStore = defineStore('auth', () => {
     })
 
     if (!response.ok) {
-      const errorText = await response.text()
-      throw new Error(errorText || '登录失败')
+      throw new Error(await readError(response, '登录失败'))
     }
 
     const data = await response.json()
-    token.value = data.token
-    username.value = usernameInput
-    localStorage.setItem('token', data.token)
+    if (response.status === 202 && data.two_factor_required) {
+      return { challengeToken: data.challenge_token, expiresIn: data.expires_in }
+    }
+    setTokens(data)
+    return null
+  }
+
+  // 提交两步验证码（或恢复码）完成登录
+  const verifyTwoFactor = async (challenge: TwoFactorChallenge, code: string, isRecoveryCode = false) => {
+    const response = await fetch(buildApiUrl('/api/login/2fa'), {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json'
+      },
+      body: JSON.stringify({
+        challenge_token: challenge.challengeToken,
+        ...(isRecoveryCode ? { recovery_code: code } : { code })
+      })
+    })
+
+    if (!response.ok) {
+      throw new Error(await readError(response, '验证失败'))
+    }
+
+    setTokens(await response.json())
   }
 
   const register = async (usernameInput: string, password: string) => {
@@ -56,20 +189,22 @@ export const useAuthStore = defineStore('auth', () => {
     })
 
     if (!response.ok) {
-      const errorText = await response.text()
-      throw new Error(errorText || '注册失败')
+      throw new Error(await readError(response, '注册失败'))
     }
 
-    const data = await response.json()
-    token.value = data.token
-    username.value = usernameInput
-    localStorage.setItem('token', data.token)
+    setTokens(await response.json())
   }
 
-  const logout = () => {
-    token.value = null
-    username.value = ''
-    localStorage.removeItem('token')
+  // 注销服务端的会话（同时断开该会话的WebSocket连接），再清除本地登录状态
+  const logout = async () => {
+    if (token.value) {
+      try {
+        await authFetch(buildApiUrl('/api/logout'), { method: 'POST' })
+      } catch (error) {
+        console.error('退出登录请求失败:', error)
+      }
+    }
+    clear()
   }
 
   const isAuthenticated = () => {
@@ -80,8 +215,12 @@ export const useAuthStore = defineStore('auth', () => {
     token,
     username,
     login,
+    verifyTwoFactor,
     register,
     logout,
+    refresh,
+    getValidToken,
+    authFetch,
     isAuthenticated
   }
-}) 
\ No newline at end of file
+})